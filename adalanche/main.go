@@ -7,6 +7,8 @@ import (
 	_ "github.com/lkarlslund/adalanche/modules/integrations/activedirectory/analyze"
 	_ "github.com/lkarlslund/adalanche/modules/integrations/activedirectory/collect"
 	_ "github.com/lkarlslund/adalanche/modules/integrations/localmachine/analyze"
+	_ "github.com/lkarlslund/adalanche/modules/integrations/localmachine/collect"
+	_ "github.com/lkarlslund/adalanche/modules/integrations/sharphound/analyze"
 	_ "github.com/lkarlslund/adalanche/modules/quickmode"
 	"github.com/lkarlslund/adalanche/modules/ui"
 )
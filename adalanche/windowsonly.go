@@ -1,8 +0,0 @@
-//go:build windows
-// +build windows
-
-package main
-
-import (
-	_ "github.com/lkarlslund/adalanche/modules/integrations/localmachine/collect"
-)
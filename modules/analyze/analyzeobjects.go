@@ -1,6 +1,7 @@
 package analyze
 
 import (
+	"context"
 	"sort"
 
 	"github.com/lkarlslund/adalanche/modules/engine"
@@ -49,6 +50,15 @@ type AnalyzeObjectsOptions struct {
 	PruneIslands              bool
 	NodeLimit                 int
 	DontExpandAUEO            bool
+	Progress                  func(AnalysisProgress) // Called as the analysis moves along, if set
+}
+
+// AnalysisProgress tells how far a running analysis has come
+type AnalysisProgress struct {
+	Phase string `json:"phase"`
+	Round int    `json:"round"`
+	Nodes int    `json:"nodes"`
+	Edges int    `json:"edges"`
 }
 
 type GraphNode struct {
@@ -72,6 +82,19 @@ type AnalysisResults struct {
 }
 
 func AnalyzeObjects(opts AnalyzeObjectsOptions) AnalysisResults {
+	results, _ := AnalyzeObjectsContext(context.Background(), opts)
+	return results
+}
+
+// AnalyzeObjectsContext runs the analysis, giving up with the context error if it is cancelled.
+// Cancellation is checked between rounds, so a single round always runs to completion.
+func AnalyzeObjectsContext(ctx context.Context, opts AnalyzeObjectsOptions) (AnalysisResults, error) {
+	progress := func(phase string, round int, pg graph.Graph[*engine.Object, engine.EdgeBitmap]) {
+		if opts.Progress != nil {
+			opts.Progress(AnalysisProgress{Phase: phase, Round: round, Nodes: pg.Order(), Edges: pg.Size()})
+		}
+	}
+
 	if opts.MethodsM.Count() == 0 {
 		opts.MethodsM = opts.MethodsF
 	}
@@ -120,6 +143,11 @@ func AnalyzeObjects(opts AnalyzeObjectsOptions) AnalysisResults {
 
 	pb := ui.ProgressBar("Analyzing graph", opts.MaxDepth)
 	for opts.MaxDepth >= currentRound || opts.MaxDepth == -1 {
+		if err := ctx.Err(); err != nil {
+			pb.Finish()
+			return AnalysisResults{}, err
+		}
+		progress("analyzing", currentRound, pg)
 		pb.Add(1)
 		if currentRound == 2 {
 			detectedges = opts.MethodsM
@@ -331,8 +359,15 @@ func AnalyzeObjects(opts AnalyzeObjectsOptions) AnalysisResults {
 		}
 	}
 
+	progress("filtering", currentRound, pg)
+
 	// Keep removing stuff while it makes sense
 	for {
+		if err := ctx.Err(); err != nil {
+			pb.Finish()
+			return AnalysisResults{}, err
+		}
+
 		var removed int
 
 		// This map contains all the nodes that is pointed by someone else. If you're in this map you're not an outer node
@@ -403,6 +438,11 @@ func AnalyzeObjects(opts AnalyzeObjectsOptions) AnalysisResults {
 		pb = ui.ProgressBar("Removing excessive nodes", lefttoremove)
 
 		for lefttoremove > 0 {
+			if err := ctx.Err(); err != nil {
+				pb.Finish()
+				return AnalysisResults{}, err
+			}
+
 			// This map contains all the nodes that point to someone else. If you're in this map you're not an outer node
 			var removedthisround, maxround int
 
@@ -476,9 +516,10 @@ func AnalyzeObjects(opts AnalyzeObjectsOptions) AnalysisResults {
 	}
 
 	ui.Debug().Msgf("Final analysis node count is %v objects", pg.Order())
+	progress("done", currentRound, pg)
 
 	return AnalysisResults{
 		Graph:   pg,
 		Removed: totalnodes - pg.Order(),
-	}
+	}, nil
 }
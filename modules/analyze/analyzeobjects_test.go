@@ -0,0 +1,51 @@
+package analyze
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/query"
+)
+
+func TestAnalyzeObjectsContext(t *testing.T) {
+	ao := engine.NewObjects()
+	target := engine.NewObject(engine.Name, engine.AttributeValueString("target"))
+	attacker := engine.NewObject(engine.Name, engine.AttributeValueString("attacker"))
+	ao.Add(target, attacker)
+	attacker.EdgeTo(target, EdgeMemberOfGroup)
+
+	filter, err := query.ParseLDAPQueryStrict("(name=target)", ao)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := NewAnalyzeObjectsOptions()
+	opts.Objects = ao
+	opts.StartFilter = filter
+
+	var rounds int
+	opts.Progress = func(progress AnalysisProgress) {
+		if progress.Phase == "analyzing" {
+			rounds++
+		}
+	}
+
+	results, err := AnalyzeObjectsContext(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Graph.Order() != 2 || results.Graph.Size() != 1 {
+		t.Errorf("Expected 2 nodes and 1 edge, got %v nodes and %v edges", results.Graph.Order(), results.Graph.Size())
+	}
+	if rounds == 0 {
+		t.Error("No progress was reported")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = AnalyzeObjectsContext(ctx, opts)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancelled analysis, got %v", err)
+	}
+}
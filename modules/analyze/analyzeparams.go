@@ -0,0 +1,268 @@
+package analyze
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/query"
+	"github.com/lkarlslund/adalanche/modules/util"
+)
+
+const DefaultAnalysisQuery = "(&(objectClass=group)(|(name=Domain Admins)(name=Enterprise Admins)))"
+
+// ParseAnalyzeObjectsOptions turns the flat parameter map used by the /analyzegraph endpoint into analysis options.
+// Edges are selected with pwn_<edge>_f/_m/_l keys and object types with type_<type>_f/_m/_l keys.
+func ParseAnalyzeObjectsOptions(params map[string]string, ao *engine.Objects) (AnalyzeObjectsOptions, error) {
+	opts := NewAnalyzeObjectsOptions()
+
+	mode := params["mode"]
+	if mode == "" {
+		mode = "normal"
+	}
+
+	direction := engine.In
+	if mode != "normal" {
+		direction = engine.Out
+	}
+
+	prune, _ := util.ParseBool(params["prune"])
+
+	startquerytext := params["query"]
+	if startquerytext == "" {
+		startquerytext = DefaultAnalysisQuery
+	}
+
+	middlequerytext := params["middlequery"]
+	endquerytext := params["endquery"]
+
+	maxdepth := -1
+	if maxdepthval, err := strconv.Atoi(params["maxdepth"]); err == nil {
+		maxdepth = maxdepthval
+	}
+
+	minprobability := 0
+	if minprobabilityval, err := strconv.Atoi(params["minprobability"]); err == nil {
+		minprobability = minprobabilityval
+	}
+
+	minaccprobability := 0
+	if minaccprobabilityval, err := strconv.Atoi(params["minaccprobability"]); err == nil {
+		minaccprobability = minaccprobabilityval
+	}
+
+	// Maximum number of outgoing connections from one object in analysis
+	// If more are available you can right click the object and select EXPAND
+	maxoutgoing := -1
+	if maxoutgoingval, err := strconv.Atoi(params["maxoutgoing"]); err == nil {
+		maxoutgoing = maxoutgoingval
+	}
+
+	backlinks, _ := strconv.Atoi(params["backlinks"])
+
+	nodelimit, _ := strconv.Atoi(params["nodelimit"])
+
+	dontexpandaueo, _ := util.ParseBool(params["dont-expand-au-eo"])
+
+	// tricky tricky - if we get a call with the expanddn set, then we handle things .... differently :-)
+	if expanddn := params["expanddn"]; expanddn != "" {
+		startquerytext = `(distinguishedName=` + expanddn + `)`
+		maxoutgoing = 0
+		maxdepth = 1
+		nodelimit = 1000
+	}
+
+	var err error
+	opts.StartFilter, err = query.ParseLDAPQueryStrict(startquerytext, ao)
+	if err != nil {
+		return opts, fmt.Errorf("Error parsing start query: %v", err)
+	}
+
+	if middlequerytext != "" {
+		opts.MiddleFilter, err = query.ParseLDAPQueryStrict(middlequerytext, ao)
+		if err != nil {
+			return opts, fmt.Errorf("Error parsing middle query: %v", err)
+		}
+	}
+
+	if endquerytext != "" {
+		opts.EndFilter, err = query.ParseLDAPQueryStrict(endquerytext, ao)
+		if err != nil {
+			return opts, fmt.Errorf("Error parsing end query: %v", err)
+		}
+	}
+
+	var edges_f, egdes_m, edges_l engine.EdgeBitmap
+	var objecttypes_f, objecttypes_m, objecttypes_l []engine.ObjectType
+	for potentialfilter := range params {
+		if len(potentialfilter) < 7 {
+			continue
+		}
+		if strings.HasPrefix(potentialfilter, "pwn_") {
+			prefix := potentialfilter[4 : len(potentialfilter)-2]
+			suffix := potentialfilter[len(potentialfilter)-2:]
+			edge := engine.LookupEdge(prefix)
+			if edge == engine.NonExistingEdge {
+				continue
+			}
+			switch suffix {
+			case "_f":
+				edges_f = edges_f.Set(edge)
+			case "_m":
+				egdes_m = egdes_m.Set(edge)
+			case "_l":
+				edges_l = edges_l.Set(edge)
+			}
+		} else if strings.HasPrefix(potentialfilter, "type_") {
+			prefix := potentialfilter[5 : len(potentialfilter)-2]
+			suffix := potentialfilter[len(potentialfilter)-2:]
+			ot, found := engine.ObjectTypeLookup(prefix)
+			if !found {
+				continue
+			}
+
+			switch suffix {
+			case "_f":
+				objecttypes_f = append(objecttypes_f, ot)
+			case "_m":
+				objecttypes_m = append(objecttypes_m, ot)
+			case "_l":
+				objecttypes_l = append(objecttypes_l, ot)
+			}
+		}
+	}
+
+	// Are we using the new format FML? The just choose the old format methods for FML
+	if edges_f.Count() == 0 && egdes_m.Count() == 0 && edges_l.Count() == 0 {
+		// Spread the choices to FML
+		edges_f = engine.AllEdgesBitmap
+		egdes_m = engine.AllEdgesBitmap
+		edges_l = engine.AllEdgesBitmap
+	}
+
+	opts.Objects = ao
+	opts.MethodsF = edges_f
+	opts.MethodsM = egdes_m
+	opts.MethodsL = edges_l
+	opts.ObjectTypesF = objecttypes_f
+	opts.ObjectTypesM = objecttypes_m
+	opts.ObjectTypesL = objecttypes_l
+	opts.Direction = direction
+	opts.MaxDepth = maxdepth
+	opts.MaxOutgoingConnections = maxoutgoing
+	opts.MinEdgeProbability = engine.Probability(minprobability)
+	opts.MinAccumulatedProbability = engine.Probability(minaccprobability)
+	opts.PruneIslands = prune
+	opts.Backlinks = backlinks
+	opts.NodeLimit = nodelimit
+	opts.DontExpandAUEO = dontexpandaueo
+
+	return opts, nil
+}
+
+// ParsePathOptions reads the parameters for a path search, using the same pwn_<edge>_f/_m/_l keys as the graph analysis to select edges
+func ParsePathOptions(params map[string]string, ao *engine.Objects) (PathOptions, error) {
+	opts := NewPathOptions()
+	opts.Objects = ao
+
+	var err error
+	if params["source"] == "" || params["target"] == "" {
+		return opts, fmt.Errorf("Both source and target queries are required")
+	}
+	opts.SourceFilter, err = query.ParseLDAPQueryStrict(params["source"], ao)
+	if err != nil {
+		return opts, fmt.Errorf("Error parsing source query: %v", err)
+	}
+	opts.TargetFilter, err = query.ParseLDAPQueryStrict(params["target"], ao)
+	if err != nil {
+		return opts, fmt.Errorf("Error parsing target query: %v", err)
+	}
+
+	if k, err := strconv.Atoi(params["k"]); err == nil {
+		opts.K = k
+	}
+	if minprobability, err := strconv.Atoi(params["minprobability"]); err == nil {
+		opts.MinEdgeProbability = engine.Probability(minprobability)
+	}
+
+	if edges := parseEdgeParams(params); !edges.IsBlank() {
+		opts.Edges = edges
+	}
+
+	return opts, nil
+}
+
+// ParseChokepointOptions reads the parameters for a chokepoint search over all objects. The source query is optional,
+// and edges are selected with the same pwn_<edge>_f/_m/_l keys as the graph analysis.
+func ParseChokepointOptions(params map[string]string, ao *engine.Objects) (ChokepointOptions, error) {
+	opts := NewChokepointOptions()
+	opts.Objects = ao
+
+	targetquerytext := params["target"]
+	if targetquerytext == "" {
+		targetquerytext = DefaultAnalysisQuery
+	}
+
+	var err error
+	opts.TargetFilter, err = query.ParseLDAPQueryStrict(targetquerytext, ao)
+	if err != nil {
+		return opts, fmt.Errorf("Error parsing target query: %v", err)
+	}
+	if params["source"] != "" {
+		opts.SourceFilter, err = query.ParseLDAPQueryStrict(params["source"], ao)
+		if err != nil {
+			return opts, fmt.Errorf("Error parsing source query: %v", err)
+		}
+	}
+
+	if minprobability, err := strconv.Atoi(params["minprobability"]); err == nil {
+		opts.MinEdgeProbability = engine.Probability(minprobability)
+	}
+
+	if edges := parseEdgeParams(params); !edges.IsBlank() {
+		opts.Edges = edges
+	}
+
+	return opts, nil
+}
+
+// All edges selected with pwn_<edge>_* keys, regardless of position
+func parseEdgeParams(params map[string]string) engine.EdgeBitmap {
+	var edges engine.EdgeBitmap
+	for potentialfilter := range params {
+		if len(potentialfilter) < 7 || !strings.HasPrefix(potentialfilter, "pwn_") {
+			continue
+		}
+		edge := engine.LookupEdge(potentialfilter[4 : len(potentialfilter)-2])
+		if edge == engine.NonExistingEdge {
+			continue
+		}
+		edges = edges.Set(edge)
+	}
+	return edges
+}
+
+// setEdgeParams selects the named edges for one position (_f, _m or _l) using the pwn_<edge><suffix> keys
+func setEdgeParams(params map[string]string, suffix string, names []string) error {
+	for _, name := range names {
+		edge := engine.LookupEdge(name)
+		if edge == engine.NonExistingEdge {
+			return fmt.Errorf("Unknown edge %v", name)
+		}
+		params["pwn_"+edge.String()+suffix] = "on"
+	}
+	return nil
+}
+
+// setObjectTypeParams selects the named object types for one position (_f, _m or _l) using the type_<type><suffix> keys
+func setObjectTypeParams(params map[string]string, suffix string, names []string) error {
+	for _, name := range names {
+		ot, found := engine.ObjectTypeLookup(name)
+		if !found {
+			return fmt.Errorf("Unknown object type %v", name)
+		}
+		params["type_"+ot.String()+suffix] = "on"
+	}
+	return nil
+}
@@ -0,0 +1,917 @@
+package analyze
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/query"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/lkarlslund/adalanche/modules/util"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+// The versioned API lives under this prefix. Anything in here is kept backwards compatible,
+// unlike the endpoints used by the web interface.
+const APIBase = "/api/v1"
+
+const (
+	apiDefaultLimit = 100
+	apiMaxLimit     = 10000
+)
+
+type APIError struct {
+	Error string `json:"error"`
+}
+
+type APIObject struct {
+	ID                engine.ObjectID     `json:"id"`
+	Label             string              `json:"label"`
+	Type              string              `json:"type"`
+	DistinguishedName string              `json:"distinguishedName,omitempty"`
+	Attributes        map[string][]string `json:"attributes,omitempty" doc:"All attributes when looking up a single object, or the ones asked for when listing objects"`
+}
+
+type APIObjectPage struct {
+	Total   int         `json:"total" doc:"Number of objects matching the query"`
+	Offset  int         `json:"offset"`
+	Limit   int         `json:"limit"`
+	Objects []APIObject `json:"objects"`
+}
+
+type APIEdgeName struct {
+	Name        string `json:"name"`
+	Probability int    `json:"probability" doc:"Probability in percent that this edge can be exploited"`
+}
+
+type APIEdge struct {
+	Source      engine.ObjectID `json:"source"`
+	SourceLabel string          `json:"sourceLabel"`
+	Target      engine.ObjectID `json:"target"`
+	TargetLabel string          `json:"targetLabel"`
+	Probability int             `json:"probability" doc:"Highest probability of the edges between source and target"`
+	Edges       []APIEdgeName   `json:"edges"`
+}
+
+type APIAnalysisRequest struct {
+	Query                     string   `json:"query" yaml:"query" doc:"Start query, the targets in normal mode and the sources in reverse mode"`
+	MiddleQuery               string   `json:"middleQuery,omitempty" yaml:"middleQuery,omitempty" doc:"Query that nodes between start and end must match"`
+	EndQuery                  string   `json:"endQuery,omitempty" yaml:"endQuery,omitempty" doc:"Query that the final nodes must match"`
+	Reverse                   bool     `json:"reverse,omitempty" yaml:"reverse,omitempty" doc:"Find what the start objects can reach instead of who can reach them"`
+	MaxDepth                  int      `json:"maxDepth" yaml:"maxDepth" doc:"Maximum analysis depth, -1 is unlimited"`
+	MaxOutgoing               int      `json:"maxOutgoing" yaml:"maxOutgoing" doc:"Maximum number of outgoing connections from one object, -1 is unlimited"`
+	MinProbability            int      `json:"minProbability,omitempty" yaml:"minProbability,omitempty"`
+	MinAccumulatedProbability int      `json:"minAccumulatedProbability,omitempty" yaml:"minAccumulatedProbability,omitempty"`
+	Backlinks                 int      `json:"backlinks,omitempty" yaml:"backlinks,omitempty"`
+	NodeLimit                 int      `json:"nodeLimit,omitempty" yaml:"nodeLimit,omitempty" doc:"Maximum number of nodes in the result, 0 is unlimited"`
+	Prune                     bool     `json:"prune,omitempty" yaml:"prune,omitempty" doc:"Remove islands from the result"`
+	DontExpandAUEO            bool     `json:"dontExpandAUEO,omitempty" yaml:"dontExpandAUEO,omitempty" doc:"Don't expand Authenticated Users and Everyone"`
+	EdgesFirst                []string `json:"edgesFirst,omitempty" yaml:"edgesFirst,omitempty" doc:"Edges allowed on the first step, default is all edges"`
+	EdgesMiddle               []string `json:"edgesMiddle,omitempty" yaml:"edgesMiddle,omitempty"`
+	EdgesLast                 []string `json:"edgesLast,omitempty" yaml:"edgesLast,omitempty"`
+	TypesFirst                []string `json:"typesFirst,omitempty" yaml:"typesFirst,omitempty" doc:"Object types allowed on the first step, default is all types"`
+	TypesMiddle               []string `json:"typesMiddle,omitempty" yaml:"typesMiddle,omitempty"`
+	TypesLast                 []string `json:"typesLast,omitempty" yaml:"typesLast,omitempty"`
+}
+
+func NewAPIAnalysisRequest() APIAnalysisRequest {
+	return APIAnalysisRequest{
+		Query:       DefaultAnalysisQuery,
+		MaxDepth:    -1,
+		MaxOutgoing: -1,
+	}
+}
+
+// params translates the request into the same parameters the web interface posts to /analyzegraph
+func (r APIAnalysisRequest) params() (map[string]string, error) {
+	mode := "normal"
+	if r.Reverse {
+		mode = "reverse"
+	}
+	params := map[string]string{
+		"query":             r.Query,
+		"middlequery":       r.MiddleQuery,
+		"endquery":          r.EndQuery,
+		"mode":              mode,
+		"maxdepth":          strconv.Itoa(r.MaxDepth),
+		"maxoutgoing":       strconv.Itoa(r.MaxOutgoing),
+		"minprobability":    strconv.Itoa(r.MinProbability),
+		"minaccprobability": strconv.Itoa(r.MinAccumulatedProbability),
+		"backlinks":         strconv.Itoa(r.Backlinks),
+		"nodelimit":         strconv.Itoa(r.NodeLimit),
+		"prune":             strconv.FormatBool(r.Prune),
+		"dont-expand-au-eo": strconv.FormatBool(r.DontExpandAUEO),
+	}
+	for suffix, edges := range map[string][]string{"_f": r.EdgesFirst, "_m": r.EdgesMiddle, "_l": r.EdgesLast} {
+		if err := setEdgeParams(params, suffix, edges); err != nil {
+			return nil, err
+		}
+	}
+	for suffix, types := range map[string][]string{"_f": r.TypesFirst, "_m": r.TypesMiddle, "_l": r.TypesLast} {
+		if err := setObjectTypeParams(params, suffix, types); err != nil {
+			return nil, err
+		}
+	}
+	return params, nil
+}
+
+// apiAnalysisRequestFromParams is the opposite of params, reading the flat parameters the web interface posts
+func apiAnalysisRequestFromParams(params map[string]string) APIAnalysisRequest {
+	r := NewAPIAnalysisRequest()
+	if params["query"] != "" {
+		r.Query = params["query"]
+	}
+	r.MiddleQuery = params["middlequery"]
+	r.EndQuery = params["endquery"]
+	r.Reverse = params["mode"] != "" && params["mode"] != "normal"
+	for key, value := range map[string]*int{
+		"maxdepth":          &r.MaxDepth,
+		"maxoutgoing":       &r.MaxOutgoing,
+		"minprobability":    &r.MinProbability,
+		"minaccprobability": &r.MinAccumulatedProbability,
+		"backlinks":         &r.Backlinks,
+		"nodelimit":         &r.NodeLimit,
+	} {
+		if i, err := strconv.Atoi(params[key]); err == nil {
+			*value = i
+		}
+	}
+	r.Prune, _ = util.ParseBool(params["prune"])
+	r.DontExpandAUEO, _ = util.ParseBool(params["dont-expand-au-eo"])
+
+	lists := map[string]*[]string{
+		"pwn__f": &r.EdgesFirst, "pwn__m": &r.EdgesMiddle, "pwn__l": &r.EdgesLast,
+		"type__f": &r.TypesFirst, "type__m": &r.TypesMiddle, "type__l": &r.TypesLast,
+	}
+	for key := range params {
+		prefix, name, found := strings.Cut(key, "_")
+		if !found || len(name) < 3 || (prefix != "pwn" && prefix != "type") {
+			continue
+		}
+		suffix := name[len(name)-2:]
+		if list := lists[prefix+"_"+suffix]; list != nil {
+			*list = append(*list, name[:len(name)-2])
+		}
+	}
+	for _, list := range lists {
+		slices.Sort(*list)
+	}
+	return r
+}
+
+type APIAnalysisNode struct {
+	APIObject
+	Target    bool `json:"target,omitempty" doc:"Object matched the start query"`
+	CanExpand int  `json:"canExpand,omitempty" doc:"Number of connections left out because of the outgoing connection limit"`
+}
+
+type APIAnalysisResult struct {
+	Nodes   []APIAnalysisNode `json:"nodes"`
+	Edges   []APIEdge         `json:"edges"`
+	Removed int               `json:"removed" doc:"Nodes removed by the node limit"`
+}
+
+type APIJob struct {
+	ID       string              `json:"id"`
+	Status   JobStatus           `json:"status" doc:"running, done, failed or cancelled"`
+	Error    string              `json:"error,omitempty"`
+	Created  time.Time           `json:"created"`
+	Finished *time.Time          `json:"finished,omitempty"`
+	Request  *APIAnalysisRequest `json:"request,omitempty" doc:"Missing for jobs started from the web interface"`
+	Progress AnalysisProgress    `json:"progress"`
+	Result   *APIAnalysisResult  `json:"result,omitempty" doc:"Only included when fetching a single finished job"`
+}
+
+type APIStatus struct {
+	Ready    bool               `json:"ready" doc:"True when post-processing has finished and analysis results are final"`
+	Objects  int                `json:"objects"`
+	Progress []ui.ProgressEvent `json:"progress" doc:"Background processors currently running"`
+}
+
+type APIFinding struct {
+	Rule
+	Count   int         `json:"count" doc:"Number of affected objects"`
+	Objects []APIObject `json:"objects"`
+	Paths   []string    `json:"paths,omitempty" doc:"Matching paths for path pattern rules, rendered as text"`
+}
+
+type APIFindings struct {
+	Ready    bool         `json:"ready" doc:"False until post-processing and rule evaluation has finished"`
+	Rules    int          `json:"rules" doc:"Number of rules evaluated"`
+	Errors   []string     `json:"errors,omitempty" doc:"Rules that could not be evaluated"`
+	Findings []APIFinding `json:"findings"`
+}
+
+func newAPIFinding(finding Finding) APIFinding {
+	result := APIFinding{
+		Rule:    finding.Rule,
+		Count:   len(finding.Objects),
+		Objects: make([]APIObject, len(finding.Objects)),
+	}
+	for i, o := range finding.Objects {
+		result.Objects[i] = newAPIObject(o, false)
+	}
+	for _, path := range finding.Paths {
+		result.Paths = append(result.Paths, pathMatchString(path))
+	}
+	return result
+}
+
+// locateObject finds an object by ID, distinguishedName, SID or GUID
+func locateObject(ao *engine.Objects, locateby, id string) (*engine.Object, bool, error) {
+	switch strings.ToLower(locateby) {
+	case "id":
+		oid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, false, err
+		}
+		o, found := ao.FindID(engine.ObjectID(oid))
+		return o, found, nil
+	case "dn", "distinguishedname":
+		o, found := ao.Find(activedirectory.DistinguishedName, engine.AttributeValueString(id))
+		return o, found, nil
+	case "sid":
+		sid, err := windowssecurity.ParseStringSID(id)
+		if err != nil {
+			return nil, false, err
+		}
+		o, found := ao.Find(activedirectory.ObjectSid, engine.AttributeValueSID(sid))
+		return o, found, nil
+	case "guid":
+		u, err := uuid.FromString(id)
+		if err != nil {
+			return nil, false, err
+		}
+		o, found := ao.Find(activedirectory.ObjectGUID, engine.AttributeValueGUID(u))
+		return o, found, nil
+	}
+	return nil, false, fmt.Errorf("Unknown lookup method %v, use id, dn, sid or guid", locateby)
+}
+
+func newAPIObject(o *engine.Object, withattributes bool) APIObject {
+	result := APIObject{
+		ID:                o.ID(),
+		Label:             o.Label(),
+		Type:              o.Type().String(),
+		DistinguishedName: o.DN(),
+	}
+	if withattributes {
+		result.Attributes = make(map[string][]string)
+		o.AttrIterator(func(attr engine.Attribute, values engine.AttributeValues) bool {
+			result.Attributes[attr.String()] = apiAttributeValues(values)
+			return true
+		})
+	}
+	return result
+}
+
+// newAPIObjectProjection returns an object with only the listed attributes, skipping the ones it doesn't have
+func newAPIObjectProjection(o *engine.Object, attributes []engine.Attribute) APIObject {
+	result := newAPIObject(o, false)
+	result.Attributes = make(map[string][]string, len(attributes))
+	for _, attr := range attributes {
+		if values, found := o.Get(attr); found {
+			result.Attributes[attr.String()] = apiAttributeValues(values)
+		}
+	}
+	return result
+}
+
+func apiAttributeValues(values engine.AttributeValues) []string {
+	slice := values.StringSlice()
+	for i := range slice {
+		if !util.IsASCII(slice[i]) {
+			slice[i] = util.Hexify(slice[i])
+		}
+	}
+	return slice
+}
+
+// apiAttributeList parses a comma separated list of attribute names, where * selects all attributes
+func apiAttributeList(text string) (attributes []engine.Attribute, all bool, err error) {
+	for _, name := range strings.Split(text, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "*":
+			all = true
+			continue
+		}
+		attr := engine.LookupAttribute(name)
+		if attr == engine.NonExistingAttribute {
+			return nil, false, fmt.Errorf("Unknown attribute %v", name)
+		}
+		attributes = append(attributes, attr)
+	}
+	return attributes, all, nil
+}
+
+// apiSortObjects orders objects by the attribute named in sort, descending if it's prefixed with a minus.
+// Objects are ordered by ID first, so pages are stable even when many objects have the same value.
+// Without a sort attribute the analysis --sortby attribute is used (descending) if set.
+func apiSortObjects(objects *engine.ObjectSlice, sort string) error {
+	objects.SortFunc(func(a, b *engine.Object) bool {
+		return a.ID() < b.ID()
+	})
+
+	attr, reverse := SortBy, true
+	if sort != "" {
+		sort, reverse = strings.CutPrefix(sort, "-")
+		attr = engine.LookupAttribute(sort)
+		if attr == engine.NonExistingAttribute {
+			return fmt.Errorf("Unknown sort attribute %v", sort)
+		}
+	}
+	if attr != engine.NonExistingAttribute {
+		objects.Sort(attr, reverse)
+	}
+	return nil
+}
+
+func newAPIEdge(source, target *engine.Object, eb engine.EdgeBitmap) APIEdge {
+	result := APIEdge{
+		Source:      source.ID(),
+		SourceLabel: source.Label(),
+		Target:      target.ID(),
+		TargetLabel: target.Label(),
+		Probability: int(eb.MaxProbability(source, target)),
+	}
+	for _, edge := range eb.Edges() {
+		result.Edges = append(result.Edges, APIEdgeName{
+			Name:        edge.String(),
+			Probability: int(edge.Probability(source, target)),
+		})
+	}
+	return result
+}
+
+func newAPIAnalysisResult(results AnalysisResults) *APIAnalysisResult {
+	pg := results.Graph
+	result := &APIAnalysisResult{
+		Nodes:   make([]APIAnalysisNode, 0, pg.Order()),
+		Edges:   make([]APIEdge, 0, pg.Size()),
+		Removed: results.Removed,
+	}
+	for _, o := range sortedNodes(pg) {
+		node := APIAnalysisNode{
+			APIObject: newAPIObject(o, false),
+			Target:    pg.GetNodeData(o, "target") == true,
+		}
+		if canexpand, ok := pg.GetNodeData(o, "canexpand").(int); ok {
+			node.CanExpand = canexpand
+		}
+		result.Nodes = append(result.Nodes, node)
+	}
+	pg.IterateEdges(func(source, target *engine.Object, eb engine.EdgeBitmap) bool {
+		result.Edges = append(result.Edges, newAPIEdge(source, target, eb))
+		return true
+	})
+	sortAPIEdges(result.Edges)
+	return result
+}
+
+func sortAPIEdges(edges []APIEdge) {
+	slices.SortFunc(edges, func(a, b APIEdge) int {
+		if a.Source != b.Source {
+			return int(a.Source) - int(b.Source)
+		}
+		return int(a.Target) - int(b.Target)
+	})
+}
+
+// Reads offset and limit query parameters
+func apiPaging(c *gin.Context) (offset, limit int, err error) {
+	limit = apiDefaultLimit
+	if value := c.Query("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Invalid offset %v", value)
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, fmt.Errorf("Invalid limit %v, must be between 1 and %v", value, apiMaxLimit)
+		}
+	}
+	return offset, limit, nil
+}
+
+func apiError(c *gin.Context, status int, err error) {
+	c.AbortWithStatusJSON(status, APIError{Error: err.Error()})
+}
+
+var apiLocateParameters = []apiParameter{
+	{Name: "locateby", In: "path", Description: "How to find the object", Enum: []string{"id", "dn", "sid", "guid"}},
+	{Name: "id", In: "path", Description: "Object ID, distinguishedName, SID or GUID"},
+}
+
+var apiJobParameters = []apiParameter{
+	{Name: "jobid", In: "path", Description: "Job ID returned when starting the analysis"},
+}
+
+var apiSavedQueryParameters = []apiParameter{
+	{Name: "name", In: "path", Description: "Name of the saved query"},
+}
+
+// streamJobEvents sends the state of a job as server-sent events until it is no longer running
+func streamJobEvents(c *gin.Context, jobs *jobManager, id string) {
+	info, updated, found := jobs.Watch(id)
+	if !found {
+		apiError(c, 404, fmt.Errorf("Job not found"))
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		c.SSEvent("job", info)
+		if info.Status != JobRunning {
+			return false
+		}
+		select {
+		case <-updated:
+		case <-c.Request.Context().Done():
+			return false
+		}
+		info, updated, found = jobs.Watch(id)
+		return found
+	})
+}
+
+func (ws *webservice) status() APIStatus {
+	progress := ui.ProgressSnapshot()
+	slices.SortFunc(progress, func(a, b ui.ProgressEvent) int {
+		return a.Started.Compare(b.Started)
+	})
+	return APIStatus{
+		Ready:    ws.Ready(),
+		Objects:  ws.Objs.Len(),
+		Progress: progress,
+	}
+}
+
+// streamServerEvents pushes progress bar changes and log lines as server-sent events until the client disconnects.
+// A status event is sent first and again when post-processing finishes.
+func streamServerEvents(c *gin.Context, ws *webservice) {
+	events, unsubscribe := ui.Subscribe(256)
+	defer unsubscribe()
+
+	ready := ws.ready
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.SSEvent("status", ws.status())
+	if ws.Ready() {
+		ready = nil
+	}
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-events:
+			switch e.Type {
+			case ui.EventLog:
+				c.SSEvent(string(e.Type), e.Log)
+			default:
+				c.SSEvent(string(e.Type), e.Progress)
+			}
+		case <-ready:
+			c.SSEvent("status", ws.status())
+			ready = nil
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
+
+func apiv1funcs(ws *webservice) {
+	api := newAPIRegistry(ws.Router, APIBase)
+
+	api.add(apiEndpoint{
+		Method:   "GET",
+		Path:     "/openapi.json",
+		Summary:  "OpenAPI description of this API",
+		Response: map[string]any{},
+		Handler: func(c *gin.Context) {
+			c.JSON(200, api.OpenAPI())
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:   "GET",
+		Path:     "/status",
+		Summary:  "Whether background post-processing has finished, and which processors are running",
+		Response: APIStatus{},
+		Handler: func(c *gin.Context) {
+			c.JSON(200, ws.status())
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:  "GET",
+		Path:    "/events",
+		Summary: "Follow background processing and log output as server-sent events",
+		Description: "Starts with a status event, followed by progress-start, progress-update and progress-finish events " +
+			"carrying a progress bar, and log events carrying a log line. A new status event with ready set is sent when post-processing finishes.",
+		Response: APIStatus{},
+		Handler: func(c *gin.Context) {
+			streamServerEvents(c, ws)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:  "GET",
+		Path:    "/objects",
+		Summary: "Search for objects using an LDAP style query",
+		Parameters: []apiParameter{
+			{Name: "query", In: "query", Description: "LDAP style query, all objects if empty"},
+			{Name: "attributes", In: "query", Description: "Comma separated attributes to include for each object, * for all. None if empty"},
+			{Name: "sort", In: "query", Description: "Attribute to sort by, prefix with - for descending order. Defaults to the --sortby attribute (descending) or object ID"},
+			{Name: "offset", In: "query", Type: "integer", Description: "Number of matching objects to skip"},
+			{Name: "limit", In: "query", Type: "integer", Description: fmt.Sprintf("Maximum number of objects to return (default %v, max %v)", apiDefaultLimit, apiMaxLimit)},
+		},
+		Response: APIObjectPage{},
+		Handler: func(c *gin.Context) {
+			offset, limit, err := apiPaging(c)
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+
+			attributes, allattributes, err := apiAttributeList(c.Query("attributes"))
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+
+			objects := ws.Objs
+			if querytext := strings.TrimSpace(c.Query("query")); querytext != "" {
+				filter, err := query.ParseLDAPQueryStrict(querytext, ws.Objs)
+				if err != nil {
+					apiError(c, 400, err)
+					return
+				}
+				// Uses the indexes for the parts of the query that can
+				objects = query.Execute(filter, ws.Objs)
+			}
+
+			matches := objects.AsSlice()
+			if err = apiSortObjects(&matches, c.Query("sort")); err != nil {
+				apiError(c, 400, err)
+				return
+			}
+
+			page := APIObjectPage{
+				Total:   matches.Len(),
+				Offset:  offset,
+				Limit:   limit,
+				Objects: []APIObject{},
+			}
+			matches.Skip(offset)
+			matches.Limit(limit)
+			matches.Iterate(func(o *engine.Object) bool {
+				switch {
+				case allattributes:
+					page.Objects = append(page.Objects, newAPIObject(o, true))
+				case len(attributes) > 0:
+					page.Objects = append(page.Objects, newAPIObjectProjection(o, attributes))
+				default:
+					page.Objects = append(page.Objects, newAPIObject(o, false))
+				}
+				return true
+			})
+			c.JSON(200, page)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:     "GET",
+		Path:       "/objects/:locateby/:id",
+		Summary:    "Get one object with all its attributes",
+		Parameters: apiLocateParameters,
+		Response:   APIObject{},
+		Handler: func(c *gin.Context) {
+			o, found, err := locateObject(ws.Objs, c.Param("locateby"), c.Param("id"))
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			if !found {
+				apiError(c, 404, fmt.Errorf("Object not found"))
+				return
+			}
+			c.JSON(200, newAPIObject(o, true))
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:  "GET",
+		Path:    "/objects/:locateby/:id/edges",
+		Summary: "Get the edges to or from one object",
+		Parameters: append(slices.Clone(apiLocateParameters),
+			apiParameter{Name: "direction", In: "query", Description: "out lists what the object can do to others, in lists who can do something to the object", Enum: []string{"out", "in"}},
+		),
+		Response: []APIEdge{},
+		Handler: func(c *gin.Context) {
+			o, found, err := locateObject(ws.Objs, c.Param("locateby"), c.Param("id"))
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			if !found {
+				apiError(c, 404, fmt.Errorf("Object not found"))
+				return
+			}
+
+			edges := []APIEdge{}
+			switch c.DefaultQuery("direction", "out") {
+			case "out":
+				o.Edges(engine.Out).Range(func(target *engine.Object, eb engine.EdgeBitmap) bool {
+					edges = append(edges, newAPIEdge(o, target, eb))
+					return true
+				})
+			case "in":
+				o.Edges(engine.In).Range(func(source *engine.Object, eb engine.EdgeBitmap) bool {
+					edges = append(edges, newAPIEdge(source, o, eb))
+					return true
+				})
+			default:
+				apiError(c, 400, fmt.Errorf("Invalid direction %v, use in or out", c.Query("direction")))
+				return
+			}
+			sortAPIEdges(edges)
+			c.JSON(200, edges)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:      "POST",
+		Path:        "/analysis",
+		Summary:     "Start an attack path analysis job",
+		Description: "The analysis runs in the background. Poll the returned job or follow its events until it is no longer running to get the result.",
+		Request:     APIAnalysisRequest{},
+		Response:    APIJob{},
+		Status:      202,
+		Handler: func(c *gin.Context) {
+			request := NewAPIAnalysisRequest()
+			if err := c.ShouldBindJSON(&request); err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			params, err := request.params()
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			// Parse before starting, so broken queries are reported right away
+			opts, err := ParseAnalyzeObjectsOptions(params, ws.Objs)
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+
+			c.JSON(202, ws.jobs.Start(&request, opts))
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:   "GET",
+		Path:     "/analysis",
+		Summary:  "List analysis jobs, newest first",
+		Response: []APIJob{},
+		Handler: func(c *gin.Context) {
+			c.JSON(200, ws.jobs.List())
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:     "GET",
+		Path:       "/analysis/:jobid",
+		Summary:    "Get an analysis job, including the result once it is done",
+		Parameters: apiJobParameters,
+		Response:   APIJob{},
+		Handler: func(c *gin.Context) {
+			info, found := ws.jobs.Get(c.Param("jobid"), true)
+			if !found {
+				apiError(c, 404, fmt.Errorf("Job not found"))
+				return
+			}
+			c.JSON(200, info)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:      "DELETE",
+		Path:        "/analysis/:jobid",
+		Summary:     "Cancel a running analysis job",
+		Description: "The analysis stops at the end of the current round, after which the job status is cancelled.",
+		Parameters:  apiJobParameters,
+		Response:    APIJob{},
+		Handler: func(c *gin.Context) {
+			info, found := ws.jobs.Cancel(c.Param("jobid"))
+			if !found {
+				apiError(c, 404, fmt.Errorf("Job not found"))
+				return
+			}
+			c.JSON(200, info)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:      "GET",
+		Path:        "/analysis/:jobid/events",
+		Summary:     "Follow the progress of an analysis job as server-sent events",
+		Description: "Sends a job event with the job state (without result) every time it changes. The stream ends when the job is no longer running.",
+		Parameters:  apiJobParameters,
+		Response:    APIJob{},
+		Handler: func(c *gin.Context) {
+			streamJobEvents(c, ws.jobs, c.Param("jobid"))
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:      "GET",
+		Path:        "/findings",
+		Summary:     "Results of the security rules, most severe first",
+		Description: "Rules are evaluated once post-processing has finished. Until then ready is false and there are no findings.",
+		Parameters: []apiParameter{
+			{Name: "minseverity", In: "query", Description: "Only return findings with at least this severity", Enum: severityNames},
+		},
+		Response: APIFindings{},
+		Handler: func(c *gin.Context) {
+			result := ws.Findings()
+			if name := c.Query("minseverity"); name != "" {
+				minseverity, err := ParseSeverity(name)
+				if err != nil {
+					apiError(c, 400, err)
+					return
+				}
+				result.Findings = slices.DeleteFunc(slices.Clone(result.Findings), func(f APIFinding) bool {
+					return f.Severity < minseverity
+				})
+			}
+			if result.Findings == nil {
+				result.Findings = []APIFinding{}
+			}
+			c.JSON(200, result)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:  "GET",
+		Path:    "/queries",
+		Summary: "List saved queries",
+		Parameters: []apiParameter{
+			{Name: "format", In: "query", Description: "Return the list as JSON or as YAML for sharing", Enum: []string{"json", "yaml"}},
+		},
+		Response: []SavedQuery{},
+		Handler: func(c *gin.Context) {
+			queries := ws.SavedQueries.List()
+			switch c.DefaultQuery("format", "json") {
+			case "json":
+				c.JSON(200, queries)
+			case "yaml":
+				c.Header("Content-Type", "application/yaml")
+				c.Header("Content-Disposition", "attachment; filename=adalanche-queries.yaml")
+				WriteSavedQueriesYAML(c.Writer, queries)
+			default:
+				apiError(c, 400, fmt.Errorf("Unknown format, use json or yaml"))
+			}
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:      "POST",
+		Path:        "/queries",
+		Summary:     "Import saved queries",
+		Description: "Takes a list of saved queries as YAML or JSON, replacing existing queries with the same names.",
+		Request:     []SavedQuery{},
+		Response:    []SavedQuery{},
+		AdminOnly:   true,
+		Handler: func(c *gin.Context) {
+			// JSON is valid YAML, so this reads both
+			queries, err := ReadSavedQueriesYAML(c.Request.Body)
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			if err = ws.SavedQueries.Put(queries...); err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			c.JSON(200, queries)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:     "GET",
+		Path:       "/queries/:name",
+		Summary:    "Get a saved query",
+		Parameters: apiSavedQueryParameters,
+		Response:   SavedQuery{},
+		Handler: func(c *gin.Context) {
+			sq, found := ws.SavedQueries.Get(c.Param("name"))
+			if !found {
+				apiError(c, 404, fmt.Errorf("Saved query not found"))
+				return
+			}
+			c.JSON(200, sq)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:     "PUT",
+		Path:       "/queries/:name",
+		Summary:    "Save a query, replacing any existing query with the same name",
+		Parameters: apiSavedQueryParameters,
+		Request:    SavedQuery{},
+		Response:   SavedQuery{},
+		AdminOnly:  true,
+		Handler: func(c *gin.Context) {
+			sq := SavedQuery{APIAnalysisRequest: NewAPIAnalysisRequest()}
+			if err := c.ShouldBindJSON(&sq); err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			sq.Name = c.Param("name")
+			if err := ws.SavedQueries.Put(sq); err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			c.JSON(200, sq)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:     "DELETE",
+		Path:       "/queries/:name",
+		Summary:    "Delete a saved query",
+		Parameters: apiSavedQueryParameters,
+		Response:   SavedQuery{},
+		AdminOnly:  true,
+		Handler: func(c *gin.Context) {
+			sq, found := ws.SavedQueries.Get(c.Param("name"))
+			if !found {
+				apiError(c, 404, fmt.Errorf("Saved query not found"))
+				return
+			}
+			if _, err := ws.SavedQueries.Delete(sq.Name); err != nil {
+				apiError(c, 500, err)
+				return
+			}
+			c.JSON(200, sq)
+		},
+	})
+
+	api.add(apiEndpoint{
+		Method:      "POST",
+		Path:        "/queries/:name/analysis",
+		Summary:     "Start an analysis job from a saved query",
+		Description: "The body maps placeholder names to values, which are escaped and put into the queries. Placeholders without a value use the defaults of the saved query.",
+		Parameters:  apiSavedQueryParameters,
+		Request:     map[string]string{},
+		Response:    APIJob{},
+		Status:      202,
+		Handler: func(c *gin.Context) {
+			sq, found := ws.SavedQueries.Get(c.Param("name"))
+			if !found {
+				apiError(c, 404, fmt.Errorf("Saved query not found"))
+				return
+			}
+			values := map[string]string{}
+			if c.Request.ContentLength != 0 {
+				if err := c.ShouldBindJSON(&values); err != nil {
+					apiError(c, 400, err)
+					return
+				}
+			}
+			request, err := sq.Resolve(values)
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			params, err := request.params()
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+			opts, err := ParseAnalyzeObjectsOptions(params, ws.Objs)
+			if err != nil {
+				apiError(c, 400, err)
+				return
+			}
+
+			c.JSON(202, ws.jobs.Start(&request, opts))
+		},
+	})
+}
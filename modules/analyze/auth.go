@@ -0,0 +1,199 @@
+package analyze
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role decides what an authenticated caller is allowed to do in the webservice
+type Role int
+
+const (
+	RoleReadOnly Role = iota // Can query and analyze, but not change preferences, quit or debug
+	RoleAdmin
+)
+
+const roleContextKey = "adalanche_role"
+
+func (r Role) String() string {
+	switch r {
+	case RoleReadOnly:
+		return "readonly"
+	case RoleAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("unknown role %d", int(r))
+}
+
+func ParseRole(s string) (Role, error) {
+	switch strings.ToLower(s) {
+	case "readonly", "read-only", "ro":
+		return RoleReadOnly, nil
+	case "admin", "":
+		return RoleAdmin, nil
+	}
+	return RoleReadOnly, fmt.Errorf("Unknown role %v, use admin or readonly", s)
+}
+
+type credential struct {
+	hash [sha256.Size]byte
+	role Role
+}
+
+// Authenticator holds the local users and bearer tokens allowed to use the webservice.
+// With no users or tokens configured everyone is let in as admin, which is how adalanche has always worked.
+type Authenticator struct {
+	lock   sync.RWMutex
+	users  map[string]credential
+	tokens []credential
+}
+
+func (a *Authenticator) AddUser(username, password string, role Role) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.users == nil {
+		a.users = make(map[string]credential)
+	}
+	a.users[username] = credential{hash: sha256.Sum256([]byte(password)), role: role}
+}
+
+func (a *Authenticator) AddToken(token string, role Role) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.tokens = append(a.tokens, credential{hash: sha256.Sum256([]byte(token)), role: role})
+}
+
+// AddUserString adds a user given as name:password[:role]
+func (a *Authenticator) AddUserString(s string) error {
+	name, rest, found := strings.Cut(s, ":")
+	if !found || name == "" {
+		return fmt.Errorf("Invalid user definition, expected name:password[:role]")
+	}
+	password, rolename := rest, ""
+	if i := strings.LastIndex(rest, ":"); i != -1 {
+		if _, err := ParseRole(rest[i+1:]); err == nil {
+			password, rolename = rest[:i], rest[i+1:]
+		}
+	}
+	role, err := ParseRole(rolename)
+	if err != nil {
+		return err
+	}
+	a.AddUser(name, password, role)
+	return nil
+}
+
+// AddTokenString adds a bearer token given as token[:role]
+func (a *Authenticator) AddTokenString(s string) error {
+	token, rolename := s, ""
+	if i := strings.LastIndex(s, ":"); i != -1 {
+		if _, err := ParseRole(s[i+1:]); err == nil {
+			token, rolename = s[:i], s[i+1:]
+		}
+	}
+	if token == "" {
+		return fmt.Errorf("Empty bearer token")
+	}
+	role, err := ParseRole(rolename)
+	if err != nil {
+		return err
+	}
+	a.AddToken(token, role)
+	return nil
+}
+
+// LoadFile reads credentials from a file with one "user name:password[:role]" or "token value[:role]" per line.
+// Blank lines and lines starting with # are ignored.
+func (a *Authenticator) LoadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	var lineno int
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, value, _ := strings.Cut(line, " ")
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(kind) {
+		case "user":
+			err = a.AddUserString(value)
+		case "token":
+			err = a.AddTokenString(value)
+		default:
+			err = fmt.Errorf("expected user or token, got %q", kind)
+		}
+		if err != nil {
+			return fmt.Errorf("Problem in %v line %v: %v", filename, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (a *Authenticator) Enabled() bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return len(a.users) > 0 || len(a.tokens) > 0
+}
+
+func (a *Authenticator) authenticate(c *gin.Context) (Role, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if username, password, ok := c.Request.BasicAuth(); ok {
+		user, found := a.users[username]
+		hash := sha256.Sum256([]byte(password))
+		// Always compare, so unknown users take as long as wrong passwords
+		if subtle.ConstantTimeCompare(hash[:], user.hash[:]) == 1 && found {
+			return user.role, true
+		}
+		return RoleReadOnly, false
+	}
+
+	scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		hash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+				return t.role, true
+			}
+		}
+	}
+	return RoleReadOnly, false
+}
+
+// Middleware rejects unauthenticated requests, and records the role of the caller for requireAdmin
+func (a *Authenticator) Middleware(c *gin.Context) {
+	if !a.Enabled() {
+		c.Set(roleContextKey, RoleAdmin)
+		return
+	}
+	role, ok := a.authenticate(c)
+	if !ok {
+		c.Header("WWW-Authenticate", `Basic realm="adalanche", charset="UTF-8"`)
+		c.AbortWithStatus(401)
+		return
+	}
+	c.Set(roleContextKey, role)
+}
+
+// requireAdmin is added in front of handlers that change server state or expose internals
+func requireAdmin(c *gin.Context) {
+	if role, _ := c.Get(roleContextKey); role != RoleAdmin {
+		c.String(403, "This requires the admin role")
+		c.Abort()
+	}
+}
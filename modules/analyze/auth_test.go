@@ -0,0 +1,65 @@
+package analyze
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-contrib/pprof"
+)
+
+func TestAuthenticator(t *testing.T) {
+	ws := NewWebservice()
+	pprof.RouteRegister(ws.Router.Group("", requireAdmin))
+
+	get := func(path string, setup func(r *http.Request)) int {
+		r := httptest.NewRequest("GET", path, nil)
+		if setup != nil {
+			setup(r)
+		}
+		w := httptest.NewRecorder()
+		ws.Router.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Without credentials configured everyone is admin
+	if code := get("/debug/pprof/cmdline", nil); code != 200 {
+		t.Errorf("Open webservice gave %v for admin route", code)
+	}
+
+	ws.Auth.AddUser("alice", "secret", RoleAdmin)
+	ws.Auth.AddUser("bob", "hunter2", RoleReadOnly)
+	if err := ws.Auth.AddTokenString("readtoken:readonly"); err != nil {
+		t.Fatal(err)
+	}
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	for _, test := range []struct {
+		name     string
+		path     string
+		setup    func(r *http.Request)
+		expected int
+	}{
+		{"missing credentials", "/preferences", nil, 401},
+		{"wrong password", "/preferences", basic("alice", "wrong"), 401},
+		{"unknown user", "/preferences", basic("mallory", "secret"), 401},
+		{"wrong token", "/preferences", bearer("nottoken"), 401},
+		{"read-only user", "/preferences", basic("bob", "hunter2"), 200},
+		{"read-only token", "/preferences", bearer("readtoken"), 200},
+		{"admin user", "/preferences", basic("alice", "secret"), 200},
+		{"read-only user on admin route", "/debug/pprof/cmdline", basic("bob", "hunter2"), 403},
+		{"read-only token on admin route", "/debug/pprof/cmdline", bearer("readtoken"), 403},
+		{"admin user on admin route", "/debug/pprof/cmdline", basic("alice", "secret"), 200},
+		{"read-only user quitting", "/quit", basic("bob", "hunter2"), 403},
+		{"missing credentials on admin route", "/debug/pprof/cmdline", nil, 401},
+	} {
+		if code := get(test.path, test.setup); code != test.expected {
+			t.Errorf("%v gave %v, expected %v", test.name, code, test.expected)
+		}
+	}
+}
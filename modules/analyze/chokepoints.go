@@ -0,0 +1,94 @@
+package analyze
+
+import (
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+	"github.com/lkarlslund/adalanche/modules/query"
+)
+
+type ChokepointOptions struct {
+	Objects            *engine.Objects
+	SourceFilter       query.NodeFilter // nil means every object that isn't a target
+	TargetFilter       query.NodeFilter
+	Edges              engine.EdgeBitmap
+	MinEdgeProbability engine.Probability
+}
+
+func NewChokepointOptions() ChokepointOptions {
+	return ChokepointOptions{
+		Edges:              engine.AllEdgesBitmap,
+		MinEdgeProbability: 1,
+	}
+}
+
+type Chokepoints = graph.Chokepoints[*engine.Object]
+
+// FindChokepoints ranks the objects and edges across the whole object set that the most attack paths
+// from the sources to the targets go through
+func FindChokepoints(opts ChokepointOptions) Chokepoints {
+	targetset := make(map[*engine.Object]struct{})
+	query.Execute(opts.TargetFilter, opts.Objects).Iterate(func(o *engine.Object) bool {
+		targetset[o] = struct{}{}
+		return true
+	})
+	if len(targetset) == 0 {
+		return Chokepoints{}
+	}
+
+	var sources []*engine.Object
+	if opts.SourceFilter != nil {
+		query.Execute(opts.SourceFilter, opts.Objects).Iterate(func(o *engine.Object) bool {
+			sources = append(sources, o)
+			return true
+		})
+	} else {
+		opts.Objects.Iterate(func(o *engine.Object) bool {
+			if _, found := targetset[o]; !found {
+				sources = append(sources, o)
+			}
+			return true
+		})
+	}
+
+	pathopts := PathOptions{
+		Edges:              opts.Edges,
+		MinEdgeProbability: opts.MinEdgeProbability,
+	}
+
+	return graph.FindChokepoints(sources, func(o *engine.Object) bool {
+		_, found := targetset[o]
+		return found
+	}, func(o *engine.Object, each func(neighbour *engine.Object, cost float64) bool) {
+		o.Edges(engine.Out).Range(func(target *engine.Object, eb engine.EdgeBitmap) bool {
+			if pathStepProbability(o, target, eb, pathopts) > 0 {
+				return each(target, 1)
+			}
+			return true
+		})
+	})
+}
+
+// GraphChokepoints ranks the objects and edges in an analysis result. Edges in the result always point
+// from attacker to victim, so the query targets are the sources when the analysis was done in reverse.
+func GraphChokepoints(pg graph.Graph[*engine.Object, engine.EdgeBitmap], reverse bool) Chokepoints {
+	var sources []*engine.Object
+	targets := make(map[*engine.Object]struct{})
+	for node, data := range pg.Nodes() {
+		_, isoutside := data["source"]
+		_, isquery := data["target"]
+		if reverse {
+			isoutside, isquery = isquery, isoutside
+		}
+		if isoutside {
+			sources = append(sources, node)
+		}
+		if isquery {
+			targets[node] = struct{}{}
+		}
+	}
+
+	return pg.Chokepoints(sources, func(o *engine.Object) bool {
+		_, found := targets[o]
+		return found
+	})
+}
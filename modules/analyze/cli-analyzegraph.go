@@ -0,0 +1,130 @@
+package analyze
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/cli"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/spf13/cobra"
+)
+
+var (
+	AnalyzeGraphCommand = &cobra.Command{
+		Use:   "analyzegraph [-options]",
+		Short: "Runs an attack path analysis without the web interface and saves the resulting graph to a file",
+	}
+
+	agQuery          = AnalyzeGraphCommand.Flags().String("query", DefaultAnalysisQuery, "Start query (targets in normal mode, sources in reverse mode)")
+	agMiddleQuery    = AnalyzeGraphCommand.Flags().String("middlequery", "", "Query that nodes between start and end must match")
+	agEndQuery       = AnalyzeGraphCommand.Flags().String("endquery", "", "Query that the final nodes must match")
+	agMode           = AnalyzeGraphCommand.Flags().String("mode", "normal", "Analysis mode, normal finds who can reach the targets, reverse finds what the sources can reach")
+	agMaxDepth       = AnalyzeGraphCommand.Flags().Int("maxdepth", -1, "Maximum analysis depth (-1 is unlimited)")
+	agMaxOutgoing    = AnalyzeGraphCommand.Flags().Int("maxoutgoing", -1, "Maximum number of outgoing connections from one object (-1 is unlimited)")
+	agMinProbability = AnalyzeGraphCommand.Flags().Int("minprobability", 0, "Minimum edge probability in percent")
+	agMinAccProb     = AnalyzeGraphCommand.Flags().Int("minaccprobability", 0, "Minimum accumulated probability in percent")
+	agBacklinks      = AnalyzeGraphCommand.Flags().Int("backlinks", 0, "Backlink depth")
+	agNodeLimit      = AnalyzeGraphCommand.Flags().Int("nodelimit", 0, "Maximum number of nodes in the result (0 is unlimited)")
+	agPrune          = AnalyzeGraphCommand.Flags().Bool("prune", false, "Remove islands from the result")
+	agDontExpand     = AnalyzeGraphCommand.Flags().Bool("dont-expand-au-eo", false, "Don't expand Authenticated Users and Everyone")
+	agEdgesF         = AnalyzeGraphCommand.Flags().StringSlice("edges-first", nil, "Edges allowed on the first step (default is all edges)")
+	agEdgesM         = AnalyzeGraphCommand.Flags().StringSlice("edges-middle", nil, "Edges allowed on middle steps (default is all edges)")
+	agEdgesL         = AnalyzeGraphCommand.Flags().StringSlice("edges-last", nil, "Edges allowed on the last step (default is all edges)")
+	agTypesF         = AnalyzeGraphCommand.Flags().StringSlice("types-first", nil, "Object types allowed on the first step")
+	agTypesM         = AnalyzeGraphCommand.Flags().StringSlice("types-middle", nil, "Object types allowed on middle steps")
+	agTypesL         = AnalyzeGraphCommand.Flags().StringSlice("types-last", nil, "Object types allowed on the last step")
+	agAllDetails     = AnalyzeGraphCommand.Flags().Bool("alldetails", false, "Include all object attributes in the output")
+	agFormat         = AnalyzeGraphCommand.Flags().String("format", "cytoscapejs", "Output format ("+GraphFormatNames()+")")
+	agOutput         = AnalyzeGraphCommand.Flags().String("output", "analysis.json", "File to write the resulting graph to")
+	agSnapshot       = AnalyzeGraphCommand.Flags().String("snapshot", "", "Load the analyzed graph from this snapshot file if it exists, otherwise save it there once processing completes")
+)
+
+func init() {
+	cli.Root.AddCommand(AnalyzeGraphCommand)
+	AnalyzeGraphCommand.RunE = ExecuteAnalyzeGraph
+}
+
+// Translates the command line flags into the same parameters the web interface posts to /analyzegraph
+func analyzeGraphParams() (map[string]string, error) {
+	params := map[string]string{
+		"query":             *agQuery,
+		"middlequery":       *agMiddleQuery,
+		"endquery":          *agEndQuery,
+		"mode":              *agMode,
+		"maxdepth":          strconv.Itoa(*agMaxDepth),
+		"maxoutgoing":       strconv.Itoa(*agMaxOutgoing),
+		"minprobability":    strconv.Itoa(*agMinProbability),
+		"minaccprobability": strconv.Itoa(*agMinAccProb),
+		"backlinks":         strconv.Itoa(*agBacklinks),
+		"nodelimit":         strconv.Itoa(*agNodeLimit),
+		"prune":             strconv.FormatBool(*agPrune),
+		"dont-expand-au-eo": strconv.FormatBool(*agDontExpand),
+	}
+
+	for suffix, edges := range map[string][]string{"_f": *agEdgesF, "_m": *agEdgesM, "_l": *agEdgesL} {
+		if err := setEdgeParams(params, suffix, edges); err != nil {
+			return nil, err
+		}
+	}
+
+	for suffix, types := range map[string][]string{"_f": *agTypesF, "_m": *agTypesM, "_l": *agTypesL} {
+		if err := setObjectTypeParams(params, suffix, types); err != nil {
+			return nil, err
+		}
+	}
+
+	return params, nil
+}
+
+func ExecuteAnalyzeGraph(cmd *cobra.Command, args []string) error {
+	datapath := cmd.InheritedFlags().Lookup("datapath").Value.String()
+
+	format := strings.ToLower(*agFormat)
+	graphformat, found := GraphFormats[format]
+	if !found {
+		return fmt.Errorf("Unknown output format %v", *agFormat)
+	}
+	write := graphformat.Write
+	if format == "cytoscapejs" {
+		write = func(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error {
+			return WriteCytoscapeJS(pg, w, *agAllDetails)
+		}
+	}
+
+	params, err := analyzeGraphParams()
+	if err != nil {
+		return err
+	}
+
+	objs, err := loadObjects(datapath, *agSnapshot, false)
+	if err != nil {
+		return err
+	}
+
+	// Analysis needs all the edges in place
+	objs.WaitForPostProcessing()
+
+	opts, err := ParseAnalyzeObjectsOptions(params, objs)
+	if err != nil {
+		return err
+	}
+
+	results := AnalyzeObjects(opts)
+	for _, postprocessor := range PostProcessors {
+		results.Graph = postprocessor(results.Graph)
+	}
+
+	ui.Info().Msgf("Analysis found %v nodes and %v edges (%v removed by node limiter)", results.Graph.Order(), results.Graph.Size(), results.Removed)
+
+	err = exportGraphFile(results.Graph, *agOutput, write)
+	if err != nil {
+		return fmt.Errorf("Problem writing graph to %v: %v", *agOutput, err)
+	}
+	ui.Info().Msgf("Graph saved to %v", *agOutput)
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package analyze
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lkarlslund/adalanche/modules/cli"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ChokepointsCommand = &cobra.Command{
+		Use:   "chokepoints [-options]",
+		Short: "Ranks the objects and edges that cut off the most attack paths towards the target objects",
+	}
+
+	chokepointsSource         = ChokepointsCommand.Flags().String("source", "", "Query for the objects attack paths start from (default is all objects)")
+	chokepointsTarget         = ChokepointsCommand.Flags().String("target", DefaultAnalysisQuery, "Query for the objects attack paths end at")
+	chokepointsScope          = ChokepointsCommand.Flags().String("scope", "objects", "Search all objects, or just the graph found by the normal analysis of the target query (objects or analysis)")
+	chokepointsMaxDepth       = ChokepointsCommand.Flags().Int("maxdepth", -1, "Maximum analysis depth with analysis scope")
+	chokepointsEdges          = ChokepointsCommand.Flags().StringSlice("edges", nil, "Edges that attack paths may use (default is all edges)")
+	chokepointsMinProbability = ChokepointsCommand.Flags().Int("minprobability", 1, "Minimum edge probability in percent")
+	chokepointsLimit          = ChokepointsCommand.Flags().Int("limit", 25, "Maximum number of objects and edges to list, 0 for all")
+	chokepointsFormat         = ChokepointsCommand.Flags().String("format", "text", "Output format (text or json)")
+	chokepointsOutput         = ChokepointsCommand.Flags().String("output", "", "File to write results to (default is standard output)")
+	chokepointsSnapshot       = ChokepointsCommand.Flags().String("snapshot", "", "Load the analyzed graph from this snapshot file if it exists, otherwise save it there once processing completes")
+)
+
+func init() {
+	cli.Root.AddCommand(ChokepointsCommand)
+	ChokepointsCommand.RunE = ExecuteChokepoints
+}
+
+func ExecuteChokepoints(cmd *cobra.Command, args []string) error {
+	datapath := cmd.InheritedFlags().Lookup("datapath").Value.String()
+
+	format := strings.ToLower(*chokepointsFormat)
+	if format != "text" && format != "json" {
+		return fmt.Errorf("Unknown output format %v", *chokepointsFormat)
+	}
+
+	scope := strings.ToLower(*chokepointsScope)
+	if scope != "objects" && scope != "analysis" {
+		return fmt.Errorf("Unknown scope %v", *chokepointsScope)
+	}
+
+	params := map[string]string{
+		"source":         *chokepointsSource,
+		"target":         *chokepointsTarget,
+		"minprobability": strconv.Itoa(*chokepointsMinProbability),
+	}
+	for _, name := range *chokepointsEdges {
+		edge := engine.LookupEdge(name)
+		if edge == engine.NonExistingEdge {
+			return fmt.Errorf("Unknown edge %v", name)
+		}
+		params["pwn_"+edge.String()+"_f"] = "on"
+	}
+
+	objs, err := loadObjects(datapath, *chokepointsSnapshot, false)
+	if err != nil {
+		return err
+	}
+	objs.WaitForPostProcessing()
+
+	var result Chokepoints
+	if scope == "analysis" {
+		params["query"] = *chokepointsTarget
+		params["endquery"] = *chokepointsSource
+		params["maxdepth"] = strconv.Itoa(*chokepointsMaxDepth)
+		for key := range params {
+			if strings.HasPrefix(key, "pwn_") {
+				// Same edges for the whole chain
+				params[key[:len(key)-2]+"_m"] = "on"
+				params[key[:len(key)-2]+"_l"] = "on"
+			}
+		}
+		opts, err := ParseAnalyzeObjectsOptions(params, objs)
+		if err != nil {
+			return err
+		}
+		result = GraphChokepoints(AnalyzeObjects(opts).Graph, false)
+	} else {
+		opts, err := ParseChokepointOptions(params, objs)
+		if err != nil {
+			return err
+		}
+		result = FindChokepoints(opts)
+	}
+	ui.Info().Msgf("Found %v objects and %v edges on attack paths from %v sources", len(result.Nodes), len(result.Edges), result.Sources)
+
+	result.Limit(*chokepointsLimit)
+
+	var out io.Writer = os.Stdout
+	if *chokepointsOutput != "" {
+		outfile, err := os.Create(*chokepointsOutput)
+		if err != nil {
+			return fmt.Errorf("Problem creating output file: %v", err)
+		}
+		defer outfile.Close()
+		out = outfile
+	}
+
+	if format == "json" {
+		data, err := qjson.MarshalIndent(chokepointsReport(result, displayLabel), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(data, '\n'))
+		return err
+	}
+
+	fmt.Fprintf(out, "%v sources can reach a target\n\n", result.Sources)
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCES CUT\tPATHS\tOBJECT")
+	for _, node := range result.Nodes {
+		fmt.Fprintf(tw, "%v\t%.1f\t%v\n", node.Sources, node.Paths, displayLabel(node.Node))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "SOURCES CUT\tPATHS\tEDGE")
+	for _, edge := range result.Edges {
+		eb := edgesBetween(edge.Source, edge.Target)
+		fmt.Fprintf(tw, "%v\t%.1f\t%v --[%v]--> %v\n", edge.Sources, edge.Paths, displayLabel(edge.Source), eb.JoinedString(), displayLabel(edge.Target))
+	}
+	return tw.Flush()
+}
+
+type chokepointNodeReport struct {
+	Object  string  `json:"object"`
+	Sources int     `json:"sources"`
+	Paths   float64 `json:"paths"`
+}
+
+type chokepointEdgeReport struct {
+	Source  string   `json:"source"`
+	Target  string   `json:"target"`
+	Edges   []string `json:"edges"`
+	Sources int      `json:"sources"`
+	Paths   float64  `json:"paths"`
+}
+
+type chokepointReport struct {
+	Sources int                    `json:"sources"`
+	Nodes   []chokepointNodeReport `json:"nodes"`
+	Edges   []chokepointEdgeReport `json:"edges"`
+}
+
+func chokepointsReport(result Chokepoints, label func(o *engine.Object) string) chokepointReport {
+	report := chokepointReport{
+		Sources: result.Sources,
+		Nodes:   make([]chokepointNodeReport, len(result.Nodes)),
+		Edges:   make([]chokepointEdgeReport, len(result.Edges)),
+	}
+	for i, node := range result.Nodes {
+		report.Nodes[i] = chokepointNodeReport{
+			Object:  label(node.Node),
+			Sources: node.Sources,
+			Paths:   node.Paths,
+		}
+	}
+	for i, edge := range result.Edges {
+		eb := edgesBetween(edge.Source, edge.Target)
+		report.Edges[i] = chokepointEdgeReport{
+			Source:  label(edge.Source),
+			Target:  label(edge.Target),
+			Edges:   eb.StringSlice(),
+			Sources: edge.Sources,
+			Paths:   edge.Paths,
+		}
+	}
+	return report
+}
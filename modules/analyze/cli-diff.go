@@ -0,0 +1,270 @@
+package analyze
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/cli"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/spf13/cobra"
+)
+
+var (
+	DiffCommand = &cobra.Command{
+		Use:   "diff [-options] olddatapath newdatapath",
+		Short: "Compares two collections and reports added, removed and changed objects and edges",
+		Long:  "Compares two collections and reports added, removed and changed objects and edges. Each path can be a data folder or a snapshot file.",
+		Args:  cobra.ExactArgs(2),
+	}
+
+	diffIgnore     = DiffCommand.Flags().StringSlice("ignore", []string{"lastLogon", "lastLogonTimestamp", "logonCount", "badPwdCount", "badPasswordTime", "uSNChanged", "whenChanged", "dSCorePropagationData", "replPropertyMetaData"}, "Attributes to ignore when comparing objects")
+	diffIgnoreMeta = DiffCommand.Flags().Bool("ignoremeta", true, "Ignore calculated meta attributes (starting with _)")
+	diffFormat     = DiffCommand.Flags().String("format", "text", "Output format (text or json)")
+	diffOutput     = DiffCommand.Flags().String("output", "", "File to write the report to (default is standard output)")
+)
+
+func init() {
+	cli.Root.AddCommand(DiffCommand)
+	DiffCommand.RunE = ExecuteDiff
+}
+
+// Loads a data folder or a snapshot file and waits for all processing to complete
+func loadForDiff(path string) (*engine.Objects, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return engine.LoadSnapshot(path)
+	}
+	objs, err := engine.Run(path)
+	if err != nil {
+		return nil, err
+	}
+	objs.WaitForPostProcessing()
+	return objs, nil
+}
+
+func ExecuteDiff(cmd *cobra.Command, args []string) error {
+	format := strings.ToLower(*diffFormat)
+	if format != "text" && format != "json" {
+		return fmt.Errorf("Unknown output format %v, use text or json", *diffFormat)
+	}
+
+	ui.Info().Msgf("Loading old data from %v", args[0])
+	oldobjs, err := loadForDiff(args[0])
+	if err != nil {
+		return fmt.Errorf("Problem loading %v: %v", args[0], err)
+	}
+
+	ui.Info().Msgf("Loading new data from %v", args[1])
+	newobjs, err := loadForDiff(args[1])
+	if err != nil {
+		return fmt.Errorf("Problem loading %v: %v", args[1], err)
+	}
+
+	// Attributes might first be registered while loading, so look them up afterwards
+	opts := engine.DiffOptions{
+		IgnoreMeta: *diffIgnoreMeta,
+	}
+	for _, name := range *diffIgnore {
+		if attr := engine.A(name); attr != engine.NonExistingAttribute {
+			opts.IgnoreAttributes = append(opts.IgnoreAttributes, attr)
+		}
+	}
+
+	result := engine.Diff(oldobjs, newobjs, opts)
+
+	ui.Info().Msgf("%v objects added, %v removed, %v changed, %v connections with edge changes", result.Added.Len(), result.Removed.Len(), len(result.Changed), len(result.Edges))
+
+	var out io.Writer = os.Stdout
+	if *diffOutput != "" {
+		outfile, err := os.Create(*diffOutput)
+		if err != nil {
+			return fmt.Errorf("Problem creating output file: %v", err)
+		}
+		defer outfile.Close()
+		out = outfile
+	}
+
+	if format == "json" {
+		data, err := qjson.MarshalIndent(newDiffReport(result), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(data, '\n'))
+		return err
+	}
+
+	return writeDiffText(out, result)
+}
+
+type diffReportObject struct {
+	Label string `json:"label"`
+	DN    string `json:"dn,omitempty"`
+	Type  string `json:"type"`
+}
+
+type diffReportAttribute struct {
+	Attribute string   `json:"attribute"`
+	Removed   []string `json:"removed,omitempty"`
+	Added     []string `json:"added,omitempty"`
+}
+
+type diffReportChange struct {
+	diffReportObject
+	Attributes []diffReportAttribute `json:"attributes"`
+}
+
+type diffReportEdge struct {
+	Source diffReportObject `json:"source"`
+	Target diffReportObject `json:"target"`
+	Gained []string         `json:"gained,omitempty"`
+	Lost   []string         `json:"lost,omitempty"`
+}
+
+type diffReportEdgeStats struct {
+	Gained int `json:"gained"`
+	Lost   int `json:"lost"`
+}
+
+type diffReport struct {
+	Added       []diffReportObject             `json:"added"`
+	Removed     []diffReportObject             `json:"removed"`
+	Changed     []diffReportChange             `json:"changed"`
+	Edges       []diffReportEdge               `json:"edges"`
+	EdgeStats   map[string]diffReportEdgeStats `json:"edgestats"`
+	Unmatchable int                            `json:"unmatchable"`
+}
+
+func newDiffReportObject(o *engine.Object) diffReportObject {
+	return diffReportObject{
+		Label: o.Label(),
+		DN:    o.DN(),
+		Type:  o.Type().String(),
+	}
+}
+
+func newDiffReport(result engine.DiffResult) diffReport {
+	report := diffReport{
+		Added:       []diffReportObject{},
+		Removed:     []diffReportObject{},
+		Changed:     []diffReportChange{},
+		Edges:       []diffReportEdge{},
+		EdgeStats:   make(map[string]diffReportEdgeStats),
+		Unmatchable: result.Unmatchable,
+	}
+	result.Added.Iterate(func(o *engine.Object) bool {
+		report.Added = append(report.Added, newDiffReportObject(o))
+		return true
+	})
+	result.Removed.Iterate(func(o *engine.Object) bool {
+		report.Removed = append(report.Removed, newDiffReportObject(o))
+		return true
+	})
+	for _, change := range result.Changed {
+		rc := diffReportChange{
+			diffReportObject: newDiffReportObject(change.New),
+		}
+		for _, ad := range change.Attributes {
+			rc.Attributes = append(rc.Attributes, diffReportAttribute{
+				Attribute: ad.Attribute.String(),
+				Removed:   ad.Removed,
+				Added:     ad.Added,
+			})
+		}
+		report.Changed = append(report.Changed, rc)
+	}
+	for _, ed := range result.Edges {
+		report.Edges = append(report.Edges, diffReportEdge{
+			Source: newDiffReportObject(ed.Source),
+			Target: newDiffReportObject(ed.Target),
+			Gained: ed.Gained.StringSlice(),
+			Lost:   ed.Lost.StringSlice(),
+		})
+	}
+	for edge, stats := range result.EdgeStats {
+		report.EdgeStats[edge.String()] = diffReportEdgeStats{
+			Gained: stats.Gained,
+			Lost:   stats.Lost,
+		}
+	}
+	return report
+}
+
+func writeDiffText(out io.Writer, result engine.DiffResult) error {
+	fmt.Fprintf(out, "Objects added: %v, removed: %v, changed: %v (%v objects could not be matched)\n", result.Added.Len(), result.Removed.Len(), len(result.Changed), result.Unmatchable)
+
+	if len(result.EdgeStats) > 0 {
+		fmt.Fprintln(out, "\nEdge changes per type:")
+		edges := make([]engine.Edge, 0, len(result.EdgeStats))
+		for edge := range result.EdgeStats {
+			edges = append(edges, edge)
+		}
+		slices.SortFunc(edges, func(a, b engine.Edge) int {
+			return strings.Compare(a.String(), b.String())
+		})
+		for _, edge := range edges {
+			stats := result.EdgeStats[edge]
+			fmt.Fprintf(out, "  %-30v +%v -%v\n", edge.String(), stats.Gained, stats.Lost)
+		}
+	}
+
+	if result.Added.Len() > 0 {
+		fmt.Fprintln(out, "\nAdded objects:")
+		result.Added.Iterate(func(o *engine.Object) bool {
+			fmt.Fprintf(out, "  + %v (%v)\n", displayLabel(o), o.Type().String())
+			return true
+		})
+	}
+
+	if result.Removed.Len() > 0 {
+		fmt.Fprintln(out, "\nRemoved objects:")
+		result.Removed.Iterate(func(o *engine.Object) bool {
+			fmt.Fprintf(out, "  - %v (%v)\n", displayLabel(o), o.Type().String())
+			return true
+		})
+	}
+
+	if len(result.Changed) > 0 {
+		fmt.Fprintln(out, "\nChanged objects:")
+		for _, change := range result.Changed {
+			fmt.Fprintf(out, "  %v\n", displayLabel(change.New))
+			for _, ad := range change.Attributes {
+				for _, v := range ad.Removed {
+					fmt.Fprintf(out, "    - %v: %v\n", ad.Attribute.String(), v)
+				}
+				for _, v := range ad.Added {
+					fmt.Fprintf(out, "    + %v: %v\n", ad.Attribute.String(), v)
+				}
+			}
+		}
+	}
+
+	if len(result.Edges) > 0 {
+		fmt.Fprintln(out, "\nEdge changes:")
+		for _, ed := range result.Edges {
+			fmt.Fprintf(out, "  %v -> %v", displayLabel(ed.Source), displayLabel(ed.Target))
+			if !ed.Gained.IsBlank() {
+				fmt.Fprintf(out, " +[%v]", ed.Gained.JoinedString())
+			}
+			if !ed.Lost.IsBlank() {
+				fmt.Fprintf(out, " -[%v]", ed.Lost.JoinedString())
+			}
+			fmt.Fprintln(out)
+		}
+	}
+
+	return nil
+}
+
+func displayLabel(o *engine.Object) string {
+	if dn := o.DN(); dn != "" {
+		return dn
+	}
+	return o.Label()
+}
@@ -0,0 +1,76 @@
+package analyze
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/cli"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ExportCommand = &cobra.Command{
+		Use:   "export [-options]",
+		Short: "Exports all objects and edges to a file for use in other tools",
+	}
+
+	exportFormat   = ExportCommand.Flags().String("format", "bloodhound", "Output format ("+GraphFormatNames()+")")
+	exportOutput   = ExportCommand.Flags().String("output", "adalanche-export.json", "File to write the exported data to")
+	exportSnapshot = ExportCommand.Flags().String("snapshot", "", "Load the analyzed graph from this snapshot file if it exists, otherwise save it there once processing completes")
+)
+
+func init() {
+	cli.Root.AddCommand(ExportCommand)
+	ExportCommand.RunE = ExecuteExport
+}
+
+func ExecuteExport(cmd *cobra.Command, args []string) error {
+	datapath := cmd.InheritedFlags().Lookup("datapath").Value.String()
+
+	var export func(ao *engine.Objects, filename string) error
+	format := strings.ToLower(*exportFormat)
+	switch format {
+	case "bloodhound":
+		// Avoids building an intermediate graph of everything
+		export = ExportObjectsBloodHound
+	default:
+		graphformat, found := GraphFormats[format]
+		if !found {
+			return fmt.Errorf("Unknown output format %v", *exportFormat)
+		}
+		export = func(ao *engine.Objects, filename string) error {
+			return exportGraphFile(ObjectsToGraph(ao), filename, graphformat.Write)
+		}
+	}
+
+	objs, err := loadObjects(datapath, *exportSnapshot, false)
+	if err != nil {
+		return err
+	}
+	objs.WaitForPostProcessing()
+
+	err = export(objs, *exportOutput)
+	if err != nil {
+		return fmt.Errorf("Problem writing export to %v: %v", *exportOutput, err)
+	}
+	ui.Info().Msgf("Exported %v objects to %v", objs.Len(), *exportOutput)
+
+	return nil
+}
+
+// ObjectsToGraph returns a graph with all objects and their outgoing edges
+func ObjectsToGraph(ao *engine.Objects) graph.Graph[*engine.Object, engine.EdgeBitmap] {
+	pg := graph.NewGraph[*engine.Object, engine.EdgeBitmap]()
+	ao.Iterate(func(source *engine.Object) bool {
+		pg.AddNode(source)
+		source.Edges(engine.Out).Range(func(target *engine.Object, edge engine.EdgeBitmap) bool {
+			pg.AddEdge(source, target, edge)
+			return true
+		})
+		return true
+	})
+	return pg
+}
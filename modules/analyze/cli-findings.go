@@ -0,0 +1,144 @@
+package analyze
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/cli"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/spf13/cobra"
+)
+
+var (
+	FindingsCommand = &cobra.Command{
+		Use:   "findings [-options]",
+		Short: "Evaluates the built-in and custom security rules and lists the findings",
+		Long: `Evaluates security rules against the data and lists what they found, most severe first.
+
+Custom rules are read from ` + RulesFile + ` in the datapath, or the file given with --rules. It holds a YAML list of rules
+with id, title, severity (info, low, medium, high or critical), description, remediation and query, where the query is an
+LDAP filter or a path pattern as accepted by the query command. A rule with the id of a built-in rule replaces it, and
+"disabled: true" turns it off.`,
+	}
+
+	findingsRules       = FindingsCommand.Flags().String("rules", "", "YAML file with custom rules (default is "+RulesFile+" in the datapath)")
+	findingsMinSeverity = FindingsCommand.Flags().String("minseverity", "info", "Only list findings with at least this severity")
+	findingsLimit       = FindingsCommand.Flags().Int("limit", 10, "Maximum number of affected objects listed per finding in text output, 0 for all")
+	findingsListRules   = FindingsCommand.Flags().Bool("list-rules", false, "List the rules that would be evaluated instead of evaluating them")
+	findingsFormat      = FindingsCommand.Flags().String("format", "text", "Output format (text, csv or json)")
+	findingsOutput      = FindingsCommand.Flags().String("output", "", "File to write results to (default is standard output)")
+	findingsSnapshot    = FindingsCommand.Flags().String("snapshot", "", "Load the analyzed graph from this snapshot file if it exists, otherwise save it there once processing completes")
+)
+
+func init() {
+	cli.Root.AddCommand(FindingsCommand)
+	FindingsCommand.RunE = ExecuteFindings
+}
+
+func ExecuteFindings(cmd *cobra.Command, args []string) error {
+	datapath := cmd.InheritedFlags().Lookup("datapath").Value.String()
+
+	format := strings.ToLower(*findingsFormat)
+	if format != "text" && format != "csv" && format != "json" {
+		return fmt.Errorf("Unknown output format %v", *findingsFormat)
+	}
+
+	minseverity, err := ParseSeverity(*findingsMinSeverity)
+	if err != nil {
+		return err
+	}
+
+	rulesfile := *findingsRules
+	if rulesfile == "" {
+		rulesfile = filepath.Join(datapath, RulesFile)
+	}
+	rules, err := LoadRules(rulesfile)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *findingsOutput != "" {
+		outfile, err := os.Create(*findingsOutput)
+		if err != nil {
+			return fmt.Errorf("Problem creating output file: %v", err)
+		}
+		defer outfile.Close()
+		out = outfile
+	}
+
+	if *findingsListRules {
+		return WriteRulesYAML(out, rules)
+	}
+
+	objs, err := loadObjects(datapath, *findingsSnapshot, false)
+	if err != nil {
+		return err
+	}
+	objs.WaitForPostProcessing()
+
+	var selected []Rule
+	for _, rule := range rules {
+		if rule.Severity >= minseverity {
+			selected = append(selected, rule)
+		}
+	}
+
+	findings, err := EvaluateRules(selected, objs)
+	if err != nil {
+		ui.Error().Msgf("%v", err)
+	}
+	ui.Info().Msgf("%v of %v rules produced findings", len(findings), len(selected))
+
+	switch format {
+	case "json":
+		report := APIFindings{
+			Ready:    true,
+			Rules:    len(selected),
+			Findings: make([]APIFinding, len(findings)),
+		}
+		for i, finding := range findings {
+			report.Findings[i] = newAPIFinding(finding)
+		}
+		data, err := qjson.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(data, '\n'))
+		return err
+	case "csv":
+		// One row per affected object
+		cw := csv.NewWriter(out)
+		cw.Write([]string{"severity", "rule", "title", "object"})
+		for _, finding := range findings {
+			for _, o := range finding.Objects {
+				cw.Write([]string{finding.Rule.Severity.String(), finding.Rule.ID, finding.Rule.Title, displayLabel(o)})
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	for _, finding := range findings {
+		fmt.Fprintf(out, "[%v] %v (%v objects)\n", strings.ToUpper(finding.Rule.Severity.String()), finding.Rule.Title, len(finding.Objects))
+		if finding.Rule.Description != "" {
+			fmt.Fprintf(out, "  %v\n", finding.Rule.Description)
+		}
+		if finding.Rule.Remediation != "" {
+			fmt.Fprintf(out, "  Remediation: %v\n", finding.Rule.Remediation)
+		}
+		for i, o := range finding.Objects {
+			if *findingsLimit > 0 && i == *findingsLimit {
+				fmt.Fprintf(out, "  ... and %v more\n", len(finding.Objects)-i)
+				break
+			}
+			fmt.Fprintf(out, "  - %v\n", displayLabel(o))
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
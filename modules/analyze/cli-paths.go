@@ -0,0 +1,138 @@
+package analyze
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/cli"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/spf13/cobra"
+)
+
+var (
+	PathsCommand = &cobra.Command{
+		Use:   "paths [-options]",
+		Short: "Finds the most likely attack paths between objects matching a source and a target query",
+	}
+
+	pathsSource         = PathsCommand.Flags().String("source", "", "Query for the objects the paths start from")
+	pathsTarget         = PathsCommand.Flags().String("target", DefaultAnalysisQuery, "Query for the objects the paths end at")
+	pathsK              = PathsCommand.Flags().Int("k", 1, "Number of distinct paths to find")
+	pathsEdges          = PathsCommand.Flags().StringSlice("edges", nil, "Edges that paths may use (default is all edges)")
+	pathsMinProbability = PathsCommand.Flags().Int("minprobability", 1, "Minimum edge probability in percent")
+	pathsFormat         = PathsCommand.Flags().String("format", "text", "Output format (text, json or a graph format: "+GraphFormatNames()+")")
+	pathsOutput         = PathsCommand.Flags().String("output", "", "File to write results to (default is standard output, required for graph formats)")
+	pathsSnapshot       = PathsCommand.Flags().String("snapshot", "", "Load the analyzed graph from this snapshot file if it exists, otherwise save it there once processing completes")
+)
+
+func init() {
+	cli.Root.AddCommand(PathsCommand)
+	PathsCommand.RunE = ExecutePaths
+}
+
+func ExecutePaths(cmd *cobra.Command, args []string) error {
+	datapath := cmd.InheritedFlags().Lookup("datapath").Value.String()
+
+	format := strings.ToLower(*pathsFormat)
+	graphformat, isgraph := GraphFormats[format]
+	switch {
+	case format == "text", format == "json":
+	case isgraph:
+		if *pathsOutput == "" {
+			return fmt.Errorf("Output file is required for %v format", format)
+		}
+	default:
+		return fmt.Errorf("Unknown output format %v", *pathsFormat)
+	}
+
+	params := map[string]string{
+		"source":         *pathsSource,
+		"target":         *pathsTarget,
+		"k":              strconv.Itoa(*pathsK),
+		"minprobability": strconv.Itoa(*pathsMinProbability),
+	}
+	for _, name := range *pathsEdges {
+		edge := engine.LookupEdge(name)
+		if edge == engine.NonExistingEdge {
+			return fmt.Errorf("Unknown edge %v", name)
+		}
+		params["pwn_"+edge.String()+"_f"] = "on"
+	}
+
+	objs, err := loadObjects(datapath, *pathsSnapshot, false)
+	if err != nil {
+		return err
+	}
+	objs.WaitForPostProcessing()
+
+	opts, err := ParsePathOptions(params, objs)
+	if err != nil {
+		return err
+	}
+
+	paths := FindPaths(opts)
+	ui.Info().Msgf("Found %v paths", len(paths))
+
+	if isgraph {
+		return exportGraphFile(PathsToGraph(paths), *pathsOutput, graphformat.Write)
+	}
+
+	var out io.Writer = os.Stdout
+	if *pathsOutput != "" {
+		outfile, err := os.Create(*pathsOutput)
+		if err != nil {
+			return fmt.Errorf("Problem creating output file: %v", err)
+		}
+		defer outfile.Close()
+		out = outfile
+	}
+
+	if format == "json" {
+		type jsonstep struct {
+			Source      string   `json:"source"`
+			Target      string   `json:"target"`
+			Edges       []string `json:"edges"`
+			Probability int      `json:"probability"`
+		}
+		type jsonpath struct {
+			Steps       []jsonstep `json:"steps"`
+			Probability float64    `json:"probability"`
+		}
+		result := make([]jsonpath, len(paths))
+		for i, path := range paths {
+			result[i].Probability = path.Probability * 100
+			for _, step := range path.Steps {
+				result[i].Steps = append(result[i].Steps, jsonstep{
+					Source:      displayLabel(step.Source),
+					Target:      displayLabel(step.Target),
+					Edges:       step.Edges.StringSlice(),
+					Probability: int(step.Probability),
+				})
+			}
+		}
+		data, err := qjson.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(append(data, '\n'))
+		return err
+	}
+
+	for i, path := range paths {
+		fmt.Fprintf(out, "Path %v (%.1f%% probability, %v steps):\n", i+1, path.Probability*100, len(path.Steps))
+		for j, step := range path.Steps {
+			if j == 0 {
+				fmt.Fprintf(out, "  %v\n", displayLabel(step.Source))
+			}
+			fmt.Fprintf(out, "    --[%v]--> (%v%%)\n", step.Edges.JoinedString(), step.Probability)
+			fmt.Fprintf(out, "  %v\n", displayLabel(step.Target))
+		}
+		fmt.Fprintln(out)
+	}
+
+	return nil
+}
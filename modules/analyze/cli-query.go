@@ -0,0 +1,306 @@
+package analyze
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lkarlslund/adalanche/modules/cli"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/query"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/spf13/cobra"
+)
+
+var (
+	QueryCommand = &cobra.Command{
+		Use:   "query [-options] ldapfilter|pathpattern",
+		Short: "Runs an LDAP style filter or a path pattern against the data and prints the matching objects or paths",
+		Long: `Runs an LDAP style filter against the data and prints the matching objects, or a path pattern and prints the matching paths.
+
+Path patterns chain LDAP filters with edge patterns:
+
+  (objectClass=user)-[GenericAll|WriteDACL*1..3]->(&(objectClass=computer)(userAccountControl:and:=524288))
+
+() matches any object, -[edges*min..max]-> follows edges from left to right and <-[...]- the opposite way.`,
+		Args: cobra.ExactArgs(1),
+	}
+
+	queryAttributes = QueryCommand.Flags().StringSlice("attributes", []string{"type", "name", "distinguishedName"}, "Attributes to output for each matching object")
+	queryFormat     = QueryCommand.Flags().String("format", "table", "Output format (table, csv, xlsx, json or ndjson)")
+	queryOutput     = QueryCommand.Flags().String("output", "", "File to write results to (default is standard output)")
+	querySnapshot   = QueryCommand.Flags().String("snapshot", "", "Load the analyzed graph from this snapshot file if it exists, otherwise save it there once processing completes")
+	queryMultiSep   = QueryCommand.Flags().String("separator", ";", "Separator used when joining multiple values in table and csv output")
+	queryMaxPaths   = QueryCommand.Flags().Int("maxpaths", 1000, "Maximum number of paths returned by a path pattern, 0 for unlimited")
+	queryMinProb    = QueryCommand.Flags().Int("minprobability", 0, "Minimum edge probability in percent followed by a path pattern")
+)
+
+func init() {
+	cli.Root.AddCommand(QueryCommand)
+	QueryCommand.RunE = ExecuteQuery
+}
+
+func ExecuteQuery(cmd *cobra.Command, args []string) error {
+	datapath := cmd.InheritedFlags().Lookup("datapath").Value.String()
+
+	format := strings.ToLower(*queryFormat)
+	switch format {
+	case "table", "csv", "xlsx", "json", "ndjson":
+	default:
+		return fmt.Errorf("Unknown output format %v, use table, csv, xlsx, json or ndjson", *queryFormat)
+	}
+
+	objs, err := loadObjects(datapath, *querySnapshot, false)
+	if err != nil {
+		return err
+	}
+
+	// Queries can depend on edges, so everything must be done
+	objs.WaitForPostProcessing()
+
+	pattern, err := query.ParsePathPattern(args[0], objs)
+	if err != nil {
+		return fmt.Errorf("Error parsing query: %v", err)
+	}
+
+	attributes := make([]engine.Attribute, len(*queryAttributes))
+	for i, name := range *queryAttributes {
+		attributes[i] = engine.A(name)
+		if attributes[i] == engine.NonExistingAttribute {
+			return fmt.Errorf("Unknown attribute %v", name)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if *queryOutput != "" {
+		outfile, err := os.Create(*queryOutput)
+		if err != nil {
+			return fmt.Errorf("Problem creating output file: %v", err)
+		}
+		defer outfile.Close()
+		out = outfile
+	}
+
+	if len(pattern.Edges) > 0 {
+		paths := query.ExecutePathPattern(pattern, objs, query.PathPatternOptions{
+			MinProbability: engine.Probability(*queryMinProb),
+			MaxResults:     *queryMaxPaths,
+		})
+		if *queryMaxPaths > 0 && len(paths) == *queryMaxPaths {
+			ui.Warn().Msgf("Stopped after %v paths, use --maxpaths to get more", len(paths))
+		}
+
+		switch format {
+		case "xlsx":
+			return fmt.Errorf("Path patterns can't be written as xlsx, use csv instead")
+		case "table":
+			err = writePathsTable(out, paths)
+		case "csv":
+			err = writePathsCSV(out, paths)
+		case "json":
+			err = writePathsJSON(out, attributes, paths, false)
+		case "ndjson":
+			err = writePathsJSON(out, attributes, paths, true)
+		}
+		if err != nil {
+			return err
+		}
+
+		if *queryOutput != "" {
+			ui.Info().Msgf("Wrote %v paths to %v", len(paths), *queryOutput)
+		}
+		return nil
+	}
+
+	var results engine.ObjectSlice
+	if pattern.Nodes[0] == nil {
+		results = objs.AsSlice()
+	} else {
+		results = query.Execute(pattern.Nodes[0], objs).AsSlice()
+	}
+	results.Sort(engine.Name, false)
+
+	switch format {
+	case "table":
+		err = writeQueryTable(out, attributes, results, *queryMultiSep)
+	case "csv":
+		err = writeQueryCSV(out, attributes, results, *queryMultiSep)
+	case "xlsx":
+		err = writeQueryXLSX(out, attributes, results, *queryMultiSep)
+	case "json":
+		err = writeQueryJSON(out, attributes, results, false)
+	case "ndjson":
+		err = writeQueryJSON(out, attributes, results, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	if *queryOutput != "" {
+		ui.Info().Msgf("Wrote %v objects to %v", results.Len(), *queryOutput)
+	}
+
+	return nil
+}
+
+func writeQueryTable(out io.Writer, attributes []engine.Attribute, results engine.ObjectSlice, separator string) error {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	headers := make([]string, len(attributes))
+	for i, attr := range attributes {
+		headers[i] = attr.String()
+	}
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+
+	row := make([]string, len(attributes))
+	results.Iterate(func(o *engine.Object) bool {
+		for i, attr := range attributes {
+			// Tabs and newlines would break the layout
+			row[i] = strings.NewReplacer("\t", " ", "\n", " ", "\r", "").Replace(strings.Join(o.Attr(attr).StringSlice(), separator))
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+		return true
+	})
+	return tw.Flush()
+}
+
+func writeQueryCSV(out io.Writer, attributes []engine.Attribute, results engine.ObjectSlice, separator string) error {
+	cw := csv.NewWriter(out)
+	headers := make([]string, len(attributes))
+	for i, attr := range attributes {
+		headers[i] = attr.String()
+	}
+	cw.Write(headers)
+
+	row := make([]string, len(attributes))
+	results.Iterate(func(o *engine.Object) bool {
+		for i, attr := range attributes {
+			row[i] = strings.Join(o.Attr(attr).StringSlice(), separator)
+		}
+		cw.Write(row)
+		return true
+	})
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeQueryJSON(out io.Writer, attributes []engine.Attribute, results engine.ObjectSlice, ndjson bool) error {
+	rows := make([]map[string]any, 0, results.Len())
+	results.Iterate(func(o *engine.Object) bool {
+		rows = append(rows, queryJSONObject(o, attributes))
+		return true
+	})
+	return writeJSONRows(out, rows, ndjson)
+}
+
+func queryJSONObject(o *engine.Object, attributes []engine.Attribute) map[string]any {
+	row := make(map[string]any, len(attributes))
+	for _, attr := range attributes {
+		values := o.Attr(attr)
+		if values.Len() == 0 {
+			continue
+		}
+		if attr.IsSingle() {
+			row[attr.String()] = values.First().String()
+		} else {
+			row[attr.String()] = values.StringSlice()
+		}
+	}
+	return row
+}
+
+func writeJSONRows[T any](out io.Writer, rows []T, ndjson bool) error {
+	if ndjson {
+		encoder := qjson.NewEncoder(out)
+		for _, row := range rows {
+			if err := encoder.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data, err := qjson.MarshalIndent(rows, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(data, '\n'))
+	return err
+}
+
+// Renders a path like A --[GenericAll]--> B <--[WriteDACL]-- C
+func pathMatchString(path query.PathMatch) string {
+	var sb strings.Builder
+	for i, o := range path.Objects {
+		if i > 0 {
+			hop := path.Hops[i-1]
+			if hop.Direction == engine.In {
+				sb.WriteString(" <--[" + hop.Edges.JoinedString() + "]-- ")
+			} else {
+				sb.WriteString(" --[" + hop.Edges.JoinedString() + "]--> ")
+			}
+		}
+		sb.WriteString(displayLabel(o))
+	}
+	return sb.String()
+}
+
+func writePathsTable(out io.Writer, paths []query.PathMatch) error {
+	for _, path := range paths {
+		if _, err := fmt.Fprintln(out, pathMatchString(path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// One row per hop, with source and target in attack direction
+func writePathsCSV(out io.Writer, paths []query.PathMatch) error {
+	cw := csv.NewWriter(out)
+	cw.Write([]string{"path", "step", "source", "edges", "target"})
+	for i, path := range paths {
+		for j, hop := range path.Hops {
+			source, target := path.Objects[j], path.Objects[j+1]
+			if hop.Direction == engine.In {
+				source, target = target, source
+			}
+			cw.Write([]string{strconv.Itoa(i + 1), strconv.Itoa(j + 1), displayLabel(source), hop.Edges.JoinedString(), displayLabel(target)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writePathsJSON(out io.Writer, attributes []engine.Attribute, paths []query.PathMatch, ndjson bool) error {
+	type jsonhop struct {
+		Direction string   `json:"direction"`
+		Edges     []string `json:"edges"`
+	}
+	type jsonpath struct {
+		Objects []map[string]any `json:"objects"`
+		Hops    []jsonhop        `json:"hops"`
+	}
+
+	rows := make([]jsonpath, len(paths))
+	for i, path := range paths {
+		rows[i].Objects = make([]map[string]any, len(path.Objects))
+		for j, o := range path.Objects {
+			rows[i].Objects[j] = queryJSONObject(o, attributes)
+		}
+		rows[i].Hops = make([]jsonhop, len(path.Hops))
+		for j, hop := range path.Hops {
+			direction := "out"
+			if hop.Direction == engine.In {
+				direction = "in"
+			}
+			rows[i].Hops[j] = jsonhop{
+				Direction: direction,
+				Edges:     hop.Edges.StringSlice(),
+			}
+		}
+	}
+	return writeJSONRows(out, rows, ndjson)
+}
@@ -0,0 +1,191 @@
+package analyze
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/lkarlslund/adalanche/modules/cli"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ReportCommand = &cobra.Command{
+		Use:   "report [-options]",
+		Short: "Generates a self contained HTML assessment report, optionally rendered to PDF",
+		Long: `Runs the findings rules, the paths to Domain Admins and Enterprise Admins, DCsync, tier 0 exposure and account
+analyses and writes the results as a single HTML file with all graphics embedded, so it can be handed over as is.
+
+PDF rendering uses a Chrome, Chromium or Edge browser in headless mode. It is found automatically, or can be given with --browser.`,
+	}
+
+	reportOutput     = ReportCommand.Flags().String("output", "report.html", "HTML file to write the report to")
+	reportPDF        = ReportCommand.Flags().String("pdf", "", "Also render the report to this PDF file")
+	reportBrowser    = ReportCommand.Flags().String("browser", "", "Chrome, Chromium or Edge executable used for PDF rendering (default is to search for one)")
+	reportTitle      = ReportCommand.Flags().String("title", NewReportOptions().Title, "Title of the report")
+	reportRules      = ReportCommand.Flags().String("rules", "", "YAML file with custom findings rules (default is "+RulesFile+" in the datapath)")
+	reportStaleDays  = ReportCommand.Flags().Int("staledays", NewReportOptions().StaleDays, "Enabled accounts without a logon for this many days are stale")
+	reportPaths      = ReportCommand.Flags().Int("paths", NewReportOptions().Paths, "Number of most likely attack paths to show per analysis")
+	reportGraphNodes = ReportCommand.Flags().Int("graphnodes", NewReportOptions().GraphNodes, "Maximum number of objects drawn in each graph (0 is unlimited)")
+	reportLimit      = ReportCommand.Flags().Int("limit", NewReportOptions().Limit, "Maximum number of rows in object tables (0 is unlimited)")
+	reportSnapshot   = ReportCommand.Flags().String("snapshot", "", "Load the analyzed graph from this snapshot file if it exists, otherwise save it there once processing completes")
+)
+
+func init() {
+	cli.Root.AddCommand(ReportCommand)
+	ReportCommand.RunE = ExecuteReport
+}
+
+func ExecuteReport(cmd *cobra.Command, args []string) error {
+	datapath := cmd.InheritedFlags().Lookup("datapath").Value.String()
+
+	// Find the browser up front, so we don't spend time on analysis just to fail at the end
+	var browser string
+	if *reportPDF != "" {
+		var err error
+		browser, err = findPDFBrowser(*reportBrowser)
+		if err != nil {
+			return err
+		}
+	}
+
+	rulesfile := *reportRules
+	if rulesfile == "" {
+		rulesfile = filepath.Join(datapath, RulesFile)
+	}
+	rules, err := LoadRules(rulesfile)
+	if err != nil {
+		return err
+	}
+
+	objs, err := loadObjects(datapath, *reportSnapshot, false)
+	if err != nil {
+		return err
+	}
+	objs.WaitForPostProcessing()
+
+	opts := NewReportOptions()
+	opts.Title = *reportTitle
+	opts.Rules = rules
+	opts.StaleDays = *reportStaleDays
+	opts.Paths = *reportPaths
+	opts.GraphNodes = *reportGraphNodes
+	opts.Limit = *reportLimit
+
+	report, err := BuildReport(objs, opts)
+	if err != nil {
+		return err
+	}
+
+	outfile, err := os.Create(*reportOutput)
+	if err != nil {
+		return fmt.Errorf("Problem creating output file: %v", err)
+	}
+	bw := bufio.NewWriter(outfile)
+	err = WriteReportHTML(bw, report)
+	if err == nil {
+		err = bw.Flush()
+	}
+	outfile.Close()
+	if err != nil {
+		return fmt.Errorf("Problem writing report to %v: %v", *reportOutput, err)
+	}
+	ui.Info().Msgf("Report saved to %v", *reportOutput)
+
+	if *reportPDF != "" {
+		if err = renderPDF(browser, *reportOutput, *reportPDF); err != nil {
+			return err
+		}
+		ui.Info().Msgf("PDF saved to %v", *reportPDF)
+	}
+	return nil
+}
+
+// Executable names of browsers that can print to PDF from the command line
+var pdfBrowsers = []string{
+	"chromium", "chromium-browser", "google-chrome", "google-chrome-stable", "microsoft-edge", "msedge", "chrome",
+}
+
+func findPDFBrowser(browser string) (string, error) {
+	if browser != "" {
+		path, err := exec.LookPath(browser)
+		if err != nil {
+			return "", fmt.Errorf("Browser %v not found: %v", browser, err)
+		}
+		return path, nil
+	}
+
+	for _, name := range pdfBrowsers {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+
+	var candidates []string
+	switch runtime.GOOS {
+	case "windows":
+		for _, env := range []string{"ProgramFiles", "ProgramFiles(x86)", "LocalAppData"} {
+			if dir := os.Getenv(env); dir != "" {
+				candidates = append(candidates,
+					filepath.Join(dir, "Google", "Chrome", "Application", "chrome.exe"),
+					filepath.Join(dir, "Microsoft", "Edge", "Application", "msedge.exe"))
+			}
+		}
+	case "darwin":
+		candidates = []string{
+			"/Applications/Google Chrome.app/Contents/MacOS/Google Chrome",
+			"/Applications/Chromium.app/Contents/MacOS/Chromium",
+			"/Applications/Microsoft Edge.app/Contents/MacOS/Microsoft Edge",
+		}
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("No Chrome, Chromium or Edge browser found for PDF rendering, use --browser to point to one")
+}
+
+func renderPDF(browser, htmlfile, pdffile string) error {
+	source, err := filepath.Abs(htmlfile)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.Abs(pdffile)
+	if err != nil {
+		return err
+	}
+
+	url := "file://" + filepath.ToSlash(source)
+	if !strings.HasPrefix(filepath.ToSlash(source), "/") {
+		url = "file:///" + filepath.ToSlash(source) // Windows drive letters
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	ui.Info().Msgf("Rendering PDF using %v", browser)
+	output, err := exec.CommandContext(ctx, browser,
+		"--headless",
+		"--disable-gpu",
+		"--no-pdf-header-footer",
+		"--print-to-pdf-no-header",
+		"--print-to-pdf="+target,
+		url,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Problem rendering PDF: %v: %s", err, output)
+	}
+	if _, err = os.Stat(target); err != nil {
+		return fmt.Errorf("Browser didn't produce a PDF: %s", output)
+	}
+	return nil
+}
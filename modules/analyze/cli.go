@@ -1,8 +1,12 @@
 package analyze
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 
 	"github.com/lkarlslund/adalanche/modules/cli"
@@ -20,6 +24,15 @@ var (
 	bind      = Command.Flags().String("bind", "127.0.0.1:8080", "Address and port of webservice to bind to")
 	nobrowser = Command.Flags().Bool("nobrowser", false, "Don't launch browser after starting webservice")
 	localhtml = Command.Flags().StringSlice("localhtml", nil, "Override embedded HTML and use a local folders for webservice (for development)")
+	sortby    = Command.Flags().String("sortby", "", "Attribute used to prioritize objects when the expansion limit is hit, and to order object listings (highest first)")
+	snapshot  = Command.Flags().String("snapshot", "", "Load the analyzed graph from this snapshot file if it exists, otherwise save it there once processing completes")
+
+	tlscert       = Command.Flags().String("tls-cert", "", "Serve HTTPS using this PEM certificate file (requires --tls-key)")
+	tlskey        = Command.Flags().String("tls-key", "", "PEM private key file for --tls-cert")
+	tlsselfsigned = Command.Flags().Bool("tls-selfsigned", false, "Serve HTTPS using a generated self-signed certificate")
+	authusers     = Command.Flags().StringSlice("auth-user", nil, "Require login, allowing this user given as name:password[:admin|readonly] (can be repeated)")
+	authtokens    = Command.Flags().StringSlice("auth-token", nil, "Require login, allowing this bearer token given as token[:admin|readonly] (can be repeated)")
+	authfile      = Command.Flags().String("auth-file", "", "Require login, allowing users and tokens from this file (lines of 'user name:password[:role]' or 'token value[:role]')")
 
 	WebService = NewWebservice()
 )
@@ -33,12 +46,29 @@ func init() {
 func Execute(cmd *cobra.Command, args []string) error {
 	datapath := cmd.InheritedFlags().Lookup("datapath").Value.String()
 
-	// Process what we can in foreground, and the rest in the background
-	objs, err := engine.Run(datapath)
+	err := configureWebserviceSecurity()
+	if err != nil {
+		return err
+	}
+
+	err = WebService.SavedQueries.Open(filepath.Join(datapath, SavedQueriesFile))
+	if err != nil {
+		return err
+	}
+	WebService.RulesFile = filepath.Join(datapath, RulesFile)
+
+	objs, err := loadObjects(datapath, *snapshot, true)
 	if err != nil {
 		return err
 	}
 
+	if *sortby != "" {
+		SortBy = engine.LookupAttribute(*sortby)
+		if SortBy == engine.NonExistingAttribute {
+			return fmt.Errorf("Unknown attribute %v for --sortby", *sortby)
+		}
+	}
+
 	// Fire up the web interface with incomplete results
 	err = WebService.Start(*bind, objs, *localhtml)
 	if err != nil {
@@ -48,7 +78,7 @@ func Execute(cmd *cobra.Command, args []string) error {
 	// Launch browser
 	if !*nobrowser {
 		var err error
-		url := "http://" + *bind
+		url := WebService.URL(*bind)
 		switch runtime.GOOS {
 		case "linux":
 			err = exec.Command("xdg-open", url).Start()
@@ -68,3 +98,88 @@ func Execute(cmd *cobra.Command, args []string) error {
 	<-WebService.QuitChan()
 	return nil
 }
+
+// Sets up TLS and authentication for the webservice from the command line flags
+func configureWebserviceSecurity() error {
+	switch {
+	case *tlscert != "" || *tlskey != "":
+		if *tlscert == "" || *tlskey == "" {
+			return fmt.Errorf("Both --tls-cert and --tls-key are needed for HTTPS")
+		}
+		if *tlsselfsigned {
+			return fmt.Errorf("Use either --tls-cert/--tls-key or --tls-selfsigned, not both")
+		}
+		cert, err := tls.LoadX509KeyPair(*tlscert, *tlskey)
+		if err != nil {
+			return fmt.Errorf("Problem loading TLS certificate: %v", err)
+		}
+		WebService.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	case *tlsselfsigned:
+		host, _, _ := net.SplitHostPort(*bind)
+		cert, err := SelfSignedCertificate(host)
+		if err != nil {
+			return fmt.Errorf("Problem generating self-signed certificate: %v", err)
+		}
+		ui.Info().Msgf("Generated self-signed certificate with SHA-256 fingerprint %v", CertificateFingerprint(cert))
+		WebService.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	for _, user := range *authusers {
+		if err := WebService.Auth.AddUserString(user); err != nil {
+			return err
+		}
+	}
+	for _, token := range *authtokens {
+		if err := WebService.Auth.AddTokenString(token); err != nil {
+			return err
+		}
+	}
+	if *authfile != "" {
+		if err := WebService.Auth.LoadFile(*authfile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Loads data from a snapshot if one is available, otherwise runs the loaders and saves a snapshot when post-processing is done.
+// The web service saves in the background so it can start right away, headless commands wait for the snapshot to be written
+// so they don't exit in the middle of it.
+func loadObjects(datapath, snapshotfile string, background bool) (*engine.Objects, error) {
+	if snapshotfile != "" {
+		if _, err := os.Stat(snapshotfile); err == nil {
+			if err = engine.CheckSnapshot(snapshotfile, datapath); err == nil {
+				ui.Info().Msgf("Loading analyzed data from snapshot %v", snapshotfile)
+				var objs *engine.Objects
+				if objs, err = engine.LoadSnapshot(snapshotfile); err == nil {
+					return objs, nil
+				}
+			}
+			ui.Warn().Msgf("Not using snapshot %v, processing data instead: %v", snapshotfile, err)
+		}
+	}
+
+	// Process what we can in foreground, and the rest in the background
+	objs, err := engine.Run(datapath)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshotfile != "" {
+		save := func() {
+			objs.WaitForPostProcessing()
+			ui.Info().Msgf("Saving analyzed data to snapshot %v", snapshotfile)
+			if err := engine.SaveSnapshot(objs, snapshotfile); err != nil {
+				ui.Error().Msgf("Problem saving snapshot: %v", err)
+			}
+		}
+		if background {
+			go save()
+		} else {
+			save()
+		}
+	}
+
+	return objs, nil
+}
@@ -6,10 +6,11 @@ import (
 )
 
 func debugfuncs(ws *webservice) {
-	ws.Router.GET("/debug/attributes", func(c *gin.Context) {
+	debug := ws.Router.Group("/debug", requireAdmin)
+	debug.GET("/attributes", func(c *gin.Context) {
 		c.JSON(200, engine.AttributeInfos())
 	})
-	ws.Router.GET("/debug/edges", func(c *gin.Context) {
+	debug.GET("/edges", func(c *gin.Context) {
 		c.JSON(200, engine.EdgeInfos())
 	})
 }
@@ -1,37 +1,100 @@
 package analyze
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"slices"
+	"strings"
 
+	"github.com/gofrs/uuid"
 	"github.com/lkarlslund/adalanche/modules/engine"
 	"github.com/lkarlslund/adalanche/modules/graph"
-	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/util"
 	"github.com/lkarlslund/adalanche/modules/version"
 )
 
-func ExportGraphViz(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string) error {
-	df, _ := os.Create(filename)
-	defer df.Close()
-
-	fmt.Fprintln(df, "digraph G {")
-	for object, _ := range pg.Nodes() {
-		var formatting = ""
-		switch object.Type() {
-		case engine.ObjectTypeComputer:
-			formatting = ""
-		}
-		fmt.Fprintf(df, "    \"%v\" [label=\"%v\";%v];\n", object.ID(), object.OneAttr(activedirectory.Name), formatting)
+// GraphFormat is a file format an analysis graph can be written in
+type GraphFormat struct {
+	Extension   string
+	ContentType string
+	Write       func(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error
+}
+
+var GraphFormats = map[string]GraphFormat{
+	"cytoscapejs": {".json", "application/json", func(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error {
+		return WriteCytoscapeJS(pg, w, false)
+	}},
+	"graphviz":   {".dot", "text/vnd.graphviz", WriteGraphViz},
+	"graphml":    {".graphml", "application/graphml+xml", WriteGraphML},
+	"gexf":       {".gexf", "application/gexf+xml", WriteGEXF},
+	"xgmml":      {".xgmml", "application/xml", WriteXGMML},
+	"bloodhound": {".json", "application/json", WriteBloodHound},
+}
+
+// GraphFormatNames returns the supported graph formats for use in help texts
+func GraphFormatNames() string {
+	names := make([]string, 0, len(GraphFormats))
+	for name := range GraphFormats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+func exportGraphFile(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string, write func(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error) error {
+	df, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(df)
+	err = write(pg, bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if closeerr := df.Close(); err == nil {
+		err = closeerr
+	}
+	return err
+}
+
+// sortedNodes returns the nodes ordered by ID, so exports are stable
+func sortedNodes(pg graph.Graph[*engine.Object, engine.EdgeBitmap]) []*engine.Object {
+	nodes := make([]*engine.Object, 0, pg.Order())
+	for node := range pg.Nodes() {
+		nodes = append(nodes, node)
 	}
-	fmt.Fprintln(df, "")
+	slices.SortFunc(nodes, func(a, b *engine.Object) int {
+		return int(a.ID()) - int(b.ID())
+	})
+	return nodes
+}
+
+// Escapes a string for use inside double quotes in the DOT language
+var graphVizEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "")
+
+func WriteGraphViz(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error {
+	fmt.Fprintln(w, "digraph G {")
+	for _, object := range sortedNodes(pg) {
+		fmt.Fprintf(w, "    \"%v\" [label=\"%v\", type=\"%v\"];\n", object.ID(), graphVizEscaper.Replace(object.Label()), object.Type().String())
+	}
+	fmt.Fprintln(w, "")
 
+	var err error
 	pg.IterateEdges(func(source, target *engine.Object, edge engine.EdgeBitmap) bool {
-		fmt.Fprintf(df, "    \"%v\" -> \"%v\" [label=\"%v\"];\n", source, target, edge.JoinedString())
-		return true
+		_, err = fmt.Fprintf(w, "    \"%v\" -> \"%v\" [label=\"%v\", probability=%v];\n", source.ID(), target.ID(), graphVizEscaper.Replace(edge.JoinedString()), edge.MaxProbability(source, target))
+		return err == nil
 	})
-	fmt.Fprintln(df, "}")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, "}")
+	return err
+}
 
-	return nil
+func ExportGraphViz(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string) error {
+	return exportGraphFile(pg, filename, WriteGraphViz)
 }
 
 type MethodMap map[string]bool
@@ -153,22 +216,358 @@ func GenerateCytoscapeJS(pg graph.Graph[*engine.Object, engine.EdgeBitmap], alld
 	return g, nil
 }
 
-func ExportCytoscapeJS(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string) error {
-	g, err := GenerateCytoscapeJS(pg, false)
+func WriteCytoscapeJS(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer, alldetails bool) error {
+	g, err := GenerateCytoscapeJS(pg, alldetails)
 	if err != nil {
 		return err
 	}
-	data, err := qjson.MarshalIndent(g, "", "  ")
-	if err != nil {
-		return err
+	return writeJSON(g, w)
+}
+
+func ExportCytoscapeJS(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string) error {
+	return exportCytoscapeJS(pg, filename, false)
+}
+
+func exportCytoscapeJS(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string, alldetails bool) error {
+	return exportGraphFile(pg, filename, func(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error {
+		return WriteCytoscapeJS(pg, w, alldetails)
+	})
+}
+
+// BloodHound CE OpenGraph ingest format
+type BloodHoundGraph struct {
+	Metadata BloodHoundMetadata  `json:"metadata"`
+	Graph    BloodHoundGraphData `json:"graph"`
+}
+
+type BloodHoundMetadata struct {
+	SourceKind string `json:"source_kind"`
+}
+
+type BloodHoundGraphData struct {
+	Nodes []BloodHoundNode `json:"nodes"`
+	Edges []BloodHoundEdge `json:"edges"`
+}
+
+type BloodHoundNode struct {
+	ID         string             `json:"id"`
+	Kinds      []string           `json:"kinds"`
+	Properties MapStringInterface `json:"properties"`
+}
+
+type BloodHoundEdge struct {
+	Start      BloodHoundEndpoint `json:"start"`
+	End        BloodHoundEndpoint `json:"end"`
+	Kind       string             `json:"kind"`
+	Properties MapStringInterface `json:"properties,omitempty"`
+}
+
+type BloodHoundEndpoint struct {
+	Value   string `json:"value"`
+	MatchBy string `json:"match_by"`
+}
+
+// Object types that have a native BloodHound node kind
+var bloodHoundNodeKinds = map[engine.ObjectType]string{
+	engine.ObjectTypeUser:                       "User",
+	engine.ObjectTypeManagedServiceAccount:      "User",
+	engine.ObjectTypeGroupManagedServiceAccount: "User",
+	engine.ObjectTypeGroup:                      "Group",
+	engine.ObjectTypeComputer:                   "Computer",
+	engine.ObjectTypeDomainDNS:                  "Domain",
+	engine.ObjectTypeGroupPolicyContainer:       "GPO",
+	engine.ObjectTypeOrganizationalUnit:         "OU",
+	engine.ObjectTypeContainer:                  "Container",
+	engine.ObjectTypeCertificateTemplate:        "CertTemplate",
+	engine.ObjectTypePKIEnrollmentService:       "EnterpriseCA",
+}
+
+// Edge names that have a native BloodHound edge kind with the same meaning and direction,
+// everything else is exported with the adalanche edge name as a custom kind
+var bloodHoundEdgeKinds = map[string]string{
+	"MemberOfGroup":           "MemberOf",
+	"GenericAll":              "GenericAll",
+	"WriteAll":                "GenericWrite",
+	"WriteDACL":               "WriteDacl",
+	"TakeOwnership":           "WriteOwner",
+	"Owns":                    "Owns",
+	"AddMember":               "AddMember",
+	"AddSelfMember":           "AddSelf",
+	"ResetPassword":           "ForceChangePassword",
+	"AllExtendedRights":       "AllExtendedRights",
+	"ReadLAPSPassword":        "ReadLAPSPassword",
+	"ReadGMSAPassword":        "ReadGMSAPassword",
+	"WriteKeyCredentialLink":  "AddKeyCredentialLink",
+	"WriteSPN":                "WriteSPN",
+	"WriteAllowedToAct":       "AddAllowedToAct",
+	"RBConstrainedDeleg":      "AllowedToAct",
+	"ConstrainedDeleg":        "AllowedToDelegate",
+	"DSReplGetChngs":          "GetChanges",
+	"DSReplGetChngsAll":       "GetChangesAll",
+	"DSReplGetChngsInFiltSet": "GetChangesInFilteredSet",
+	"SIDHistoryEquality":      "HasSIDHistory",
+	"AdminRights":             "AdminTo",
+	"RDPRights":               "CanRDP",
+	"DCOMRights":              "ExecuteDCOM",
+	"PSRemoteRights":          "CanPSRemote",
+	"SessionLastDay":          "HasSession",
+	"SessionLastWeek":         "HasSession",
+	"SessionLastMonth":        "HasSession",
+	"CertificateEnroll":       "Enroll",
+}
+
+type bloodHoundExporter struct {
+	g   BloodHoundGraph
+	ids map[*engine.Object]string
+	// Used IDs, as objects from different sources can share SIDs
+	used map[string]struct{}
+}
+
+func newBloodHoundExporter() *bloodHoundExporter {
+	return &bloodHoundExporter{
+		g: BloodHoundGraph{
+			Metadata: BloodHoundMetadata{
+				SourceKind: "Adalanche",
+			},
+		},
+		ids:  make(map[*engine.Object]string),
+		used: make(map[string]struct{}),
+	}
+}
+
+// Uses the same object identifiers as SharpHound where possible, so data can be combined in BloodHound
+func (bh *bloodHoundExporter) objectID(o *engine.Object) string {
+	var id string
+	var domain string
+	if dc := o.OneAttrString(engine.DomainContext); dc != "" {
+		domain = strings.ToUpper(util.DomainContextToDomainSuffix(dc))
+	}
+	if sid := o.SID(); !sid.IsBlank() {
+		id = sid.String()
+		if (sid.Component(2) != 21 || sid.Component(3) == 0) && domain != "" {
+			id = domain + "-" + id
+		}
+	} else if guid, ok := o.OneAttrRaw(engine.ObjectGUID).(uuid.UUID); ok {
+		id = strings.ToUpper(util.SwapUUIDEndianess(guid).String())
+	}
+	if _, taken := bh.used[id]; id == "" || taken {
+		id = fmt.Sprintf("ADALANCHE-%v", o.ID())
+	}
+	bh.used[id] = struct{}{}
+	return id
+}
+
+func (bh *bloodHoundExporter) addNode(o *engine.Object, data map[string]any) {
+	id := bh.objectID(o)
+	bh.ids[o] = id
+
+	kinds := []string{o.Type().String()}
+	if kind, found := bloodHoundNodeKinds[o.Type()]; found {
+		kinds = []string{kind, "Base"}
+	}
+
+	properties := MapStringInterface{
+		"name":     o.Label(),
+		"objectid": id,
+	}
+	if dn := o.DN(); dn != "" {
+		properties["distinguishedname"] = strings.ToUpper(dn)
+	}
+	if dc := o.OneAttrString(engine.DomainContext); dc != "" {
+		properties["domain"] = strings.ToUpper(util.DomainContextToDomainSuffix(dc))
+	}
+	for attr, key := range map[engine.Attribute]string{
+		engine.SAMAccountName: "samaccountname",
+		engine.DisplayName:    "displayname",
+		engine.Description:    "description",
+		engine.DataSource:     "adalanche_datasource",
+	} {
+		if value := o.OneAttrString(attr); value != "" {
+			properties[key] = value
+		}
+	}
+	if o.HasTag("account_active") {
+		properties["enabled"] = true
+	} else if o.HasTag("account_inactive") {
+		properties["enabled"] = false
+	}
+	var tags []string
+	o.Attr(engine.Tag).Iterate(func(tag engine.AttributeValue) bool {
+		tags = append(tags, tag.String())
+		return true
+	})
+	if len(tags) > 0 {
+		properties["adalanche_tags"] = tags
+	}
+	if data["target"] == true {
+		properties["adalanche_querytarget"] = true
+	}
+	if data["source"] == true {
+		properties["adalanche_querysource"] = true
+	}
+
+	bh.g.Graph.Nodes = append(bh.g.Graph.Nodes, BloodHoundNode{
+		ID:         id,
+		Kinds:      kinds,
+		Properties: properties,
+	})
+}
+
+func (bh *bloodHoundExporter) addEdges(source, target *engine.Object, eb engine.EdgeBitmap) {
+	sourceid, found := bh.ids[source]
+	if !found {
+		return
+	}
+	targetid, found := bh.ids[target]
+	if !found {
+		return
+	}
+
+	kinds := make(map[string]engine.Probability)
+	for _, edge := range eb.Edges() {
+		kind, found := bloodHoundEdgeKinds[edge.String()]
+		if !found {
+			kind = edge.String()
+		}
+		if probability := edge.Probability(source, target); probability >= kinds[kind] {
+			kinds[kind] = probability
+		}
+	}
+	for kind, probability := range kinds {
+		bh.g.Graph.Edges = append(bh.g.Graph.Edges, BloodHoundEdge{
+			Start: BloodHoundEndpoint{Value: sourceid, MatchBy: "id"},
+			End:   BloodHoundEndpoint{Value: targetid, MatchBy: "id"},
+			Kind:  kind,
+			Properties: MapStringInterface{
+				"adalanche_probability": int(probability),
+			},
+		})
+	}
+}
+
+// GenerateBloodHound converts an analysis graph to BloodHound CE OpenGraph JSON
+func GenerateBloodHound(pg graph.Graph[*engine.Object, engine.EdgeBitmap]) BloodHoundGraph {
+	bh := newBloodHoundExporter()
+	for object, data := range pg.Nodes() {
+		bh.addNode(object, data)
 	}
+	pg.IterateEdges(func(source, target *engine.Object, edge engine.EdgeBitmap) bool {
+		bh.addEdges(source, target, edge)
+		return true
+	})
+	return bh.g
+}
+
+// GenerateObjectsBloodHound converts all objects and edges to BloodHound CE OpenGraph JSON
+func GenerateObjectsBloodHound(ao *engine.Objects) BloodHoundGraph {
+	bh := newBloodHoundExporter()
+	ao.Iterate(func(o *engine.Object) bool {
+		bh.addNode(o, nil)
+		return true
+	})
+	ao.Iterate(func(source *engine.Object) bool {
+		source.Edges(engine.Out).Range(func(target *engine.Object, edge engine.EdgeBitmap) bool {
+			bh.addEdges(source, target, edge)
+			return true
+		})
+		return true
+	})
+	return bh.g
+}
+
+func WriteBloodHound(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error {
+	return writeJSON(GenerateBloodHound(pg), w)
+}
 
+func ExportBloodHound(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string) error {
+	return exportGraphFile(pg, filename, WriteBloodHound)
+}
+
+func ExportObjectsBloodHound(ao *engine.Objects, filename string) error {
 	df, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
-	defer df.Close()
-	_, err = df.Write(data)
+	err = writeJSON(GenerateObjectsBloodHound(ao), df)
+	if closeerr := df.Close(); err == nil {
+		err = closeerr
+	}
+	return err
+}
 
+func writeJSON(v any, w io.Writer) error {
+	data, err := qjson.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
 	return err
 }
+
+// Node and edge attributes written by the GraphML and GEXF exporters
+type graphExportKey struct {
+	Name string
+	Type string // XML schema type names, as both GraphML and GEXF use them
+}
+
+var graphExportNodeAttributes = []engine.Attribute{
+	engine.DistinguishedName,
+	engine.ObjectSid,
+	engine.SAMAccountName,
+	engine.DataSource,
+}
+
+func graphExportNodeKeys() []graphExportKey {
+	keys := []graphExportKey{{"label", "string"}, {"type", "string"}}
+	for _, attr := range graphExportNodeAttributes {
+		keys = append(keys, graphExportKey{attr.String(), "string"})
+	}
+	return append(keys,
+		graphExportKey{"tags", "string"},
+		graphExportKey{"querytarget", "boolean"},
+		graphExportKey{"querysource", "boolean"},
+	)
+}
+
+func graphExportNodeValues(o *engine.Object, data map[string]any) map[string]string {
+	values := map[string]string{
+		"label":       o.Label(),
+		"type":        o.Type().String(),
+		"querytarget": fmt.Sprint(data["target"] == true),
+		"querysource": fmt.Sprint(data["source"] == true),
+	}
+	for _, attr := range graphExportNodeAttributes {
+		if value := o.OneAttrString(attr); value != "" {
+			values[attr.String()] = value
+		}
+	}
+	if tags := o.Attr(engine.Tag).StringSlice(); len(tags) > 0 {
+		values["tags"] = strings.Join(tags, ";")
+	}
+	return values
+}
+
+// graphExportEdgeKeys returns the edge attributes, with a boolean attribute for each edge name used in the graph
+func graphExportEdgeKeys(pg graph.Graph[*engine.Object, engine.EdgeBitmap]) []graphExportKey {
+	var used engine.EdgeBitmap
+	pg.IterateEdges(func(source, target *engine.Object, edge engine.EdgeBitmap) bool {
+		used = used.Merge(edge)
+		return true
+	})
+	keys := []graphExportKey{{"edges", "string"}, {"probability", "int"}}
+	for _, name := range used.StringSlice() {
+		keys = append(keys, graphExportKey{name, "boolean"})
+	}
+	return keys
+}
+
+func graphExportEdgeValues(source, target *engine.Object, edge engine.EdgeBitmap) map[string]string {
+	values := map[string]string{
+		"edges":       edge.JoinedString(),
+		"probability": fmt.Sprint(edge.MaxProbability(source, target)),
+	}
+	for _, name := range edge.StringSlice() {
+		values[name] = "true"
+	}
+	return values
+}
@@ -0,0 +1,295 @@
+package analyze
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/query"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"gopkg.in/yaml.v3"
+)
+
+// Custom rules are read from this file in the datapath if it exists
+const RulesFile = "rules.yaml"
+
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var severityNames = []string{"info", "low", "medium", "high", "critical"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+func ParseSeverity(name string) (Severity, error) {
+	if i := slices.Index(severityNames, strings.ToLower(name)); i != -1 {
+		return Severity(i), nil
+	}
+	return SeverityInfo, fmt.Errorf("Unknown severity %v, use %v", name, strings.Join(severityNames, ", "))
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(text []byte) error {
+	var err error
+	*s, err = ParseSeverity(string(text))
+	return err
+}
+
+// Rule flags objects matching an LDAP filter, or objects at the constrained end of paths matching a path pattern
+type Rule struct {
+	ID          string   `json:"id" yaml:"id"`
+	Title       string   `json:"title" yaml:"title"`
+	Severity    Severity `json:"severity" yaml:"severity" doc:"info, low, medium, high or critical"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"`
+	Remediation string   `json:"remediation,omitempty" yaml:"remediation,omitempty"`
+	Query       string   `json:"query" yaml:"query" doc:"LDAP filter or path pattern, as accepted by the query command"`
+	Disabled    bool     `json:"disabled,omitempty" yaml:"disabled,omitempty" doc:"Turns off a built-in rule with the same ID"`
+
+	MinProbability engine.Probability `json:"minprobability,omitempty" yaml:"minprobability,omitempty" doc:"Path patterns only follow edges with at least this probability, 0 follows all"`
+}
+
+// Finding is the result of a rule that matched something
+type Finding struct {
+	Rule    Rule
+	Objects []*engine.Object // Matching objects, or the objects at the constrained end of matching paths
+	Paths   []query.PathMatch
+}
+
+// Paths found per rule are capped, the affected objects are not
+const maxFindingPaths = 1000
+
+const uacFilter = "userAccountControl:1.2.840.113556.1.4.803:="
+
+// BuiltinRules are evaluated unless disabled by a rule with the same ID in the rules file
+var BuiltinRules = []Rule{
+	{
+		ID:          "kerberoastable-admins",
+		Title:       "Kerberoastable privileged accounts",
+		Severity:    SeverityCritical,
+		Description: "Privileged accounts with a service principal name. Any domain user can request a service ticket for them and crack the password offline.",
+		Remediation: "Remove the SPNs from privileged accounts, or use a managed service account or a long random password.",
+		Query:       "()-[HasSPN]->(&(type=Person)(adminCount=1)(!" + uacFilter + "2))",
+	},
+	{
+		ID:          "kerberoastable-users",
+		Title:       "Kerberoastable accounts",
+		Severity:    SeverityMedium,
+		Description: "Enabled accounts with a service principal name, where the password can be cracked offline from a service ticket.",
+		Remediation: "Use group managed service accounts, or make sure service account passwords are long and random.",
+		Query:       "(&(type=Person)(servicePrincipalName=*)(!" + uacFilter + "2))",
+	},
+	{
+		ID:          "asrep-roastable",
+		Title:       "Accounts without Kerberos pre-authentication",
+		Severity:    SeverityHigh,
+		Description: "Accounts with DONT_REQ_PREAUTH set. Anyone can request an AS-REP for them and crack the password offline.",
+		Remediation: "Clear \"Do not require Kerberos preauthentication\" on the accounts.",
+		Query:       "(&(type=Person)(" + uacFilter + "4194304)(!" + uacFilter + "2))",
+	},
+	{
+		ID:          "unconstrained-delegation",
+		Title:       "Computers with unconstrained delegation",
+		Severity:    SeverityHigh,
+		Description: "Computers other than domain controllers that are trusted for unconstrained delegation, and keep the TGT of every user authenticating to them.",
+		Remediation: "Switch to constrained or resource based constrained delegation, and add privileged accounts to Protected Users.",
+		Query:       "(&(type=Computer)(" + uacFilter + "524288)(!" + uacFilter + "8192))",
+	},
+	{
+		ID:          "protocol-transition",
+		Title:       "Accounts trusted to authenticate for delegation",
+		Severity:    SeverityMedium,
+		Description: "Accounts with TRUSTED_TO_AUTH_FOR_DELEGATION can impersonate any user towards the services they may delegate to, without that user authenticating.",
+		Remediation: "Remove protocol transition where it isn't needed, and review msDS-AllowedToDelegateTo.",
+		Query:       "(" + uacFilter + "16777216)",
+	},
+	{
+		ID:          "dcsync-non-admins",
+		Title:       "Non-administrative principals that can DCsync",
+		Severity:    SeverityCritical,
+		Description: "Principals other than administrators and domain controllers with the Replicating Directory Changes All right, which lets them extract every password hash in the domain.",
+		Remediation: "Remove the replication rights from the domain object for these principals.",
+		Query:       "(!(|(adminCount=1)(objectSid=S-1-5-9)(objectSid=S-1-5-18)(objectSid=S-1-5-32-544)(objectSid=S-1-5-21-*-498)(objectSid=S-1-5-21-*-516)(objectSid=S-1-5-21-*-512)(objectSid=S-1-5-21-*-519)))-[DSReplGetChngsAll]->()",
+	},
+	{
+		ID:          "password-not-required",
+		Title:       "Enabled accounts that don't require a password",
+		Severity:    SeverityMedium,
+		Description: "Accounts with PASSWD_NOTREQD set can have an empty password regardless of the password policy.",
+		Remediation: "Clear PASSWD_NOTREQD and set a password on the accounts.",
+		Query:       "(&(type=Person)(" + uacFilter + "32)(!" + uacFilter + "2))",
+	},
+	{
+		ID:          "reversible-encryption",
+		Title:       "Passwords stored with reversible encryption",
+		Severity:    SeverityMedium,
+		Description: "Accounts with ENCRYPTED_TEXT_PWD_ALLOWED store their password in a form that can be decrypted.",
+		Remediation: "Clear \"Store password using reversible encryption\" and change the passwords.",
+		Query:       "(&(type=Person)(" + uacFilter + "128))",
+	},
+	{
+		ID:          "admin-password-never-expires",
+		Title:       "Privileged accounts with passwords that never expire",
+		Severity:    SeverityLow,
+		Description: "Privileged accounts with DONT_EXPIRE_PASSWORD tend to keep the same password for years.",
+		Remediation: "Rotate the passwords and clear DONT_EXPIRE_PASSWORD, or use managed accounts.",
+		Query:       "(&(type=Person)(adminCount=1)(" + uacFilter + "65536)(!" + uacFilter + "2))",
+	},
+}
+
+// ReadRulesYAML reads a list of rules
+func ReadRulesYAML(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	if err := yaml.NewDecoder(r).Decode(&rules); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Problem parsing rules: %v", err)
+	}
+	for i, rule := range rules {
+		if rule.ID == "" {
+			return nil, fmt.Errorf("Rule %v has no id", i+1)
+		}
+		if rule.Query == "" && !rule.Disabled {
+			return nil, fmt.Errorf("Rule %v has no query", rule.ID)
+		}
+	}
+	return rules, nil
+}
+
+func WriteRulesYAML(w io.Writer, rules []Rule) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(rules); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// LoadRules returns the built-in rules combined with the ones in the file, where rules in the file replace or disable built-in ones with the same ID.
+// A missing file just gives the built-in rules.
+func LoadRules(path string) ([]Rule, error) {
+	rules := slices.Clone(BuiltinRules)
+	if path == "" {
+		return rules, nil
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	custom, err := ReadRulesYAML(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	for _, rule := range custom {
+		if i := slices.IndexFunc(rules, func(r Rule) bool { return r.ID == rule.ID }); i != -1 {
+			rules[i] = rule
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+	return slices.DeleteFunc(rules, func(r Rule) bool { return r.Disabled }), nil
+}
+
+// EvaluateRules runs all rules against the objects and returns the findings, most severe first.
+// Rules that can't be parsed are reported as errors, but don't stop the others.
+func EvaluateRules(rules []Rule, ao *engine.Objects) ([]Finding, error) {
+	var findings []Finding
+	var errs []error
+
+	pb := ui.ProgressBar("Evaluating findings rules", len(rules))
+	for _, rule := range rules {
+		finding, err := EvaluateRule(rule, ao)
+		pb.Add(1)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(finding.Objects) > 0 {
+			findings = append(findings, finding)
+		}
+	}
+	pb.Finish()
+
+	slices.SortStableFunc(findings, func(a, b Finding) int {
+		if a.Rule.Severity != b.Rule.Severity {
+			return int(b.Rule.Severity - a.Rule.Severity)
+		}
+		return len(b.Objects) - len(a.Objects)
+	})
+	return findings, errors.Join(errs...)
+}
+
+func EvaluateRule(rule Rule, ao *engine.Objects) (Finding, error) {
+	finding := Finding{Rule: rule}
+
+	pattern, err := query.ParsePathPattern(rule.Query, ao)
+	if err != nil {
+		return finding, fmt.Errorf("Error parsing query for rule %v: %v", rule.ID, err)
+	}
+
+	var matches engine.ObjectSlice
+	if len(pattern.Edges) == 0 {
+		if pattern.Nodes[0] == nil {
+			matches = ao.AsSlice()
+		} else {
+			matches = query.Execute(pattern.Nodes[0], ao).AsSlice()
+		}
+		finding.Objects = make([]*engine.Object, 0, matches.Len())
+		matches.Iterate(func(o *engine.Object) bool {
+			finding.Objects = append(finding.Objects, o)
+			return true
+		})
+	} else {
+		finding.Paths = query.ExecutePathPattern(pattern, ao, query.PathPatternOptions{
+			MinProbability: rule.MinProbability,
+			MaxResults:     maxFindingPaths,
+		})
+		affected := finding.Paths
+		if len(finding.Paths) == maxFindingPaths {
+			// There may be more, so look for one path from each possible object to get all of them
+			affected = query.ExecutePathPattern(pattern, ao, query.PathPatternOptions{
+				MinProbability: rule.MinProbability,
+				MaxPerStart:    1,
+			})
+		}
+		// The affected objects are at the start of the paths, unless the pattern only constrains the end like ()-[HasSPN]->(...)
+		last := pattern.Nodes[0] == nil && pattern.Nodes[len(pattern.Nodes)-1] != nil
+		seen := make(map[*engine.Object]struct{})
+		for _, path := range affected {
+			o := path.Objects[0]
+			if last {
+				o = path.Objects[len(path.Objects)-1]
+			}
+			if _, found := seen[o]; !found {
+				seen[o] = struct{}{}
+				finding.Objects = append(finding.Objects, o)
+			}
+		}
+	}
+
+	slices.SortFunc(finding.Objects, func(a, b *engine.Object) int {
+		return strings.Compare(displayLabel(a), displayLabel(b))
+	})
+	return finding, nil
+}
@@ -0,0 +1,121 @@
+package analyze
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+func TestLoadRules(t *testing.T) {
+	rules, err := LoadRules(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil || len(rules) != len(BuiltinRules) {
+		t.Fatalf("Expected built-in rules for missing file, got %v rules and %v", len(rules), err)
+	}
+
+	path := filepath.Join(t.TempDir(), RulesFile)
+	err = os.WriteFile(path, []byte(`
+- id: kerberoastable-users
+  disabled: true
+- id: asrep-roastable
+  title: Replaced
+  severity: critical
+  query: (name=x)
+- id: custom
+  title: Custom rule
+  severity: low
+  query: (type=Computer)
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err = LoadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != len(BuiltinRules) {
+		t.Errorf("Expected %v rules, got %v", len(BuiltinRules), len(rules))
+	}
+	if slices.ContainsFunc(rules, func(r Rule) bool { return r.ID == "kerberoastable-users" }) {
+		t.Error("Disabled rule still present")
+	}
+	i := slices.IndexFunc(rules, func(r Rule) bool { return r.ID == "asrep-roastable" })
+	if i == -1 || rules[i].Title != "Replaced" || rules[i].Severity != SeverityCritical {
+		t.Errorf("Built-in rule not replaced: %+v", rules)
+	}
+	if rules[len(rules)-1].ID != "custom" || rules[len(rules)-1].Severity != SeverityLow {
+		t.Errorf("Custom rule not appended: %+v", rules[len(rules)-1])
+	}
+
+	if err = os.WriteFile(path, []byte("- id: bad\n  severity: extreme\n  query: (name=x)\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadRules(path); err == nil {
+		t.Error("Expected error for unknown severity")
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	sid := func(s string) engine.AttributeValue {
+		parsed, err := windowssecurity.ParseStringSID(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return engine.AttributeValueSID(parsed)
+	}
+	uac := func(flags int64) engine.AttributeValue {
+		return engine.AttributeValueInt(flags)
+	}
+
+	ao := engine.NewObjects()
+	domain := engine.NewObject(engine.Name, engine.AttributeValueString("corp.local"), engine.Type, engine.AttributeValueString("DomainDNS"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3"))
+	authusers := engine.NewObject(engine.Name, engine.AttributeValueString("Authenticated Users"), engine.Type, engine.AttributeValueString("Group"), activedirectory.ObjectSid, sid("S-1-5-11"))
+	dcs := engine.NewObject(engine.Name, engine.AttributeValueString("Domain Controllers"), engine.Type, engine.AttributeValueString("Group"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3-516"))
+	svcadmin := engine.NewObject(engine.Name, engine.AttributeValueString("svc_admin"), engine.Type, engine.AttributeValueString("Person"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3-1000"),
+		activedirectory.AdminCount, engine.AttributeValueInt(1), activedirectory.UserAccountControl, uac(0x10200), activedirectory.ServicePrincipalName, engine.AttributeValueString("MSSQLSvc/sql01"))
+	legacy := engine.NewObject(engine.Name, engine.AttributeValueString("legacy"), engine.Type, engine.AttributeValueString("Person"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3-1001"),
+		activedirectory.UserAccountControl, uac(0x400000|0x1000000|0x200|0x80|0x20))
+	server := engine.NewObject(engine.Name, engine.AttributeValueString("server01"), engine.Type, engine.AttributeValueString("Computer"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3-1002"),
+		activedirectory.UserAccountControl, uac(0x80000|0x1000))
+	backup := engine.NewObject(engine.Name, engine.AttributeValueString("backup"), engine.Type, engine.AttributeValueString("Person"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3-1003"))
+	ao.Add(domain, authusers, dcs, svcadmin, legacy, server, backup)
+	authusers.EdgeTo(svcadmin, activedirectory.EdgeHasSPN)
+	dcs.EdgeTo(domain, activedirectory.EdgeDSReplicationGetChangesAll)
+	backup.EdgeTo(domain, activedirectory.EdgeDSReplicationGetChangesAll)
+
+	findings, err := EvaluateRules(BuiltinRules, ao)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range BuiltinRules {
+		i := slices.IndexFunc(findings, func(f Finding) bool { return f.Rule.ID == rule.ID })
+		if i == -1 {
+			t.Errorf("Built-in rule %v did not fire", rule.ID)
+			continue
+		}
+		if rule.ID == "dcsync-non-admins" && (len(findings[i].Objects) != 1 || findings[i].Objects[0] != backup) {
+			t.Errorf("Expected only backup to DCsync as non-admin, got %v", findings[i].Objects)
+		}
+	}
+
+	// Objects beyond the path cap are still reported
+	for i := 0; i < maxFindingPaths+10; i++ {
+		replicator := engine.NewObject(engine.Name, engine.AttributeValueString(fmt.Sprintf("replicator%v", i)), engine.Type, engine.AttributeValueString("Person"))
+		ao.Add(replicator)
+		replicator.EdgeTo(domain, activedirectory.EdgeDSReplicationGetChangesAll)
+	}
+	i := slices.IndexFunc(BuiltinRules, func(r Rule) bool { return r.ID == "dcsync-non-admins" })
+	finding, err := EvaluateRule(BuiltinRules[i], ao)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finding.Paths) != maxFindingPaths || len(finding.Objects) != maxFindingPaths+11 {
+		t.Errorf("Expected %v paths and %v objects, got %v and %v", maxFindingPaths, maxFindingPaths+11, len(finding.Paths), len(finding.Objects))
+	}
+}
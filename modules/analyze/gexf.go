@@ -0,0 +1,141 @@
+package analyze
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+	"github.com/lkarlslund/adalanche/modules/version"
+)
+
+type GEXF struct {
+	XMLName xml.Name  `xml:"gexf"`
+	XMLNS   string    `xml:"xmlns,attr"`
+	Version string    `xml:"version,attr"`
+	Meta    GEXFMeta  `xml:"meta"`
+	Graph   GEXFGraph `xml:"graph"`
+}
+
+type GEXFMeta struct {
+	Creator     string `xml:"creator"`
+	Description string `xml:"description"`
+}
+
+type GEXFGraph struct {
+	DefaultEdgeType string           `xml:"defaultedgetype,attr"`
+	Mode            string           `xml:"mode,attr"`
+	Attributes      []GEXFAttributes `xml:"attributes"`
+	Nodes           []GEXFNode       `xml:"nodes>node"`
+	Edges           []GEXFEdge       `xml:"edges>edge"`
+}
+
+type GEXFAttributes struct {
+	Class      string          `xml:"class,attr"`
+	Attributes []GEXFAttribute `xml:"attribute"`
+}
+
+type GEXFAttribute struct {
+	ID    string `xml:"id,attr"`
+	Title string `xml:"title,attr"`
+	Type  string `xml:"type,attr"`
+}
+
+type GEXFNode struct {
+	ID        string         `xml:"id,attr"`
+	Label     string         `xml:"label,attr"`
+	AttValues []GEXFAttValue `xml:"attvalues>attvalue"`
+}
+
+type GEXFEdge struct {
+	ID        string         `xml:"id,attr"`
+	Source    string         `xml:"source,attr"`
+	Target    string         `xml:"target,attr"`
+	Label     string         `xml:"label,attr"`
+	Weight    float64        `xml:"weight,attr"`
+	AttValues []GEXFAttValue `xml:"attvalues>attvalue"`
+}
+
+type GEXFAttValue struct {
+	For   string `xml:"for,attr"`
+	Value string `xml:"value,attr"`
+}
+
+func GenerateGEXF(pg graph.Graph[*engine.Object, engine.EdgeBitmap]) GEXF {
+	g := GEXF{
+		XMLNS:   "http://gexf.net/1.3",
+		Version: "1.3",
+		Meta: GEXFMeta{
+			Creator:     version.ProgramVersionShort(),
+			Description: "Adalanche analysis data",
+		},
+		Graph: GEXFGraph{
+			DefaultEdgeType: "directed",
+			Mode:            "static",
+		},
+	}
+
+	nodekeys := graphExportNodeKeys()
+	nodeattributes := GEXFAttributes{Class: "node"}
+	for i, key := range nodekeys {
+		nodeattributes.Attributes = append(nodeattributes.Attributes, GEXFAttribute{ID: fmt.Sprintf("n%v", i), Title: key.Name, Type: gexfType(key.Type)})
+	}
+	edgekeys := graphExportEdgeKeys(pg)
+	edgeattributes := GEXFAttributes{Class: "edge"}
+	for i, key := range edgekeys {
+		edgeattributes.Attributes = append(edgeattributes.Attributes, GEXFAttribute{ID: fmt.Sprintf("e%v", i), Title: key.Name, Type: gexfType(key.Type)})
+	}
+	g.Graph.Attributes = []GEXFAttributes{nodeattributes, edgeattributes}
+
+	nodes := pg.Nodes()
+	for _, object := range sortedNodes(pg) {
+		values := graphExportNodeValues(object, nodes[object])
+		node := GEXFNode{
+			ID:    fmt.Sprintf("n%v", object.ID()),
+			Label: object.Label(),
+		}
+		for i, key := range nodekeys {
+			if value, found := values[key.Name]; found {
+				node.AttValues = append(node.AttValues, GEXFAttValue{For: fmt.Sprintf("n%v", i), Value: value})
+			}
+		}
+		g.Graph.Nodes = append(g.Graph.Nodes, node)
+	}
+
+	pg.IterateEdges(func(source, target *engine.Object, eb engine.EdgeBitmap) bool {
+		values := graphExportEdgeValues(source, target, eb)
+		edge := GEXFEdge{
+			ID:     fmt.Sprintf("e%v-%v", source.ID(), target.ID()),
+			Source: fmt.Sprintf("n%v", source.ID()),
+			Target: fmt.Sprintf("n%v", target.ID()),
+			Label:  eb.JoinedString(),
+			Weight: float64(eb.MaxProbability(source, target)) / 100,
+		}
+		for i, key := range edgekeys {
+			if value, found := values[key.Name]; found {
+				edge.AttValues = append(edge.AttValues, GEXFAttValue{For: fmt.Sprintf("e%v", i), Value: value})
+			}
+		}
+		g.Graph.Edges = append(g.Graph.Edges, edge)
+		return true
+	})
+
+	return g
+}
+
+// GEXF uses integer where GraphML uses int
+func gexfType(t string) string {
+	if t == "int" {
+		return "integer"
+	}
+	return t
+}
+
+func WriteGEXF(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error {
+	return writeXML(GenerateGEXF(pg), w)
+}
+
+func ExportGEXF(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string) error {
+	return exportGraphFile(pg, filename, WriteGEXF)
+}
@@ -0,0 +1,119 @@
+package analyze
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+)
+
+type GraphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []GraphMLKey `xml:"key"`
+	Graph   GraphMLGraph `xml:"graph"`
+}
+
+type GraphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type GraphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []GraphMLNode `xml:"node"`
+	Edges       []GraphMLEdge `xml:"edge"`
+}
+
+type GraphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []GraphMLData `xml:"data"`
+}
+
+type GraphMLEdge struct {
+	ID     string        `xml:"id,attr"`
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []GraphMLData `xml:"data"`
+}
+
+type GraphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+func GenerateGraphML(pg graph.Graph[*engine.Object, engine.EdgeBitmap]) GraphML {
+	g := GraphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Graph: GraphMLGraph{
+			ID:          "G",
+			EdgeDefault: "directed",
+		},
+	}
+
+	// GraphML keys must be valid XML IDs, and edge names could clash with node attributes
+	nodekeys := graphExportNodeKeys()
+	for i, key := range nodekeys {
+		g.Keys = append(g.Keys, GraphMLKey{ID: fmt.Sprintf("n%v", i), For: "node", AttrName: key.Name, AttrType: key.Type})
+	}
+	edgekeys := graphExportEdgeKeys(pg)
+	for i, key := range edgekeys {
+		g.Keys = append(g.Keys, GraphMLKey{ID: fmt.Sprintf("e%v", i), For: "edge", AttrName: key.Name, AttrType: key.Type})
+	}
+
+	nodes := pg.Nodes()
+	for _, object := range sortedNodes(pg) {
+		values := graphExportNodeValues(object, nodes[object])
+		node := GraphMLNode{ID: fmt.Sprintf("n%v", object.ID())}
+		for i, key := range nodekeys {
+			if value, found := values[key.Name]; found {
+				node.Data = append(node.Data, GraphMLData{Key: fmt.Sprintf("n%v", i), Value: value})
+			}
+		}
+		g.Graph.Nodes = append(g.Graph.Nodes, node)
+	}
+
+	pg.IterateEdges(func(source, target *engine.Object, eb engine.EdgeBitmap) bool {
+		values := graphExportEdgeValues(source, target, eb)
+		edge := GraphMLEdge{
+			ID:     fmt.Sprintf("e%v-%v", source.ID(), target.ID()),
+			Source: fmt.Sprintf("n%v", source.ID()),
+			Target: fmt.Sprintf("n%v", target.ID()),
+		}
+		for i, key := range edgekeys {
+			if value, found := values[key.Name]; found {
+				edge.Data = append(edge.Data, GraphMLData{Key: fmt.Sprintf("e%v", i), Value: value})
+			}
+		}
+		g.Graph.Edges = append(g.Graph.Edges, edge)
+		return true
+	})
+
+	return g
+}
+
+func WriteGraphML(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error {
+	return writeXML(GenerateGraphML(pg), w)
+}
+
+func ExportGraphML(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string) error {
+	return exportGraphFile(pg, filename, WriteGraphML)
+}
+
+func writeXML(v any, w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	xe := xml.NewEncoder(w)
+	xe.Indent("", "  ")
+	if err := xe.Encode(v); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
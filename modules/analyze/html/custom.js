@@ -237,73 +237,65 @@ function busystatus(busytext) {
         .show();
 }
 
+function analysisparams() {
+    return JSON.stringify(
+        $('#queryform, #analysisoptionsform, #analysispwnform, #analysistypeform')
+            .serializeArray()
+            .reduce(function (m, o) {
+                m[o.name] = o.value;
+                return m;
+            }, {})
+    );
+}
+
+// Runs the current analysis again on the server, and downloads the result in another graph format
+function exportgraph(format) {
+    fetch('export-graph?format=' + encodeURIComponent(format), {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json; charset=utf-8' },
+        body: analysisparams(),
+    })
+        .then(function (response) {
+            if (!response.ok) {
+                return response.text().then(function (text) {
+                    throw new Error(text);
+                });
+            }
+            var filename = 'adalanche-analysis';
+            var match = /filename=([^;]+)/.exec(response.headers.get('Content-Disposition') || '');
+            if (match) {
+                filename = match[1];
+            }
+            return response.blob().then(function (blob) {
+                var link = document.createElement('a');
+                link.href = URL.createObjectURL(blob);
+                link.download = filename;
+                document.body.appendChild(link);
+                link.click();
+                link.remove();
+                URL.revokeObjectURL(link.href);
+            });
+        })
+        .catch(function (error) {
+            $('#status')
+                .html('Problem exporting graph:<br>' + error.message)
+                .show();
+        });
+}
+
 function analyze(e) {
     busystatus("Analyzing")
 
+    var params = analysisparams();
+
     $.ajax({
         type: 'POST',
-        url: 'analyzegraph',
+        url: 'analyzegraph/job',
         contentType: 'charset=utf-8',
-        data: JSON.stringify(
-            $('#queryform, #analysisoptionsform, #analysispwnform, #analysistypeform')
-                .serializeArray()
-                .reduce(function (m, o) {
-                    m[o.name] = o.value;
-                    return m;
-                }, {})
-        ),
+        data: params,
         dataType: 'json',
-        success: function (data) {
-            if (data.total == 0) {
-                $('#status').html('No results').show();
-            } else {
-                // Remove all windows
-                $('#windows div').remove();
-
-                // Hide status
-                $('#status').hide();
-
-                var info =
-                    data.targets +
-                    ' target nodes can ' +
-                    (!data.reversed ? 'be reached via ' : 'reach ') +
-                    data.links +
-                    ' edges ' +
-                    (!data.reversed ? 'from' : 'to') +
-                    ':<hr/><table class="w-100">';
-                for (var objecttype in data.resulttypes) {
-                    info += '<tr><td class="text-right pr-5">'+ data.resulttypes[objecttype] + '</td><td>' + objecttype + '</td></tr>';
-                }
-                info += '<tr><td class="text-right pr-5">' + data.total + '</td><td>total nodes in analysis</td></tr>';
-                if (data.removed>0) {
-                    info += '<tr><td class="text-right pr-5"><b>' + data.removed + '</b></td><td><b>nodes were removed by node limiter</b></td></tr>';
-                }
-                info += '</table>';
-
-                newwindow('results', 'Query results', info);
-
-                if ($('infowrap').prop('width') == 0) {
-                    $('#infowrap').animate({ width: 'toggle' }, 400);
-                }
-
-                if (
-                    $('#hideoptionsonanalysis').prop('checked') &&
-                    $('#optionspanel').prop('width') != 0
-                ) {
-                    $('#optionspanel').animate({ width: 'toggle' }, 400);
-                }
-
-                if (
-                    $('#hidequeryonanalysis').prop('checked') &&
-                    $('#querydiv').prop('height') != 0
-                ) {
-                    $('#querydiv').slideToggle('fast');
-                }
-
-                initgraph(data.elements);
-
-                history.pushState($('body').html(), 'adalanche')
-            }
+        success: function (job) {
+            followanalysis(job.id, JSON.parse(params));
         },
         error: function (xhr, status, error) {
             $('#status')
@@ -313,70 +305,208 @@ function analyze(e) {
     });
 }
 
-function refreshProgress() {
-    var lastwasidle = false
-    var progressSocket = new WebSocket(location.origin.replace(/^http/, 'ws') + '/progress');
+// Shows progress of a background analysis job, and loads the graph once it is done
+function followanalysis(jobid, params) {
+    busystatus(`Analyzing<div id="analysisprogress" class="small"></div>
+        <button id="cancelanalysis" class="btn btn-sm btn-outline-secondary mt-2">Cancel</button>`);
 
-    progressSocket.onerror = function (event) {
-        $("#backendstatus").html("Adalanche backend is still offline");
-        $("#upperstatus").show();
-        $("#progressbars").empty().hide();
-        $("#offlineblur").show();
-        setTimeout(refreshProgress, 3000);
+    $('#cancelanalysis').on('click', function () {
+        $(this).prop('disabled', true);
+        $.ajax({ type: 'DELETE', url: 'api/v1/analysis/' + jobid });
+    });
+
+    var events = new EventSource('api/v1/analysis/' + jobid + '/events');
+    events.addEventListener('job', function (event) {
+        var job = JSON.parse(event.data);
+        switch (job.status) {
+            case 'running':
+                $('#analysisprogress').html(
+                    job.progress.phase + ' round ' + job.progress.round + ', ' +
+                    job.progress.nodes + ' nodes, ' + job.progress.edges + ' edges'
+                );
+                return;
+            case 'done':
+                events.close();
+                $.ajax({
+                    type: 'GET',
+                    url: 'analyzegraph/job/' + jobid,
+                    data: { alldetails: params.alldetails },
+                    dataType: 'json',
+                    success: showanalysis,
+                    error: function (xhr, status, error) {
+                        $('#status')
+                            .html('Problem loading graph:<br>' + xhr.responseText)
+                            .show();
+                    },
+                });
+                return;
+            case 'cancelled':
+                events.close();
+                $('#status').html('Analysis cancelled').show();
+                return;
+            default:
+                events.close();
+                $('#status')
+                    .html('Problem running analysis:<br>' + job.error)
+                    .show();
+        }
+    });
+    events.onerror = function () {
+        if (events.readyState == EventSource.CLOSED) {
+            $('#status').html('Lost connection to analysis job').show();
+        }
     };
+}
+
+function showanalysis(data) {
+    if (data.total == 0) {
+        $('#status').html('No results').show();
+    } else {
+        // Remove all windows
+        $('#windows div').remove();
+
+        // Hide status
+        $('#status').hide();
+
+        var info =
+            data.targets +
+            ' target nodes can ' +
+            (!data.reversed ? 'be reached via ' : 'reach ') +
+            data.links +
+            ' edges ' +
+            (!data.reversed ? 'from' : 'to') +
+            ':<hr/><table class="w-100">';
+        for (var objecttype in data.resulttypes) {
+            info += '<tr><td class="text-right pr-5">'+ data.resulttypes[objecttype] + '</td><td>' + objecttype + '</td></tr>';
+        }
+        info += '<tr><td class="text-right pr-5">' + data.total + '</td><td>total nodes in analysis</td></tr>';
+        if (data.removed>0) {
+            info += '<tr><td class="text-right pr-5"><b>' + data.removed + '</b></td><td><b>nodes were removed by node limiter</b></td></tr>';
+        }
+        info += '</table>';
+
+        info += '<hr/>Download as';
+        for (const [format, title] of [
+            ['graphml', 'GraphML'],
+            ['gexf', 'GEXF'],
+            ['graphviz', 'GraphViz'],
+            ['xgmml', 'XGMML'],
+            ['bloodhound', 'BloodHound'],
+            ['cytoscapejs', 'CytoscapeJS'],
+        ]) {
+            info += ' <a href="#" onclick="exportgraph(\'' + format + '\'); return false;">' + title + '</a>';
+        }
+
+        newwindow('results', 'Query results', info);
+
+        if ($('infowrap').prop('width') == 0) {
+            $('#infowrap').animate({ width: 'toggle' }, 400);
+        }
+
+        if (
+            $('#hideoptionsonanalysis').prop('checked') &&
+            $('#optionspanel').prop('width') != 0
+        ) {
+            $('#optionspanel').animate({ width: 'toggle' }, 400);
+        }
+
+        if (
+            $('#hidequeryonanalysis').prop('checked') &&
+            $('#querydiv').prop('height') != 0
+        ) {
+            $('#querydiv').slideToggle('fast');
+        }
+
+        initgraph(data.elements);
 
-    progressSocket.onclose = function (event) {
+        history.pushState($('body').html(), 'adalanche')
+    }
+}
+
+// Elements with the needs-ready class are disabled until the backend has finished post-processing
+var backendready = false
+
+function setBackendReady(ready) {
+    backendready = ready
+    $(".needs-ready").toggleClass("disabled", !ready).attr("aria-disabled", !ready)
+}
+
+function showBackendStatus() {
+    var running = $("#progressbars .progress-group").length
+    if (running > 0) {
+        $("#backendstatus").html(backendready ? "Adalanche is processing" : "Adalanche is post-processing, results are not final yet")
+        $("#upperstatus").show()
+        $("#progressbars").show()
+    } else if (!backendready) {
+        $("#backendstatus").html("Adalanche is post-processing, results are not final yet")
+        $("#upperstatus").show()
+    } else {
+        $("#backendstatus").html("Adalanche backend is idle")
+        $("#progressbars").hide()
+        $("#upperstatus").fadeOut("slow")
+    }
+}
+
+function updateProgressbar(progressbar) {
+    var pb = $("#" + progressbar.id)
+    if (pb.length == 0) {
+        var group = $(`<div class="progress-group"><span class="progress-group-label"></span><div class="progress"><div class="progress-bar rounded-0" role="progressbar" aria-valuemin="0" aria-valuemax="100"></div></div><span class="progress-group-label"></span></div>`)
+        group.children().first().text(progressbar.title)
+        group.find(".progress-bar").attr("id", progressbar.id)
+        $("#progressbars").append(group)
+        pb = $("#" + progressbar.id)
+    }
+    pb.attr("aria-valuenow", progressbar.percent.toFixed(0))
+    pb.css("width", progressbar.percent.toFixed(0) + "%")
+    pb.parent().next().html(progressbar.percent.toFixed(2) + "%")
+}
+
+function refreshProgress() {
+    var events = new EventSource('api/v1/events');
+
+    events.onerror = function (event) {
+        events.close()
         $("#backendstatus").html("Adalanche backend is offline");
         $("#upperstatus").show();
         $("#progressbars").empty().hide();
         $("#offlineblur").show();
         setTimeout(refreshProgress, 3000);
-    }
+    };
 
-    progressSocket.onmessage = function (progressbars) {
+    events.addEventListener("status", function (event) {
+        var serverstatus = JSON.parse(event.data)
         $("#offlineblur").hide()
-        if (progressbars.length > 0) {
-            lastwasidle = false
-            keepProgressbars = new Set()
-            for (i in progressbars) {
-                progressbar = progressbars[i]
-                if (progressbar.Done) {
-                    continue
-                }
-                keepProgressbars.add(progressbar.ID)
+        $("#progressbars").empty()
+        for (var progressbar of serverstatus.progress) {
+            updateProgressbar(progressbar)
+        }
+        setBackendReady(serverstatus.ready)
+        showBackendStatus()
+    });
 
-                // find progressbar
-                pb = $("#"+progressbar.ID)
-                if (pb.length == 0 && !progressbar.Done) {
-                    $("#progressbars").append(`<div class="progress-group"><span class="progress-group-label">` + progressbar.Title + `</span><div class="progress"><div id="` + progressbar.ID + `" class="progress-bar rounded-0" role="progressbar" aria-valuemin="0" aria-valuemax="100"></div></div><span class="progress-group-label"></span></div>`)
-                    pb = $("#" + progressbar.ID)
-                }
+    events.addEventListener("progress-start", function (event) {
+        updateProgressbar(JSON.parse(event.data))
+        showBackendStatus()
+    });
 
-                // Update progressbar
-                pb.attr("aria-valuenow", progressbar.Percent.toFixed(0))
-                pb.css("width", progressbar.Percent.toFixed(0)+"%")
-                pb.parent().next().html(progressbar.Percent.toFixed(2)+"%")
-            }
-            // remove old progressbars
-            $("#progressbars .progress-bar").each(function (index) {
-                id = $(this).attr('id')
-                if (!keepProgressbars.has(id)) {
-                    $(this).parent().parent().slideUp("slow", function () { $(this).remove(); })
-                }
-            })
+    events.addEventListener("progress-update", function (event) {
+        updateProgressbar(JSON.parse(event.data))
+    });
 
-            $("#upperstatus").show()
-            $("#progressbars").show()
-            $("#backendstatus").html("Adalanche is processing")
-        } else {
-            if (!lastwasidle) {
-                $("#progressbars").empty().hide()
-                $("#backendstatus").html("Adalanche backend is idle")
-                $("#upperstatus").fadeOut("slow")
-            }
-            lastwasidle = true
+    events.addEventListener("progress-finish", function (event) {
+        var progressbar = JSON.parse(event.data)
+        $("#" + progressbar.id).parent().parent().slideUp("slow", function () {
+            $(this).remove();
+            showBackendStatus()
+        })
+    });
+
+    events.addEventListener("log", function (event) {
+        var logline = JSON.parse(event.data)
+        if (logline.level == "Warn" || logline.level == "Error") {
+            toast(logline.level, $("<span>").text(logline.message).html())
         }
-    };
+    });
 };
 
 refreshProgress();
@@ -0,0 +1,90 @@
+// Results of the security rules the backend evaluates once post-processing is done
+
+var severityclasses = {
+    critical: 'bg-danger',
+    high: 'bg-danger',
+    medium: 'bg-warning text-dark',
+    low: 'bg-info text-dark',
+    info: 'bg-secondary',
+};
+
+function renderfindings(data) {
+    if (!data.ready) {
+        return '<div>Findings are evaluated when post-processing has finished</div>';
+    }
+
+    var html = '<div class="mb-1">' + data.findings.length + ' of ' + data.rules + ' rules found something</div>';
+    for (error of data.errors || []) {
+        html += '<div class="text-danger mb-1">' + escapetext(error) + '</div>';
+    }
+
+    html += '<div class="accordion" id="findingslist">';
+    data.findings.forEach(function (finding, i) {
+        html += '<div class="accordion-item bg-dark">' +
+            '<h2 class="accordion-header"><button class="accordion-button collapsed bg-dark text-light p-1" type="button" data-bs-toggle="collapse" data-bs-target="#finding_' + i + '">' +
+            '<span class="badge ' + (severityclasses[finding.severity] || 'bg-secondary') + ' me-2">' + escapetext(finding.severity) + '</span>' +
+            escapetext(finding.title) + '&nbsp;<span class="text-muted">(' + finding.count + ')</span></button></h2>' +
+            '<div id="finding_' + i + '" class="accordion-collapse collapse" data-bs-parent="#findingslist"><div class="accordion-body p-1 font-size-12">';
+        if (finding.description) {
+            html += '<p>' + escapetext(finding.description) + '</p>';
+        }
+        if (finding.remediation) {
+            html += '<p><b>Remediation:</b> ' + escapetext(finding.remediation) + '</p>';
+        }
+        html += '<p><b>Query:</b> <code class="findingquery cursor-pointer" title="Use as start query">' + escapetext(finding.query) + '</code></p><ul>';
+        for (object of finding.objects) {
+            html += '<li class="findingobject cursor-pointer" objectid="' + object.id + '">' + escapetext(object.distinguishedName || object.label) + '</li>';
+        }
+        html += '</ul>';
+        if (finding.paths) {
+            html += '<b>Paths</b><ul>';
+            for (path of finding.paths) {
+                html += '<li>' + escapetext(path) + '</li>';
+            }
+            html += '</ul>';
+        }
+        html += '</div></div></div>';
+    });
+    html += '</div>';
+    return html;
+}
+
+function showfindings() {
+    $.ajax({
+        url: 'api/v1/findings',
+        dataType: 'json',
+        success: function (data) {
+            newwindow('findings', 'Findings', renderfindings(data));
+        },
+        error: function (xhr) {
+            var message = xhr.responseJSON ? xhr.responseJSON.error : xhr.responseText;
+            newwindow('findings', 'Findings', 'Problem loading findings: ' + escapetext(message));
+        },
+    });
+}
+
+$(function () {
+    $('#findings').on('click', showfindings);
+
+    $(document).on('click', '#findingslist .findingobject', function () {
+        var id = $(this).attr('objectid');
+        $.ajax({
+            url: 'details/id/' + id,
+            dataType: 'json',
+            success: function (data) {
+                newwindow('details_' + id, 'Item details', renderdetails(data));
+            },
+        });
+    });
+
+    // LDAP filters can be analyzed directly, path patterns can't
+    $(document).on('click', '#findingslist .findingquery', function () {
+        var query = $(this).text();
+        if (query.includes(')-[') || query.includes(']-(')) {
+            toast('Findings', 'Path patterns can only be run with the query command');
+            return;
+        }
+        $('#querytext').val(query);
+        analyze();
+    });
+});
@@ -0,0 +1,138 @@
+// Saved queries stored on the server, with {placeholders} asked for when one is picked
+
+function loadsavedqueries() {
+    $.ajax({
+        url: 'api/v1/queries',
+        dataType: 'json',
+        success: function (queries) {
+            var items = '';
+            for (query of queries) {
+                items += '<li class="dropdown-item savedquery" name="' + escapetext(query.name) + '" title="' + escapetext(query.description || '') + '">' +
+                    escapetext(query.name) + '</li>';
+            }
+            if (queries.length > 0) {
+                items += '<li><hr class="dropdown-divider"></li>';
+            }
+            items += '<li class="dropdown-item" id="savequery">Save current query ...</li>';
+            items += '<li class="dropdown-item" id="importqueries">Import YAML ...</li>';
+            items += '<li><a class="dropdown-item" href="api/v1/queries?format=yaml">Export YAML</a></li>';
+            $('#savedqueries').html(items);
+        },
+    });
+}
+
+// Fills in placeholders in a query text, asking for values that haven't been given yet
+function fillplaceholders(text, values, defaults) {
+    return text.replace(/\{([A-Za-z][A-Za-z0-9_]*)\}/g, function (placeholder, name) {
+        if (!(name in values)) {
+            var value = prompt('Value for ' + name, (defaults || {})[name] || '');
+            if (value == null) {
+                throw new Error('cancelled');
+            }
+            values[name] = value;
+        }
+        return values[name].replace(/[\\()]/g, '\\$&');
+    });
+}
+
+// Puts a saved query into the analysis form, the opposite of what the server does when saving
+function applysavedquery(query) {
+    var values = {};
+    try {
+        $('#querytext').val(fillplaceholders(query.query || '', values, query.defaults));
+        $('#queryexclude').val(fillplaceholders(query.middleQuery || '', values, query.defaults));
+        $('#queryexcludelast').val(fillplaceholders(query.endQuery || '', values, query.defaults));
+    } catch (e) {
+        return false;
+    }
+
+    set_querymode(query.reverse ? 'reverse' : 'normal');
+    $('#maxdepth').val(query.maxDepth >= 0 ? query.maxDepth : 99);
+    $('#maxoutgoing').val(query.maxOutgoing >= 0 ? query.maxOutgoing : 0);
+    $('#minprobability').val(query.minProbability || 0);
+    $('#minaccprobability').val(query.minAccumulatedProbability || 0);
+    $('#backlinks').val(query.backlinks || 0);
+    if (query.nodeLimit) {
+        $('#nodelimit').val(query.nodeLimit);
+    }
+    $('#prune').prop('checked', !!query.prune);
+    $('#dont-expand-au-eo').prop('checked', !!query.dontExpandAUEO);
+
+    // No list means everything is allowed
+    var lists = {
+        pwn_: [query.edgesFirst, query.edgesMiddle, query.edgesLast],
+        type_: [query.typesFirst, query.typesMiddle, query.typesLast],
+    };
+    for (prefix in lists) {
+        ['_f', '_m', '_l'].forEach(function (suffix, i) {
+            var list = lists[prefix][i];
+            $('input[type=checkbox][name^="' + prefix + '"][name$="' + suffix + '"]').each(function () {
+                var name = this.name.substring(prefix.length, this.name.length - suffix.length);
+                $(this).prop('checked', !list || list.length == 0 || list.includes(name));
+            });
+        });
+    }
+    return true;
+}
+
+$(function () {
+    loadsavedqueries();
+
+    $('#savedqueries').on('click', 'li.savedquery', function () {
+        $.ajax({
+            url: 'api/v1/queries/' + encodeURIComponent($(this).attr('name')),
+            dataType: 'json',
+            success: function (query) {
+                applysavedquery(query);
+            },
+        });
+    });
+
+    $('#savedqueries').on('click', '#savequery', function () {
+        var name = prompt('Name of saved query');
+        if (!name) {
+            return;
+        }
+        var description = prompt('Description (optional)') || '';
+        $.ajax({
+            type: 'POST',
+            url: 'savequery?' + $.param({ name: name, description: description }),
+            contentType: 'application/json; charset=utf-8',
+            data: analysisparams(),
+            success: function () {
+                toast('Saved query', escapetext(name) + ' was saved');
+                loadsavedqueries();
+            },
+            error: function (xhr) {
+                toast('Problem saving query', escapetext(xhr.responseText));
+            },
+        });
+    });
+
+    $('#savedqueries').on('click', '#importqueries', function () {
+        var input = $('<input type="file" accept=".yaml,.yml,.json">');
+        input.on('change', function () {
+            var file = this.files[0];
+            if (!file) {
+                return;
+            }
+            file.text().then(function (text) {
+                $.ajax({
+                    type: 'POST',
+                    url: 'api/v1/queries',
+                    contentType: 'application/yaml',
+                    data: text,
+                    success: function (queries) {
+                        toast('Imported queries', queries.length + ' saved queries imported');
+                        loadsavedqueries();
+                    },
+                    error: function (xhr) {
+                        var message = xhr.responseJSON ? xhr.responseJSON.error : xhr.responseText;
+                        toast('Problem importing queries', escapetext(message));
+                    },
+                });
+            });
+        });
+        input.click();
+    });
+});
@@ -0,0 +1,175 @@
+// Table view of the objects matching the start query, with selectable attribute columns
+
+var tablecolumns = ['type', 'name', 'distinguishedName'];
+var tablesort = '';
+var tableoffset = 0;
+var tablepagesize = 100;
+
+function escapetext(text) {
+    return $('<span>').text(text).html();
+}
+
+function tableparams(extra) {
+    var params = {
+        query: $('#querytext').val(),
+        attributes: tablecolumns.join(','),
+        sort: tablesort,
+    };
+    return $.param(Object.assign(params, extra));
+}
+
+function showtable() {
+    if (typeof prefs !== 'undefined' && prefs) {
+        tablecolumns = getpref('table.columns', tablecolumns);
+    }
+    tableoffset = 0;
+
+    newwindow(
+        'table',
+        'Table',
+        `<div id="tablecontrols" class="mb-1">
+            <div class="input-group input-group-sm mb-1">
+                <input id="tablecolumnadd" class="form-control" list="tableattributes" placeholder="Add column">
+                <datalist id="tableattributes"></datalist>
+                <button id="tablecolumnaddbutton" class="btn btn-primary btn-sm" type="button">Add</button>
+                <a id="tableexportcsv" class="btn btn-primary btn-sm" href="#">CSV</a>
+                <a id="tableexportxlsx" class="btn btn-primary btn-sm" href="#">XLSX</a>
+            </div>
+            <div id="tablecolumns"></div>
+        </div>
+        <div id="tablestatus" class="mb-1"></div>
+        <div class="overflow-auto"><table id="objecttable" class="table table-sm table-striped font-size-12"></table></div>
+        <div class="mt-1">
+            <button id="tableprev" class="btn btn-sm" type="button">Previous</button>
+            <button id="tablenext" class="btn btn-sm" type="button">Next</button>
+        </div>`
+    );
+
+    $.ajax({
+        url: '/filteroptions',
+        dataType: 'json',
+        success: function (data) {
+            var options = '';
+            for (attribute of data.attributes || []) {
+                options += '<option value="' + escapetext(attribute.lookup) + '">';
+            }
+            $('#tableattributes').html(options);
+        },
+    });
+
+    $('#tablecolumnaddbutton').on('click', function () {
+        var column = $('#tablecolumnadd').val().trim();
+        if (column != '' && !tablecolumns.includes(column)) {
+            tablecolumns.push(column);
+            savetablecolumns();
+            loadtable();
+        }
+        $('#tablecolumnadd').val('');
+    });
+    $('#tablecolumnadd').on('keydown', function (event) {
+        if (event.key == 'Enter') {
+            $('#tablecolumnaddbutton').click();
+        }
+    });
+
+    $('#tablecolumns').on('click', '.tablecolumnremove', function () {
+        var column = $(this).parent().attr('column');
+        tablecolumns = tablecolumns.filter((c) => c != column);
+        if (tablesort.replace(/^-/, '') == column) {
+            tablesort = '';
+        }
+        savetablecolumns();
+        loadtable();
+    });
+
+    $('#objecttable').on('click', 'th', function () {
+        var column = $(this).attr('column');
+        tablesort = tablesort == column ? '-' + column : column;
+        tableoffset = 0;
+        loadtable();
+    });
+
+    $('#tableprev').on('click', function () {
+        tableoffset = Math.max(0, tableoffset - tablepagesize);
+        loadtable();
+    });
+    $('#tablenext').on('click', function () {
+        tableoffset += tablepagesize;
+        loadtable();
+    });
+
+    $('#tableexportcsv, #tableexportxlsx').on('click', function (event) {
+        var format = this.id == 'tableexportcsv' ? 'csv' : 'xlsx';
+        this.href = 'export-table?' + tableparams({ format: format });
+    });
+
+    loadtable();
+}
+
+function savetablecolumns() {
+    if (typeof prefs !== 'undefined' && prefs) {
+        setpref('table.columns', tablecolumns);
+    }
+}
+
+function loadtable() {
+    var columns = '';
+    for (column of tablecolumns) {
+        columns += '<span class="badge badge-primary me-1" column="' + escapetext(column) + '">' + escapetext(column) +
+            ' <span class="tablecolumnremove cursor-pointer">&times;</span></span>';
+    }
+    $('#tablecolumns').html(columns);
+    $('#tablestatus').html('Loading ...');
+
+    $.ajax({
+        url: 'api/v1/objects?' + tableparams({ offset: tableoffset, limit: tablepagesize }),
+        dataType: 'json',
+        success: function (data) {
+            var header = '<thead><tr>';
+            for (column of tablecolumns) {
+                var arrow = '';
+                if (tablesort == column) {
+                    arrow = ' &#9650;';
+                } else if (tablesort == '-' + column) {
+                    arrow = ' &#9660;';
+                }
+                header += '<th class="cursor-pointer" column="' + escapetext(column) + '">' + escapetext(column) + arrow + '</th>';
+            }
+            header += '</tr></thead>';
+
+            var rows = '<tbody>';
+            for (object of data.objects) {
+                rows += '<tr objectid="' + object.id + '">';
+                for (column of tablecolumns) {
+                    var values = (object.attributes || {})[column] || [];
+                    rows += '<td>' + values.map(escapetext).join('<br>') + '</td>';
+                }
+                rows += '</tr>';
+            }
+            rows += '</tbody>';
+            $('#objecttable').html(header + rows);
+
+            var last = Math.min(data.offset + data.objects.length, data.total);
+            $('#tablestatus').html(data.total == 0 ? 'No matching objects' : 'Showing ' + (data.offset + 1) + ' to ' + last + ' of ' + data.total + ' objects');
+            $('#tableprev').prop('disabled', data.offset == 0);
+            $('#tablenext').prop('disabled', last >= data.total);
+        },
+        error: function (xhr, status, error) {
+            var message = xhr.responseJSON ? xhr.responseJSON.error : xhr.responseText;
+            $('#tablestatus').html('Problem loading table: ' + escapetext(message));
+        },
+    });
+}
+
+$(function () {
+    $(document).on('dblclick', '#objecttable tr[objectid]', function () {
+        var id = $(this).attr('objectid');
+        $.ajax({
+            url: 'details/id/' + id,
+            dataType: 'json',
+            success: function (data) {
+                newwindow('details_' + id, 'Item details', renderdetails(data));
+            },
+        });
+    });
+});
@@ -0,0 +1,211 @@
+package analyze
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/lkarlslund/adalanche/modules/engine"
+)
+
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobDone      JobStatus = "done"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// How many finished jobs are kept around for clients to collect results from
+const keepFinishedJobs = 32
+
+type job struct {
+	id       string
+	created  time.Time
+	finished time.Time
+	status   JobStatus
+	err      error
+	request  *APIAnalysisRequest
+	reversed bool // Analysis didn't follow edges inwards, so the graph is shown reversed
+	progress AnalysisProgress
+	results  *AnalysisResults
+	apiview  *APIAnalysisResult // Converted on first request
+	cancel   context.CancelFunc
+	updated  chan struct{} // Closed and replaced whenever the job changes
+}
+
+// jobManager runs analysis jobs in the background
+type jobManager struct {
+	lock sync.Mutex
+	jobs map[string]*job
+	done []string // IDs of finished jobs, oldest first
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{
+		jobs: make(map[string]*job),
+	}
+}
+
+// Start runs the analysis and post processors in the background and returns immediately.
+// The request is only kept for reporting, and can be nil for jobs started from the web interface.
+func (jm *jobManager) Start(request *APIAnalysisRequest, opts AnalyzeObjectsOptions) APIJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		id:       uuid.Must(uuid.NewV4()).String(),
+		created:  time.Now(),
+		status:   JobRunning,
+		request:  request,
+		reversed: opts.Direction != engine.In,
+		progress: AnalysisProgress{Phase: "starting"},
+		cancel:   cancel,
+		updated:  make(chan struct{}),
+	}
+
+	opts.Progress = func(progress AnalysisProgress) {
+		jm.lock.Lock()
+		defer jm.lock.Unlock()
+		j.progress = progress
+		j.notify()
+	}
+
+	jm.lock.Lock()
+	jm.jobs[j.id] = j
+	info := j.info(false)
+	jm.lock.Unlock()
+
+	go func() {
+		defer cancel()
+
+		results, err := AnalyzeObjectsContext(ctx, opts)
+		if err == nil {
+			jm.lock.Lock()
+			j.progress.Phase = "postprocessing"
+			j.notify()
+			jm.lock.Unlock()
+
+			for _, postprocessor := range PostProcessors {
+				results.Graph = postprocessor(results.Graph)
+			}
+		}
+
+		jm.lock.Lock()
+		defer jm.lock.Unlock()
+		j.finished = time.Now()
+		switch {
+		case errors.Is(err, context.Canceled):
+			j.status = JobCancelled
+		case err != nil:
+			j.status = JobFailed
+			j.err = err
+		default:
+			j.status = JobDone
+			j.results = &results
+			j.progress.Phase = "done"
+			j.progress.Nodes = results.Graph.Order()
+			j.progress.Edges = results.Graph.Size()
+		}
+		j.notify()
+
+		jm.done = append(jm.done, j.id)
+		for len(jm.done) > keepFinishedJobs {
+			delete(jm.jobs, jm.done[0])
+			jm.done = jm.done[1:]
+		}
+	}()
+
+	return info
+}
+
+// Cancel stops a running job. The job is marked as cancelled once the analysis notices.
+func (jm *jobManager) Cancel(id string) (APIJob, bool) {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	j, found := jm.jobs[id]
+	if !found {
+		return APIJob{}, false
+	}
+	j.cancel()
+	return j.info(false), true
+}
+
+func (jm *jobManager) Get(id string, withresult bool) (APIJob, bool) {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	j, found := jm.jobs[id]
+	if !found {
+		return APIJob{}, false
+	}
+	return j.info(withresult), true
+}
+
+// Watch returns the current state of a job and a channel that is closed the next time it changes
+func (jm *jobManager) Watch(id string) (APIJob, <-chan struct{}, bool) {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	j, found := jm.jobs[id]
+	if !found {
+		return APIJob{}, nil, false
+	}
+	return j.info(false), j.updated, true
+}
+
+// Results returns the analysis graph of a finished job, and whether it was analyzed in reverse
+func (jm *jobManager) Results(id string) (*AnalysisResults, bool, APIJob, bool) {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	j, found := jm.jobs[id]
+	if !found {
+		return nil, false, APIJob{}, false
+	}
+	return j.results, j.reversed, j.info(false), true
+}
+
+// List returns all known jobs, newest first and without their results
+func (jm *jobManager) List() []APIJob {
+	jm.lock.Lock()
+	defer jm.lock.Unlock()
+	result := make([]APIJob, 0, len(jm.jobs))
+	for _, j := range jm.jobs {
+		result = append(result, j.info(false))
+	}
+	slices.SortFunc(result, func(a, b APIJob) int {
+		return b.Created.Compare(a.Created)
+	})
+	return result
+}
+
+// Must be called with the lock held
+func (j *job) notify() {
+	close(j.updated)
+	j.updated = make(chan struct{})
+}
+
+// Must be called with the lock held
+func (j *job) info(withresult bool) APIJob {
+	info := APIJob{
+		ID:       j.id,
+		Status:   j.status,
+		Created:  j.created,
+		Request:  j.request,
+		Progress: j.progress,
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		info.Finished = &finished
+	}
+	if j.err != nil {
+		info.Error = j.err.Error()
+	}
+	if withresult && j.results != nil {
+		if j.apiview == nil {
+			j.apiview = newAPIAnalysisResult(*j.results)
+		}
+		info.Result = j.apiview
+	}
+	return info
+}
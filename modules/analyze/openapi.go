@@ -0,0 +1,271 @@
+package analyze
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lkarlslund/adalanche/modules/version"
+)
+
+// apiEndpoint describes one route of the versioned API, so the OpenAPI document is generated from the same
+// table that registers the handlers and can't drift from them
+type apiEndpoint struct {
+	Method      string
+	Path        string // gin syntax, relative to the API base
+	Summary     string
+	Description string
+	Parameters  []apiParameter
+	Request     any // Zero value of the JSON request body type, or nil
+	Response    any // Zero value of the JSON response body type
+	Status      int // Status code on success, defaults to 200
+	Handler     gin.HandlerFunc
+	AdminOnly   bool
+}
+
+type apiParameter struct {
+	Name        string
+	In          string // path or query
+	Description string
+	Type        string // OpenAPI primitive type, defaults to string
+	Enum        []string
+	Required    bool
+}
+
+type apiRegistry struct {
+	base      string
+	group     *gin.RouterGroup
+	endpoints []apiEndpoint
+}
+
+func newAPIRegistry(router *gin.Engine, base string) *apiRegistry {
+	return &apiRegistry{
+		base:  base,
+		group: router.Group(base),
+	}
+}
+
+func (api *apiRegistry) add(e apiEndpoint) {
+	if e.Status == 0 {
+		e.Status = 200
+	}
+	handlers := []gin.HandlerFunc{e.Handler}
+	if e.AdminOnly {
+		handlers = []gin.HandlerFunc{requireAdmin, e.Handler}
+	}
+	api.group.Handle(e.Method, e.Path, handlers...)
+	api.endpoints = append(api.endpoints, e)
+}
+
+// OpenAPI returns an OpenAPI 3.0 document describing all registered endpoints
+func (api *apiRegistry) OpenAPI() map[string]any {
+	schemas := make(map[string]any)
+	paths := make(map[string]any)
+
+	for _, e := range api.endpoints {
+		path := api.base + openAPIPath(e.Path)
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = make(map[string]any)
+			paths[path] = item
+		}
+
+		operation := map[string]any{
+			"summary":     e.Summary,
+			"operationId": strings.ToLower(e.Method) + openAPIOperationName(e.Path),
+		}
+		if e.Description != "" {
+			operation["description"] = e.Description
+		}
+
+		var parameters []any
+		for _, p := range e.Parameters {
+			schema := map[string]any{"type": "string"}
+			if p.Type != "" {
+				schema["type"] = p.Type
+			}
+			if len(p.Enum) > 0 {
+				schema["enum"] = p.Enum
+			}
+			parameters = append(parameters, map[string]any{
+				"name":        p.Name,
+				"in":          p.In,
+				"description": p.Description,
+				"required":    p.Required || p.In == "path",
+				"schema":      schema,
+			})
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+
+		if e.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": openAPISchema(reflect.TypeOf(e.Request), schemas),
+					},
+				},
+			}
+		}
+
+		responses := map[string]any{
+			strconv.Itoa(e.Status): map[string]any{
+				"description": "Success",
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": openAPISchema(reflect.TypeOf(e.Response), schemas),
+					},
+				},
+			},
+			"default": map[string]any{
+				"description": "Error",
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": openAPISchema(reflect.TypeOf(APIError{}), schemas),
+					},
+				},
+			},
+		}
+		operation["responses"] = responses
+
+		item[strings.ToLower(e.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Adalanche API",
+			"version": "1",
+			"description": "Stable JSON API for objects, edges and analysis in " + version.ProgramVersionShort() +
+				". Requests use HTTP basic or bearer authentication when the server has been started with users or tokens.",
+		},
+		"servers": []any{map[string]any{"url": "/"}},
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"basic":  map[string]any{"type": "http", "scheme": "basic"},
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []any{map[string]any{"basic": []any{}}, map[string]any{"bearer": []any{}}},
+		"paths":    paths,
+	}
+}
+
+// Converts /objects/:locateby/:id to /objects/{locateby}/{id}
+func openAPIPath(ginpath string) string {
+	parts := strings.Split(ginpath, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") || strings.HasPrefix(part, "*") {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Converts /objects/:locateby/:id to ObjectsLocatebyId
+func openAPIOperationName(ginpath string) string {
+	var name strings.Builder
+	for _, part := range strings.FieldsFunc(ginpath, func(r rune) bool {
+		return r == '/' || r == ':' || r == '*' || r == '-' || r == '.'
+	}) {
+		name.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return name.String()
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// openAPISchema returns the schema for a Go type, adding named structs to schemas and referencing them
+func openAPISchema(t reflect.Type, schemas map[string]any) map[string]any {
+	if t == nil {
+		return map[string]any{}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": openAPISchema(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := t.Name()
+		if _, found := schemas[name]; found && name != "" {
+			return map[string]any{"$ref": "#/components/schemas/" + name}
+		}
+
+		properties := make(map[string]any)
+		var required []string
+		schema := map[string]any{"type": "object", "properties": properties}
+		if name != "" {
+			// Placeholder first, so recursive types terminate
+			schemas[name] = schema
+		}
+
+		required = openAPIProperties(t, properties, required, schemas)
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+
+		if name == "" {
+			return schema
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// openAPIProperties adds the JSON fields of a struct to properties, flattening embedded structs like encoding/json does
+func openAPIProperties(t reflect.Type, properties map[string]any, required []string, schemas map[string]any) []string {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		jsonname, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && jsonname == "" && field.Type.Kind() == reflect.Struct {
+			required = openAPIProperties(field.Type, properties, required, schemas)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if jsonname == "" {
+			jsonname = field.Name
+		}
+		property := openAPISchema(field.Type, schemas)
+		if description := field.Tag.Get("doc"); description != "" {
+			if _, isref := property["$ref"]; isref {
+				property = map[string]any{"allOf": []any{property}, "description": description}
+			} else {
+				property["description"] = description
+			}
+		}
+		properties[jsonname] = property
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, jsonname)
+		}
+	}
+	return required
+}
@@ -0,0 +1,147 @@
+package analyze
+
+import (
+	"math"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+	"github.com/lkarlslund/adalanche/modules/query"
+)
+
+// Added to the cost of every step, so shorter paths win when probabilities are equal
+const pathHopPenalty = 0.001
+
+type PathOptions struct {
+	Objects            *engine.Objects
+	SourceFilter       query.NodeFilter
+	TargetFilter       query.NodeFilter
+	Edges              engine.EdgeBitmap
+	MinEdgeProbability engine.Probability
+	K                  int // Number of paths to find, 1 returns just the shortest
+}
+
+func NewPathOptions() PathOptions {
+	return PathOptions{
+		Edges:              engine.AllEdgesBitmap,
+		MinEdgeProbability: 1,
+		K:                  1,
+	}
+}
+
+type AttackPathStep struct {
+	Source, Target *engine.Object
+	Edges          engine.EdgeBitmap
+	Probability    engine.Probability
+}
+
+type AttackPath struct {
+	Steps       []AttackPathStep
+	Probability float64 // Combined probability of the whole chain, 0-1
+}
+
+// FindPaths returns the most likely attack paths from objects matching the source filter to objects matching the target filter,
+// weighing each edge by its probability so the most likely chains come first
+func FindPaths(opts PathOptions) []AttackPath {
+	if opts.K < 1 {
+		opts.K = 1
+	}
+
+	sources := query.Execute(opts.SourceFilter, opts.Objects).AsSlice()
+	targets := query.Execute(opts.TargetFilter, opts.Objects)
+
+	targetset := make(map[*engine.Object]struct{}, targets.Len())
+	targets.Iterate(func(o *engine.Object) bool {
+		targetset[o] = struct{}{}
+		return true
+	})
+	if sources.Len() == 0 || len(targetset) == 0 {
+		return nil
+	}
+
+	var sourcelist []*engine.Object
+	sources.Iterate(func(o *engine.Object) bool {
+		sourcelist = append(sourcelist, o)
+		return true
+	})
+
+	neighbours := func(o *engine.Object, each func(neighbour *engine.Object, cost float64) bool) {
+		o.Edges(engine.Out).Range(func(target *engine.Object, eb engine.EdgeBitmap) bool {
+			if probability := pathStepProbability(o, target, eb, opts); probability > 0 {
+				return each(target, -math.Log(float64(probability)/100)+pathHopPenalty)
+			}
+			return true
+		})
+	}
+
+	istarget := func(o *engine.Object) bool {
+		_, found := targetset[o]
+		return found
+	}
+
+	paths := graph.KShortestPaths(sourcelist, istarget, neighbours, opts.K)
+
+	results := make([]AttackPath, len(paths))
+	for i, path := range paths {
+		result := AttackPath{
+			Probability: 1,
+		}
+		for j := 0; j < len(path.Nodes)-1; j++ {
+			source, target := path.Nodes[j], path.Nodes[j+1]
+			eb := edgesBetween(source, target).Intersect(opts.Edges)
+			probability := pathStepProbability(source, target, eb, opts)
+			result.Steps = append(result.Steps, AttackPathStep{
+				Source:      source,
+				Target:      target,
+				Edges:       eb,
+				Probability: probability,
+			})
+			result.Probability *= float64(probability) / 100
+		}
+		results[i] = result
+	}
+
+	return results
+}
+
+// Probability of the best allowed edge between two objects, or 0 if it can't be used
+func pathStepProbability(source, target *engine.Object, eb engine.EdgeBitmap, opts PathOptions) engine.Probability {
+	eb = eb.Intersect(opts.Edges)
+	if eb.IsBlank() {
+		return 0
+	}
+	probability := eb.MaxProbability(source, target)
+	if probability < opts.MinEdgeProbability {
+		return 0
+	}
+	return probability
+}
+
+// All the edges from source to target
+func edgesBetween(source, target *engine.Object) engine.EdgeBitmap {
+	var eb engine.EdgeBitmap
+	source.Edges(engine.Out).Range(func(o *engine.Object, edges engine.EdgeBitmap) bool {
+		if o == target {
+			eb = edges
+			return false
+		}
+		return true
+	})
+	return eb
+}
+
+// PathsToGraph combines the paths into one graph, suitable for the usual exporters
+func PathsToGraph(paths []AttackPath) graph.Graph[*engine.Object, engine.EdgeBitmap] {
+	pg := graph.NewGraph[*engine.Object, engine.EdgeBitmap]()
+	for _, path := range paths {
+		for i, step := range path.Steps {
+			pg.AddEdge(step.Source, step.Target, step.Edges)
+			if i == 0 {
+				pg.SetNodeData(step.Source, "source", true)
+			}
+			if i == len(path.Steps)-1 {
+				pg.SetNodeData(step.Target, "target", true)
+			}
+		}
+	}
+	return pg
+}
@@ -0,0 +1,618 @@
+package analyze
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/query"
+	"github.com/lkarlslund/adalanche/modules/risk"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/lkarlslund/adalanche/modules/version"
+)
+
+//go:embed report.gohtml
+var reportTemplateText string
+
+// Groups and objects are found by SID, so the report works regardless of the language of the domain
+const (
+	reportAdminsQuery     = "(&(type=Group)(|(objectSid=S-1-5-21-*-512)(objectSid=S-1-5-21-*-519)))"
+	reportPrivilegedQuery = "(|(adminCount=1)" + risk.Tier0Query + ")" // Members of these are privileged too
+	reportAttackerQuery   = "(&(type=Person)(!adminCount=1)(!tag=account_disabled))"
+	reportDCsyncQuery     = "()-[DSReplGetChngsAll]->()"
+)
+
+type ReportOptions struct {
+	Title      string
+	Rules      []Rule
+	StaleDays  int // Enabled accounts that haven't logged on for this many days are stale
+	Paths      int // Number of most likely attack paths to show
+	GraphNodes int // Maximum number of nodes drawn in a graph
+	Limit      int // Maximum number of rows in object tables, 0 for all
+}
+
+func NewReportOptions() ReportOptions {
+	return ReportOptions{
+		Title:      "Active Directory assessment",
+		Rules:      BuiltinRules,
+		StaleDays:  90,
+		Paths:      5,
+		GraphNodes: 150,
+		Limit:      100,
+	}
+}
+
+// Report is everything that goes into the assessment report
+type Report struct {
+	Options   ReportOptions
+	Generated time.Time
+	Version   string
+
+	Statistics []ReportCount
+	Edges      int
+	Accounts   []AccountStatistics
+
+	Findings   []Finding
+	Severities []ReportCount // Number of findings per severity, most severe first
+
+	Admins ReportAnalysis // Who can reach Domain Admins and Enterprise Admins
+	Tier0  ReportAnalysis // Who can reach tier 0 without being privileged
+
+	DCsync []ReportObject
+
+	Risky []*engine.Object // Non-privileged principals that can reach tier 0, highest risk score first
+
+	Privileged []ReportAccount
+	Stale      []ReportAccount
+}
+
+type ReportCount struct {
+	Name  string
+	Count int
+}
+
+// ReportAnalysis sums up a graph analysis towards a set of targets
+type ReportAnalysis struct {
+	Query       string
+	Targets     int
+	Reachable   int // Objects that can reach one of the targets
+	Nodes       int
+	Edges       int
+	Reaching    []ReportCount // Objects that can reach the targets by type, targets not included
+	Exposed     []*engine.Object
+	Graph       template.HTML
+	Paths       []AttackPath
+	Chokepoints Chokepoints
+}
+
+type ReportObject struct {
+	Object     *engine.Object
+	Privileged bool
+}
+
+type ReportAccount struct {
+	Object          *engine.Object
+	Enabled         bool
+	LastLogon       time.Time
+	PasswordLastSet time.Time
+	Flags           []string
+}
+
+type reportAccountTable struct {
+	Accounts  []ReportAccount
+	Total     int
+	Truncated bool
+}
+
+// AccountStatistics counts users or computers by the properties that usually end up in an assessment
+type AccountStatistics struct {
+	Type                 string
+	Total                int
+	Enabled              int
+	Stale                int
+	NeverLoggedOn        int
+	PasswordNeverExpires int
+	PasswordNotRequired  int
+	OldPassword          int // Enabled accounts with a password older than a year
+	Privileged           int
+	PrivilegedStale      int
+}
+
+// ObjectStatistics counts the objects by type, and the number of edges between them
+func ObjectStatistics(ao *engine.Objects) (map[string]int, int) {
+	result := make(map[string]int)
+	for objecttype, count := range ao.Statistics() {
+		if objecttype == 0 {
+			continue // skip the dummy one
+		}
+		if count == 0 {
+			continue
+		}
+		result[engine.ObjectType(objecttype).String()] += count
+	}
+
+	var edgeCount int
+	ao.Iterate(func(object *engine.Object) bool {
+		edgeCount += object.Edges(engine.Out).Len()
+		return true
+	})
+	return result, edgeCount
+}
+
+// BuildReport runs the analyses for the report. Problems with individual analyses are logged and leave that part empty.
+func BuildReport(ao *engine.Objects, opts ReportOptions) (Report, error) {
+	report := Report{
+		Options:   opts,
+		Generated: time.Now(),
+		Version:   version.VersionStringShort(),
+	}
+
+	privileged, err := privilegedObjects(ao)
+	if err != nil {
+		return report, err
+	}
+
+	statistics, edges := ObjectStatistics(ao)
+	for name, count := range statistics {
+		report.Statistics = append(report.Statistics, ReportCount{Name: name, Count: count})
+	}
+	sortReportCounts(report.Statistics)
+	report.Edges = edges
+
+	report.Accounts, report.Privileged, report.Stale = accountStatistics(ao, privileged, opts)
+
+	report.Findings, err = EvaluateRules(opts.Rules, ao)
+	if err != nil {
+		ui.Warn().Msgf("Problem evaluating rules: %v", err)
+	}
+	counts := make([]int, len(severityNames))
+	for _, finding := range report.Findings {
+		counts[finding.Rule.Severity]++
+	}
+	for severity := SeverityCritical; severity >= SeverityInfo; severity-- {
+		report.Severities = append(report.Severities, ReportCount{Name: severity.String(), Count: counts[severity]})
+	}
+
+	report.Admins, err = reportAnalysis(ao, reportAdminsQuery, privileged, false, opts)
+	if err != nil {
+		ui.Warn().Msgf("Problem analyzing paths to administrators: %v", err)
+	}
+
+	// Privileged accounts are expected to reach tier 0, everyone else is exposure
+	report.Tier0, err = reportAnalysis(ao, risk.Tier0Query, privileged, true, opts)
+	if err != nil {
+		ui.Warn().Msgf("Problem analyzing tier 0 exposure: %v", err)
+	}
+
+	dcsync, err := EvaluateRule(Rule{ID: "dcsync", Query: reportDCsyncQuery}, ao)
+	if err != nil {
+		ui.Warn().Msgf("Problem finding DCsync principals: %v", err)
+	}
+	for _, o := range dcsync.Objects {
+		report.DCsync = append(report.DCsync, ReportObject{
+			Object:     o,
+			Privileged: privileged.Contains(o),
+		})
+	}
+
+	ao.Iterate(func(o *engine.Object) bool {
+		if score, found := o.AttrInt(risk.Score); found && score > 0 && !privileged.Contains(o) {
+			report.Risky = append(report.Risky, o)
+		}
+		return true
+	})
+	slices.SortFunc(report.Risky, func(a, b *engine.Object) int {
+		ascore, _ := a.AttrInt(risk.Score)
+		bscore, _ := b.AttrInt(risk.Score)
+		if ascore != bscore {
+			return int(bscore - ascore)
+		}
+		areachable, _ := a.AttrInt(risk.Tier0Reachable)
+		breachable, _ := b.AttrInt(risk.Tier0Reachable)
+		if areachable != breachable {
+			return int(breachable - areachable)
+		}
+		return strings.Compare(displayLabel(a), displayLabel(b))
+	})
+
+	return report, nil
+}
+
+type reportObjectSet map[*engine.Object]struct{}
+
+func (s reportObjectSet) Contains(o *engine.Object) bool {
+	_, found := s[o]
+	return found
+}
+
+// privilegedObjects returns the objects matching the privileged query along with all their direct and nested members
+func privilegedObjects(ao *engine.Objects) (reportObjectSet, error) {
+	filter, err := query.ParseLDAPQueryStrict(reportPrivilegedQuery, ao)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing privileged query: %v", err)
+	}
+
+	result := make(reportObjectSet)
+	var pending []*engine.Object
+	query.Execute(filter, ao).Iterate(func(o *engine.Object) bool {
+		result[o] = struct{}{}
+		pending = append(pending, o)
+		return true
+	})
+	for len(pending) > 0 {
+		group := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		group.Edges(engine.In).Range(func(member *engine.Object, eb engine.EdgeBitmap) bool {
+			if eb.IsSet(activedirectory.EdgeMemberOfGroup) && !result.Contains(member) {
+				result[member] = struct{}{}
+				pending = append(pending, member)
+			}
+			return true
+		})
+	}
+	return result, nil
+}
+
+// unprivilegedFilter leaves out privileged objects, so attack paths start from someone who isn't supposed to get there
+type unprivilegedFilter struct {
+	query.NodeFilter
+	privileged reportObjectSet
+}
+
+func (f unprivilegedFilter) Evaluate(o *engine.Object) bool {
+	return !f.privileged.Contains(o) && f.NodeFilter.Evaluate(o)
+}
+
+// reportAnalysis analyzes who can reach the targets. With exposed set, reaching objects that aren't privileged are listed as exposed.
+func reportAnalysis(ao *engine.Objects, targetquery string, privileged reportObjectSet, exposed bool, opts ReportOptions) (ReportAnalysis, error) {
+	result := ReportAnalysis{
+		Query: targetquery,
+	}
+
+	analysisopts, err := ParseAnalyzeObjectsOptions(map[string]string{"query": targetquery}, ao)
+	if err != nil {
+		return result, err
+	}
+	analysisopts.MinEdgeProbability = 1
+	analysis := AnalyzeObjects(analysisopts)
+	pg := analysis.Graph
+	result.Nodes = pg.Order()
+	result.Edges = pg.Size()
+
+	reaching := make(map[string]int)
+	for node, data := range pg.Nodes() {
+		if _, istarget := data["target"]; istarget {
+			result.Targets++
+			continue
+		}
+		result.Reachable++
+		reaching[node.Type().String()]++
+		if exposed && !privileged.Contains(node) && (node.Type() == engine.ObjectTypeUser || node.Type() == engine.ObjectTypeComputer || node.Type() == engine.ObjectTypeGroup) {
+			result.Exposed = append(result.Exposed, node)
+		}
+	}
+	for name, count := range reaching {
+		result.Reaching = append(result.Reaching, ReportCount{Name: name, Count: count})
+	}
+	sortReportCounts(result.Reaching)
+	slices.SortFunc(result.Exposed, func(a, b *engine.Object) int {
+		return strings.Compare(displayLabel(a), displayLabel(b))
+	})
+
+	result.Graph = reportGraphSVG(pg, opts.GraphNodes)
+
+	result.Chokepoints = GraphChokepoints(pg, false)
+	result.Chokepoints.Limit(10)
+
+	pathopts := NewPathOptions()
+	pathopts.Objects = ao
+	pathopts.K = opts.Paths
+	attackers, err := query.ParseLDAPQueryStrict(reportAttackerQuery, ao)
+	if err != nil {
+		return result, err
+	}
+	pathopts.SourceFilter = unprivilegedFilter{NodeFilter: attackers, privileged: privileged}
+	if pathopts.TargetFilter, err = query.ParseLDAPQueryStrict(targetquery, ao); err != nil {
+		return result, err
+	}
+	if opts.Paths > 0 {
+		result.Paths = FindPaths(pathopts)
+	}
+
+	return result, nil
+}
+
+func accountStatistics(ao *engine.Objects, privileged reportObjectSet, opts ReportOptions) ([]AccountStatistics, []ReportAccount, []ReportAccount) {
+	users := AccountStatistics{Type: "Users"}
+	computers := AccountStatistics{Type: "Computers"}
+	var privilegedaccounts, staleaccounts []ReportAccount
+
+	now := time.Now()
+	staleafter := now.AddDate(0, 0, -opts.StaleDays)
+	oldpassword := now.AddDate(-1, 0, 0)
+
+	ao.Iterate(func(o *engine.Object) bool {
+		var stats *AccountStatistics
+		switch o.Type() {
+		case engine.ObjectTypeUser:
+			stats = &users
+		case engine.ObjectTypeComputer:
+			stats = &computers
+		default:
+			return true
+		}
+
+		account := ReportAccount{
+			Object: o,
+		}
+		uac, hasuac := o.AttrInt(activedirectory.UserAccountControl)
+		account.Enabled = !o.HasTag("account_disabled") && (!hasuac || uac&engine.UAC_ACCOUNTDISABLE == 0)
+		account.LastLogon, _ = o.AttrTime(activedirectory.LastLogonTimestamp)
+		if lastlogon, found := o.AttrTime(activedirectory.LastLogon); found && lastlogon.After(account.LastLogon) {
+			account.LastLogon = lastlogon
+		}
+		account.PasswordLastSet, _ = o.AttrTime(activedirectory.PwdLastSet)
+
+		stats.Total++
+		if !account.Enabled {
+			return true
+		}
+		stats.Enabled++
+
+		stale := account.LastLogon.Before(staleafter)
+		if account.LastLogon.IsZero() {
+			stats.NeverLoggedOn++
+			account.Flags = append(account.Flags, "never logged on")
+		} else if stale {
+			account.Flags = append(account.Flags, "stale")
+		}
+		if stale {
+			stats.Stale++
+		}
+		if uac&engine.UAC_DONT_EXPIRE_PASSWORD != 0 {
+			stats.PasswordNeverExpires++
+			account.Flags = append(account.Flags, "password never expires")
+		}
+		if uac&engine.UAC_PASSWD_NOTREQD != 0 {
+			stats.PasswordNotRequired++
+			account.Flags = append(account.Flags, "password not required")
+		}
+		if !account.PasswordLastSet.IsZero() && account.PasswordLastSet.Before(oldpassword) {
+			stats.OldPassword++
+			account.Flags = append(account.Flags, "old password")
+		}
+
+		if privileged.Contains(o) {
+			stats.Privileged++
+			privilegedaccounts = append(privilegedaccounts, account)
+			if stale {
+				stats.PrivilegedStale++
+			}
+		}
+		if stale {
+			staleaccounts = append(staleaccounts, account)
+		}
+		return true
+	})
+
+	// Oldest logons first, as those are the most likely to be forgotten
+	for _, accounts := range [][]ReportAccount{privilegedaccounts, staleaccounts} {
+		slices.SortFunc(accounts, func(a, b ReportAccount) int {
+			if c := a.LastLogon.Compare(b.LastLogon); c != 0 {
+				return c
+			}
+			return strings.Compare(displayLabel(a.Object), displayLabel(b.Object))
+		})
+	}
+
+	return []AccountStatistics{users, computers}, privilegedaccounts, staleaccounts
+}
+
+func sortReportCounts(counts []ReportCount) {
+	slices.SortFunc(counts, func(a, b ReportCount) int {
+		if a.Count != b.Count {
+			return b.Count - a.Count
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"label": displayLabel,
+	"type": func(o *engine.Object) string {
+		return o.Type().String()
+	},
+	"attr": func(o *engine.Object, name string) string {
+		return o.OneAttrString(engine.LookupAttribute(name))
+	},
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format("2006-01-02")
+	},
+	"edges": func(eb engine.EdgeBitmap) string {
+		return eb.JoinedString()
+	},
+	"percent": func(p float64) string {
+		return fmt.Sprintf("%.0f%%", p*100)
+	},
+	"join": strings.Join,
+	"bars": reportBarsSVG,
+	"limit": func(n, limit int) bool {
+		return limit > 0 && n >= limit
+	},
+	"add": func(a, b int) int {
+		return a + b
+	},
+	"sub": func(a, b int) int {
+		return a - b
+	},
+	"accounts": func(accounts []ReportAccount, limit int) reportAccountTable {
+		table := reportAccountTable{Accounts: accounts, Total: len(accounts)}
+		if limit > 0 && len(accounts) > limit {
+			table.Accounts = accounts[:limit]
+			table.Truncated = true
+		}
+		return table
+	},
+}).Parse(reportTemplateText))
+
+// WriteReportHTML writes the report as a single HTML file with all styles and graphics inline
+func WriteReportHTML(w io.Writer, report Report) error {
+	return reportTemplate.Execute(w, report)
+}
+
+// Keeps the layout of a graph drawn in the report
+type reportGraphNode struct {
+	object *engine.Object
+	layer  int
+	row    int
+	target bool
+}
+
+// reportGraphSVG draws an analysis graph in layers by distance to the targets, with the targets to the right.
+// Only the maxnodes objects closest to the targets are drawn.
+func reportGraphSVG(pg graph.Graph[*engine.Object, engine.EdgeBitmap], maxnodes int) template.HTML {
+	if pg.Order() == 0 {
+		return ""
+	}
+
+	// Breadth first from the targets along incoming edges, so every node gets its shortest distance
+	predecessors := pg.PredecessorMap()
+	placed := make(map[*engine.Object]*reportGraphNode)
+	var queue []*engine.Object
+	for node, data := range pg.Nodes() {
+		if _, istarget := data["target"]; istarget {
+			placed[node] = &reportGraphNode{object: node, target: true}
+			queue = append(queue, node)
+		}
+	}
+	slices.SortFunc(queue, func(a, b *engine.Object) int {
+		return strings.Compare(displayLabel(a), displayLabel(b))
+	})
+	for i := 0; i < len(queue) && (maxnodes <= 0 || len(placed) < maxnodes); i++ {
+		current := placed[queue[i]]
+		for _, predecessor := range predecessors[queue[i]] {
+			if _, found := placed[predecessor]; found {
+				continue
+			}
+			placed[predecessor] = &reportGraphNode{object: predecessor, layer: current.layer + 1}
+			queue = append(queue, predecessor)
+			if maxnodes > 0 && len(placed) >= maxnodes {
+				break
+			}
+		}
+	}
+
+	var layers [][]*reportGraphNode
+	for _, o := range queue {
+		if node, found := placed[o]; found {
+			for len(layers) <= node.layer {
+				layers = append(layers, nil)
+			}
+			node.row = len(layers[node.layer])
+			layers[node.layer] = append(layers[node.layer], node)
+		}
+	}
+
+	const columnwidth, rowheight, margin = 220, 34, 20
+	var maxrows int
+	for _, layer := range layers {
+		maxrows = max(maxrows, len(layer))
+	}
+	width := len(layers)*columnwidth + 2*margin
+	height := maxrows*rowheight + 2*margin
+	position := func(node *reportGraphNode) (int, int) {
+		// Center each layer vertically, and put the targets in the rightmost column
+		offset := (maxrows - len(layers[node.layer])) * rowheight / 2
+		return margin + (len(layers)-1-node.layer)*columnwidth + columnwidth/2, margin + offset + node.row*rowheight + rowheight/2
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" class="graph" viewBox="0 0 %d %d" width="%d" height="%d">`, width, height, width, height)
+	sb.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto-start-reverse"><path d="M 0 0 L 10 5 L 0 10 z" fill="#888"/></marker></defs>`)
+
+	pg.IterateEdges(func(source, target *engine.Object, eb engine.EdgeBitmap) bool {
+		from, sfound := placed[source]
+		to, tfound := placed[target]
+		if !sfound || !tfound {
+			return true
+		}
+		x1, y1 := position(from)
+		x2, y2 := position(to)
+		fmt.Fprintf(&sb, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#888" stroke-width="1" marker-end="url(#arrow)"><title>%s</title></line>`,
+			x1+6, y1, x2-6, y2, template.HTMLEscapeString(eb.JoinedString()))
+		return true
+	})
+
+	for _, o := range queue {
+		node, found := placed[o]
+		if !found {
+			continue
+		}
+		x, y := position(node)
+		color := reportTypeColor(o.Type())
+		if node.target {
+			color = "#c0392b"
+		}
+		label := o.Label()
+		if len([]rune(label)) > 28 {
+			label = string([]rune(label)[:27]) + "…"
+		}
+		fmt.Fprintf(&sb, `<g><title>%s (%s)</title><circle cx="%d" cy="%d" r="6" fill="%s"/><text x="%d" y="%d" text-anchor="middle" font-size="10">%s</text></g>`,
+			template.HTMLEscapeString(displayLabel(o)), template.HTMLEscapeString(o.Type().String()), x, y, color, x, y-9, template.HTMLEscapeString(label))
+	}
+	sb.WriteString(`</svg>`)
+
+	if maxnodes > 0 && pg.Order() > len(placed) {
+		fmt.Fprintf(&sb, `<p class="note">Showing the %d objects closest to the targets out of %d.</p>`, len(placed), pg.Order())
+	}
+	return template.HTML(sb.String())
+}
+
+func reportTypeColor(ot engine.ObjectType) string {
+	switch ot {
+	case engine.ObjectTypeUser:
+		return "#2e86c1"
+	case engine.ObjectTypeGroup:
+		return "#f39c12"
+	case engine.ObjectTypeComputer, engine.ObjectTypeMachine:
+		return "#27ae60"
+	default:
+		return "#7f8c8d"
+	}
+}
+
+// reportBarsSVG draws a horizontal bar chart of the counts
+func reportBarsSVG(counts []ReportCount) template.HTML {
+	if len(counts) == 0 {
+		return ""
+	}
+	var highest int
+	for _, count := range counts {
+		highest = max(highest, count.Count)
+	}
+
+	const labelwidth, barwidth, rowheight = 200, 400, 20
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" class="bars" width="%d" height="%d">`, labelwidth+barwidth+80, len(counts)*rowheight)
+	for i, count := range counts {
+		y := i * rowheight
+		width := 1
+		if highest > 0 {
+			width = max(1, count.Count*barwidth/highest)
+		}
+		fmt.Fprintf(&sb, `<text x="%d" y="%d" text-anchor="end" font-size="12">%s</text><rect x="%d" y="%d" width="%d" height="%d" fill="#2e86c1"/><text x="%d" y="%d" font-size="12">%d</text>`,
+			labelwidth-6, y+14, template.HTMLEscapeString(count.Name), labelwidth, y+3, width, rowheight-6, labelwidth+width+6, y+14, count.Count)
+	}
+	sb.WriteString(`</svg>`)
+	return template.HTML(sb.String())
+}
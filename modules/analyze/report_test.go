@@ -0,0 +1,67 @@
+package analyze
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/risk"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+func TestBuildReport(t *testing.T) {
+	sid := func(s string) engine.AttributeValue {
+		parsed, err := windowssecurity.ParseStringSID(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return engine.AttributeValueSID(parsed)
+	}
+
+	ao := engine.NewObjects()
+	admins := engine.NewObject(engine.Name, engine.AttributeValueString("Domain Admins"), engine.Type, engine.AttributeValueString("Group"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3-512"))
+	admin := engine.NewObject(engine.Name, engine.AttributeValueString("admin"), engine.Type, engine.AttributeValueString("Person"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3-1000"))
+	helpdesk := engine.NewObject(engine.Name, engine.AttributeValueString("helpdesk"), engine.Type, engine.AttributeValueString("Person"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3-1001"))
+	domain := engine.NewObject(engine.Name, engine.AttributeValueString("corp.local"), engine.Type, engine.AttributeValueString("DomainDNS"), activedirectory.ObjectSid, sid("S-1-5-21-1-2-3"))
+	ao.Add(admins, admin, helpdesk, domain)
+	admin.EdgeTo(admins, activedirectory.EdgeMemberOfGroup)
+	helpdesk.EdgeTo(admin, activedirectory.EdgeWriteDACL)
+	admins.EdgeTo(domain, activedirectory.EdgeDSReplicationGetChangesAll)
+	if err := risk.ComputeScores(ao); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := BuildReport(ao, NewReportOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Admins.Targets != 1 || report.Admins.Reachable != 2 {
+		t.Errorf("Expected 1 target reachable by 2 objects, got %v and %v", report.Admins.Targets, report.Admins.Reachable)
+	}
+	// The admin is privileged through group membership, the helpdesk account is exposure
+	if len(report.Tier0.Exposed) != 1 || report.Tier0.Exposed[0] != helpdesk {
+		t.Errorf("Expected helpdesk to be exposed, got %v", report.Tier0.Exposed)
+	}
+	if len(report.Admins.Paths) != 1 || len(report.Admins.Paths[0].Steps) != 2 {
+		t.Errorf("Expected one path of two steps, got %+v", report.Admins.Paths)
+	}
+	if len(report.Privileged) != 1 || report.Privileged[0].Object != admin {
+		t.Errorf("Expected admin to be the only privileged account, got %+v", report.Privileged)
+	}
+	if len(report.Risky) != 1 || report.Risky[0] != helpdesk {
+		t.Errorf("Expected helpdesk as the only risky principal, got %v", report.Risky)
+	}
+	if len(report.DCsync) != 1 || report.DCsync[0].Object != admins {
+		t.Errorf("Expected Domain Admins to be able to DCsync, got %+v", report.DCsync)
+	}
+
+	var sb strings.Builder
+	if err = WriteReportHTML(&sb, report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sb.String(), "<svg") || !strings.Contains(sb.String(), "helpdesk") {
+		t.Error("Report is missing the graph or the exposed account")
+	}
+}
@@ -0,0 +1,233 @@
+package analyze
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"gopkg.in/yaml.v3"
+)
+
+// Saved queries are kept in this file in the datapath, so they follow the data they were made for
+const SavedQueriesFile = "savedqueries.json"
+
+// SavedQuery is a named analysis. The queries can contain {placeholders} which are filled in when it is run.
+type SavedQuery struct {
+	Name               string            `json:"name" yaml:"name"`
+	Description        string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Defaults           map[string]string `json:"defaults,omitempty" yaml:"defaults,omitempty" doc:"Values used for placeholders that are not given when running the query"`
+	APIAnalysisRequest `yaml:",inline"`
+}
+
+var placeholderRegexp = regexp.MustCompile(`\{([A-Za-z][A-Za-z0-9_]*)\}`)
+
+// Placeholders returns the names of all {placeholders} in the queries, in order of appearance
+func (sq SavedQuery) Placeholders() []string {
+	var result []string
+	for _, text := range []string{sq.Query, sq.MiddleQuery, sq.EndQuery} {
+		for _, match := range placeholderRegexp.FindAllStringSubmatch(text, -1) {
+			if !slices.Contains(result, match[1]) {
+				result = append(result, match[1])
+			}
+		}
+	}
+	return result
+}
+
+// Resolve returns the analysis with placeholders replaced by the given values or the defaults.
+// Values are escaped, so they can't change the structure of the query or turn into wildcards.
+// Values that look like a regular expression are rejected, as the query parser has no way to escape them.
+func (sq SavedQuery) Resolve(values map[string]string) (APIAnalysisRequest, error) {
+	var missing, invalid []string
+	replace := func(text string) string {
+		return placeholderRegexp.ReplaceAllStringFunc(text, func(placeholder string) string {
+			name := placeholder[1 : len(placeholder)-1]
+			value, found := values[name]
+			if !found {
+				value, found = sq.Defaults[name]
+			}
+			if !found {
+				if !slices.Contains(missing, name) {
+					missing = append(missing, name)
+				}
+				return placeholder
+			}
+			escaped, ok := escapeQueryValue(value)
+			if !ok && !slices.Contains(invalid, name) {
+				invalid = append(invalid, name)
+			}
+			return escaped
+		})
+	}
+
+	r := sq.APIAnalysisRequest
+	r.Query = replace(r.Query)
+	r.MiddleQuery = replace(r.MiddleQuery)
+	r.EndQuery = replace(r.EndQuery)
+	if len(missing) > 0 {
+		return r, fmt.Errorf("Missing value for %v", strings.Join(missing, ", "))
+	}
+	if len(invalid) > 0 {
+		return r, fmt.Errorf("Value for %v can't start and end with /", strings.Join(invalid, ", "))
+	}
+	return r, nil
+}
+
+var (
+	// Characters the LDAP query parser treats specially inside a value
+	queryValueEscaper = strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`)
+	// Values with * or ? are glob patterns, where these must be escaped to match literally
+	globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`, `{`, `\{`, `}`, `\}`)
+)
+
+// escapeQueryValue makes a value match literally, returning false for values the parser would take as a regular expression
+func escapeQueryValue(value string) (string, bool) {
+	if len(value) >= 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+		return value, false
+	}
+	if strings.ContainsAny(value, "*?") {
+		value = globEscaper.Replace(value)
+	}
+	return queryValueEscaper.Replace(value), true
+}
+
+// savedQueries holds the saved queries, and writes them to a file on every change if it has one
+type savedQueries struct {
+	lock    sync.Mutex
+	path    string
+	queries map[string]SavedQuery
+}
+
+func newSavedQueries() *savedQueries {
+	return &savedQueries{
+		queries: make(map[string]SavedQuery),
+	}
+}
+
+// Open loads the saved queries from a file, which is created on the first change if it doesn't exist
+func (sqs *savedQueries) Open(path string) error {
+	sqs.lock.Lock()
+	defer sqs.lock.Unlock()
+	sqs.path = path
+	sqs.queries = make(map[string]SavedQuery)
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var queries []SavedQuery
+	if err = json.Unmarshal(raw, &queries); err != nil {
+		return fmt.Errorf("Problem reading saved queries from %v: %v", path, err)
+	}
+	for _, sq := range queries {
+		sqs.queries[sq.Name] = sq
+	}
+	ui.Debug().Msgf("Loaded %v saved queries from %v", len(queries), path)
+	return nil
+}
+
+// Must be called with the lock held
+func (sqs *savedQueries) save() error {
+	if sqs.path == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(sqs.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write and rename, so a crash can't leave a truncated file behind
+	temp := sqs.path + ".tmp"
+	if err = os.WriteFile(temp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, sqs.path)
+}
+
+// Must be called with the lock held
+func (sqs *savedQueries) list() []SavedQuery {
+	result := make([]SavedQuery, 0, len(sqs.queries))
+	for _, sq := range sqs.queries {
+		result = append(result, sq)
+	}
+	slices.SortFunc(result, func(a, b SavedQuery) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+	return result
+}
+
+func (sqs *savedQueries) List() []SavedQuery {
+	sqs.lock.Lock()
+	defer sqs.lock.Unlock()
+	return sqs.list()
+}
+
+func (sqs *savedQueries) Get(name string) (SavedQuery, bool) {
+	sqs.lock.Lock()
+	defer sqs.lock.Unlock()
+	sq, found := sqs.queries[name]
+	return sq, found
+}
+
+// Put adds or replaces saved queries by name
+func (sqs *savedQueries) Put(queries ...SavedQuery) error {
+	for _, sq := range queries {
+		if strings.TrimSpace(sq.Name) == "" {
+			return errors.New("Saved query has no name")
+		}
+		if sq.Query == "" {
+			return fmt.Errorf("Saved query %v has no start query", sq.Name)
+		}
+	}
+
+	sqs.lock.Lock()
+	defer sqs.lock.Unlock()
+	for _, sq := range queries {
+		sqs.queries[sq.Name] = sq
+	}
+	return sqs.save()
+}
+
+func (sqs *savedQueries) Delete(name string) (bool, error) {
+	sqs.lock.Lock()
+	defer sqs.lock.Unlock()
+	if _, found := sqs.queries[name]; !found {
+		return false, nil
+	}
+	delete(sqs.queries, name)
+	return true, sqs.save()
+}
+
+// ReadSavedQueriesYAML reads a list of saved queries. Missing analysis options get the same defaults as the API uses.
+func ReadSavedQueriesYAML(r io.Reader) ([]SavedQuery, error) {
+	var raw []yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&raw); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Problem parsing saved queries: %v", err)
+	}
+	queries := make([]SavedQuery, len(raw))
+	for i := range raw {
+		queries[i].APIAnalysisRequest = NewAPIAnalysisRequest()
+		if err := raw[i].Decode(&queries[i]); err != nil {
+			return nil, fmt.Errorf("Problem parsing saved query %v: %v", i+1, err)
+		}
+	}
+	return queries, nil
+}
+
+func WriteSavedQueriesYAML(w io.Writer, queries []SavedQuery) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(queries); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,138 @@
+package analyze
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/query"
+)
+
+func TestSavedQueryResolve(t *testing.T) {
+	sq := SavedQuery{
+		Name:     "Members",
+		Defaults: map[string]string{"domain": "contoso.local"},
+		APIAnalysisRequest: APIAnalysisRequest{
+			Query:    "(&(name={group})(dnsRoot={domain}))",
+			EndQuery: "(name={group})",
+		},
+	}
+
+	if placeholders := sq.Placeholders(); !slices.Equal(placeholders, []string{"group", "domain"}) {
+		t.Errorf("Placeholders are %v", placeholders)
+	}
+
+	if _, err := sq.Resolve(nil); err == nil || !strings.Contains(err.Error(), "group") {
+		t.Errorf("Expected missing group error, got %v", err)
+	}
+
+	r, err := sq.Resolve(map[string]string{"group": "Domain Admins (old)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Query != `(&(name=Domain Admins \(old\))(dnsRoot=contoso.local))` {
+		t.Errorf("Unexpected query %v", r.Query)
+	}
+	if r.EndQuery != `(name=Domain Admins \(old\))` {
+		t.Errorf("Unexpected end query %v", r.EndQuery)
+	}
+
+	// Wildcards in values match literally
+	ao := engine.NewObjects()
+	literal := engine.NewObject(engine.Name, engine.AttributeValueString(`Sales* [EU] \ ops?`))
+	ao.Add(literal, engine.NewObject(engine.Name, engine.AttributeValueString(`Sales team [EU] \ ops!`)))
+	if r, err = sq.Resolve(map[string]string{"group": `sales* [eu] \ ops?`}); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := query.ParseLDAPQueryStrict(r.EndQuery, ao)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches := query.Execute(filter, ao).AsSlice(); matches.Len() != 1 || matches.First() != literal {
+		t.Errorf("Expected only the literal name to match %v, got %v objects", r.EndQuery, matches.Len())
+	}
+
+	if _, err = sq.Resolve(map[string]string{"group": "/.*/"}); err == nil {
+		t.Error("Expected regular expression value to be rejected")
+	}
+}
+
+func TestSavedQueriesStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SavedQueriesFile)
+
+	sqs := newSavedQueries()
+	if err := sqs.Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := ReadSavedQueriesYAML(strings.NewReader(`
+- name: Kerberoastable
+  query: (&(type=Person)(servicePrincipalName=*))
+  maxDepth: 3
+  edgesFirst: [MemberOfGroup]
+- name: Admins of {domain}
+  description: Who can reach the domain admins
+  query: (&(type=Group)(name=Domain Admins)(dnsRoot={domain}))
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 2 || queries[0].MaxDepth != 3 || queries[1].MaxDepth != -1 || queries[1].MaxOutgoing != -1 {
+		t.Fatalf("Unexpected queries %+v", queries)
+	}
+	if err = sqs.Put(queries...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen from disk
+	sqs = newSavedQueries()
+	if err = sqs.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	sq, found := sqs.Get("Kerberoastable")
+	if !found || !slices.Equal(sq.EdgesFirst, []string{"MemberOfGroup"}) {
+		t.Fatalf("Saved query not restored: %+v", sq)
+	}
+
+	var buf bytes.Buffer
+	if err = WriteSavedQueriesYAML(&buf, sqs.List()); err != nil {
+		t.Fatal(err)
+	}
+	roundtrip, err := ReadSavedQueriesYAML(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roundtrip) != 2 || roundtrip[0].Name != "Admins of {domain}" || roundtrip[0].Description == "" {
+		t.Errorf("Unexpected YAML round trip %+v", roundtrip)
+	}
+
+	if deleted, err := sqs.Delete("Kerberoastable"); !deleted || err != nil {
+		t.Errorf("Delete failed: %v %v", deleted, err)
+	}
+	if len(sqs.List()) != 1 {
+		t.Errorf("Expected one query left")
+	}
+}
+
+func TestAnalysisRequestFromParams(t *testing.T) {
+	params := map[string]string{
+		"query":                 "(name=x)",
+		"mode":                  "reverse",
+		"maxdepth":              "5",
+		"maxoutgoing":           "50",
+		"prune":                 "on",
+		"pwn_ACLContainsDeny_f": "on",
+		"pwn_AddMember_f":       "on",
+		"type_Group_l":          "on",
+	}
+	r := apiAnalysisRequestFromParams(params)
+	if r.Query != "(name=x)" || !r.Reverse || r.MaxDepth != 5 || r.MaxOutgoing != 50 || !r.Prune {
+		t.Errorf("Unexpected request %+v", r)
+	}
+	if !slices.Equal(r.EdgesFirst, []string{"ACLContainsDeny", "AddMember"}) || !slices.Equal(r.TypesLast, []string{"Group"}) || len(r.EdgesMiddle) != 0 {
+		t.Errorf("Unexpected edges or types %+v", r)
+	}
+}
@@ -1,11 +1,15 @@
 package analyze
 
 import (
+	"crypto/tls"
 	"embed"
 	"io"
 	"io/fs"
+	"net"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -54,6 +58,18 @@ type webservice struct {
 	UnionFS
 	Objs *engine.Objects
 	srv  *http.Server
+	jobs *jobManager
+
+	ready chan struct{} // Closed when post-processing of the loaded objects has finished
+
+	SavedQueries *savedQueries // Named analyses, kept in the datapath when started from the command line
+	RulesFile    string        // Custom findings rules, evaluated along with the built-in ones once post-processing is done
+
+	findingslock sync.Mutex
+	findings     APIFindings
+
+	Auth      Authenticator // Users and tokens allowed to connect, everyone is admin if empty
+	TLSConfig *tls.Config   // Serve HTTPS with these certificates if set
 
 	AdditionalHeaders []string // Additional things to add to the main page
 }
@@ -62,6 +78,10 @@ func NewWebservice() *webservice {
 	ws := &webservice{
 		quit:   make(chan bool),
 		Router: gin.New(),
+		jobs:   newJobManager(),
+		ready:  make(chan struct{}),
+
+		SavedQueries: newSavedQueries(),
 	}
 
 	gin.SetMode(gin.ReleaseMode)
@@ -81,12 +101,14 @@ func NewWebservice() *webservice {
 		logger.Msgf("%s %s (%v) %v, %v bytes", c.Request.Method, path, c.Writer.Status(), time.Since(start), c.Writer.Size())
 	})
 	ws.Router.Use(gin.Recovery()) // adds the default recovery middleware
+	ws.Router.Use(ws.Auth.Middleware)
 
 	htmlFs, _ := fs.Sub(embeddedassets, "html")
 	ws.AddFS(http.FS(htmlFs))
 
 	// Add stock functions
 	analysisfuncs(ws)
+	apiv1funcs(ws)
 
 	// Add debug functions
 	if ui.GetLoglevel() >= ui.LevelDebug {
@@ -96,6 +118,51 @@ func NewWebservice() *webservice {
 	return ws
 }
 
+func (w *webservice) evaluateFindings() {
+	result := APIFindings{
+		Ready:    true,
+		Findings: []APIFinding{},
+	}
+
+	rules, err := LoadRules(w.RulesFile)
+	if err != nil {
+		ui.Error().Msgf("Problem loading findings rules: %v", err)
+		result.Errors = append(result.Errors, err.Error())
+	} else {
+		result.Rules = len(rules)
+		findings, err := EvaluateRules(rules, w.Objs)
+		if err != nil {
+			ui.Error().Msgf("%v", err)
+			result.Errors = append(result.Errors, strings.Split(err.Error(), "\n")...)
+		}
+		for _, finding := range findings {
+			result.Findings = append(result.Findings, newAPIFinding(finding))
+		}
+		ui.Info().Msgf("%v of %v findings rules matched", len(findings), len(rules))
+	}
+
+	w.findingslock.Lock()
+	w.findings = result
+	w.findingslock.Unlock()
+}
+
+// Findings returns the result of evaluating the findings rules, which is not ready until post-processing has finished
+func (w *webservice) Findings() APIFindings {
+	w.findingslock.Lock()
+	defer w.findingslock.Unlock()
+	return w.findings
+}
+
+// Ready returns true once post-processing has finished and the loaded data is final
+func (w *webservice) Ready() bool {
+	select {
+	case <-w.ready:
+		return true
+	default:
+		return false
+	}
+}
+
 func (w *webservice) QuitChan() <-chan bool {
 	return w.quit
 }
@@ -103,12 +170,26 @@ func (w *webservice) QuitChan() <-chan bool {
 func (w *webservice) Start(bind string, objs *engine.Objects, localhtml []string) error {
 	w.Objs = objs
 
+	go func() {
+		objs.WaitForPostProcessing()
+		ui.Info().Msg("Post-processing done, all analysis results are final")
+		close(w.ready)
+		w.evaluateFindings()
+	}()
+
 	// Profiling
-	pprof.Register(w.Router)
+	pprof.RouteRegister(w.Router.Group("", requireAdmin))
 
 	w.srv = &http.Server{
-		Addr:    bind,
-		Handler: w.Router,
+		Addr:      bind,
+		Handler:   w.Router,
+		TLSConfig: w.TLSConfig,
+	}
+
+	if w.Auth.Enabled() && w.TLSConfig == nil {
+		if host, _, _ := net.SplitHostPort(bind); host != "127.0.0.1" && host != "localhost" && host != "::1" {
+			ui.Warn().Msgf("Authentication is enabled without TLS, credentials will be sent unencrypted")
+		}
 	}
 
 	if len(localhtml) != 0 {
@@ -147,16 +228,31 @@ func (w *webservice) Start(bind string, objs *engine.Objects, localhtml []string
 	// w.Router.StaticFS("/", http.FS(w.UnionFS))
 
 	go func() {
-		if err := w.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if w.TLSConfig != nil {
+			err = w.srv.ListenAndServeTLS("", "")
+		} else {
+			err = w.srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			ui.Fatal().Msgf("Problem launching webservice listener: %s", err)
 		}
 	}()
 
-	ui.Info().Msgf("Listening - navigate to http://%v/ ... (ctrl-c or similar to quit)", bind)
+	ui.Info().Msgf("Listening - navigate to %v ... (ctrl-c or similar to quit)", w.URL(bind))
 
 	return nil
 }
 
+// URL returns the address users should point their browser at
+func (w *webservice) URL(bind string) string {
+	scheme := "http"
+	if w.TLSConfig != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + bind + "/"
+}
+
 func (w *webservice) ServeTemplate(c *gin.Context, path string, data any) {
 	templatefile, err := w.UnionFS.Open(path)
 	if err != nil {
@@ -3,6 +3,7 @@ package analyze
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"slices"
 	"sort"
 	"strconv"
@@ -13,12 +14,11 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/lkarlslund/adalanche/modules/engine"
-	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/graph"
 	"github.com/lkarlslund/adalanche/modules/query"
 	"github.com/lkarlslund/adalanche/modules/ui"
 	"github.com/lkarlslund/adalanche/modules/util"
 	"github.com/lkarlslund/adalanche/modules/version"
-	"github.com/lkarlslund/adalanche/modules/windowssecurity"
 )
 
 func analysisfuncs(ws *webservice) {
@@ -36,6 +36,7 @@ func analysisfuncs(ws *webservice) {
 		type returnobject struct {
 			ObjectTypes []filterinfo `json:"objecttypes"`
 			Methods     []filterinfo `json:"methods"`
+			Attributes  []filterinfo `json:"attributes"`
 		}
 		var results returnobject
 
@@ -61,6 +62,20 @@ func analysisfuncs(ws *webservice) {
 			})
 		}
 
+		// Includes the attributes computed or added by analyzers, so they can be shown as columns
+		for _, attribute := range engine.Attributes() {
+			if attribute.IsHidden() {
+				continue
+			}
+			results.Attributes = append(results.Attributes, filterinfo{
+				Name:   attribute.String(),
+				Lookup: attribute.String(),
+			})
+		}
+		slices.SortFunc(results.Attributes, func(a, b filterinfo) int {
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		})
+
 		c.JSON(200, results)
 	})
 	// Checks a LDAP style query for input errors, and returns a hint to the user
@@ -79,32 +94,10 @@ func analysisfuncs(ws *webservice) {
 
 	// Returns JSON descruibing an object located by distinguishedName, sid or guid
 	ws.Router.GET("/details/:locateby/:id", func(c *gin.Context) {
-		var o *engine.Object
-		var found bool
-		switch strings.ToLower(c.Param("locateby")) {
-		case "id":
-			id, err := strconv.Atoi(c.Param("id"))
-			if err != nil {
-				c.String(500, err.Error())
-				return
-			}
-			o, found = ws.Objs.FindID(engine.ObjectID(id))
-		case "dn", "distinguishedname":
-			o, found = ws.Objs.Find(activedirectory.DistinguishedName, engine.AttributeValueString(c.Param("id")))
-		case "sid":
-			sid, err := windowssecurity.ParseStringSID(c.Param("id"))
-			if err != nil {
-				c.String(500, err.Error())
-				return
-			}
-			o, found = ws.Objs.Find(activedirectory.ObjectSid, engine.AttributeValueSID(sid))
-		case "guid":
-			u, err := uuid.FromString(c.Param("id"))
-			if err != nil {
-				c.String(500, err.Error())
-				return
-			}
-			o, found = ws.Objs.Find(activedirectory.ObjectGUID, engine.AttributeValueGUID(u))
+		o, found, err := locateObject(ws.Objs, c.Param("locateby"), c.Param("id"))
+		if err != nil {
+			c.String(500, err.Error())
+			return
 		}
 		if !found {
 			c.AbortWithStatus(404)
@@ -167,405 +160,223 @@ func analysisfuncs(ws *webservice) {
 			return
 		}
 
-		mode := params["mode"]
-		if mode == "" {
-			mode = "normal"
-		}
+		alldetails, _ := util.ParseBool(params["alldetails"])
+		// force, _ := util.ParseBool(vars["force"])
 
-		direction := engine.In
-		if mode != "normal" {
-			direction = engine.Out
+		opts, err := ParseAnalyzeObjectsOptions(params, ws.Objs)
+		if err != nil {
+			c.String(500, err.Error())
+			return
 		}
 
-		prune, _ := util.ParseBool(params["prune"])
+		results := AnalyzeObjects(opts)
 
-		startquerytext := params["query"]
-		if startquerytext == "" {
-			startquerytext = "(&(objectClass=group)(|(name=Domain Admins)(name=Enterprise Admins)))"
+		for _, postprocessor := range PostProcessors {
+			results.Graph = postprocessor(results.Graph)
 		}
 
-		middlequerytext := params["middlequery"]
-		endquerytext := params["endquery"]
-
-		maxdepth := -1
-		if maxdepthval, err := strconv.Atoi(params["maxdepth"]); err == nil {
-			maxdepth = maxdepthval
+		response, err := newAnalyzeGraphResponse(results, opts.Direction != engine.In, alldetails)
+		if err != nil {
+			c.String(500, "Error generating cytoscape graph: %v", err)
+			return
 		}
 
-		minprobability := 0
-		if minprobabilityval, err := strconv.Atoi(params["minprobability"]); err == nil {
-			minprobability = minprobabilityval
-		}
+		c.JSON(200, response)
+	})
 
-		minaccprobability := 0
-		if minaccprobabilityval, err := strconv.Atoi(params["minaccprobability"]); err == nil {
-			minaccprobability = minaccprobabilityval
+	// Same as /analyzegraph, but runs in the background as a job that can be followed and cancelled using the API
+	ws.Router.POST("/analyzegraph/job", func(c *gin.Context) {
+		params := make(map[string]string)
+		err := c.ShouldBindJSON(&params)
+		if err != nil {
+			c.String(500, err.Error())
+			return
 		}
 
-		// Maximum number of outgoing connections from one object in analysis
-		// If more are available you can right click the object and select EXPAND
-		maxoutgoing := -1
-		if maxoutgoingval, err := strconv.Atoi(params["maxoutgoing"]); err == nil {
-			maxoutgoing = maxoutgoingval
+		opts, err := ParseAnalyzeObjectsOptions(params, ws.Objs)
+		if err != nil {
+			c.String(500, err.Error())
+			return
 		}
 
-		alldetails, _ := util.ParseBool(params["alldetails"])
-		// force, _ := util.ParseBool(vars["force"])
-
-		backlinks, _ := strconv.Atoi(params["backlinks"])
-
-		nodelimit, _ := strconv.Atoi(params["nodelimit"])
-
-		dontexpandaueo, _ := util.ParseBool(params["dont-expand-au-eo"])
+		c.JSON(202, ws.jobs.Start(nil, opts))
+	})
 
-		opts := NewAnalyzeObjectsOptions()
+	// Saves the current analysis options from the web interface under a name
+	ws.Router.POST("/savequery", requireAdmin, func(c *gin.Context) {
+		params := make(map[string]string)
+		err := c.ShouldBindJSON(&params)
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
 
-		// tricky tricky - if we get a call with the expanddn set, then we handle things .... differently :-)
-		if expanddn := params["expanddn"]; expanddn != "" {
-			startquerytext = `(distinguishedName=` + expanddn + `)`
-			maxoutgoing = 0
-			maxdepth = 1
-			nodelimit = 1000
+		sq := SavedQuery{
+			Name:               c.Query("name"),
+			Description:        c.Query("description"),
+			APIAnalysisRequest: apiAnalysisRequestFromParams(params),
+		}
+		if err = ws.SavedQueries.Put(sq); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		c.JSON(200, sq)
+	})
 
-			// tricky this is - if we're expanding a node it's suddenly the target, so we need to reverse the mode
-			/*			if mode == "normal" {
-							mode = "reverse"
-						} else {
-							mode = "normal"
-						}*/
+	// Returns the result of a finished job in the same format as /analyzegraph
+	ws.Router.GET("/analyzegraph/job/:jobid", func(c *gin.Context) {
+		results, reversed, info, found := ws.jobs.Results(c.Param("jobid"))
+		if !found {
+			c.String(404, "Job not found")
+			return
+		}
+		if results == nil {
+			c.String(409, "Job is %v", info.Status)
+			return
 		}
 
-		opts.StartFilter, err = query.ParseLDAPQueryStrict(startquerytext, ws.Objs)
+		alldetails, _ := util.ParseBool(c.Query("alldetails"))
+		response, err := newAnalyzeGraphResponse(*results, reversed, alldetails)
 		if err != nil {
-			c.String(500, "Error parsing start query: %v", err)
+			c.String(500, "Error generating cytoscape graph: %v", err)
 			return
 		}
 
-		if middlequerytext != "" {
-			opts.MiddleFilter, err = query.ParseLDAPQueryStrict(middlequerytext, ws.Objs)
-			if err != nil {
-				c.String(500, "Error parsing middle query: %v", err)
-				return
-			}
-		}
+		c.JSON(200, response)
+	})
 
-		if endquerytext != "" {
-			opts.EndFilter, err = query.ParseLDAPQueryStrict(endquerytext, ws.Objs)
-			if err != nil {
-				c.String(500, "Error parsing end query: %v", err)
-				return
-			}
+	// Runs the same analysis as /analyzegraph, and returns the result as a downloadable graph file
+	ws.Router.POST("/export-graph", func(c *gin.Context) {
+		params := make(map[string]string)
+		err := c.ShouldBindJSON(&params)
+		if err != nil {
+			c.String(500, err.Error())
+			return
 		}
 
-		// var methods engine.EdgeBitmap
-		var edges_f, egdes_m, edges_l engine.EdgeBitmap
-		var objecttypes_f, objecttypes_m, objecttypes_l []engine.ObjectType
-		for potentialfilter := range c.Request.PostForm {
-			if len(potentialfilter) < 7 {
-				continue
-			}
-			if strings.HasPrefix(potentialfilter, "pwn_") {
-				prefix := potentialfilter[4 : len(potentialfilter)-2]
-				suffix := potentialfilter[len(potentialfilter)-2:]
-				edge := engine.LookupEdge(prefix)
-				if edge == engine.NonExistingEdge {
-					continue
-				}
-				switch suffix {
-				case "_f":
-					edges_f = edges_f.Set(edge)
-				case "_m":
-					egdes_m = egdes_m.Set(edge)
-				case "_l":
-					edges_l = edges_l.Set(edge)
-				}
-			} else if strings.HasPrefix(potentialfilter, "type_") {
-				prefix := potentialfilter[5 : len(potentialfilter)-2]
-				suffix := potentialfilter[len(potentialfilter)-2:]
-				ot, found := engine.ObjectTypeLookup(prefix)
-				if !found {
-					continue
-				}
-
-				switch suffix {
-				case "_f":
-					objecttypes_f = append(objecttypes_f, ot)
-				case "_m":
-					objecttypes_m = append(objecttypes_m, ot)
-				case "_l":
-					objecttypes_l = append(objecttypes_l, ot)
-				}
+		format := c.Query("format")
+		if format == "" {
+			format = "graphml"
+		}
+		graphformat, found := GraphFormats[format]
+		if !found {
+			c.String(400, "Unknown graph format %v, supported formats are %v", format, GraphFormatNames())
+			return
+		}
+		if alldetails, _ := util.ParseBool(params["alldetails"]); format == "cytoscapejs" && alldetails {
+			graphformat.Write = func(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error {
+				return WriteCytoscapeJS(pg, w, true)
 			}
+		}
 
+		opts, err := ParseAnalyzeObjectsOptions(params, ws.Objs)
+		if err != nil {
+			c.String(500, err.Error())
+			return
 		}
 
-		// Are we using the new format FML? The just choose the old format methods for FML
-		if edges_f.Count() == 0 && egdes_m.Count() == 0 && edges_l.Count() == 0 {
-			// Spread the choices to FML
-			edges_f = engine.AllEdgesBitmap
-			egdes_m = engine.AllEdgesBitmap
-			edges_l = engine.AllEdgesBitmap
-		}
-
-		opts.Objects = ws.Objs
-		opts.MethodsF = edges_f
-		opts.MethodsM = egdes_m
-		opts.MethodsL = edges_l
-		opts.ObjectTypesF = objecttypes_f
-		opts.ObjectTypesM = objecttypes_m
-		opts.ObjectTypesL = objecttypes_l
-		opts.Direction = direction
-		opts.MaxDepth = maxdepth
-		opts.MaxOutgoingConnections = maxoutgoing
-		opts.MinEdgeProbability = engine.Probability(minprobability)
-		opts.MinAccumulatedProbability = engine.Probability(minaccprobability)
-		opts.PruneIslands = prune
-		opts.Backlinks = backlinks
-		opts.NodeLimit = nodelimit
-		opts.DontExpandAUEO = dontexpandaueo
 		results := AnalyzeObjects(opts)
-
 		for _, postprocessor := range PostProcessors {
 			results.Graph = postprocessor(results.Graph)
 		}
-		var targets int
-
-		var objecttypes [256]int
 
-		for node := range results.Graph.Nodes() {
-			if results.Graph.GetNodeData(node, "target") == true {
-				targets++
-				continue
-			}
-			objecttypes[node.Type()]++
+		c.Header("Content-Type", graphformat.ContentType)
+		c.Header("Content-Disposition", "attachment; filename=adalanche-analysis"+graphformat.Extension)
+		c.Status(200)
+		err = graphformat.Write(results.Graph, c.Writer)
+		if err != nil {
+			ui.Error().Msgf("Problem writing %v export: %v", format, err)
 		}
+	})
 
-		resulttypes := make(map[string]int)
-		for i := 0; i < 256; i++ {
-			if objecttypes[i] > 0 {
-				resulttypes[engine.ObjectType(i).String()] = objecttypes[i]
-			}
+	ws.Router.POST("/paths", func(c *gin.Context) {
+		params := make(map[string]string)
+		err := c.ShouldBindJSON(&params)
+		if err != nil {
+			c.String(500, err.Error())
+			return
 		}
 
-		cytograph, err := GenerateCytoscapeJS(results.Graph, alldetails)
+		opts, err := ParsePathOptions(params, ws.Objs)
 		if err != nil {
-			c.String(500, "Error generating cytoscape graph: %v", err)
+			c.JSON(400, gin.H{"error": err.Error()})
 			return
 		}
 
-		response := struct {
-			Reversed bool `json:"reversed"`
-
-			ResultTypes map[string]int `json:"resulttypes"`
+		paths := FindPaths(opts)
 
-			Targets int `json:"targets"`
-			Total   int `json:"total"`
-			Links   int `json:"links"`
-			Removed int `json:"removed"`
+		type pathstep struct {
+			Source      string   `json:"source"`
+			Target      string   `json:"target"`
+			Edges       []string `json:"edges"`
+			Probability int      `json:"probability"`
+		}
+		type path struct {
+			Steps       []pathstep `json:"steps"`
+			Probability float64    `json:"probability"`
+		}
 
+		response := struct {
+			Paths    []path        `json:"paths"`
 			Elements *CytoElements `json:"elements"`
 		}{
-			Reversed: mode != "normal",
+			Paths: make([]path, len(paths)),
+		}
+		for i, ap := range paths {
+			response.Paths[i].Probability = ap.Probability * 100
+			for _, step := range ap.Steps {
+				response.Paths[i].Steps = append(response.Paths[i].Steps, pathstep{
+					Source:      fmt.Sprintf("n%v", step.Source.ID()),
+					Target:      fmt.Sprintf("n%v", step.Target.ID()),
+					Edges:       step.Edges.StringSlice(),
+					Probability: int(step.Probability),
+				})
+			}
+		}
 
-			ResultTypes: resulttypes,
+		cytograph, err := GenerateCytoscapeJS(PathsToGraph(paths), false)
+		if err != nil {
+			c.String(500, "Error generating cytoscape graph: %v", err)
+			return
+		}
+		response.Elements = &cytograph.Elements
 
-			Targets: targets,
-			Total:   results.Graph.Order(),
-			Links:   results.Graph.Size(),
-			Removed: results.Removed,
+		c.JSON(200, response)
+	})
+	ws.Router.POST("/chokepoints", func(c *gin.Context) {
+		params := make(map[string]string)
+		err := c.ShouldBindJSON(&params)
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
 
-			Elements: &cytograph.Elements,
+		var result Chokepoints
+		if analysis, _ := util.ParseBool(params["analysis"]); analysis {
+			// Same parameters as /analyzegraph, ranking the resulting graph
+			opts, err := ParseAnalyzeObjectsOptions(params, ws.Objs)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			result = GraphChokepoints(AnalyzeObjects(opts).Graph, opts.Direction == engine.Out)
+		} else {
+			opts, err := ParseChokepointOptions(params, ws.Objs)
+			if err != nil {
+				c.JSON(400, gin.H{"error": err.Error()})
+				return
+			}
+			result = FindChokepoints(opts)
 		}
 
-		c.JSON(200, response)
+		if limit, err := strconv.Atoi(params["limit"]); err == nil {
+			result.Limit(limit)
+		}
+
+		c.JSON(200, chokepointsReport(result, func(o *engine.Object) string {
+			return fmt.Sprintf("n%v", o.ID())
+		}))
 	})
-	/*
-	   	ws.Router.HandleFunc("/export-graph", func(c *gin.Context) {
-	   		uq := r.URL.Query()
-
-	   		format := uq.Get("format")
-	   		if format == "" {
-	   			format = "xgmml"
-	   		}
-
-	   		mode := uq.Get("mode")
-	   		if mode == "" {
-	   			mode = "normal"
-	   		}
-	   		direction := engine.In
-	   		if mode != "normal" {
-	   			direction = engine.Out
-	   		}
-
-	   		querystr := uq.Get("query")
-	   		if querystr == "" {
-	   			querystr = "(&(objectClass=group)(|(name=Domain Admins)(name=Enterprise Admins)))"
-	   		}
-
-	   		maxdepth := 99
-	   		if maxdepthval, err := strconv.Atoi(uq.Get("maxdepth")); err == nil {
-	   			maxdepth = maxdepthval
-	   		}
-
-	   		maxoutgoing := -1
-	   		if maxoutgoingval, err := strconv.Atoi(uq.Get("maxotgoing")); err == nil {
-	   			maxoutgoing = maxoutgoingval
-	   		}
-
-	   		alldetails, err := util.ParseBool(uq.Get("alldetails"))
-	   		if err != nil {
-	   			alldetails = true
-	   		}
-
-	   		rest, includequery, err := query.ParseLDAPQuery(r.URL.Query().Get("query"), ws.Objs)
-	   		if err != nil {
-	   			w.WriteHeader(400) // bad request
-	   			w.Write([]byte(err.Error()))
-	   			return
-	   		}
-	   		if rest != "" {
-	   			if rest[0] != ',' {
-	   				w.WriteHeader(400) // bad request
-	   				fmt.Fprintf(w, "Error parsing ldap query: %v", err)
-	   				return
-	   			}
-	   			if excludequery, err = query.ParseLDAPQueryStrict(rest[1:], ws.Objs); err != nil {
-	   				w.WriteHeader(400) // bad request
-	   				fmt.Fprintf(w, "Error parsing ldap query: %v", err)
-	   				return
-	   			}
-	   		}
-
-	   		includeobjects = query.Execute(includequery, ws.Objs)
-
-	   		if excludequery != nil {
-	   			excludeobjects = query.Execute(excludequery, ws.Objs)
-	   		}
-
-	   		var selectededges []engine.Edge
-	   		for potentialedge, values := range uq {
-	   			if edge := engine.E(potentialedge); edge != engine.NonExistingEdgeType {
-	   				enabled, _ := util.ParseBool(values[0])
-	   				if len(values) == 1 && enabled {
-	   					selectededges = append(selectededges, edge)
-	   				}
-	   			}
-	   		}
-	   		// If everything is deselected, select everything
-	   		if len(selectededges) == 0 {
-	   			selectededges = engine.AllEdgesSlice()
-	   		}
-
-	   		var methods engine.EdgeBitmap
-	   		for _, m := range selectededges {
-	   			methods = methods.Set(m)
-	   		}
-
-	   		// Defaults
-	   		opts := NewAnalyzeObjectsOptions()
-	   		opts.Objects = ws.Objs
-	   		opts.MethodsF = methods
-	   		opts.MethodsM = methods
-	   		opts.MethodsL = methods
-	   		opts.Direction = direction
-	   		opts.MaxDepth = maxdepth
-	   		opts.MaxOutgoingConnections = maxoutgoing
-	   		opts.MinProbability = 0
-
-	   		results := AnalyzeObjects(opts)
-
-	   		// Make browser download this
-	   		filename := "analysis-" + time.Now().Format(time.RFC3339)
-
-	   		switch format {
-	   		case "gml":
-	   			filename += ".gml"
-	   		case "xgmml":
-	   			filename += ".xgmml"
-	   		}
-
-	   		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-
-	   		switch format {
-	   		case "gml":
-	   			// Lets go
-	   			w.Write([]byte("graph\n[\n"))
-
-	   			for node, _ := range results.Graph.Nodes() {
-	   				fmt.Fprintf(w,
-	   					`  node
-	     [
-	       id %v
-	       label %v
-	   	distinguishedName %v
-	   `, node.ID(), node.Label(), node.DN())
-
-	   				if alldetails {
-	   					node.AttrIterator(func(attribute engine.Attribute, values engine.AttributeValues) bool {
-	   						valuesjoined := strings.Join(values.StringSlice(), ", ")
-	   						if util.IsASCII(valuesjoined) {
-	   							fmt.Fprintf(w, "  %v %v\n", attribute, valuesjoined)
-	   						}
-	   						return true
-	   					})
-	   				}
-	   				fmt.Fprintf(w, "  ]\n")
-	   			}
-
-	   			for connection, edge := range results.Graph.Edges() {
-	   				fmt.Fprintf(w,
-	   					`  edge
-	     [
-	       source %v
-	       target %v
-	   	label "%v"
-	     ]
-	   `, connection.Source.ID(), connection.Target.ID(), edge.JoinedString())
-	   			}
-
-	   			w.Write([]byte("]\n"))
-
-	   		case "xgmml":
-	   			graph := NewXGMMLGraph()
-
-	   			for node := range results.Graph.Nodes() {
-	   				object := node
-	   				xmlnode := XGMMLNode{
-	   					Id:    object.ID(),
-	   					Label: object.Label(),
-	   				}
-
-	   				if alldetails {
-	   					object.AttrIterator(func(attribute engine.Attribute, values engine.AttributeValues) bool {
-	   						if values != nil {
-	   							valuesjoined := strings.Join(values.StringSlice(), ", ")
-	   							if util.IsASCII(valuesjoined) {
-	   								xmlnode.Attributes = append(xmlnode.Attributes, XGMMLAttribute{
-	   									Name:  attribute.String(),
-	   									Value: valuesjoined,
-	   								})
-	   							}
-	   						}
-	   						return true
-	   					})
-	   				}
-	   				graph.Nodes = append(graph.Nodes, xmlnode)
-	   			}
-
-	   			for connection, edge := range results.Graph.Edges() {
-	   				graph.Edges = append(graph.Edges, XGMMLEdge{
-	   					Source: connection.Source.ID(),
-	   					Target: connection.Target.ID(),
-	   					Label:  edge.JoinedString(),
-	   				})
-	   			}
-	   			fmt.Fprint(w, xml.Header)
-	   			xe := xml.NewEncoder(w)
-	   			xe.Indent("", "  ")
-	   			xe.Encode(graph)
-	   		}
-	   	})
-	*/
 	ws.Router.GET("/query/objects/:query", func(c *gin.Context) {
 		querystr := c.Param("query")
 
@@ -748,23 +559,8 @@ func analysisfuncs(ws *webservice) {
 		result.Adalanche["version"] = version.Version
 		result.Adalanche["commit"] = version.Commit
 
-		result.Statistics = make(map[string]int)
-
-		for objecttype, count := range ws.Objs.Statistics() {
-			if objecttype == 0 {
-				continue // skip the dummy one
-			}
-			if count == 0 {
-				continue
-			}
-			result.Statistics[engine.ObjectType(objecttype).String()] += count
-		}
-
 		var edgeCount int
-		ws.Objs.Iterate(func(object *engine.Object) bool {
-			edgeCount += object.Edges(engine.Out).Len()
-			return true
-		})
+		result.Statistics, edgeCount = ObjectStatistics(ws.Objs)
 		result.Statistics["Total"] = ws.Objs.Len()
 		result.Statistics["PwnConnections"] = edgeCount
 
@@ -829,7 +625,7 @@ func analysisfuncs(ws *webservice) {
 	ws.Router.GET("/preferences", func(c *gin.Context) {
 		c.JSON(200, prefs.data)
 	})
-	ws.Router.POST("/preferences", func(c *gin.Context) {
+	ws.Router.POST("/preferences", requireAdmin, func(c *gin.Context) {
 		var prefsmap = make(map[string]any)
 		err := c.BindJSON(&prefsmap)
 		if err != nil {
@@ -848,7 +644,7 @@ func analysisfuncs(ws *webservice) {
 		c.Writer.Write(out)
 	})
 
-	ws.Router.GET("/preferences/:key/:value", func(c *gin.Context) {
+	ws.Router.GET("/preferences/:key/:value", requireAdmin, func(c *gin.Context) {
 		key := c.Param("key")
 		value := c.Param("value")
 		prefs.Set(key, value)
@@ -857,6 +653,52 @@ func analysisfuncs(ws *webservice) {
 
 	// Shutdown
 
+	// Objects matching a query as a spreadsheet, with one column per attribute
+	ws.Router.GET("/export-table", func(c *gin.Context) {
+		attributes, _, err := apiAttributeList(c.Query("attributes"))
+		if err != nil {
+			c.String(400, err.Error())
+			return
+		}
+		if len(attributes) == 0 {
+			attributes = []engine.Attribute{engine.Type, engine.Name, engine.DistinguishedName}
+		}
+
+		separator := c.DefaultQuery("separator", ";")
+
+		objects := ws.Objs
+		if querytext := strings.TrimSpace(c.Query("query")); querytext != "" {
+			filter, err := query.ParseLDAPQueryStrict(querytext, ws.Objs)
+			if err != nil {
+				c.String(400, err.Error())
+				return
+			}
+			objects = query.Execute(filter, ws.Objs)
+		}
+		results := objects.AsSlice()
+		if err = apiSortObjects(&results, c.Query("sort")); err != nil {
+			c.String(400, err.Error())
+			return
+		}
+
+		switch c.DefaultQuery("format", "csv") {
+		case "csv":
+			c.Header("Content-Type", "text/csv; charset=utf-8")
+			c.Header("Content-Disposition", "attachment; filename=adalanche-objects.csv")
+			err = writeQueryCSV(c.Writer, attributes, results, separator)
+		case "xlsx":
+			c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+			c.Header("Content-Disposition", "attachment; filename=adalanche-objects.xlsx")
+			err = writeQueryXLSX(c.Writer, attributes, results, separator)
+		default:
+			c.String(400, "Unknown format, use csv or xlsx")
+			return
+		}
+		if err != nil {
+			ui.Error().Msgf("Problem exporting table: %v", err)
+		}
+	})
+
 	ws.Router.GET("/export-words", func(c *gin.Context) {
 		split := c.Query("split") == "true"
 
@@ -940,12 +782,65 @@ func analysisfuncs(ws *webservice) {
 	})
 
 	// Shutdown
-	ws.Router.GET("/quit", func(c *gin.Context) {
+	ws.Router.GET("/quit", requireAdmin, func(c *gin.Context) {
 		ws.quit <- true
 	})
 
 }
 
+type analyzeGraphResponse struct {
+	Reversed bool `json:"reversed"`
+
+	ResultTypes map[string]int `json:"resulttypes"`
+
+	Targets int `json:"targets"`
+	Total   int `json:"total"`
+	Links   int `json:"links"`
+	Removed int `json:"removed"`
+
+	Elements *CytoElements `json:"elements"`
+}
+
+// Summarizes the analysis results and converts the graph for the web interface
+func newAnalyzeGraphResponse(results AnalysisResults, reversed, alldetails bool) (analyzeGraphResponse, error) {
+	var targets int
+
+	var objecttypes [256]int
+
+	for node := range results.Graph.Nodes() {
+		if results.Graph.GetNodeData(node, "target") == true {
+			targets++
+			continue
+		}
+		objecttypes[node.Type()]++
+	}
+
+	resulttypes := make(map[string]int)
+	for i := 0; i < 256; i++ {
+		if objecttypes[i] > 0 {
+			resulttypes[engine.ObjectType(i).String()] = objecttypes[i]
+		}
+	}
+
+	cytograph, err := GenerateCytoscapeJS(results.Graph, alldetails)
+	if err != nil {
+		return analyzeGraphResponse{}, err
+	}
+
+	return analyzeGraphResponse{
+		Reversed: reversed,
+
+		ResultTypes: resulttypes,
+
+		Targets: targets,
+		Total:   results.Graph.Order(),
+		Links:   results.Graph.Size(),
+		Removed: results.Removed,
+
+		Elements: &cytograph.Elements,
+	}, nil
+}
+
 func extractwords(input string, split bool) []string {
 	result := []string{input}
 	if split {
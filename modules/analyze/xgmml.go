@@ -2,8 +2,10 @@ package analyze
 
 import (
 	"encoding/xml"
+	"io"
 
 	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/graph"
 )
 
 // type XGMML struct {
@@ -59,3 +61,51 @@ type XGMMLAttribute struct {
 	Name    string   `xml:"name,attr"`
 	Value   string   `xml:"value,attr"`
 }
+
+func GenerateXGMML(pg graph.Graph[*engine.Object, engine.EdgeBitmap]) XGMMLGraph {
+	g := NewXGMMLGraph()
+	g.Label = "Adalanche analysis"
+
+	nodekeys := graphExportNodeKeys()
+	nodes := pg.Nodes()
+	for _, object := range sortedNodes(pg) {
+		values := graphExportNodeValues(object, nodes[object])
+		node := XGMMLNode{
+			Id:    object.ID(),
+			Label: object.Label(),
+		}
+		for _, key := range nodekeys {
+			if value, found := values[key.Name]; found {
+				node.Attributes = append(node.Attributes, XGMMLAttribute{Name: key.Name, Value: value})
+			}
+		}
+		g.Nodes = append(g.Nodes, node)
+	}
+
+	edgekeys := graphExportEdgeKeys(pg)
+	pg.IterateEdges(func(source, target *engine.Object, eb engine.EdgeBitmap) bool {
+		values := graphExportEdgeValues(source, target, eb)
+		edge := XGMMLEdge{
+			Source: source.ID(),
+			Target: target.ID(),
+			Label:  eb.JoinedString(),
+		}
+		for _, key := range edgekeys {
+			if value, found := values[key.Name]; found {
+				edge.Attributes = append(edge.Attributes, XGMMLAttribute{Name: key.Name, Value: value})
+			}
+		}
+		g.Edges = append(g.Edges, edge)
+		return true
+	})
+
+	return g
+}
+
+func WriteXGMML(pg graph.Graph[*engine.Object, engine.EdgeBitmap], w io.Writer) error {
+	return writeXML(GenerateXGMML(pg), w)
+}
+
+func ExportXGMML(pg graph.Graph[*engine.Object, engine.EdgeBitmap], filename string) error {
+	return exportGraphFile(pg, filename, WriteXGMML)
+}
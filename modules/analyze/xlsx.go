@@ -0,0 +1,188 @@
+package analyze
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+)
+
+// Excel refuses cells longer than this
+const xlsxMaxCellLength = 32767
+
+// xlsxWriter streams a workbook with a single worksheet of text cells. The first row is written in bold and frozen,
+// so it works as a header. Only the parts of the format needed for that are written, so there are no dependencies.
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet *bufio.Writer
+	rows  int
+}
+
+func newXLSXWriter(out io.Writer, sheetname string) (*xlsxWriter, error) {
+	xw := &xlsxWriter{
+		zw: zip.NewWriter(out),
+	}
+
+	static := []struct{ name, content string }{
+		{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			`</Types>`},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="` + xlsxEscape(xlsxSheetName(sheetname)) + `" sheetId="1" r:id="rId1"/></sheets>` +
+			`</workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+			`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+			`</Relationships>`},
+		{"xl/styles.xml", `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<fonts count="2"><font/><font><b/></font></fonts>` +
+			`<fills count="1"><fill/></fills>` +
+			`<borders count="1"><border/></borders>` +
+			`<cellStyleXfs count="1"><xf/></cellStyleXfs>` +
+			`<cellXfs count="2"><xf/><xf fontId="1" applyFont="1"/></cellXfs>` +
+			`</styleSheet>`},
+	}
+	for _, part := range static {
+		w, err := xw.zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(w, xml.Header+part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	// The worksheet has to be the last part, as rows are streamed into it
+	w, err := xw.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	xw.sheet = bufio.NewWriter(w)
+	xw.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+		`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>` +
+		`<sheetData>`)
+
+	return xw, nil
+}
+
+// WriteRow adds a row of text cells, the first row is styled as a header
+func (xw *xlsxWriter) WriteRow(cells []string) error {
+	xw.rows++
+	style := ""
+	if xw.rows == 1 {
+		style = ` s="1"`
+	}
+
+	row := strconv.Itoa(xw.rows)
+	xw.sheet.WriteString(`<row r="` + row + `">`)
+	for i, cell := range cells {
+		if cell == "" {
+			continue
+		}
+		xw.sheet.WriteString(`<c r="` + xlsxColumn(i) + row + `" t="inlineStr"` + style + `><is><t xml:space="preserve">`)
+		xw.sheet.WriteString(xlsxEscape(xlsxCellText(cell)))
+		xw.sheet.WriteString(`</t></is></c>`)
+	}
+	_, err := xw.sheet.WriteString(`</row>`)
+	return err
+}
+
+// Close finishes the worksheet and the zip archive, but not the underlying writer
+func (xw *xlsxWriter) Close() error {
+	xw.sheet.WriteString(`</sheetData></worksheet>`)
+	if err := xw.sheet.Flush(); err != nil {
+		return err
+	}
+	return xw.zw.Close()
+}
+
+// Spreadsheet column name for a zero based index: A, B, ... Z, AA, AB ...
+func xlsxColumn(i int) string {
+	var name []byte
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = append([]byte{byte('A' + (i-1)%26)}, name...)
+	}
+	return string(name)
+}
+
+// Sheet names are limited to 31 characters and can't contain some characters
+func xlsxSheetName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if utf8.RuneCountInString(name) > 31 {
+		name = string([]rune(name)[:31])
+	}
+	if name == "" {
+		name = "Sheet1"
+	}
+	return name
+}
+
+// Binary values are hexified, and text that isn't allowed in XML is dropped
+func xlsxCellText(text string) string {
+	if !utf8.ValidString(text) {
+		text = hex.EncodeToString([]byte(text))
+	}
+	text = strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' || r == 0xfffe || r == 0xffff {
+			return -1
+		}
+		return r
+	}, text)
+	if len(text) > xlsxMaxCellLength {
+		text = text[:xlsxMaxCellLength]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return text
+}
+
+func xlsxEscape(text string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(text))
+	return sb.String()
+}
+
+// writeQueryXLSX writes the objects as a spreadsheet with one column per attribute, joining multiple values with the separator
+func writeQueryXLSX(out io.Writer, attributes []engine.Attribute, results engine.ObjectSlice, separator string) error {
+	xw, err := newXLSXWriter(out, "Objects")
+	if err != nil {
+		return err
+	}
+
+	row := make([]string, len(attributes))
+	for i, attr := range attributes {
+		row[i] = attr.String()
+	}
+	xw.WriteRow(row)
+
+	results.Iterate(func(o *engine.Object) bool {
+		for i, attr := range attributes {
+			row[i] = strings.Join(o.Attr(attr).StringSlice(), separator)
+		}
+		err = xw.WriteRow(row)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return xw.Close()
+}
@@ -0,0 +1,80 @@
+package analyze
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"testing"
+)
+
+func TestXLSXColumn(t *testing.T) {
+	for i, expected := range map[int]string{0: "A", 25: "Z", 26: "AA", 27: "AB", 701: "ZZ", 702: "AAA"} {
+		if column := xlsxColumn(i); column != expected {
+			t.Errorf("Column %v is %v, expected %v", i, column, expected)
+		}
+	}
+}
+
+func TestXLSXWriter(t *testing.T) {
+	var buf bytes.Buffer
+	xw, err := newXLSXWriter(&buf, "Objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.WriteRow([]string{"name", "description"})
+	xw.WriteRow([]string{"Bob <admin>", "line\x00one\nline two"})
+	xw.WriteRow([]string{"", "\xff\xfe"})
+	if err = xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cells := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+
+		// Every part must be well formed XML
+		var sheet struct {
+			Rows []struct {
+				Cells []struct {
+					Ref  string `xml:"r,attr"`
+					Text string `xml:"is>t"`
+				} `xml:"c"`
+			} `xml:"sheetData>row"`
+		}
+		if err = xml.Unmarshal(data, &sheet); err != nil {
+			t.Fatalf("%v is not valid XML: %v", f.Name, err)
+		}
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			for _, row := range sheet.Rows {
+				for _, cell := range row.Cells {
+					cells[cell.Ref] = cell.Text
+				}
+			}
+		}
+	}
+
+	for ref, expected := range map[string]string{
+		"A1": "name",
+		"A2": "Bob <admin>",
+		"B2": "lineone\nline two",
+		"B3": "fffe",
+	} {
+		if cells[ref] != expected {
+			t.Errorf("Cell %v is %q, expected %q", ref, cells[ref], expected)
+		}
+	}
+	if _, found := cells["A3"]; found {
+		t.Errorf("Empty cell A3 should not be written")
+	}
+}
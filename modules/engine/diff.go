@@ -0,0 +1,288 @@
+package engine
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/lkarlslund/adalanche/modules/ui"
+)
+
+type DiffOptions struct {
+	IgnoreAttributes []Attribute // Attributes that are expected to change, like lastLogonTimestamp
+	IgnoreMeta       bool        // Skip attributes starting with _ as they're mostly calculated
+}
+
+type AttributeDiff struct {
+	Attribute Attribute
+	Removed   []string
+	Added     []string
+}
+
+type ObjectDiff struct {
+	Old, New   *Object
+	Attributes []AttributeDiff
+}
+
+type EdgeDiff struct {
+	Source, Target *Object // Objects from the new collection if they exist there, otherwise from the old one
+	Gained, Lost   EdgeBitmap
+}
+
+type EdgeDiffStatistics struct {
+	Gained, Lost int
+}
+
+type DiffResult struct {
+	Added       ObjectSlice // Only in the new collection
+	Removed     ObjectSlice // Only in the old collection
+	Changed     []ObjectDiff
+	Edges       []EdgeDiff
+	EdgeStats   map[Edge]EdgeDiffStatistics
+	Unmatchable int // Objects without any attributes to match on (root, loader containers etc.)
+}
+
+// Attributes used to pair objects from two collections, in order of preference
+func diffMatchAttributes() []Attribute {
+	matchon := []Attribute{ObjectGUID, ObjectSid, DistinguishedName}
+	for _, a := range getMergeAttributes() {
+		if !slices.Contains(matchon, a) {
+			matchon = append(matchon, a)
+		}
+	}
+	return matchon
+}
+
+// Diff compares two object collections, pairing objects on the attributes used for merging.
+// Both collections must be fully processed before calling this.
+func Diff(old, new *Objects, opts DiffOptions) DiffResult {
+	result := DiffResult{
+		EdgeStats: make(map[Edge]EdgeDiffStatistics),
+	}
+
+	matchon := diffMatchAttributes()
+
+	oldtonew := make(map[*Object]*Object)
+	newtoold := make(map[*Object]*Object)
+
+	pb := ui.ProgressBar("Matching objects", old.Len())
+	old.Iterate(func(o *Object) bool {
+		pb.Add(1)
+		var haskey bool
+		for _, attr := range matchon {
+			value := o.OneAttr(attr)
+			if value == nil || value.IsZero() {
+				continue
+			}
+			haskey = true
+			candidates, found := new.FindMulti(attr, value)
+			if !found {
+				continue
+			}
+			var matches ObjectSlice
+			candidates.Iterate(func(candidate *Object) bool {
+				if _, taken := newtoold[candidate]; !taken {
+					matches.Add(candidate)
+				}
+				return true
+			})
+			if matches.Len() > 1 {
+				// Local SIDs repeat across machines, so try narrowing it down by source
+				ds := diffDataSource(o)
+				var narrowed ObjectSlice
+				matches.Iterate(func(candidate *Object) bool {
+					if strings.EqualFold(diffDataSource(candidate), ds) {
+						narrowed.Add(candidate)
+					}
+					return true
+				})
+				matches = narrowed
+			}
+			if matches.Len() == 1 {
+				oldtonew[o] = matches.First()
+				newtoold[matches.First()] = o
+				break
+			}
+		}
+		if !haskey {
+			result.Unmatchable++
+		} else if _, matched := oldtonew[o]; !matched {
+			result.Removed.Add(o)
+		}
+		return true
+	})
+	pb.Finish()
+
+	new.Iterate(func(o *Object) bool {
+		if _, matched := newtoold[o]; matched {
+			return true
+		}
+		for _, attr := range matchon {
+			if value := o.OneAttr(attr); value != nil && !value.IsZero() {
+				result.Added.Add(o)
+				return true
+			}
+		}
+		result.Unmatchable++
+		return true
+	})
+
+	pb = ui.ProgressBar("Comparing objects", len(oldtonew))
+	for oldobject, newobject := range oldtonew {
+		pb.Add(1)
+		if attributes := diffAttributes(oldobject, newobject, opts); len(attributes) > 0 {
+			result.Changed = append(result.Changed, ObjectDiff{
+				Old:        oldobject,
+				New:        newobject,
+				Attributes: attributes,
+			})
+		}
+	}
+	pb.Finish()
+
+	// Edges are compared from the perspective of the new collection, translating old objects where possible
+	translate := func(o *Object) *Object {
+		if n, found := oldtonew[o]; found {
+			return n
+		}
+		return o
+	}
+
+	type edgekey struct {
+		source, target *Object
+	}
+	oldedges := make(map[edgekey]EdgeBitmap)
+	old.Iterate(func(o *Object) bool {
+		source := translate(o)
+		o.Edges(Out).Range(func(target *Object, eb EdgeBitmap) bool {
+			oldedges[edgekey{source, translate(target)}] = eb
+			return true
+		})
+		return true
+	})
+
+	addedgediff := func(key edgekey, gained, lost EdgeBitmap) {
+		if gained.IsBlank() && lost.IsBlank() {
+			return
+		}
+		result.Edges = append(result.Edges, EdgeDiff{
+			Source: key.source,
+			Target: key.target,
+			Gained: gained,
+			Lost:   lost,
+		})
+		for _, edge := range gained.Edges() {
+			stats := result.EdgeStats[edge]
+			stats.Gained++
+			result.EdgeStats[edge] = stats
+		}
+		for _, edge := range lost.Edges() {
+			stats := result.EdgeStats[edge]
+			stats.Lost++
+			result.EdgeStats[edge] = stats
+		}
+	}
+
+	new.Iterate(func(o *Object) bool {
+		o.Edges(Out).Range(func(target *Object, eb EdgeBitmap) bool {
+			key := edgekey{o, target}
+			oldeb := oldedges[key]
+			delete(oldedges, key)
+			addedgediff(key, eb.Intersect(oldeb.Invert()), oldeb.Intersect(eb.Invert()))
+			return true
+		})
+		return true
+	})
+	for key, oldeb := range oldedges {
+		addedgediff(key, EdgeBitmap{}, oldeb)
+	}
+
+	// Stable output
+	result.Added.Sort(DistinguishedName, false)
+	result.Removed.Sort(DistinguishedName, false)
+	slices.SortFunc(result.Changed, func(a, b ObjectDiff) int {
+		return strings.Compare(a.New.Label(), b.New.Label())
+	})
+	slices.SortFunc(result.Edges, func(a, b EdgeDiff) int {
+		if c := strings.Compare(a.Source.Label(), b.Source.Label()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Target.Label(), b.Target.Label())
+	})
+
+	return result
+}
+
+func diffDataSource(o *Object) string {
+	if ds := o.OneAttr(DataSource); ds != nil {
+		return ds.String()
+	}
+	return ""
+}
+
+func diffAttributes(oldobject, newobject *Object, opts DiffOptions) []AttributeDiff {
+	var result []AttributeDiff
+
+	include := func(attr Attribute) bool {
+		if opts.IgnoreMeta && attr.IsMeta() {
+			return false
+		}
+		return !slices.Contains(opts.IgnoreAttributes, attr)
+	}
+
+	seen := make(map[Attribute]struct{})
+	compare := func(attr Attribute) {
+		if _, done := seen[attr]; done {
+			return
+		}
+		seen[attr] = struct{}{}
+		if !include(attr) {
+			return
+		}
+		oldvalues := oldobject.Attr(attr).StringSlice()
+		newvalues := newobject.Attr(attr).StringSlice()
+
+		// Group memberships and the like can be huge, so avoid quadratic lookups
+		oldset := make(map[string]struct{}, len(oldvalues))
+		for _, v := range oldvalues {
+			oldset[v] = struct{}{}
+		}
+		newset := make(map[string]struct{}, len(newvalues))
+		for _, v := range newvalues {
+			newset[v] = struct{}{}
+		}
+
+		var removed, added []string
+		for _, v := range oldvalues {
+			if _, found := newset[v]; !found {
+				removed = append(removed, v)
+			}
+		}
+		for _, v := range newvalues {
+			if _, found := oldset[v]; !found {
+				added = append(added, v)
+			}
+		}
+		if len(removed) > 0 || len(added) > 0 {
+			result = append(result, AttributeDiff{
+				Attribute: attr,
+				Removed:   removed,
+				Added:     added,
+			})
+		}
+	}
+
+	oldobject.AttrIterator(func(attr Attribute, avs AttributeValues) bool {
+		compare(attr)
+		return true
+	})
+	newobject.AttrIterator(func(attr Attribute, avs AttributeValues) bool {
+		compare(attr)
+		return true
+	})
+
+	slices.SortFunc(result, func(a, b AttributeDiff) int {
+		return strings.Compare(a.Attribute.String(), b.Attribute.String())
+	})
+
+	return result
+}
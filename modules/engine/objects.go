@@ -32,6 +32,8 @@ type Objects struct {
 
 	indexlock sync.RWMutex
 
+	postprocessing sync.WaitGroup
+
 	typecount typestatistics
 }
 
@@ -174,6 +176,11 @@ func (os *Objects) SetRoot(ro *Object) {
 	os.root = ro
 }
 
+// Blocks until the background post-processing started by Run has completed
+func (os *Objects) WaitForPostProcessing() {
+	os.postprocessing.Wait()
+}
+
 func (os *Objects) DropIndexes() {
 	// Clear all indexes
 	os.indexlock.Lock()
@@ -189,12 +189,14 @@ func (os *ObjectSlice) Sort(attr Attribute, reverse bool) {
 	}
 
 	if reverse {
+		lessf := orderf
 		orderf = func(i, j int) bool {
-			return !orderf(i, j)
+			return lessf(j, i)
 		}
 	}
 
-	sort.Slice(os.objects, orderf)
+	// Stable, so objects sorted by something else first keep that order when they are equal
+	sort.SliceStable(os.objects, orderf)
 }
 
 func (os *ObjectSlice) SortFunc(lessthan func(o, o2 *Object) bool) {
@@ -206,7 +208,7 @@ func (os *ObjectSlice) SortFunc(lessthan func(o, o2 *Object) bool) {
 func (os *ObjectSlice) Skip(count int) {
 	if count >= 0 {
 		// from start
-		if count > len(os.objects) {
+		if count < len(os.objects) {
 			os.objects = os.objects[count:]
 		} else {
 			os.objects = os.objects[:0]
@@ -214,7 +216,7 @@ func (os *ObjectSlice) Skip(count int) {
 	} else {
 		// from end
 		count = -count
-		if count > len(os.objects) {
+		if count < len(os.objects) {
 			os.objects = os.objects[:len(os.objects)-count]
 		} else {
 			os.objects = os.objects[:0]
@@ -224,12 +226,12 @@ func (os *ObjectSlice) Skip(count int) {
 
 func (os *ObjectSlice) Limit(count int) {
 	if count >= 0 {
-		if count > len(os.objects) {
+		if count < len(os.objects) {
 			os.objects = os.objects[:count]
 		}
 	} else {
 		count = -count
-		if count > len(os.objects) {
+		if count < len(os.objects) {
 			os.objects = os.objects[len(os.objects)-count:]
 		}
 	}
@@ -90,7 +90,10 @@ func Run(path string) (*Objects, error) {
 	ui.Info().Msgf("Time to UI done in %v", time.Since(starttime))
 
 	// Do global post-processing
+	ao.postprocessing.Add(1)
 	go func() {
+		defer ao.postprocessing.Done()
+
 		for priority := AfterMergeLow; priority <= AfterMergeFinal; priority++ {
 			Process(ao, fmt.Sprintf("Postprocessing global objects priority %v", priority.String()), -1, priority)
 		}
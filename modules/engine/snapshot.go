@@ -0,0 +1,670 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+	"github.com/pierrec/lz4/v4"
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	snapshotMagic   = "adalanche-snapshot"
+	snapshotVersion = 2
+)
+
+// Value type markers used in the snapshot stream
+const (
+	snapValueString byte = iota
+	snapValueBlob
+	snapValueBool
+	snapValueInt
+	snapValueTime
+	snapValueSID
+	snapValueGUID
+	snapValueSecurityDescriptor
+	snapValueObject
+)
+
+var ErrNotASnapshot = errors.New("File is not an adalanche snapshot")
+
+var ErrStaleSnapshot = errors.New("Snapshot is older than the data it was made from")
+
+// SaveSnapshot writes the fully processed object graph to a file, so it can be loaded again without running the loaders and processors
+func SaveSnapshot(ao *Objects, filename string) error {
+	modified := dataModified(ao.Datapath, filename)
+
+	// Write and rename, so a crash can't leave a truncated snapshot behind
+	temp := filename + ".tmp"
+	outfile, err := os.Create(temp)
+	if err != nil {
+		return fmt.Errorf("Problem creating snapshot file: %v", err)
+	}
+	defer outfile.Close()
+
+	boutfile := lz4.NewWriter(outfile)
+	boutfile.Apply(lz4.ConcurrencyOption(-1))
+
+	e := msgp.NewWriter(boutfile)
+
+	err = writeSnapshot(ao, modified, e)
+	if err == nil {
+		err = e.Flush()
+	}
+	if err == nil {
+		err = boutfile.Close()
+	}
+	if err == nil {
+		err = outfile.Sync()
+	}
+	if err == nil {
+		err = outfile.Close()
+	}
+	if err == nil {
+		err = os.Rename(temp, filename)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("Problem writing snapshot file: %v", err)
+	}
+	return nil
+}
+
+// dataModified returns the modification time of the newest file in the datapath, ignoring the snapshot itself
+func dataModified(datapath, snapshotfile string) time.Time {
+	var newest time.Time
+	if datapath == "" {
+		return newest
+	}
+	snapshotfile, _ = filepath.Abs(snapshotfile)
+	filepath.Walk(datapath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if abs, _ := filepath.Abs(path); abs == snapshotfile || abs == snapshotfile+".tmp" {
+			return nil
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	return newest
+}
+
+// CheckSnapshot returns ErrStaleSnapshot if files in the datapath have changed since the snapshot was made from it
+func CheckSnapshot(filename, datapath string) error {
+	infile, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("Problem opening snapshot file: %v", err)
+	}
+	defer infile.Close()
+
+	d := msgp.NewReader(lz4.NewReader(infile))
+	_, modified, err := readSnapshotHeader(d)
+	if err != nil {
+		return fmt.Errorf("Problem reading snapshot file %v: %v", filename, err)
+	}
+	if dataModified(datapath, filename).After(modified) {
+		return ErrStaleSnapshot
+	}
+	return nil
+}
+
+func writeSnapshot(ao *Objects, modified time.Time, e *msgp.Writer) error {
+	e.WriteString(snapshotMagic)
+	e.WriteInt(snapshotVersion)
+	e.WriteString(ao.Datapath)
+	e.WriteTime(modified)
+
+	// Attribute and edge names, as the numbering might differ between runs
+	attributes := Attributes()
+	e.WriteArrayHeader(uint32(len(attributes)))
+	for _, a := range attributes {
+		e.WriteString(a.String())
+	}
+
+	edges := Edges()
+	e.WriteArrayHeader(uint32(len(edges)))
+	for _, edge := range edges {
+		e.WriteString(edge.String())
+	}
+
+	objects := ao.AsSlice()
+	bar := ui.ProgressBar("Saving snapshot", objects.Len()*2)
+
+	// Security descriptors are shared between a lot of objects, so write them once
+	sdindex := make(map[*SecurityDescriptor]uint32)
+	var sds []*SecurityDescriptor
+	objects.Iterate(func(o *Object) bool {
+		o.values.Iterate(func(attr Attribute, values AttributeValues) bool {
+			values.Iterate(func(value AttributeValue) bool {
+				if sdv, ok := value.(AttributeValueSecurityDescriptor); ok && sdv.SD != nil {
+					if _, found := sdindex[sdv.SD]; !found {
+						sdindex[sdv.SD] = uint32(len(sds))
+						sds = append(sds, sdv.SD)
+					}
+				}
+				return true
+			})
+			return true
+		})
+		return true
+	})
+
+	e.WriteArrayHeader(uint32(len(sds)))
+	for _, sd := range sds {
+		writeSnapshotSD(sd, e)
+	}
+
+	var rootid ObjectID
+	if ao.Root() != nil {
+		rootid = ao.Root().ID()
+	}
+	e.WriteUint32(uint32(rootid))
+
+	// Objects with their attributes
+	e.WriteArrayHeader(uint32(objects.Len()))
+	var err error
+	objects.Iterate(func(o *Object) bool {
+		e.WriteUint32(uint32(o.ID()))
+		var parentid ObjectID
+		if o.parent != nil {
+			parentid = o.parent.id
+		}
+		e.WriteUint32(uint32(parentid))
+
+		e.WriteArrayHeader(uint32(o.values.Len()))
+		o.values.Iterate(func(attr Attribute, values AttributeValues) bool {
+			e.WriteUint16(uint16(attr))
+			e.WriteArrayHeader(uint32(values.Len()))
+			values.Iterate(func(value AttributeValue) bool {
+				err = writeSnapshotValue(value, sdindex, e)
+				return err == nil
+			})
+			return err == nil
+		})
+		bar.Add(1)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Outgoing edges, incoming are rebuilt from these
+	objects.Iterate(func(o *Object) bool {
+		e.WriteUint32(uint32(o.ID()))
+		e.WriteArrayHeader(uint32(o.edges[Out].Len()))
+		o.edges[Out].Range(func(target *Object, eb EdgeBitmap) bool {
+			e.WriteUint32(uint32(target.id))
+			for _, bits := range eb {
+				e.WriteUint64(bits)
+			}
+			return true
+		})
+		bar.Add(1)
+		return true
+	})
+	bar.Finish()
+
+	return nil
+}
+
+func writeSnapshotValue(value AttributeValue, sdindex map[*SecurityDescriptor]uint32, e *msgp.Writer) error {
+	switch v := value.(type) {
+	case AttributeValueString:
+		e.WriteByte(snapValueString)
+		return e.WriteString(string(v))
+	case AttributeValueBlob:
+		e.WriteByte(snapValueBlob)
+		return e.WriteBytes([]byte(v))
+	case AttributeValueBool:
+		e.WriteByte(snapValueBool)
+		return e.WriteBool(bool(v))
+	case AttributeValueInt:
+		e.WriteByte(snapValueInt)
+		return e.WriteInt64(int64(v))
+	case AttributeValueTime:
+		e.WriteByte(snapValueTime)
+		return e.WriteTime(time.Time(v))
+	case AttributeValueSID:
+		e.WriteByte(snapValueSID)
+		return e.WriteBytes([]byte(v))
+	case AttributeValueGUID:
+		e.WriteByte(snapValueGUID)
+		return e.WriteBytes(v[:])
+	case AttributeValueSecurityDescriptor:
+		e.WriteByte(snapValueSecurityDescriptor)
+		return e.WriteUint32(sdindex[v.SD])
+	case AttributeValueObject:
+		e.WriteByte(snapValueObject)
+		return e.WriteUint32(uint32(v.Object.id))
+	}
+	return fmt.Errorf("Unsupported attribute value type %T in snapshot", value)
+}
+
+func writeSnapshotSD(sd *SecurityDescriptor, e *msgp.Writer) {
+	e.WriteBytes([]byte(sd.Owner))
+	e.WriteBytes([]byte(sd.Group))
+	e.WriteUint16(uint16(sd.Control))
+	for _, acl := range []*ACL{&sd.SACL, &sd.DACL} {
+		e.WriteByte(acl.Revision)
+		e.WriteBool(acl.HadSortingProblem)
+		e.WriteArrayHeader(uint32(len(acl.Entries)))
+		for _, ace := range acl.Entries {
+			e.WriteBytes([]byte(ace.SID))
+			e.WriteByte(byte(ace.Type))
+			e.WriteUint32(uint32(ace.Flags))
+			e.WriteByte(byte(ace.ACEFlags))
+			e.WriteUint32(uint32(ace.Mask))
+			e.WriteBytes(ace.ObjectType[:])
+			e.WriteBytes(ace.InheritedObjectType[:])
+		}
+	}
+}
+
+// LoadSnapshot reads a snapshot written by SaveSnapshot, returning the objects ready for analysis
+func LoadSnapshot(filename string) (*Objects, error) {
+	infile, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Problem opening snapshot file: %v", err)
+	}
+	defer infile.Close()
+
+	binfile := lz4.NewReader(infile)
+	binfile.Apply(lz4.ConcurrencyOption(-1))
+
+	d := msgp.NewReaderSize(binfile, 4*1024*1024)
+
+	ao, err := readSnapshot(d)
+	if err != nil {
+		return nil, fmt.Errorf("Problem reading snapshot file %v: %v", filename, err)
+	}
+	return ao, nil
+}
+
+func readSnapshotHeader(d *msgp.Reader) (string, time.Time, error) {
+	magic, err := d.ReadString()
+	if err != nil || magic != snapshotMagic {
+		return "", time.Time{}, ErrNotASnapshot
+	}
+	version, err := d.ReadInt()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if version != snapshotVersion {
+		return "", time.Time{}, fmt.Errorf("Unsupported snapshot version %v", version)
+	}
+	datapath, err := d.ReadString()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	modified, err := d.ReadTime()
+	return datapath, modified, err
+}
+
+func readSnapshot(d *msgp.Reader) (*Objects, error) {
+	datapath, _, err := readSnapshotHeader(d)
+	if err != nil {
+		return nil, err
+	}
+
+	ao := NewObjects()
+	ao.Datapath = datapath
+
+	// Translate attributes and edges to our current numbering
+	attributecount, err := d.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	attributes := make([]Attribute, attributecount)
+	for i := range attributes {
+		name, err := d.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		attributes[i] = NewAttribute(name)
+	}
+
+	edgecount, err := d.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	edges := make([]Edge, edgecount)
+	for i := range edges {
+		name, err := d.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		edges[i] = NewEdge(name)
+	}
+
+	sdcount, err := d.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	sds := make([]*SecurityDescriptor, sdcount)
+	for i := range sds {
+		sds[i], err = readSnapshotSD(d)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rootid, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	objectcount, err := d.ReadArrayHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	bar := ui.ProgressBar("Loading snapshot", int(objectcount)*2)
+
+	type pendingobject struct {
+		o      *Object
+		parent ObjectID
+	}
+	type pendingreference struct {
+		o      *Object
+		attr   Attribute
+		values AttributeValueSlice
+		refs   map[int]ObjectID
+	}
+
+	objects := make(map[ObjectID]*Object, objectcount)
+	pending := make([]pendingobject, objectcount)
+	var references []pendingreference
+
+	for i := range pending {
+		id, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		parentid, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		valuecount, err := d.ReadArrayHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		o := NewPreload(int(valuecount))
+		for j := uint32(0); j < valuecount; j++ {
+			attrindex, err := d.ReadUint16()
+			if err != nil {
+				return nil, err
+			}
+			if int(attrindex) >= len(attributes) {
+				return nil, fmt.Errorf("Invalid attribute index %v", attrindex)
+			}
+			attr := attributes[attrindex]
+
+			count, err := d.ReadArrayHeader()
+			if err != nil {
+				return nil, err
+			}
+			values := make(AttributeValueSlice, count)
+			var refs map[int]ObjectID
+			for k := range values {
+				values[k], err = readSnapshotValue(d, sds)
+				if err != nil {
+					return nil, err
+				}
+				if ref, ok := values[k].(snapshotObjectReference); ok {
+					if refs == nil {
+						refs = make(map[int]ObjectID)
+					}
+					refs[k] = ObjectID(ref)
+				}
+			}
+			if refs != nil {
+				references = append(references, pendingreference{o, attr, values, refs})
+				continue
+			}
+			if len(values) > 0 {
+				o.SetValues(attr, values...)
+			}
+		}
+
+		objects[ObjectID(id)] = o
+		pending[i] = pendingobject{o, ObjectID(parentid)}
+		bar.Add(1)
+	}
+
+	// Resolve attributes pointing at other objects
+	for _, ref := range references {
+		for k, id := range ref.refs {
+			target, found := objects[id]
+			if !found {
+				return nil, fmt.Errorf("Snapshot references unknown object %v", id)
+			}
+			ref.values[k] = AttributeValueObject{target}
+		}
+		ref.o.SetValues(ref.attr, ref.values...)
+	}
+
+	for _, po := range pending {
+		if po.parent != 0 {
+			if parent, found := objects[po.parent]; found {
+				po.o.ChildOf(parent)
+			}
+		}
+	}
+
+	if root, found := objects[ObjectID(rootid)]; found {
+		ao.SetRoot(root)
+	}
+	for _, po := range pending {
+		ao.AddRelaxed(po.o)
+	}
+
+	for i := uint32(0); i < objectcount; i++ {
+		id, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		source, found := objects[ObjectID(id)]
+		if !found {
+			return nil, fmt.Errorf("Snapshot has edges for unknown object %v", id)
+		}
+		count, err := d.ReadArrayHeader()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint32(0); j < count; j++ {
+			targetid, err := d.ReadUint32()
+			if err != nil {
+				return nil, err
+			}
+			var stored EdgeBitmap
+			for k := range stored {
+				stored[k], err = d.ReadUint64()
+				if err != nil {
+					return nil, err
+				}
+			}
+			target, found := objects[ObjectID(targetid)]
+			if !found {
+				return nil, fmt.Errorf("Snapshot has edge to unknown object %v", targetid)
+			}
+
+			var eb EdgeBitmap
+			for _, edge := range stored.Edges() {
+				if int(edge) >= len(edges) {
+					return nil, fmt.Errorf("Invalid edge index %v", edge)
+				}
+				eb = eb.Set(edges[edge])
+			}
+			source.edges[Out].setEdges(target, eb)
+			target.edges[In].setEdges(source, eb)
+		}
+		bar.Add(1)
+	}
+	bar.Finish()
+
+	return ao, nil
+}
+
+// Placeholder for object references until all objects are loaded
+type snapshotObjectReference ObjectID
+
+func (sor snapshotObjectReference) String() string {
+	return fmt.Sprintf("unresolved object %v", uint32(sor))
+}
+
+func (sor snapshotObjectReference) Raw() any {
+	return ObjectID(sor)
+}
+
+func (sor snapshotObjectReference) IsZero() bool {
+	return sor == 0
+}
+
+func readSnapshotValue(d *msgp.Reader, sds []*SecurityDescriptor) (AttributeValue, error) {
+	valuetype, err := d.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch valuetype {
+	case snapValueString:
+		s, err := d.ReadString()
+		return AttributeValueString(s), err
+	case snapValueBlob:
+		b, err := d.ReadBytes(nil)
+		return AttributeValueBlob(b), err
+	case snapValueBool:
+		b, err := d.ReadBool()
+		return AttributeValueBool(b), err
+	case snapValueInt:
+		i, err := d.ReadInt64()
+		return AttributeValueInt(i), err
+	case snapValueTime:
+		t, err := d.ReadTime()
+		return AttributeValueTime(t), err
+	case snapValueSID:
+		b, err := d.ReadBytes(nil)
+		return AttributeValueSID(b), err
+	case snapValueGUID:
+		b, err := d.ReadBytes(nil)
+		if err != nil {
+			return nil, err
+		}
+		u, err := uuid.FromBytes(b)
+		return AttributeValueGUID(u), err
+	case snapValueSecurityDescriptor:
+		index, err := d.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		if int(index) >= len(sds) {
+			return nil, fmt.Errorf("Invalid security descriptor index %v", index)
+		}
+		return AttributeValueSecurityDescriptor{sds[index]}, nil
+	case snapValueObject:
+		id, err := d.ReadUint32()
+		return snapshotObjectReference(id), err
+	}
+	return nil, fmt.Errorf("Unknown value type %v in snapshot", valuetype)
+}
+
+func readSnapshotSD(d *msgp.Reader) (*SecurityDescriptor, error) {
+	var sd SecurityDescriptor
+	owner, err := d.ReadBytes(nil)
+	if err != nil {
+		return nil, err
+	}
+	sd.Owner = windowssecurity.SID(owner)
+	group, err := d.ReadBytes(nil)
+	if err != nil {
+		return nil, err
+	}
+	sd.Group = windowssecurity.SID(group)
+	control, err := d.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	sd.Control = SecurityDescriptorControlFlag(control)
+
+	for _, acl := range []*ACL{&sd.SACL, &sd.DACL} {
+		if acl.Revision, err = d.ReadByte(); err != nil {
+			return nil, err
+		}
+		if acl.HadSortingProblem, err = d.ReadBool(); err != nil {
+			return nil, err
+		}
+		count, err := d.ReadArrayHeader()
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			acl.Entries = make([]ACE, count)
+		}
+		for i := range acl.Entries {
+			ace := &acl.Entries[i]
+			sid, err := d.ReadBytes(nil)
+			if err != nil {
+				return nil, err
+			}
+			ace.SID = windowssecurity.SID(sid)
+			acetype, err := d.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			ace.Type = ACEType(acetype)
+			flags, err := d.ReadUint32()
+			if err != nil {
+				return nil, err
+			}
+			ace.Flags = Flags(flags)
+			aceflags, err := d.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			ace.ACEFlags = ACEFlags(aceflags)
+			mask, err := d.ReadUint32()
+			if err != nil {
+				return nil, err
+			}
+			ace.Mask = Mask(mask)
+			objecttype, err := d.ReadBytes(nil)
+			if err != nil {
+				return nil, err
+			}
+			copy(ace.ObjectType[:], objecttype)
+			inheritedobjecttype, err := d.ReadBytes(nil)
+			if err != nil {
+				return nil, err
+			}
+			copy(ace.InheritedObjectType[:], inheritedobjecttype)
+		}
+	}
+
+	// Restore the cached deny lookups that ParseSecurityDescriptor sets up
+	for _, ace := range sd.DACL.Entries {
+		if ace.Type == ACETYPE_ACCESS_DENIED || ace.Type == ACETYPE_ACCESS_DENIED_OBJECT {
+			sd.DACL.containsdeny = true
+			break
+		}
+	}
+	if sd.DACL.containsdeny {
+		sd.DACL.firstinheriteddeny = -1
+		for i := range sd.DACL.Entries {
+			if sd.DACL.Entries[i].ACEFlags&ACEFLAG_INHERITED_ACE != 0 && (sd.DACL.Entries[i].Type == ACETYPE_ACCESS_ALLOWED || sd.DACL.Entries[i].Type == ACETYPE_ACCESS_ALLOWED_OBJECT) {
+				sd.DACL.firstinheriteddeny = i
+				break
+			}
+		}
+	}
+
+	return &sd, nil
+}
@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+var (
+	snapshotTestManager = NewAttribute("snapshotTestManager")
+	snapshotTestEdge    = NewEdge("SnapshotTestEdge").RegisterProbabilityCalculator(func(source, target *Object) Probability {
+		if target.OneAttrString(Name) == "server" {
+			return 40
+		}
+		return 100
+	})
+)
+
+// snapshotTestSD is a self relative security descriptor with an explicit deny, an explicit allow and an inherited allow
+func snapshotTestSD(t *testing.T) *SecurityDescriptor {
+	sid := []byte{1, 1, 0, 0, 0, 0, 0, 5, 11, 0, 0, 0} // S-1-5-11
+	ace := func(acetype ACEType, flags ACEFlags, mask uint32) []byte {
+		data := []byte{byte(acetype), byte(flags), 8 + byte(len(sid)), 0}
+		data = binary.LittleEndian.AppendUint32(data, mask)
+		return append(data, sid...)
+	}
+	aces := append(ace(ACETYPE_ACCESS_DENIED, 0, 0x10), ace(ACETYPE_ACCESS_ALLOWED, 0, 0x20)...)
+	aces = append(aces, ace(ACETYPE_ACCESS_ALLOWED, ACEFLAG_INHERITED_ACE, 0x40)...)
+	acl := []byte{2, 0, 0, 0, 3, 0, 0, 0}
+	binary.LittleEndian.PutUint16(acl[2:], uint16(8+len(aces)))
+
+	data := []byte{1, 0, 0, 0}
+	binary.LittleEndian.PutUint16(data[2:], uint16(CONTROLFLAG_DACL_PRESENT))
+	data = binary.LittleEndian.AppendUint32(data, 20)                  // Owner
+	data = binary.LittleEndian.AppendUint32(data, 0)                   // Group
+	data = binary.LittleEndian.AppendUint32(data, 0)                   // SACL
+	data = binary.LittleEndian.AppendUint32(data, uint32(20+len(sid))) // DACL
+	data = append(data, sid...)
+	data = append(data, acl...)
+	data = append(data, aces...)
+
+	sd, err := ParseSecurityDescriptor(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sd.DACL.containsdeny || sd.DACL.firstinheriteddeny != 2 {
+		t.Fatalf("Unexpected DACL lookups %v and %v", sd.DACL.containsdeny, sd.DACL.firstinheriteddeny)
+	}
+	return &sd
+}
+
+func TestSnapshot(t *testing.T) {
+	datapath := t.TempDir()
+	datafile := filepath.Join(datapath, "data.json")
+	if err := os.WriteFile(datafile, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(datafile, old, old)
+
+	sid, _ := windowssecurity.ParseStringSID("S-1-5-21-1-2-3-1000")
+	guid := uuid.Must(uuid.NewV4())
+	when := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	sd := snapshotTestSD(t)
+
+	ao := NewObjects()
+	ao.Datapath = datapath
+	root := NewObject(Name, AttributeValueString("corp"))
+	manager := NewObject(Name, AttributeValueString("manager"))
+	server := NewObject(Name, AttributeValueString("server"))
+	user := NewObject(Name, AttributeValueString("user"),
+		ObjectSid, AttributeValueSID(sid),
+		ObjectGUID, AttributeValueGUID(guid),
+		WhenChanged, AttributeValueTime(when),
+		NewAttribute("snapshotTestCount"), AttributeValueInt(42),
+		NewAttribute("snapshotTestFlag"), AttributeValueBool(true),
+		NewAttribute("snapshotTestBlob"), AttributeValueBlob("\x00\x01\x02"),
+		NTSecurityDescriptor, AttributeValueSecurityDescriptor{sd},
+		snapshotTestManager, AttributeValueObject{manager})
+	ao.Add(root, manager, server, user)
+	ao.SetRoot(root)
+	user.ChildOf(root)
+	user.EdgeTo(server, snapshotTestEdge)
+	user.EdgeTo(manager, snapshotTestEdge)
+
+	snapshotfile := filepath.Join(datapath, "graph.snapshot")
+	if err := SaveSnapshot(ao, snapshotfile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(snapshotfile + ".tmp"); err == nil {
+		t.Error("Temporary snapshot file left behind")
+	}
+	if err := CheckSnapshot(snapshotfile, datapath); err != nil {
+		t.Fatalf("Fresh snapshot rejected: %v", err)
+	}
+
+	loaded, err := LoadSnapshot(snapshotfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Datapath != datapath || loaded.Len() != 4 || loaded.Root() == nil || loaded.Root().OneAttrString(Name) != "corp" {
+		t.Fatalf("Unexpected objects loaded from %v", loaded.Datapath)
+	}
+	find := func(name string) *Object {
+		o, found := loaded.Find(Name, AttributeValueString(name))
+		if !found {
+			t.Fatalf("Object %v missing from snapshot", name)
+		}
+		return o
+	}
+	luser, lmanager, lserver := find("user"), find("manager"), find("server")
+
+	for _, attr := range []Attribute{ObjectSid, ObjectGUID, NewAttribute("snapshotTestCount"), NewAttribute("snapshotTestFlag"), NewAttribute("snapshotTestBlob")} {
+		if !CompareAttributeValues(luser.OneAttr(attr), user.OneAttr(attr)) {
+			t.Errorf("Attribute %v is %v after loading, expected %v", attr, luser.OneAttr(attr), user.OneAttr(attr))
+		}
+	}
+	if lwhen, ok := luser.OneAttr(WhenChanged).Raw().(time.Time); !ok || !lwhen.Equal(when) {
+		t.Errorf("Time loaded as %v, expected %v", luser.OneAttr(WhenChanged), when)
+	}
+	if ref, ok := luser.OneAttr(snapshotTestManager).(AttributeValueObject); !ok || ref.Object != lmanager {
+		t.Errorf("Object reference loaded as %v", luser.OneAttr(snapshotTestManager))
+	}
+	if luser.Parent() != loaded.Root() {
+		t.Error("Parent not restored")
+	}
+
+	lsdv, ok := luser.OneAttr(NTSecurityDescriptor).(AttributeValueSecurityDescriptor)
+	if !ok {
+		t.Fatalf("Security descriptor loaded as %T", luser.OneAttr(NTSecurityDescriptor))
+	}
+	lsd := lsdv.SD
+	if lsd.Owner != sd.Owner || lsd.Control != sd.Control || len(lsd.DACL.Entries) != len(sd.DACL.Entries) {
+		t.Fatalf("Security descriptor loaded as %+v", lsd)
+	}
+	for i := range sd.DACL.Entries {
+		if lsd.DACL.Entries[i] != sd.DACL.Entries[i] {
+			t.Errorf("ACE %v loaded as %+v, expected %+v", i, lsd.DACL.Entries[i], sd.DACL.Entries[i])
+		}
+	}
+	if lsd.DACL.containsdeny != sd.DACL.containsdeny || lsd.DACL.firstinheriteddeny != sd.DACL.firstinheriteddeny {
+		t.Errorf("DACL lookups loaded as %v and %v, expected %v and %v", lsd.DACL.containsdeny, lsd.DACL.firstinheriteddeny, sd.DACL.containsdeny, sd.DACL.firstinheriteddeny)
+	}
+
+	probabilities := make(map[*Object]Probability)
+	luser.Edges(Out).Range(func(target *Object, eb EdgeBitmap) bool {
+		if !eb.IsSet(snapshotTestEdge) {
+			t.Errorf("Edge to %v loaded as %v", target.Label(), eb.JoinedString())
+		}
+		probabilities[target] = eb.MaxProbability(luser, target)
+		return true
+	})
+	if len(probabilities) != 2 || probabilities[lserver] != 40 || probabilities[lmanager] != 100 {
+		t.Errorf("Unexpected edges and probabilities %v", probabilities)
+	}
+	incoming := 0
+	lserver.Edges(In).Range(func(source *Object, eb EdgeBitmap) bool {
+		incoming++
+		if source != luser {
+			t.Errorf("Unexpected incoming edge from %v", source.Label())
+		}
+		return true
+	})
+	if incoming != 1 {
+		t.Errorf("Expected one incoming edge on server, got %v", incoming)
+	}
+
+	// Data changing after the snapshot was made
+	newer := time.Now().Add(time.Hour)
+	os.Chtimes(datafile, newer, newer)
+	if err := CheckSnapshot(snapshotfile, datapath); !errors.Is(err, ErrStaleSnapshot) {
+		t.Errorf("Expected stale snapshot, got %v", err)
+	}
+}
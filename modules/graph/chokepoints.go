@@ -0,0 +1,428 @@
+package graph
+
+import (
+	"sort"
+)
+
+// NodeChokepoint is an intermediate node that attack paths go through
+type NodeChokepoint[NodeType comparable] struct {
+	Node    NodeType
+	Sources int     // Number of sources that can't reach any target without this node
+	Paths   float64 // Share of shortest source to target paths going through this node (betweenness)
+}
+
+// EdgeChokepoint is a connection that attack paths go through
+type EdgeChokepoint[NodeType comparable] struct {
+	Source, Target NodeType
+	Sources        int     // Number of sources that can't reach any target without this edge
+	Paths          float64 // Share of shortest source to target paths using this edge (betweenness)
+}
+
+type Chokepoints[NodeType comparable] struct {
+	Nodes   []NodeChokepoint[NodeType]
+	Edges   []EdgeChokepoint[NodeType]
+	Sources int // Number of sources that can reach at least one target
+}
+
+// Limit keeps at most the n highest ranked nodes and edges, n <= 0 keeps everything
+func (c *Chokepoints[NodeType]) Limit(n int) {
+	if n <= 0 {
+		return
+	}
+	if len(c.Nodes) > n {
+		c.Nodes = c.Nodes[:n]
+	}
+	if len(c.Edges) > n {
+		c.Edges = c.Edges[:n]
+	}
+}
+
+// Chokepoints ranks the nodes and edges in the graph that sit between the sources and the targets
+func (pg Graph[NodeType, EdgeType]) Chokepoints(sources []NodeType, istarget func(NodeType) bool) Chokepoints[NodeType] {
+	pg.autoCleanupEdges()
+	adjacency := pg.AdjacencyMap()
+	return FindChokepoints(sources, istarget, func(node NodeType, each func(neighbour NodeType, cost float64) bool) {
+		for _, target := range adjacency[node] {
+			if !each(target, 1) {
+				return
+			}
+		}
+	})
+}
+
+// Betweenness is estimated from this many sources at most
+const maxBetweennessSources = 1000
+
+// FindChokepoints ranks nodes and edges between the sources and the targets, both by how many sources are cut off
+// from every target when removing them (dominators), and by how many shortest paths go through them (betweenness).
+// Paths end at the first target reached. Step costs from neighbours are ignored.
+func FindChokepoints[NodeType comparable](sources []NodeType, istarget func(NodeType) bool, neighbours NeighbourFunc[NodeType]) Chokepoints[NodeType] {
+	var result Chokepoints[NodeType]
+
+	// Index everything reachable from the sources
+	index := make(map[NodeType]int)
+	var nodes []NodeType
+	var succ [][]int
+	var targets []bool
+	var queue []int
+
+	add := func(node NodeType) int {
+		if i, found := index[node]; found {
+			return i
+		}
+		i := len(nodes)
+		index[node] = i
+		nodes = append(nodes, node)
+		succ = append(succ, nil)
+		targets = append(targets, istarget(node))
+		queue = append(queue, i)
+		return i
+	}
+
+	sourceids := make([]int, 0, len(sources))
+	for _, source := range sources {
+		if _, found := index[source]; !found {
+			sourceids = append(sourceids, add(source))
+		}
+	}
+
+	issource := make([]bool, len(nodes))
+	for _, i := range sourceids {
+		issource[i] = true
+	}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if targets[current] && !issource[current] {
+			// Paths end at the first target
+			continue
+		}
+		neighbours(nodes[current], func(neighbour NodeType, cost float64) bool {
+			next := add(neighbour)
+			if next != current {
+				succ[current] = append(succ[current], next)
+			}
+			return true
+		})
+		for len(issource) < len(nodes) {
+			issource = append(issource, false)
+		}
+	}
+
+	n := len(nodes)
+
+	// Only nodes that can reach a target matter
+	pred := make([][]int, n)
+	for from, tos := range succ {
+		for _, to := range tos {
+			pred[to] = append(pred[to], from)
+		}
+	}
+	relevant := make([]bool, n)
+	queue = queue[:0]
+	for i := range nodes {
+		if targets[i] {
+			relevant[i] = true
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, from := range pred[current] {
+			if !relevant[from] && !(targets[from] && !issource[from]) {
+				relevant[from] = true
+				queue = append(queue, from)
+			}
+		}
+	}
+
+	// Augmented graph where every edge is also a node, and all targets lead to one sink
+	var edges []chokeEdge
+	edgeindex := make(map[chokeEdge]int)
+	for from, tos := range succ {
+		if !relevant[from] || (targets[from] && !issource[from]) {
+			continue
+		}
+		for _, to := range tos {
+			if !relevant[to] {
+				continue
+			}
+			e := chokeEdge{from, to}
+			if _, found := edgeindex[e]; !found {
+				edgeindex[e] = len(edges)
+				edges = append(edges, e)
+			}
+		}
+	}
+
+	sink := n + len(edges)
+	augsucc := make([][]int, sink+1)
+	augpred := make([][]int, sink+1)
+	link := func(from, to int) {
+		augsucc[from] = append(augsucc[from], to)
+		augpred[to] = append(augpred[to], from)
+	}
+	for i, e := range edges {
+		link(e.from, n+i)
+		link(n+i, e.to)
+	}
+	for i := range nodes {
+		if targets[i] {
+			link(i, sink)
+		}
+	}
+
+	// A node or edge cuts a source off from every target when it post-dominates the source, so one dominator tree
+	// rooted at the sink of the reversed graph gives the count for all sources as the number of sources below it
+	idom, order := dominators(sink, augpred, augsucc)
+	below := make([]int, sink+1)
+	var reaching []int
+	for _, s := range sourceids {
+		if relevant[s] && idom[s] >= 0 {
+			reaching = append(reaching, s)
+			below[s]++
+		}
+	}
+	result.Sources = len(reaching)
+
+	nodesources := make([]int, n)
+	edgesources := make([]int, len(edges))
+	// Postorder has every node before its immediate dominator
+	for _, d := range order {
+		if d == sink {
+			continue
+		}
+		below[idom[d]] += below[d]
+		cut := below[d]
+		if d < n && issource[d] {
+			cut-- // Not cut off by itself
+		}
+		if d >= n {
+			edgesources[d-n] = cut
+		} else if !targets[d] {
+			nodesources[d] = cut
+		}
+	}
+
+	// Betweenness needs a search per source, so it's estimated from an even sample when there are many
+	nodepaths := make([]float64, n)
+	edgepaths := make([]float64, len(edges))
+	bc := newBetweenness(n, edges, targets)
+	samples := min(len(reaching), maxBetweennessSources)
+	for i := 0; i < samples; i++ {
+		bc.accumulate(reaching[i*len(reaching)/samples], nodepaths, edgepaths)
+	}
+	if samples < len(reaching) {
+		scale := float64(len(reaching)) / float64(samples)
+		for i := range nodepaths {
+			nodepaths[i] *= scale
+		}
+		for i := range edgepaths {
+			edgepaths[i] *= scale
+		}
+	}
+
+	for i, node := range nodes {
+		if targets[i] || (nodesources[i] == 0 && nodepaths[i] == 0) {
+			continue
+		}
+		result.Nodes = append(result.Nodes, NodeChokepoint[NodeType]{
+			Node:    node,
+			Sources: nodesources[i],
+			Paths:   nodepaths[i],
+		})
+	}
+	for i, e := range edges {
+		if edgesources[i] == 0 && edgepaths[i] == 0 {
+			continue
+		}
+		result.Edges = append(result.Edges, EdgeChokepoint[NodeType]{
+			Source:  nodes[e.from],
+			Target:  nodes[e.to],
+			Sources: edgesources[i],
+			Paths:   edgepaths[i],
+		})
+	}
+
+	sort.SliceStable(result.Nodes, func(i, j int) bool {
+		if result.Nodes[i].Sources == result.Nodes[j].Sources {
+			return result.Nodes[i].Paths > result.Nodes[j].Paths
+		}
+		return result.Nodes[i].Sources > result.Nodes[j].Sources
+	})
+	sort.SliceStable(result.Edges, func(i, j int) bool {
+		if result.Edges[i].Sources == result.Edges[j].Sources {
+			return result.Edges[i].Paths > result.Edges[j].Paths
+		}
+		return result.Edges[i].Sources > result.Edges[j].Sources
+	})
+
+	return result
+}
+
+// dominators returns the immediate dominator of every node reachable from root, -1 for unreachable nodes,
+// and the reachable nodes in postorder. This is the iterative algorithm by Cooper, Harvey and Kennedy.
+func dominators(root int, succ, pred [][]int) ([]int, []int) {
+	count := len(succ)
+
+	// Postorder numbering with an explicit stack, the graphs can be deep
+	postorder := make([]int, count)
+	for i := range postorder {
+		postorder[i] = -1
+	}
+	visited := make([]bool, count)
+	var order []int
+	type frame struct {
+		node, next int
+	}
+	stack := []frame{{root, 0}}
+	visited[root] = true
+	for len(stack) > 0 {
+		top := &stack[len(stack)-1]
+		if top.next < len(succ[top.node]) {
+			next := succ[top.node][top.next]
+			top.next++
+			if !visited[next] {
+				visited[next] = true
+				stack = append(stack, frame{next, 0})
+			}
+			continue
+		}
+		postorder[top.node] = len(order)
+		order = append(order, top.node)
+		stack = stack[:len(stack)-1]
+	}
+
+	idom := make([]int, count)
+	for i := range idom {
+		idom[i] = -1
+	}
+	idom[root] = root
+
+	intersect := func(a, b int) int {
+		for a != b {
+			for postorder[a] < postorder[b] {
+				a = idom[a]
+			}
+			for postorder[b] < postorder[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		// Reverse postorder, skipping the root
+		for i := len(order) - 2; i >= 0; i-- {
+			node := order[i]
+			newidom := -1
+			for _, p := range pred[node] {
+				if idom[p] < 0 {
+					continue
+				}
+				if newidom < 0 {
+					newidom = p
+				} else {
+					newidom = intersect(p, newidom)
+				}
+			}
+			if newidom >= 0 && idom[node] != newidom {
+				idom[node] = newidom
+				changed = true
+			}
+		}
+	}
+
+	return idom, order
+}
+
+type chokeEdge struct {
+	from, to int
+}
+
+type chokeStep struct {
+	node, edge int
+}
+
+// Reusable state for Brandes style betweenness accumulation, counting hops in the original graph
+type betweennessState struct {
+	succ    [][]chokeStep
+	targets []bool
+	dist    []int
+	sigma   []float64
+	delta   []float64
+	preds   [][]chokeStep
+	order   []int
+}
+
+func newBetweenness(n int, edges []chokeEdge, targets []bool) *betweennessState {
+	bs := betweennessState{
+		succ:    make([][]chokeStep, n),
+		targets: targets,
+		dist:    make([]int, n),
+		sigma:   make([]float64, n),
+		delta:   make([]float64, n),
+		preds:   make([][]chokeStep, n),
+	}
+	for i, e := range edges {
+		bs.succ[e.from] = append(bs.succ[e.from], chokeStep{node: e.to, edge: i})
+	}
+	for i := range bs.dist {
+		bs.dist[i] = -1
+	}
+	return &bs
+}
+
+// accumulate adds the dependency of shortest paths from s to every target it reaches
+func (bs *betweennessState) accumulate(s int, nodepaths, edgepaths []float64) {
+	bs.order = bs.order[:0]
+	bs.dist[s] = 0
+	bs.sigma[s] = 1
+	bs.order = append(bs.order, s)
+
+	for i := 0; i < len(bs.order); i++ {
+		v := bs.order[i]
+		if v != s && bs.targets[v] {
+			continue
+		}
+		for _, step := range bs.succ[v] {
+			w := step.node
+			if bs.dist[w] < 0 {
+				bs.dist[w] = bs.dist[v] + 1
+				bs.order = append(bs.order, w)
+			}
+			if bs.dist[w] == bs.dist[v]+1 {
+				bs.sigma[w] += bs.sigma[v]
+				bs.preds[w] = append(bs.preds[w], chokeStep{node: v, edge: step.edge})
+			}
+		}
+	}
+
+	for i := len(bs.order) - 1; i >= 0; i-- {
+		w := bs.order[i]
+		var reached float64
+		if w != s && bs.targets[w] {
+			reached = 1
+		}
+		coefficient := (reached + bs.delta[w]) / bs.sigma[w]
+		for _, p := range bs.preds[w] {
+			c := bs.sigma[p.node] * coefficient
+			edgepaths[p.edge] += c
+			bs.delta[p.node] += c
+		}
+		if w != s && !bs.targets[w] {
+			nodepaths[w] += bs.delta[w]
+		}
+	}
+
+	// Reset for the next source
+	for _, v := range bs.order {
+		bs.dist[v] = -1
+		bs.sigma[v] = 0
+		bs.delta[v] = 0
+		bs.preds[v] = bs.preds[v][:0]
+	}
+}
@@ -0,0 +1,31 @@
+package graph
+
+import "testing"
+
+func TestFindChokepoints(t *testing.T) {
+	edges := map[int][]int{
+		1: {3},
+		2: {3, 5},
+		3: {4},
+		5: {4},
+		6: {3},
+	}
+	neighbours := func(node int, each func(int, float64) bool) {
+		for _, target := range edges[node] {
+			if !each(target, 1) {
+				return
+			}
+		}
+	}
+
+	result := FindChokepoints([]int{1, 2, 6, 7}, func(node int) bool { return node == 4 }, neighbours)
+	if result.Sources != 3 {
+		t.Fatalf("expected 3 sources reaching the target, got %v", result.Sources)
+	}
+	if len(result.Nodes) != 2 || result.Nodes[0].Node != 3 || result.Nodes[0].Sources != 2 || result.Nodes[0].Paths != 2.5 {
+		t.Fatalf("unexpected node ranking %+v", result.Nodes)
+	}
+	if first := result.Edges[0]; first.Source != 3 || first.Target != 4 || first.Sources != 2 {
+		t.Fatalf("unexpected edge ranking %+v", result.Edges)
+	}
+}
@@ -0,0 +1,236 @@
+package graph
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Path is a chain of nodes, with the cost of each step and the total cost
+type Path[NodeType comparable] struct {
+	Nodes []NodeType
+	Costs []float64 // Cost of each step, one less than the number of nodes
+	Cost  float64
+}
+
+// NeighbourFunc calls each for every node reachable from node in one step with the cost of that step.
+// Costs must not be negative. Returning false from each stops the iteration.
+type NeighbourFunc[NodeType comparable] func(node NodeType, each func(neighbour NodeType, cost float64) bool)
+
+// ShortestPath returns the cheapest path from any of the sources to a node where istarget returns true
+func ShortestPath[NodeType comparable](sources []NodeType, istarget func(NodeType) bool, neighbours NeighbourFunc[NodeType]) (Path[NodeType], bool) {
+	return dijkstra(sources, istarget, neighbours, nil, nil)
+}
+
+// KShortestPaths returns up to k loopless paths in order of increasing cost, using Yen's algorithm
+func KShortestPaths[NodeType comparable](sources []NodeType, istarget func(NodeType) bool, neighbours NeighbourFunc[NodeType], k int) []Path[NodeType] {
+	if k < 1 {
+		return nil
+	}
+	first, found := dijkstra(sources, istarget, neighbours, nil, nil)
+	if !found {
+		return nil
+	}
+
+	results := []Path[NodeType]{first}
+	var candidates []Path[NodeType]
+
+	for len(results) < k {
+		last := results[len(results)-1]
+
+		// Spur from every node in the last path, -1 meaning the virtual node in front of all the sources
+		for i := -1; i < len(last.Nodes)-1; i++ {
+			root := last.Nodes[:i+1]
+
+			// Nodes before the spur node can't be revisited
+			blockednodes := make(map[NodeType]struct{})
+			for _, node := range last.Nodes[:max(i, 0)] {
+				blockednodes[node] = struct{}{}
+			}
+
+			blockededges := make(map[NodePair[NodeType]]struct{})
+			blockedsources := make(map[NodeType]struct{})
+			for _, p := range results {
+				if len(p.Nodes) > i+1 && equalNodes(p.Nodes[:i+1], root) {
+					if i == -1 {
+						blockedsources[p.Nodes[0]] = struct{}{}
+					} else {
+						blockededges[NodePair[NodeType]{Source: p.Nodes[i], Target: p.Nodes[i+1]}] = struct{}{}
+					}
+				}
+			}
+
+			var spursources []NodeType
+			if i == -1 {
+				for _, source := range sources {
+					if _, blocked := blockedsources[source]; !blocked {
+						spursources = append(spursources, source)
+					}
+				}
+			} else {
+				spursources = []NodeType{root[i]}
+			}
+
+			spur, found := dijkstra(spursources, istarget, neighbours, blockednodes, blockededges)
+			if !found {
+				continue
+			}
+
+			var candidate Path[NodeType]
+			if i == -1 {
+				candidate = spur
+			} else {
+				candidate.Nodes = append(append([]NodeType{}, root[:i]...), spur.Nodes...)
+				candidate.Costs = append(append([]float64{}, last.Costs[:i]...), spur.Costs...)
+				for _, c := range candidate.Costs {
+					candidate.Cost += c
+				}
+			}
+
+			var duplicate bool
+			for _, existing := range candidates {
+				if equalNodes(existing.Nodes, candidate.Nodes) {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				candidates = append(candidates, candidate)
+			}
+		}
+
+		if len(candidates) == 0 {
+			break
+		}
+
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if candidates[i].Cost == candidates[j].Cost {
+				return len(candidates[i].Nodes) < len(candidates[j].Nodes)
+			}
+			return candidates[i].Cost < candidates[j].Cost
+		})
+		results = append(results, candidates[0])
+		candidates = candidates[1:]
+	}
+
+	return results
+}
+
+func equalNodes[NodeType comparable](a, b []NodeType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type pathQueueItem[NodeType comparable] struct {
+	node NodeType
+	cost float64
+	hops int
+}
+
+type pathQueue[NodeType comparable] []pathQueueItem[NodeType]
+
+func (pq pathQueue[NodeType]) Len() int { return len(pq) }
+func (pq pathQueue[NodeType]) Less(i, j int) bool {
+	if pq[i].cost == pq[j].cost {
+		return pq[i].hops < pq[j].hops
+	}
+	return pq[i].cost < pq[j].cost
+}
+func (pq pathQueue[NodeType]) Swap(i, j int) { pq[i], pq[j] = pq[j], pq[i] }
+func (pq *pathQueue[NodeType]) Push(x any) {
+	*pq = append(*pq, x.(pathQueueItem[NodeType]))
+}
+func (pq *pathQueue[NodeType]) Pop() any {
+	old := *pq
+	item := old[len(old)-1]
+	*pq = old[:len(old)-1]
+	return item
+}
+
+type pathStep[NodeType comparable] struct {
+	previous NodeType
+	cost     float64 // cost of the step into this node
+	total    float64
+	hops     int
+	start    bool
+	done     bool
+}
+
+func dijkstra[NodeType comparable](sources []NodeType, istarget func(NodeType) bool, neighbours NeighbourFunc[NodeType], blockednodes map[NodeType]struct{}, blockededges map[NodePair[NodeType]]struct{}) (Path[NodeType], bool) {
+	steps := make(map[NodeType]*pathStep[NodeType])
+	var queue pathQueue[NodeType]
+
+	for _, source := range sources {
+		if _, blocked := blockednodes[source]; blocked {
+			continue
+		}
+		if _, found := steps[source]; found {
+			continue
+		}
+		steps[source] = &pathStep[NodeType]{start: true}
+		heap.Push(&queue, pathQueueItem[NodeType]{node: source})
+	}
+
+	for queue.Len() > 0 {
+		item := heap.Pop(&queue).(pathQueueItem[NodeType])
+		step := steps[item.node]
+		if step.done {
+			continue
+		}
+		step.done = true
+
+		// A path needs at least one step
+		if !step.start && istarget(item.node) {
+			var result Path[NodeType]
+			result.Cost = step.total
+			node := item.node
+			for {
+				s := steps[node]
+				result.Nodes = append(result.Nodes, node)
+				if s.start {
+					break
+				}
+				result.Costs = append(result.Costs, s.cost)
+				node = s.previous
+			}
+			// Reverse into source to target order
+			for i, j := 0, len(result.Nodes)-1; i < j; i, j = i+1, j-1 {
+				result.Nodes[i], result.Nodes[j] = result.Nodes[j], result.Nodes[i]
+			}
+			for i, j := 0, len(result.Costs)-1; i < j; i, j = i+1, j-1 {
+				result.Costs[i], result.Costs[j] = result.Costs[j], result.Costs[i]
+			}
+			return result, true
+		}
+
+		neighbours(item.node, func(neighbour NodeType, cost float64) bool {
+			if _, blocked := blockednodes[neighbour]; blocked {
+				return true
+			}
+			if _, blocked := blockededges[NodePair[NodeType]{Source: item.node, Target: neighbour}]; blocked {
+				return true
+			}
+			total := step.total + cost
+			existing, found := steps[neighbour]
+			if found && (existing.done || existing.total < total || (existing.total == total && existing.hops <= step.hops+1)) {
+				return true
+			}
+			steps[neighbour] = &pathStep[NodeType]{
+				previous: item.node,
+				cost:     cost,
+				total:    total,
+				hops:     step.hops + 1,
+			}
+			heap.Push(&queue, pathQueueItem[NodeType]{node: neighbour, cost: total, hops: step.hops + 1})
+			return true
+		})
+	}
+
+	return Path[NodeType]{}, false
+}
@@ -0,0 +1,39 @@
+package graph
+
+import "testing"
+
+func TestKShortestPaths(t *testing.T) {
+	edges := map[int]map[int]float64{
+		1: {2: 1, 3: 2},
+		2: {3: 0.5, 4: 1},
+		3: {4: 1},
+		5: {4: 0.1},
+	}
+	neighbours := func(node int, each func(int, float64) bool) {
+		for target, cost := range edges[node] {
+			if !each(target, cost) {
+				return
+			}
+		}
+	}
+	istarget := func(node int) bool { return node == 4 }
+
+	shortest, found := ShortestPath([]int{1}, istarget, neighbours)
+	if !found || !equalNodes(shortest.Nodes, []int{1, 2, 4}) || shortest.Cost != 2 {
+		t.Fatalf("unexpected shortest path %v", shortest)
+	}
+
+	expected := [][]int{{5, 4}, {1, 2, 4}, {1, 2, 3, 4}, {1, 3, 4}}
+	paths := KShortestPaths([]int{1, 5}, istarget, neighbours, 10)
+	if len(paths) != len(expected) {
+		t.Fatalf("expected %v paths, got %v", len(expected), len(paths))
+	}
+	for i, path := range paths {
+		if !equalNodes(path.Nodes, expected[i]) {
+			t.Errorf("path %v is %v, expected %v", i, path.Nodes, expected[i])
+		}
+		if len(path.Costs) != len(path.Nodes)-1 {
+			t.Errorf("path %v has %v step costs for %v nodes", i, len(path.Costs), len(path.Nodes))
+		}
+	}
+}
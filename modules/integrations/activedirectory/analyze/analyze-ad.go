@@ -10,6 +10,7 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/lkarlslund/adalanche/modules/engine"
 	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/risk"
 	"github.com/lkarlslund/adalanche/modules/ui"
 	"github.com/lkarlslund/adalanche/modules/util"
 	"github.com/lkarlslund/adalanche/modules/windowssecurity"
@@ -1996,4 +1997,13 @@ func init() {
 	}, "Resolve expanding environment variables in group names to real names from GPOs",
 		engine.AfterMerge,
 	)
+
+	// Needs every edge in place, so it runs last
+	LoaderID.AddProcessor(func(ao *engine.Objects) {
+		if err := risk.ComputeScores(ao); err != nil {
+			ui.Warn().Msgf("Problem computing risk scores: %v", err)
+		}
+	}, "Risk scores based on reachable tier 0 objects",
+		engine.AfterMergeFinal,
+	)
 }
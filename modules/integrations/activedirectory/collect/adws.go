@@ -0,0 +1,397 @@
+package collect
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	ldap "github.com/lkarlslund/ldap/v3"
+)
+
+const (
+	ADWSPort = 9389
+
+	adwsTimeout = 5 * time.Minute
+
+	nsSOAP        = "http://www.w3.org/2003/05/soap-envelope"
+	nsAddressing  = "http://www.w3.org/2005/08/addressing"
+	nsEnumeration = "http://schemas.xmlsoap.org/ws/2004/09/enumeration"
+	nsAD          = "http://schemas.microsoft.com/2008/1/ActiveDirectory"
+	nsADData      = "http://schemas.microsoft.com/2008/1/ActiveDirectory/Data"
+	nsLdapQuery   = "http://schemas.microsoft.com/2008/1/ActiveDirectory/Dialect/LdapQuery"
+	nsXSD         = "http://www.w3.org/2001/XMLSchema"
+	nsXSI         = "http://www.w3.org/2001/XMLSchema-instance"
+
+	adwsDialectXPath = "http://schemas.microsoft.com/2008/1/ActiveDirectory/Dialect/XPath-Level-1"
+	adwsAnonymous    = "http://www.w3.org/2005/08/addressing/anonymous"
+
+	adwsActionEnumerate = nsEnumeration + "/Enumerate"
+	adwsActionPull      = nsEnumeration + "/Pull"
+	adwsActionGet       = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Get"
+
+	// ADWS addresses the RootDSE with this magic object reference
+	adwsRootDSEReference = "11111111-1111-1111-1111-111111111111"
+
+	adwsEnumerationEndpoint = "Windows/Enumeration"
+	adwsResourceEndpoint    = "Windows/Resource"
+)
+
+// LdapSyntax values that ADWS returns base64 encoded
+var adwsBinarySyntaxes = map[string]bool{
+	"OctetString":        true,
+	"SecurityDescriptor": true,
+	"Sid":                true,
+	"ReplicaLink":        true,
+}
+
+// Synthetic attributes ADWS adds to every object
+var adwsSyntheticAttributes = map[string]bool{
+	"objectReferenceProperty":    true,
+	"container-hierarchy-parent": true,
+	"relativeDistinguishedName":  true,
+}
+
+// ADWS collects through Active Directory Web Services on port 9389 instead of LDAP. ADWS performs the LDAP
+// queries on the DC itself, so the results are the same objects as an LDAP dump.
+type ADWS struct {
+	LDAPOptions
+
+	client      *ntlmClient
+	connections map[string]*adwsConn
+	attributes  []string // Every non-constructed attribute in the schema, as ADWS has no "*"
+}
+
+func (a *ADWS) Connect() error {
+	if a.AuthDomain == "" {
+		a.AuthDomain = a.Domain
+	}
+
+	var err error
+	switch a.AuthMode {
+	case NTLM:
+		if a.User == "" {
+			return errors.New("ADWS needs a username and password, integrated authentication is not supported")
+		}
+		ui.Debug().Msgf("Doing NTLM auth over ADWS with user %s from domain %s", a.User, a.AuthDomain)
+		a.client, err = newNTLMClient(a.AuthDomain, a.User, a.Password, false)
+	case NTLMPTH:
+		ui.Debug().Msgf("Doing NTLM hash auth over ADWS with user %s from domain %s", a.User, a.AuthDomain)
+		a.client, err = newNTLMClient(a.AuthDomain, a.User, a.Password, true)
+	default:
+		return fmt.Errorf("bind method %v is not supported over ADWS, use ntlm or ntlmpth", a.AuthMode)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.connections = make(map[string]*adwsConn)
+	_, err = a.endpoint(adwsEnumerationEndpoint)
+	return err
+}
+
+func (a *ADWS) Disconnect() error {
+	if a.connections == nil {
+		return errors.New("not connected")
+	}
+	for _, conn := range a.connections {
+		conn.Close()
+	}
+	a.connections = nil
+	return nil
+}
+
+// endpoint returns the connection to an ADWS endpoint, each needs its own
+func (a *ADWS) endpoint(name string) (*adwsConn, error) {
+	if conn, found := a.connections[name]; found {
+		return conn, nil
+	}
+	conn, err := dialADWS(a.Server, a.Port, name, a.client, adwsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	a.connections[name] = conn
+	return conn, nil
+}
+
+func (a *ADWS) roundTrip(endpoint string, request func(to string) *xmlNode) (*xmlNode, error) {
+	conn, err := a.endpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	envelope := request(conn.To)
+	if a.Debug {
+		ui.Debug().Msgf("ADWS request: %v", envelope)
+	}
+	response, err := conn.RoundTrip(envelope)
+	if a.Debug && response != nil {
+		ui.Debug().Msgf("ADWS response: %v", response)
+	}
+	return response, err
+}
+
+func adwsEnvelope(action, to string, headers []*xmlNode, body ...*xmlNode) *xmlNode {
+	messageid, _ := uuid.NewV4()
+	return el("s:Envelope",
+		attr("xmlns:s", nsSOAP),
+		attr("xmlns:a", nsAddressing),
+		attr("xmlns:wsen", nsEnumeration),
+		attr("xmlns:ad", nsAD),
+		attr("xmlns:addata", nsADData),
+		attr("xmlns:xsd", nsXSD),
+		attr("xmlns:xsi", nsXSI),
+		el("s:Header",
+			el("a:Action", attr("s:mustUnderstand", "1"), action),
+			el("ad:instance", "ldap:389"),
+			headers,
+			el("a:MessageID", "urn:uuid:"+messageid.String()),
+			el("a:ReplyTo", el("a:Address", adwsAnonymous)),
+			el("a:To", attr("s:mustUnderstand", "1"), to),
+		),
+		el("s:Body", body),
+	)
+}
+
+// Dump can't resume, as enumeration contexts expire on the server shortly after use
+func (a *ADWS) Dump(do DumpOptions) ([]activedirectory.RawObject, error) {
+	if do.Split != NoSplit {
+		ui.Warn().Msg("Splitting searches is only supported by the LDAP transport, doing one search")
+		do.Split = NoSplit
+	}
+	output, err := newDumpOutput(do, a.Server, false)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+
+	if do.SearchBase == "" && do.Scope == ldap.ScopeBaseObject {
+		var rootdse activedirectory.RawObject
+		rootdse, err = a.rootDSE()
+		if err == nil {
+			err = output.Add(rootdse)
+		}
+	} else {
+		attributes := do.Attributes
+		if len(attributes) == 0 {
+			attributes, err = a.allAttributes()
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = a.enumerate(do, attributes, output.Add)
+	}
+	if err != nil {
+		return output.objects, err
+	}
+	return output.Finish()
+}
+
+// rootDSE is fetched with a WS-Transfer Get, as it can't be enumerated
+func (a *ADWS) rootDSE() (activedirectory.RawObject, error) {
+	response, err := a.roundTrip(adwsResourceEndpoint, func(to string) *xmlNode {
+		return adwsEnvelope(adwsActionGet, to, []*xmlNode{
+			el("ad:objectReferenceProperty", adwsRootDSEReference),
+		})
+	})
+	if err != nil {
+		return activedirectory.RawObject{}, fmt.Errorf("problem getting RootDSE: %v", err)
+	}
+	body := response.Child("Body")
+	if body == nil || len(body.Children) != 1 {
+		return activedirectory.RawObject{}, errors.New("RootDSE response has no object")
+	}
+	return adwsRawObject(body.Children[0]), nil
+}
+
+// allAttributes lists the attributes an LDAP search for "*" would return, which is everything that isn't constructed
+func (a *ADWS) allAttributes() ([]string, error) {
+	if a.attributes != nil {
+		return a.attributes, nil
+	}
+
+	rootdse, err := a.rootDSE()
+	if err != nil {
+		return nil, err
+	}
+	schema := rootdse.Attributes["schemaNamingContext"]
+	if len(schema) == 0 {
+		return nil, errors.New("RootDSE has no schemaNamingContext")
+	}
+
+	ui.Info().Msg("Listing attributes from schema, as ADWS needs them named ...")
+	attributes := []string{"distinguishedName"}
+	err = a.enumerate(DumpOptions{
+		SearchBase: schema[0],
+		Scope:      ldap.ScopeSingleLevel,
+		Query:      "(&(objectClass=attributeSchema)(!(systemFlags:1.2.840.113556.1.4.803:=4)))",
+	}, []string{"lDAPDisplayName"}, func(ro activedirectory.RawObject) error {
+		if name := ro.Attributes["lDAPDisplayName"]; len(name) == 1 && name[0] != "distinguishedName" {
+			attributes = append(attributes, name[0])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("problem listing schema attributes: %v", err)
+	}
+	ui.Debug().Msgf("Found %v attributes in schema", len(attributes))
+	a.attributes = attributes
+	return attributes, nil
+}
+
+func (a *ADWS) enumerate(do DumpOptions, attributes []string, emit func(activedirectory.RawObject) error) error {
+	if do.Query == "" {
+		do.Query = "(objectClass=*)"
+	}
+	var scope string
+	switch do.Scope {
+	case ldap.ScopeBaseObject:
+		scope = "base"
+	case ldap.ScopeSingleLevel:
+		scope = "oneLevel"
+	default:
+		scope = "subtree"
+	}
+
+	// The object is named by its distinguishedName, so always ask for that
+	if !slices.Contains(attributes, "distinguishedName") {
+		attributes = append([]string{"distinguishedName"}, attributes...)
+	}
+	selection := make([]*xmlNode, len(attributes))
+	for i, attribute := range attributes {
+		selection[i] = el("ad:SelectionProperty", "addata:"+attribute)
+	}
+
+	response, err := a.roundTrip(adwsEnumerationEndpoint, func(to string) *xmlNode {
+		return adwsEnvelope(adwsActionEnumerate, to, nil,
+			el("wsen:Enumerate",
+				el("wsen:Filter", attr("Dialect", nsLdapQuery),
+					el("adlq:LdapQuery", attr("xmlns:adlq", nsLdapQuery),
+						el("adlq:Filter", do.Query),
+						el("adlq:BaseObject", do.SearchBase),
+						el("adlq:Scope", scope),
+					),
+				),
+				el("ad:Selection", attr("Dialect", adwsDialectXPath), selection),
+			),
+		)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to execute enumerate request: %w", err)
+	}
+	context := response.Path("Body", "EnumerateResponse", "EnumerationContext")
+	if context == nil {
+		return errors.New("enumerate response has no enumeration context")
+	}
+	enumerationcontext := context.Text
+
+	var controls []*xmlNode
+	if do.NoSACL {
+		controls = append(controls, el("ad:control",
+			attr("type", "1.2.840.113556.1.4.801"),
+			attr("criticality", "true"),
+			el("ad:controlValue", attr("xsi:type", "xsd:base64Binary"), "MAMCAQc="), // SEQUENCE { INTEGER 7 }
+		))
+	}
+	if do.ShowDeleted {
+		controls = append(controls, el("ad:control",
+			attr("type", ldap.ControlTypeMicrosoftShowDeleted),
+			attr("criticality", "true"),
+		))
+	}
+
+	maxelements := do.ChunkSize
+	if maxelements <= 0 {
+		maxelements = 256
+	}
+	if do.MaxObjectsPerSecond > 0 && maxelements > do.MaxObjectsPerSecond {
+		// Smaller pages keep the bursts within the budget
+		maxelements = do.MaxObjectsPerSecond
+	}
+	pace := newPacer(do)
+
+	for {
+		pull := el("wsen:Pull",
+			el("wsen:EnumerationContext", enumerationcontext),
+			el("wsen:MaxElements", strconv.Itoa(maxelements)),
+		)
+		if len(controls) > 0 {
+			pull.Children = append(pull.Children, el("ad:controls", controls))
+		}
+		response, err := a.roundTrip(adwsEnumerationEndpoint, func(to string) *xmlNode {
+			return adwsEnvelope(adwsActionPull, to, nil, pull)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to execute pull request: %w", err)
+		}
+		pullresponse := response.Path("Body", "PullResponse")
+		if pullresponse == nil {
+			return errors.New("pull response has no results")
+		}
+		if context := pullresponse.Child("EnumerationContext"); context != nil {
+			enumerationcontext = context.Text
+		}
+		var pageobjects int
+		if items := pullresponse.Child("Items"); items != nil {
+			for _, item := range items.Children {
+				if err = emit(adwsRawObject(item)); err != nil {
+					return err
+				}
+			}
+			pageobjects = len(items.Children)
+		}
+		if pullresponse.Child("EndOfSequence") != nil {
+			return nil
+		}
+		pace.Wait(pageobjects)
+	}
+}
+
+// adwsRawObject converts an object from ADWS to what an LDAP search would have returned
+func adwsRawObject(item *xmlNode) activedirectory.RawObject {
+	var ro activedirectory.RawObject
+	ro.Init()
+	for _, attribute := range item.Children {
+		if adwsSyntheticAttributes[attribute.Name] {
+			continue
+		}
+		syntax, _ := attribute.Attr("LdapSyntax")
+		values := make([]string, 0, len(attribute.Children))
+		for _, value := range attribute.Children {
+			if value.Name == "value" {
+				values = append(values, adwsValue(syntax, value))
+			}
+		}
+		if attribute.Name == "distinguishedName" && len(values) > 0 {
+			ro.DistinguishedName = values[0]
+		}
+		ro.Attributes[attribute.Name] = values
+	}
+	return ro
+}
+
+func adwsValue(syntax string, value *xmlNode) string {
+	xsitype, _ := value.Attr("type")
+	switch {
+	case value.Binary:
+		return value.Text
+	case adwsBinarySyntaxes[syntax] || strings.HasSuffix(xsitype, "base64Binary"):
+		if decoded, err := value.Bytes(); err == nil {
+			return string(decoded)
+		}
+	case syntax == "Boolean":
+		return strings.ToUpper(value.Text)
+	case syntax == "GeneralizedTime" || syntax == "UTCTime" || strings.HasSuffix(xsitype, "dateTime"):
+		if t, err := time.Parse(time.RFC3339Nano, value.Text); err == nil {
+			if syntax == "UTCTime" {
+				return t.UTC().Format("060102150405Z")
+			}
+			return t.UTC().Format("20060102150405.0Z")
+		}
+	}
+	return value.Text
+}
@@ -0,0 +1,913 @@
+package collect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Minimal XML tree used for the SOAP messages exchanged with ADWS, which are encoded in the .NET Binary Format (MC-NBFX)
+// with the static (MC-NBFS) and in-band session (MC-NBFSE) dictionaries
+
+type xmlAttr struct {
+	Prefix, Name, Value string
+}
+
+type xmlNode struct {
+	Prefix, Name string
+	Attrs        []xmlAttr
+	Children     []*xmlNode
+	Text         string
+	Binary       bool // Text holds the raw bytes of a binary record, not base64
+}
+
+// el builds an element from a "prefix:name" and any mix of child elements, attributes and text
+func el(name string, content ...any) *xmlNode {
+	n := &xmlNode{}
+	n.Prefix, n.Name = splitQName(name)
+	for _, c := range content {
+		switch v := c.(type) {
+		case *xmlNode:
+			n.Children = append(n.Children, v)
+		case xmlAttr:
+			n.Attrs = append(n.Attrs, v)
+		case string:
+			n.Text += v
+		case []*xmlNode:
+			n.Children = append(n.Children, v...)
+		default:
+			panic(fmt.Sprintf("unsupported XML content %T", c))
+		}
+	}
+	return n
+}
+
+func attr(name, value string) xmlAttr {
+	prefix, local := splitQName(name)
+	return xmlAttr{Prefix: prefix, Name: local, Value: value}
+}
+
+func splitQName(name string) (string, string) {
+	if prefix, local, found := strings.Cut(name, ":"); found {
+		return prefix, local
+	}
+	return "", name
+}
+
+// Child returns the first child element with the local name, or nil
+func (n *xmlNode) Child(name string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Path follows child elements by local name
+func (n *xmlNode) Path(names ...string) *xmlNode {
+	for _, name := range names {
+		n = n.Child(name)
+	}
+	return n
+}
+
+func (n *xmlNode) Attr(name string) (string, bool) {
+	if n == nil {
+		return "", false
+	}
+	for _, a := range n.Attrs {
+		if a.Name == name && a.Prefix != "xmlns" {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Bytes returns the raw bytes of a binary record, or the base64 decoded text
+func (n *xmlNode) Bytes() ([]byte, error) {
+	if n.Binary {
+		return []byte(n.Text), nil
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(n.Text))
+}
+
+// String renders the node as text XML, for debugging
+func (n *xmlNode) String() string {
+	var sb strings.Builder
+	n.write(&sb)
+	return sb.String()
+}
+
+func (n *xmlNode) write(sb *strings.Builder) {
+	qname := n.Name
+	if n.Prefix != "" {
+		qname = n.Prefix + ":" + n.Name
+	}
+	sb.WriteString("<" + qname)
+	for _, a := range n.Attrs {
+		sb.WriteString(" ")
+		if a.Prefix != "" {
+			sb.WriteString(a.Prefix + ":")
+		}
+		sb.WriteString(a.Name + `="`)
+		xmlEscape(sb, a.Value)
+		sb.WriteString(`"`)
+	}
+	if n.Text == "" && len(n.Children) == 0 {
+		sb.WriteString("/>")
+		return
+	}
+	sb.WriteString(">")
+	if n.Binary {
+		sb.WriteString(base64.StdEncoding.EncodeToString([]byte(n.Text)))
+	} else {
+		xmlEscape(sb, n.Text)
+	}
+	for _, c := range n.Children {
+		c.write(sb)
+	}
+	sb.WriteString("</" + qname + ">")
+}
+
+func xmlEscape(sb *strings.Builder, s string) {
+	for _, r := range s {
+		switch r {
+		case '<':
+			sb.WriteString("&lt;")
+		case '>':
+			sb.WriteString("&gt;")
+		case '&':
+			sb.WriteString("&amp;")
+		case '"':
+			sb.WriteString("&quot;")
+		default:
+			sb.WriteRune(r)
+		}
+	}
+}
+
+// Record types from MC-NBFX
+const (
+	nbfxEndElement                 = 0x01
+	nbfxComment                    = 0x02
+	nbfxArray                      = 0x03
+	nbfxShortAttribute             = 0x04
+	nbfxAttribute                  = 0x05
+	nbfxShortDictionaryAttribute   = 0x06
+	nbfxDictionaryAttribute        = 0x07
+	nbfxShortXmlnsAttribute        = 0x08
+	nbfxXmlnsAttribute             = 0x09
+	nbfxShortDictionaryXmlnsAttr   = 0x0A
+	nbfxDictionaryXmlnsAttribute   = 0x0B
+	nbfxPrefixDictionaryAttributeA = 0x0C
+	nbfxPrefixAttributeA           = 0x26
+	nbfxShortElement               = 0x40
+	nbfxElement                    = 0x41
+	nbfxShortDictionaryElement     = 0x42
+	nbfxDictionaryElement          = 0x43
+	nbfxPrefixDictionaryElementA   = 0x44
+	nbfxPrefixElementA             = 0x5E
+
+	nbfxZeroText            = 0x80
+	nbfxOneText             = 0x82
+	nbfxFalseText           = 0x84
+	nbfxTrueText            = 0x86
+	nbfxInt8Text            = 0x88
+	nbfxInt16Text           = 0x8A
+	nbfxInt32Text           = 0x8C
+	nbfxInt64Text           = 0x8E
+	nbfxFloatText           = 0x90
+	nbfxDoubleText          = 0x92
+	nbfxDecimalText         = 0x94
+	nbfxDateTimeText        = 0x96
+	nbfxChars8Text          = 0x98
+	nbfxChars16Text         = 0x9A
+	nbfxChars32Text         = 0x9C
+	nbfxBytes8Text          = 0x9E
+	nbfxBytes16Text         = 0xA0
+	nbfxBytes32Text         = 0xA2
+	nbfxStartListText       = 0xA4
+	nbfxEndListText         = 0xA6
+	nbfxEmptyText           = 0xA8
+	nbfxDictionaryText      = 0xAA
+	nbfxUniqueIdText        = 0xAC
+	nbfxTimeSpanText        = 0xAE
+	nbfxUuidText            = 0xB0
+	nbfxUInt64Text          = 0xB2
+	nbfxBoolText            = 0xB4
+	nbfxUnicodeChars8Text   = 0xB6
+	nbfxUnicodeChars16Text  = 0xB8
+	nbfxUnicodeChars32Text  = 0xBA
+	nbfxQNameDictionaryText = 0xBC
+)
+
+// The start of the MC-NBFS static dictionary, which covers the SOAP envelope, addressing and fault strings used by
+// ADWS. Strings beyond this are decoded as placeholders, as none of the ADWS payload depends on them.
+var nbfsDictionary = map[int]string{
+	0x00: "mustUnderstand",
+	0x02: "Envelope",
+	0x04: "http://www.w3.org/2003/05/soap-envelope",
+	0x06: "http://www.w3.org/2005/08/addressing",
+	0x08: "Header",
+	0x0A: "Action",
+	0x0C: "To",
+	0x0E: "Body",
+	0x10: "Algorithm",
+	0x12: "RelatesTo",
+	0x14: "http://www.w3.org/2005/08/addressing/anonymous",
+	0x16: "URI",
+	0x18: "Reference",
+	0x1A: "MessageID",
+	0x1C: "Id",
+	0x1E: "Identifier",
+	0x20: "http://schemas.xmlsoap.org/ws/2005/02/rm",
+	0x22: "Transforms",
+	0x24: "Transform",
+	0x26: "DigestMethod",
+	0x28: "DigestValue",
+	0x2A: "Address",
+	0x2C: "ReplyTo",
+	0x2E: "SequenceAcknowledgement",
+	0x30: "AcknowledgementRange",
+	0x32: "Upper",
+	0x34: "Lower",
+	0x36: "BufferRemaining",
+	0x38: "http://schemas.microsoft.com/ws/2006/05/rm",
+	0x3A: "http://schemas.xmlsoap.org/ws/2005/02/rm/SequenceAcknowledgement",
+	0x3C: "SecurityTokenReference",
+	0x3E: "Sequence",
+	0x40: "MessageNumber",
+	0x42: "http://www.w3.org/2000/09/xmldsig#",
+	0x44: "http://www.w3.org/2000/09/xmldsig#enveloped-signature",
+	0x46: "KeyInfo",
+	0x48: "SignedInfo",
+	0x4A: "CanonicalizationMethod",
+	0x4C: "SignatureMethod",
+	0x4E: "SignatureValue",
+	0x50: "DataReference",
+	0x52: "EncryptedData",
+	0x54: "EncryptionMethod",
+	0x56: "CipherData",
+	0x58: "CipherValue",
+	0x5A: "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd",
+	0x5C: "Security",
+	0x5E: "Timestamp",
+	0x60: "Created",
+	0x62: "Expires",
+	0x64: "Length",
+	0x66: "ReferenceList",
+	0x68: "ValueType",
+	0x6A: "Type",
+	0x6C: "EncryptedHeader",
+	0x6E: "http://docs.oasis-open.org/wss/oasis-wss-wssecurity-secext-1.1.xsd",
+	0x70: "RequestSecurityTokenResponseCollection",
+	0x72: "http://schemas.xmlsoap.org/ws/2005/02/trust",
+	0x74: "http://schemas.xmlsoap.org/ws/2005/02/trust#BinarySecret",
+	0x76: "http://schemas.microsoft.com/ws/2006/02/transactions",
+	0x78: "s",
+	0x7A: "Fault",
+	0x7C: "MustUnderstand",
+	0x7E: "role",
+	0x80: "relay",
+	0x82: "Code",
+	0x84: "Reason",
+	0x86: "Text",
+	0x88: "Node",
+	0x8A: "Role",
+	0x8C: "Detail",
+	0x8E: "Value",
+	0x90: "Subcode",
+	0x92: "NotUnderstood",
+	0x94: "qname",
+	0x96: "",
+	0x98: "From",
+	0x9A: "FaultTo",
+	0x9C: "EndpointReference",
+	0x9E: "PortType",
+	0xA0: "ServiceName",
+	0xA2: "PortName",
+	0xA4: "ReferenceProperties",
+	0xA6: "RelationshipType",
+	0xA8: "Reply",
+	0xAA: "a",
+}
+
+// nbfxSession holds the strings the server has added to the session dictionary, they're valid for the whole connection
+type nbfxSession struct {
+	strings []string
+}
+
+func (s *nbfxSession) lookup(id int) string {
+	if id%2 == 0 {
+		if str, found := nbfsDictionary[id]; found {
+			return str
+		}
+		return fmt.Sprintf("dictionary_%v", id)
+	}
+	if index := id / 2; index < len(s.strings) {
+		return s.strings[index]
+	}
+	return fmt.Sprintf("session_%v", id)
+}
+
+// DecodeMessage decodes a sized envelope payload, which starts with the session dictionary strings added by this message
+func (s *nbfxSession) DecodeMessage(payload []byte) (*xmlNode, error) {
+	r := bufio.NewReader(bytes.NewReader(payload))
+	size, err := readMultiByteInt31(r)
+	if err != nil {
+		return nil, err
+	}
+	dictionary := io.LimitReader(r, int64(size))
+	dr := bufio.NewReader(dictionary)
+	for {
+		str, err := readNBFXString(dr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("problem decoding session dictionary: %v", err)
+		}
+		s.strings = append(s.strings, str)
+	}
+	return s.Decode(r)
+}
+
+// Decode reads one document and returns the root element
+func (s *nbfxSession) Decode(r *bufio.Reader) (*xmlNode, error) {
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	var current *xmlNode // element still accepting attributes
+
+	for {
+		recordtype, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+
+		switch {
+		case recordtype == nbfxEndElement:
+			if len(stack) == 1 {
+				return nil, errors.New("unbalanced end element")
+			}
+			stack = stack[:len(stack)-1]
+			current = nil
+		case recordtype == nbfxComment:
+			if _, err = readNBFXString(r); err != nil {
+				return nil, err
+			}
+		case recordtype == nbfxArray:
+			if err = s.decodeArray(r, parent); err != nil {
+				return nil, err
+			}
+			current = nil
+		case recordtype >= nbfxShortAttribute && recordtype <= 0x3F:
+			if current == nil {
+				return nil, fmt.Errorf("attribute record 0x%02x outside element", recordtype)
+			}
+			a, err := s.decodeAttribute(r, recordtype)
+			if err != nil {
+				return nil, err
+			}
+			current.Attrs = append(current.Attrs, a)
+		case recordtype >= nbfxShortElement && recordtype <= 0x77:
+			n, err := s.decodeElement(r, recordtype)
+			if err != nil {
+				return nil, err
+			}
+			parent.Children = append(parent.Children, n)
+			stack = append(stack, n)
+			current = n
+		case recordtype >= nbfxZeroText && recordtype <= nbfxQNameDictionaryText+1:
+			text, binary, err := s.decodeText(r, recordtype&^1)
+			if err != nil {
+				return nil, err
+			}
+			if binary {
+				parent.Binary = true
+			}
+			parent.Text += text
+			current = nil
+			if recordtype&1 == 1 {
+				if len(stack) == 1 {
+					return nil, errors.New("unbalanced end element")
+				}
+				stack = stack[:len(stack)-1]
+			}
+		default:
+			return nil, fmt.Errorf("unknown record type 0x%02x", recordtype)
+		}
+	}
+
+	if len(stack) != 1 {
+		return nil, errors.New("document ended inside an element")
+	}
+	if len(root.Children) != 1 {
+		return nil, fmt.Errorf("expected one root element, found %v", len(root.Children))
+	}
+	return root.Children[0], nil
+}
+
+func (s *nbfxSession) readDictionaryString(r *bufio.Reader) (string, error) {
+	id, err := readMultiByteInt31(r)
+	if err != nil {
+		return "", err
+	}
+	return s.lookup(id), nil
+}
+
+func (s *nbfxSession) decodeElement(r *bufio.Reader, recordtype byte) (*xmlNode, error) {
+	var n xmlNode
+	var err error
+	switch {
+	case recordtype == nbfxShortElement:
+		n.Name, err = readNBFXString(r)
+	case recordtype == nbfxElement:
+		if n.Prefix, err = readNBFXString(r); err == nil {
+			n.Name, err = readNBFXString(r)
+		}
+	case recordtype == nbfxShortDictionaryElement:
+		n.Name, err = s.readDictionaryString(r)
+	case recordtype == nbfxDictionaryElement:
+		if n.Prefix, err = readNBFXString(r); err == nil {
+			n.Name, err = s.readDictionaryString(r)
+		}
+	case recordtype < nbfxPrefixElementA:
+		n.Prefix = string(rune('a' + recordtype - nbfxPrefixDictionaryElementA))
+		n.Name, err = s.readDictionaryString(r)
+	default:
+		n.Prefix = string(rune('a' + recordtype - nbfxPrefixElementA))
+		n.Name, err = readNBFXString(r)
+	}
+	return &n, err
+}
+
+func (s *nbfxSession) decodeAttribute(r *bufio.Reader, recordtype byte) (xmlAttr, error) {
+	var a xmlAttr
+	var err error
+	switch {
+	case recordtype == nbfxShortAttribute:
+		a.Name, err = readNBFXString(r)
+	case recordtype == nbfxAttribute:
+		if a.Prefix, err = readNBFXString(r); err == nil {
+			a.Name, err = readNBFXString(r)
+		}
+	case recordtype == nbfxShortDictionaryAttribute:
+		a.Name, err = s.readDictionaryString(r)
+	case recordtype == nbfxDictionaryAttribute:
+		if a.Prefix, err = readNBFXString(r); err == nil {
+			a.Name, err = s.readDictionaryString(r)
+		}
+	case recordtype == nbfxShortXmlnsAttribute:
+		a.Name = "xmlns"
+		a.Value, err = readNBFXString(r)
+		return a, err
+	case recordtype == nbfxXmlnsAttribute:
+		a.Prefix = "xmlns"
+		if a.Name, err = readNBFXString(r); err == nil {
+			a.Value, err = readNBFXString(r)
+		}
+		return a, err
+	case recordtype == nbfxShortDictionaryXmlnsAttr:
+		a.Name = "xmlns"
+		a.Value, err = s.readDictionaryString(r)
+		return a, err
+	case recordtype == nbfxDictionaryXmlnsAttribute:
+		a.Prefix = "xmlns"
+		if a.Name, err = readNBFXString(r); err == nil {
+			a.Value, err = s.readDictionaryString(r)
+		}
+		return a, err
+	case recordtype < nbfxPrefixAttributeA:
+		a.Prefix = string(rune('a' + recordtype - nbfxPrefixDictionaryAttributeA))
+		a.Name, err = s.readDictionaryString(r)
+	default:
+		a.Prefix = string(rune('a' + recordtype - nbfxPrefixAttributeA))
+		a.Name, err = readNBFXString(r)
+	}
+	if err != nil {
+		return a, err
+	}
+
+	texttype, err := r.ReadByte()
+	if err != nil {
+		return a, err
+	}
+	if texttype < nbfxZeroText || texttype > nbfxQNameDictionaryText || texttype&1 == 1 {
+		return a, fmt.Errorf("invalid attribute value record 0x%02x", texttype)
+	}
+	a.Value, _, err = s.decodeText(r, texttype)
+	return a, err
+}
+
+// decodeText decodes a text record without the end element bit, and returns the text and whether it's raw bytes
+func (s *nbfxSession) decodeText(r *bufio.Reader, recordtype byte) (string, bool, error) {
+	readN := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	readLength := func(bytes int) (int, error) {
+		buf, err := readN(bytes)
+		if err != nil {
+			return 0, err
+		}
+		switch bytes {
+		case 1:
+			return int(buf[0]), nil
+		case 2:
+			return int(binary.LittleEndian.Uint16(buf)), nil
+		default:
+			return int(binary.LittleEndian.Uint32(buf)), nil
+		}
+	}
+
+	switch recordtype {
+	case nbfxZeroText:
+		return "0", false, nil
+	case nbfxOneText:
+		return "1", false, nil
+	case nbfxFalseText:
+		return "false", false, nil
+	case nbfxTrueText:
+		return "true", false, nil
+	case nbfxEmptyText:
+		return "", false, nil
+	case nbfxInt8Text:
+		b, err := r.ReadByte()
+		return strconv.Itoa(int(int8(b))), false, err
+	case nbfxInt16Text:
+		buf, err := readN(2)
+		if err != nil {
+			return "", false, err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), false, nil
+	case nbfxInt32Text:
+		buf, err := readN(4)
+		if err != nil {
+			return "", false, err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), false, nil
+	case nbfxInt64Text, nbfxUInt64Text, nbfxTimeSpanText:
+		buf, err := readN(8)
+		if err != nil {
+			return "", false, err
+		}
+		value := binary.LittleEndian.Uint64(buf)
+		switch recordtype {
+		case nbfxUInt64Text:
+			return strconv.FormatUint(value, 10), false, nil
+		case nbfxTimeSpanText:
+			return (time.Duration(int64(value)) * 100).String(), false, nil
+		}
+		return strconv.FormatInt(int64(value), 10), false, nil
+	case nbfxFloatText:
+		buf, err := readN(4)
+		if err != nil {
+			return "", false, err
+		}
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(buf))), 'g', -1, 32), false, nil
+	case nbfxDoubleText:
+		buf, err := readN(8)
+		if err != nil {
+			return "", false, err
+		}
+		return strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(buf)), 'g', -1, 64), false, nil
+	case nbfxDecimalText:
+		buf, err := readN(16)
+		if err != nil {
+			return "", false, err
+		}
+		return decodeDecimal(buf), false, nil
+	case nbfxDateTimeText:
+		buf, err := readN(8)
+		if err != nil {
+			return "", false, err
+		}
+		return decodeDateTime(binary.LittleEndian.Uint64(buf)).Format(time.RFC3339Nano), false, nil
+	case nbfxChars8Text, nbfxChars16Text, nbfxChars32Text:
+		length, err := readLength(1 << ((recordtype - nbfxChars8Text) / 2))
+		if err != nil {
+			return "", false, err
+		}
+		buf, err := readN(length)
+		return string(buf), false, err
+	case nbfxBytes8Text, nbfxBytes16Text, nbfxBytes32Text:
+		length, err := readLength(1 << ((recordtype - nbfxBytes8Text) / 2))
+		if err != nil {
+			return "", false, err
+		}
+		buf, err := readN(length)
+		return string(buf), true, err
+	case nbfxUnicodeChars8Text, nbfxUnicodeChars16Text, nbfxUnicodeChars32Text:
+		length, err := readLength(1 << ((recordtype - nbfxUnicodeChars8Text) / 2))
+		if err != nil {
+			return "", false, err
+		}
+		buf, err := readN(length)
+		if err != nil {
+			return "", false, err
+		}
+		u := make([]uint16, len(buf)/2)
+		for i := range u {
+			u[i] = binary.LittleEndian.Uint16(buf[i*2:])
+		}
+		return string(utf16.Decode(u)), false, nil
+	case nbfxStartListText:
+		var items []string
+		for {
+			itemtype, err := r.ReadByte()
+			if err != nil {
+				return "", false, err
+			}
+			if itemtype == nbfxEndListText {
+				break
+			}
+			item, _, err := s.decodeText(r, itemtype)
+			if err != nil {
+				return "", false, err
+			}
+			items = append(items, item)
+		}
+		return strings.Join(items, " "), false, nil
+	case nbfxDictionaryText:
+		str, err := s.readDictionaryString(r)
+		return str, false, err
+	case nbfxUniqueIdText, nbfxUuidText:
+		buf, err := readN(16)
+		if err != nil {
+			return "", false, err
+		}
+		guid := formatGUID(buf)
+		if recordtype == nbfxUniqueIdText {
+			guid = "urn:uuid:" + guid
+		}
+		return guid, false, nil
+	case nbfxBoolText:
+		b, err := r.ReadByte()
+		return strconv.FormatBool(b != 0), false, err
+	case nbfxQNameDictionaryText:
+		prefix, err := r.ReadByte()
+		if err != nil {
+			return "", false, err
+		}
+		name, err := s.readDictionaryString(r)
+		return string(rune('a'+prefix)) + ":" + name, false, err
+	}
+	return "", false, fmt.Errorf("unknown text record 0x%02x", recordtype)
+}
+
+// Arrays are an element repeated with one value each
+func (s *nbfxSession) decodeArray(r *bufio.Reader, parent *xmlNode) error {
+	recordtype, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if recordtype < nbfxShortElement || recordtype > 0x77 {
+		return fmt.Errorf("invalid array element record 0x%02x", recordtype)
+	}
+	template, err := s.decodeElement(r, recordtype)
+	if err != nil {
+		return err
+	}
+	for {
+		recordtype, err = r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if recordtype == nbfxEndElement {
+			break
+		}
+		a, err := s.decodeAttribute(r, recordtype)
+		if err != nil {
+			return err
+		}
+		template.Attrs = append(template.Attrs, a)
+	}
+	valuetype, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	count, err := readMultiByteInt31(r)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		value, _, err := s.decodeText(r, valuetype&^1)
+		if err != nil {
+			return err
+		}
+		n := *template
+		n.Text = value
+		parent.Children = append(parent.Children, &n)
+	}
+	return nil
+}
+
+// encodeNBFX writes the node as a document, with strings found in the dictionary written as references to it
+func encodeNBFX(w *bytes.Buffer, n *xmlNode, dictionary map[string]int) {
+	lookup := func(s string) (int, bool) {
+		id, found := dictionary[s]
+		return id, found
+	}
+
+	id, indictionary := lookup(n.Name)
+	switch {
+	case n.Prefix == "" && indictionary:
+		w.WriteByte(nbfxShortDictionaryElement)
+		writeMultiByteInt31(w, id)
+	case n.Prefix == "":
+		w.WriteByte(nbfxShortElement)
+		writeNBFXString(w, n.Name)
+	case len(n.Prefix) == 1 && n.Prefix[0] >= 'a' && n.Prefix[0] <= 'z' && indictionary:
+		w.WriteByte(nbfxPrefixDictionaryElementA + n.Prefix[0] - 'a')
+		writeMultiByteInt31(w, id)
+	case len(n.Prefix) == 1 && n.Prefix[0] >= 'a' && n.Prefix[0] <= 'z':
+		w.WriteByte(nbfxPrefixElementA + n.Prefix[0] - 'a')
+		writeNBFXString(w, n.Name)
+	case indictionary:
+		w.WriteByte(nbfxDictionaryElement)
+		writeNBFXString(w, n.Prefix)
+		writeMultiByteInt31(w, id)
+	default:
+		w.WriteByte(nbfxElement)
+		writeNBFXString(w, n.Prefix)
+		writeNBFXString(w, n.Name)
+	}
+
+	for _, a := range n.Attrs {
+		switch {
+		case a.Prefix == "" && a.Name == "xmlns":
+			w.WriteByte(nbfxShortXmlnsAttribute)
+			writeNBFXString(w, a.Value)
+			continue
+		case a.Prefix == "xmlns":
+			if id, found := lookup(a.Value); found {
+				w.WriteByte(nbfxDictionaryXmlnsAttribute)
+				writeNBFXString(w, a.Name)
+				writeMultiByteInt31(w, id)
+			} else {
+				w.WriteByte(nbfxXmlnsAttribute)
+				writeNBFXString(w, a.Name)
+				writeNBFXString(w, a.Value)
+			}
+			continue
+		}
+		id, found := lookup(a.Name)
+		switch {
+		case a.Prefix == "" && found:
+			w.WriteByte(nbfxShortDictionaryAttribute)
+			writeMultiByteInt31(w, id)
+		case a.Prefix == "":
+			w.WriteByte(nbfxShortAttribute)
+			writeNBFXString(w, a.Name)
+		case found:
+			w.WriteByte(nbfxDictionaryAttribute)
+			writeNBFXString(w, a.Prefix)
+			writeMultiByteInt31(w, id)
+		default:
+			w.WriteByte(nbfxAttribute)
+			writeNBFXString(w, a.Prefix)
+			writeNBFXString(w, a.Name)
+		}
+		encodeNBFXText(w, a.Value, false, false, dictionary)
+	}
+
+	if n.Text != "" {
+		encodeNBFXText(w, n.Text, n.Binary, len(n.Children) == 0, dictionary)
+		if len(n.Children) == 0 {
+			return
+		}
+	}
+	for _, c := range n.Children {
+		encodeNBFX(w, c, dictionary)
+	}
+	w.WriteByte(nbfxEndElement)
+}
+
+func encodeNBFXText(w *bytes.Buffer, text string, isbinary, endelement bool, dictionary map[string]int) {
+	var end byte
+	if endelement {
+		end = 1
+	}
+	if id, found := dictionary[text]; found && !isbinary {
+		w.WriteByte(nbfxDictionaryText | end)
+		writeMultiByteInt31(w, id)
+		return
+	}
+	if text == "" {
+		w.WriteByte(nbfxEmptyText | end)
+		return
+	}
+	base := byte(nbfxChars8Text)
+	if isbinary {
+		base = nbfxBytes8Text
+	}
+	switch {
+	case len(text) < 0x100:
+		w.WriteByte(base | end)
+		w.WriteByte(byte(len(text)))
+	case len(text) < 0x10000:
+		w.WriteByte((base + 2) | end)
+		w.Write(binary.LittleEndian.AppendUint16(nil, uint16(len(text))))
+	default:
+		w.WriteByte((base + 4) | end)
+		w.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(text))))
+	}
+	w.WriteString(text)
+}
+
+func readNBFXString(r *bufio.Reader) (string, error) {
+	length, err := readMultiByteInt31(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, length)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func writeNBFXString(w *bytes.Buffer, s string) {
+	writeMultiByteInt31(w, len(s))
+	w.WriteString(s)
+}
+
+// Seven bits at a time, least significant first, with the high bit set on all but the last byte
+func readMultiByteInt31(r io.ByteReader) (int, error) {
+	var value int
+	for i := 0; i < 5; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		value |= int(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return value, nil
+		}
+	}
+	return 0, errors.New("invalid multi byte integer")
+}
+
+func writeMultiByteInt31(w io.ByteWriter, value int) {
+	for value >= 0x80 {
+		w.WriteByte(byte(value) | 0x80)
+		value >>= 7
+	}
+	w.WriteByte(byte(value))
+}
+
+// The low 62 bits are 100ns ticks since year 1, the top two the time zone kind
+func decodeDateTime(value uint64) time.Time {
+	ticks := int64(value & 0x3FFFFFFFFFFFFFFF)
+	const unixEpochTicks = 621355968000000000
+	ticks -= unixEpochTicks
+	return time.Unix(ticks/10000000, (ticks%10000000)*100).UTC()
+}
+
+func decodeDecimal(buf []byte) string {
+	scale := int(buf[2])
+	negative := buf[3]&0x80 != 0
+	hi := binary.LittleEndian.Uint32(buf[4:])
+	lo := binary.LittleEndian.Uint64(buf[8:])
+	value := new(big.Int).Lsh(big.NewInt(int64(hi)), 64)
+	value.Or(value, new(big.Int).SetUint64(lo))
+	digits := value.String()
+	if scale > 0 {
+		for len(digits) <= scale {
+			digits = "0" + digits
+		}
+		digits = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+	if negative {
+		digits = "-" + digits
+	}
+	return digits
+}
+
+// .NET GUIDs have the first three fields little endian
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint16(b[4:]), binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
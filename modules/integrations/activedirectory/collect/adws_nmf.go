@@ -0,0 +1,311 @@
+package collect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// .NET Message Framing (MC-NMF) records
+const (
+	nmfVersion         = 0x00
+	nmfMode            = 0x01
+	nmfVia             = 0x02
+	nmfKnownEncoding   = 0x03
+	nmfSizedEnvelope   = 0x06
+	nmfEnd             = 0x07
+	nmfFault           = 0x08
+	nmfUpgradeRequest  = 0x09
+	nmfUpgradeResponse = 0x0A
+	nmfPreambleAck     = 0x0B
+	nmfPreambleEnd     = 0x0C
+
+	nmfModeDuplex            = 0x02
+	nmfEncodingBinarySession = 0x08 // application/soap+msbinsession1
+	nmfUpgradeNegotiate      = "application/negotiate"
+)
+
+// .NET NegotiateStream (MS-NNS) handshake message types
+const (
+	nnsHandshakeDone       = 0x14
+	nnsHandshakeError      = 0x15
+	nnsHandshakeInProgress = 0x16
+
+	nnsMaxPayload = 0xFC30
+)
+
+func writeNNSHandshake(w io.Writer, messageid byte, payload []byte) error {
+	header := []byte{messageid, 1, 0, 0, 0}
+	binary.BigEndian.PutUint16(header[3:], uint16(len(payload)))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+func readNNSHandshake(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if header[0] == nnsHandshakeError {
+		if len(payload) >= 4 {
+			return 0, nil, fmt.Errorf("authentication failed with error 0x%08x", binary.BigEndian.Uint32(payload))
+		}
+		return 0, nil, errors.New("authentication failed")
+	}
+	return header[0], payload, nil
+}
+
+// nnsHandshake authenticates the client on the connection, and returns the session that protects the following data
+func nnsHandshake(conn io.ReadWriter, client *ntlmClient) (*ntlmSession, error) {
+	if err := writeNNSHandshake(conn, nnsHandshakeInProgress, client.Negotiate()); err != nil {
+		return nil, err
+	}
+	messageid, challenge, err := readNNSHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if messageid != nnsHandshakeInProgress {
+		return nil, fmt.Errorf("unexpected handshake message 0x%02x instead of challenge", messageid)
+	}
+	authenticate, session, err := client.Authenticate(challenge)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeNNSHandshake(conn, nnsHandshakeInProgress, authenticate); err != nil {
+		return nil, err
+	}
+	messageid, _, err = readNNSHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	if messageid != nnsHandshakeDone {
+		return nil, fmt.Errorf("unexpected handshake message 0x%02x instead of completion", messageid)
+	}
+	return session, nil
+}
+
+// nnsConn sends and receives signed and sealed NNS data messages
+type nnsConn struct {
+	conn    io.ReadWriter
+	session *ntlmSession
+	pending []byte
+}
+
+func (nc *nnsConn) Read(p []byte) (int, error) {
+	if len(nc.pending) == 0 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(nc.conn, header); err != nil {
+			return 0, err
+		}
+		size := binary.LittleEndian.Uint32(header)
+		if size > nnsMaxPayload {
+			return 0, fmt.Errorf("NNS message of %v bytes is too large", size)
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(nc.conn, sealed); err != nil {
+			return 0, err
+		}
+		message, err := nc.session.Unseal(sealed)
+		if err != nil {
+			return 0, err
+		}
+		nc.pending = message
+	}
+	n := copy(p, nc.pending)
+	nc.pending = nc.pending[n:]
+	return n, nil
+}
+
+func (nc *nnsConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), nnsMaxPayload-16)]
+		sealed := nc.session.Seal(chunk)
+		message := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(sealed)), uint32(len(sealed)))
+		if _, err := nc.conn.Write(append(message, sealed...)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// adwsConn is an authenticated connection to one ADWS endpoint, exchanging SOAP envelopes
+type adwsConn struct {
+	conn    net.Conn
+	stream  *nnsConn
+	reader  *bufio.Reader
+	session nbfxSession
+	timeout time.Duration
+
+	To string // URL of the endpoint, also used in the SOAP headers
+}
+
+func dialADWS(server string, port uint16, endpoint string, client *ntlmClient, timeout time.Duration) (*adwsConn, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, fmt.Sprint(port)), timeout)
+	if err != nil {
+		return nil, err
+	}
+	ac := &adwsConn{
+		conn:    conn,
+		timeout: timeout,
+		To:      fmt.Sprintf("net.tcp://%v:%v/ActiveDirectoryWebServices/%v", server, port, endpoint),
+	}
+	if err = ac.open(client); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("problem opening ADWS endpoint %v: %v", ac.To, err)
+	}
+	return ac, nil
+}
+
+func (ac *adwsConn) open(client *ntlmClient) error {
+	ac.conn.SetDeadline(time.Now().Add(ac.timeout))
+
+	var preamble bytes.Buffer
+	preamble.Write([]byte{nmfVersion, 1, 0, nmfMode, nmfModeDuplex, nmfVia})
+	writeNBFXString(&preamble, ac.To)
+	preamble.Write([]byte{nmfKnownEncoding, nmfEncodingBinarySession, nmfUpgradeRequest})
+	writeNBFXString(&preamble, nmfUpgradeNegotiate)
+	if _, err := ac.conn.Write(preamble.Bytes()); err != nil {
+		return err
+	}
+
+	// Keep reading through the same buffer, the server may send the upgrade response and handshake together
+	rawreader := bufio.NewReader(ac.conn)
+	raw := struct {
+		io.Reader
+		io.Writer
+	}{rawreader, ac.conn}
+	if err := expectNMFRecord(rawreader, nmfUpgradeResponse); err != nil {
+		return err
+	}
+
+	session, err := nnsHandshake(raw, client)
+	if err != nil {
+		return err
+	}
+	ac.stream = &nnsConn{
+		conn:    raw,
+		session: session,
+	}
+	ac.reader = bufio.NewReader(ac.stream)
+
+	if _, err = ac.stream.Write([]byte{nmfPreambleEnd}); err != nil {
+		return err
+	}
+	return expectNMFRecord(ac.reader, nmfPreambleAck)
+}
+
+func expectNMFRecord(r *bufio.Reader, expected byte) error {
+	record, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch record {
+	case expected:
+		return nil
+	case nmfFault:
+		fault, err := readNBFXString(r)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("server sent fault %v", fault)
+	}
+	return fmt.Errorf("unexpected framing record 0x%02x", record)
+}
+
+// RoundTrip sends a SOAP envelope and returns the response envelope
+func (ac *adwsConn) RoundTrip(request *xmlNode) (*xmlNode, error) {
+	ac.conn.SetDeadline(time.Now().Add(ac.timeout))
+
+	// No strings are added to the session dictionary from our side
+	var payload bytes.Buffer
+	writeMultiByteInt31(&payload, 0)
+	encodeNBFX(&payload, request, nil)
+
+	var message bytes.Buffer
+	message.WriteByte(nmfSizedEnvelope)
+	writeMultiByteInt31(&message, payload.Len())
+	message.Write(payload.Bytes())
+	if _, err := ac.stream.Write(message.Bytes()); err != nil {
+		return nil, err
+	}
+
+	record, err := ac.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch record {
+	case nmfSizedEnvelope:
+	case nmfFault:
+		fault, err := readNBFXString(ac.reader)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("server sent fault %v", fault)
+	case nmfEnd:
+		return nil, errors.New("server closed the session")
+	default:
+		return nil, fmt.Errorf("unexpected framing record 0x%02x", record)
+	}
+
+	size, err := readMultiByteInt31(ac.reader)
+	if err != nil {
+		return nil, err
+	}
+	responsepayload := make([]byte, size)
+	if _, err = io.ReadFull(ac.reader, responsepayload); err != nil {
+		return nil, err
+	}
+	response, err := ac.session.DecodeMessage(responsepayload)
+	if err != nil {
+		return nil, fmt.Errorf("problem decoding response: %v", err)
+	}
+	if fault := response.Path("Body", "Fault"); fault != nil {
+		return nil, soapFaultError(fault)
+	}
+	return response, nil
+}
+
+func soapFaultError(fault *xmlNode) error {
+	reason := fault.Path("Reason", "Text")
+	message := "unknown reason"
+	if reason != nil {
+		message = reason.Text
+	}
+	if detail := fault.Child("Detail"); detail != nil {
+		// ADWS puts the LDAP error in the detail
+		var texts []string
+		var collect func(n *xmlNode)
+		collect = func(n *xmlNode) {
+			if n.Text != "" && !n.Binary {
+				texts = append(texts, n.Name+": "+n.Text)
+			}
+			for _, c := range n.Children {
+				collect(c)
+			}
+		}
+		collect(detail)
+		if len(texts) > 0 {
+			return fmt.Errorf("SOAP fault: %v (%v)", message, strings.Join(texts, ", "))
+		}
+	}
+	return fmt.Errorf("SOAP fault: %v", message)
+}
+
+func (ac *adwsConn) Close() error {
+	ac.conn.SetDeadline(time.Now().Add(ac.timeout))
+	ac.stream.Write([]byte{nmfEnd})
+	return ac.conn.Close()
+}
@@ -0,0 +1,277 @@
+package collect
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLMv2 (MS-NLMP) with session security, as ADWS requires every message to be signed and sealed
+
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateSign                    = 0x00000010
+	ntlmNegotiateSeal                    = 0x00000020
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiateKeyExch                 = 0x40000000
+	ntlmNegotiate56                      = 0x80000000
+
+	ntlmClientFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateSign | ntlmNegotiateSeal | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSecurity | ntlmNegotiateTargetInfo | ntlmNegotiate128 |
+		ntlmNegotiateKeyExch | ntlmNegotiate56
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+type ntlmClient struct {
+	Domain, User string
+	NTHash       []byte
+}
+
+func newNTLMClient(domain, user, password string, passthehash bool) (*ntlmClient, error) {
+	c := &ntlmClient{
+		Domain: domain,
+		User:   user,
+	}
+	if passthehash {
+		hash, err := hex.DecodeString(password)
+		if err != nil || len(hash) != 16 {
+			return nil, errors.New("NT hash must be 32 hex characters")
+		}
+		c.NTHash = hash
+	} else {
+		c.NTHash = ntHash(password)
+	}
+	return c, nil
+}
+
+func ntHash(password string) []byte {
+	h := md4.New()
+	h.Write(utf16le(password))
+	return h.Sum(nil)
+}
+
+func ntowfv2(nthash []byte, user, domain string) []byte {
+	return hmacMD5(nthash, utf16le(strings.ToUpper(user)+domain))
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	h := hmac.New(md5.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, r := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], r)
+	}
+	return b
+}
+
+func (c *ntlmClient) Negotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmClientFlags)
+	return msg
+}
+
+type ntlmChallenge struct {
+	Flags      uint32
+	Challenge  []byte
+	TargetInfo []byte
+}
+
+func parseNTLMChallenge(msg []byte) (ntlmChallenge, error) {
+	var challenge ntlmChallenge
+	if len(msg) < 48 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return challenge, errors.New("not an NTLM challenge message")
+	}
+	challenge.Flags = binary.LittleEndian.Uint32(msg[20:])
+	challenge.Challenge = msg[24:32]
+	targetinfo, err := ntlmField(msg, 40)
+	if err != nil {
+		return challenge, err
+	}
+	challenge.TargetInfo = targetinfo
+	return challenge, nil
+}
+
+// Fields are a length, a maximum length and an offset into the message
+func ntlmField(msg []byte, offset int) ([]byte, error) {
+	length := int(binary.LittleEndian.Uint16(msg[offset:]))
+	start := int(binary.LittleEndian.Uint32(msg[offset+4:]))
+	if start+length > len(msg) {
+		return nil, errors.New("NTLM field outside message")
+	}
+	return msg[start : start+length], nil
+}
+
+// Authenticate answers the challenge, and returns the authenticate message with the session keys for the connection
+func (c *ntlmClient) Authenticate(challengemsg []byte) ([]byte, *ntlmSession, error) {
+	challenge, err := parseNTLMChallenge(challengemsg)
+	if err != nil {
+		return nil, nil, err
+	}
+	flags := challenge.Flags & ntlmClientFlags
+	if flags&ntlmNegotiateSeal == 0 || flags&ntlmNegotiateExtendedSessionSecurity == 0 || flags&ntlmNegotiateKeyExch == 0 {
+		return nil, nil, fmt.Errorf("server does not support NTLM sealing with extended session security (flags 0x%08x)", challenge.Flags)
+	}
+
+	// Use the servers time if it gave it to us, so clock skew doesn't matter
+	timestamp := make([]byte, 8)
+	if value := ntlmAvPair(challenge.TargetInfo, ntlmAvTimestamp); len(value) == 8 {
+		copy(timestamp, value)
+	} else {
+		binary.LittleEndian.PutUint64(timestamp, uint64(time.Now().UnixNano()/100+116444736000000000))
+	}
+	clientchallenge := make([]byte, 8)
+	rand.Read(clientchallenge)
+
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientchallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(challenge.TargetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+
+	responsekey := ntowfv2(c.NTHash, c.User, c.Domain)
+	ntproofstr := hmacMD5(responsekey, challenge.Challenge, temp.Bytes())
+	ntresponse := append(ntproofstr, temp.Bytes()...)
+	lmresponse := make([]byte, 24)
+
+	keyexchangekey := hmacMD5(responsekey, ntproofstr)
+	exportedsessionkey := make([]byte, 16)
+	rand.Read(exportedsessionkey)
+	encryptedsessionkey := make([]byte, 16)
+	cipher, _ := rc4.NewCipher(keyexchangekey)
+	cipher.XORKeyStream(encryptedsessionkey, exportedsessionkey)
+
+	fields := [][]byte{
+		lmresponse,
+		ntresponse,
+		utf16le(c.Domain),
+		utf16le(c.User),
+		nil, // workstation
+		encryptedsessionkey,
+	}
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+	for i, field := range fields {
+		binary.LittleEndian.PutUint16(msg[12+i*8:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[14+i*8:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[16+i*8:], uint32(len(msg)))
+		msg = append(msg, field...)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], flags)
+
+	return msg, newNTLMSession(exportedsessionkey, flags, true), nil
+}
+
+func ntlmAvPair(targetinfo []byte, id uint16) []byte {
+	for len(targetinfo) >= 4 {
+		avid := binary.LittleEndian.Uint16(targetinfo)
+		length := int(binary.LittleEndian.Uint16(targetinfo[2:]))
+		if avid == ntlmAvEOL || 4+length > len(targetinfo) {
+			break
+		}
+		if avid == id {
+			return targetinfo[4 : 4+length]
+		}
+		targetinfo = targetinfo[4+length:]
+	}
+	return nil
+}
+
+// ntlmSession signs and seals messages in one direction and verifies and unseals them in the other
+type ntlmSession struct {
+	sendSignKey, recvSignKey []byte
+	sendSeal, recvSeal       *rc4.Cipher
+	sendSeq, recvSeq         uint32
+}
+
+func newNTLMSession(exportedsessionkey []byte, flags uint32, client bool) *ntlmSession {
+	key := func(sessionkey []byte, magic string) []byte {
+		h := md5.New()
+		h.Write(sessionkey)
+		h.Write([]byte(magic + "\x00"))
+		return h.Sum(nil)
+	}
+	// Weaker sealing uses fewer bytes of the session key
+	sealsessionkey := exportedsessionkey
+	if flags&ntlmNegotiate128 == 0 {
+		if flags&ntlmNegotiate56 != 0 {
+			sealsessionkey = exportedsessionkey[:7]
+		} else {
+			sealsessionkey = exportedsessionkey[:5]
+		}
+	}
+
+	clientsign := key(exportedsessionkey, "session key to client-to-server signing key magic constant")
+	serversign := key(exportedsessionkey, "session key to server-to-client signing key magic constant")
+	clientseal, _ := rc4.NewCipher(key(sealsessionkey, "session key to client-to-server sealing key magic constant"))
+	serverseal, _ := rc4.NewCipher(key(sealsessionkey, "session key to server-to-client sealing key magic constant"))
+
+	if client {
+		return &ntlmSession{sendSignKey: clientsign, recvSignKey: serversign, sendSeal: clientseal, recvSeal: serverseal}
+	}
+	return &ntlmSession{sendSignKey: serversign, recvSignKey: clientsign, sendSeal: serverseal, recvSeal: clientseal}
+}
+
+// Seal encrypts the message and returns the 16 byte signature followed by the encrypted message
+func (s *ntlmSession) Seal(message []byte) []byte {
+	result := make([]byte, 16+len(message))
+	s.sendSeal.XORKeyStream(result[16:], message)
+	s.signature(result[:16], s.sendSignKey, s.sendSeal, s.sendSeq, message)
+	s.sendSeq++
+	return result
+}
+
+// Unseal decrypts a signature and message from Seal, and verifies the signature
+func (s *ntlmSession) Unseal(sealed []byte) ([]byte, error) {
+	if len(sealed) < 16 {
+		return nil, errors.New("sealed message too short")
+	}
+	message := make([]byte, len(sealed)-16)
+	s.recvSeal.XORKeyStream(message, sealed[16:])
+	expected := make([]byte, 16)
+	s.signature(expected, s.recvSignKey, s.recvSeal, s.recvSeq, message)
+	s.recvSeq++
+	if !hmac.Equal(expected, sealed[:16]) {
+		return nil, errors.New("NTLM message signature mismatch")
+	}
+	return message, nil
+}
+
+func (s *ntlmSession) signature(out, signkey []byte, seal *rc4.Cipher, seq uint32, message []byte) {
+	seqnum := binary.LittleEndian.AppendUint32(nil, seq)
+	checksum := hmacMD5(signkey, seqnum, message)[:8]
+	binary.LittleEndian.PutUint32(out, 1)
+	seal.XORKeyStream(out[4:12], checksum)
+	copy(out[12:], seqnum)
+}
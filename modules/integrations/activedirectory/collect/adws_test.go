@@ -0,0 +1,429 @@
+package collect
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	ldap "github.com/lkarlslund/ldap/v3"
+)
+
+func TestNTLMKeys(t *testing.T) {
+	// Test vectors from MS-NLMP 4.2
+	if hash := hex.EncodeToString(ntHash("Password")); hash != "a4f49c406510bdcab6824ee7c30fd852" {
+		t.Errorf("NT hash is %v", hash)
+	}
+	if key := hex.EncodeToString(ntowfv2(ntHash("Password"), "User", "Domain")); key != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("NTOWFv2 is %v", key)
+	}
+
+	client := newNTLMSession(bytes.Repeat([]byte{0x55}, 16), ntlmClientFlags, true)
+	server := newNTLMSession(bytes.Repeat([]byte{0x55}, 16), ntlmClientFlags, false)
+	for _, message := range []string{"first", "second"} {
+		unsealed, err := server.Unseal(client.Seal([]byte(message)))
+		if err != nil || string(unsealed) != message {
+			t.Errorf("unsealed %q (%v), expected %q", unsealed, err, message)
+		}
+	}
+	sealed := client.Seal([]byte("tampered"))
+	sealed[20] ^= 1
+	if _, err := server.Unseal(sealed); err == nil {
+		t.Error("tampered message was accepted")
+	}
+}
+
+// adwsTestServer answers like a DC running ADWS would, for one account and a small directory
+type adwsTestServer struct {
+	listener       net.Listener
+	domain, user   string
+	password       string
+	objects        map[string][]*xmlNode // search base to items
+	lastSelection  []string
+	lastControls   []string
+	lastMaxElement string
+}
+
+func newADWSTestServer(t *testing.T) *adwsTestServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &adwsTestServer{
+		listener: listener,
+		domain:   "TEST",
+		user:     "alice",
+		password: "Secret123",
+		objects: map[string][]*xmlNode{
+			"CN=Schema,CN=Configuration,DC=test,DC=local": {
+				adwsTestItem("CN=Description,CN=Schema,CN=Configuration,DC=test,DC=local", adwsTestValue("lDAPDisplayName", "UnicodeString", "description")),
+				adwsTestItem("CN=Object-Sid,CN=Schema,CN=Configuration,DC=test,DC=local", adwsTestValue("lDAPDisplayName", "UnicodeString", "objectSid")),
+			},
+			"DC=test,DC=local": {
+				adwsTestItem("CN=Bob,CN=Users,DC=test,DC=local",
+					adwsTestValue("description", "UnicodeString", "Some user"),
+					el("addata:objectSid", attr("LdapSyntax", "Sid"), &xmlNode{Prefix: "ad", Name: "value", Text: "\x01\x01\x00\x00\x00\x00\x00\x05\x12\x00\x00\x00", Binary: true}),
+					el("addata:nTSecurityDescriptor", attr("LdapSyntax", "SecurityDescriptor"), el("ad:value", attr("xsi:type", "xsd:base64Binary"), "AQAEgA==")),
+					adwsTestValue("isCriticalSystemObject", "Boolean", "true"),
+					adwsTestValue("whenCreated", "GeneralizedTime", "2020-01-02T03:04:05Z"),
+				),
+				adwsTestItem("CN=Carol,CN=Users,DC=test,DC=local",
+					el("addata:memberOf", attr("LdapSyntax", "DSDNString"),
+						el("ad:value", "CN=Group1,DC=test,DC=local"),
+						el("ad:value", "CN=Group2,DC=test,DC=local"),
+					),
+				),
+			},
+		},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := s.serve(conn); err != nil && !errors.Is(err, io.EOF) {
+					t.Logf("test server: %v", err)
+				}
+			}()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func adwsTestItem(dn string, attributes ...*xmlNode) *xmlNode {
+	return el("addata:user",
+		el("ad:objectReferenceProperty", el("ad:value", attr("xsi:type", "xsd:string"), "2f1fa5d6-6ee3-4b25-9e61-5a0a8b1bc9d0")),
+		adwsTestValue("distinguishedName", "DSDNString", dn),
+		attributes,
+	)
+}
+
+func adwsTestValue(name, syntax, value string) *xmlNode {
+	return el("addata:"+name, attr("LdapSyntax", syntax), el("ad:value", attr("xsi:type", "xsd:string"), value))
+}
+
+func (s *adwsTestServer) options() LDAPOptions {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return LDAPOptions{
+		Domain:     "test.local",
+		Server:     addr.IP.String(),
+		Port:       uint16(addr.Port),
+		AuthMode:   NTLM,
+		User:       s.user,
+		Password:   s.password,
+		AuthDomain: s.domain,
+	}
+}
+
+func (s *adwsTestServer) serve(conn net.Conn) error {
+	raw := bufio.NewReader(conn)
+
+	// Preamble up to the upgrade request
+	for done := false; !done; {
+		record, err := raw.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch record {
+		case nmfVersion:
+			_, err = io.ReadFull(raw, make([]byte, 2))
+		case nmfMode, nmfKnownEncoding:
+			_, err = raw.ReadByte()
+		case nmfVia:
+			_, err = readNBFXString(raw)
+		case nmfUpgradeRequest:
+			_, err = readNBFXString(raw)
+			done = true
+		default:
+			return fmt.Errorf("unexpected preamble record 0x%02x", record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	conn.Write([]byte{nmfUpgradeResponse})
+
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{raw, conn}
+	session, err := s.authenticate(rw)
+	if err != nil {
+		return err
+	}
+	stream := &nnsConn{conn: rw, session: session}
+	reader := bufio.NewReader(stream)
+	if err = expectNMFRecord(reader, nmfPreambleEnd); err != nil {
+		return err
+	}
+	stream.Write([]byte{nmfPreambleAck})
+
+	var decoder nbfxSession
+	encoder := adwsTestEncoder{dictionary: map[string]int{}}
+	for id, str := range nbfsDictionary {
+		encoder.dictionary[str] = id
+	}
+	enumerations := map[string][]*xmlNode{}
+	for {
+		record, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if record == nmfEnd {
+			return nil
+		}
+		if record != nmfSizedEnvelope {
+			return fmt.Errorf("unexpected record 0x%02x", record)
+		}
+		size, err := readMultiByteInt31(reader)
+		if err != nil {
+			return err
+		}
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			return err
+		}
+		request, err := decoder.DecodeMessage(payload)
+		if err != nil {
+			return err
+		}
+		body := s.respond(request, enumerations)
+		if _, err = stream.Write(encoder.message(body)); err != nil {
+			return err
+		}
+	}
+}
+
+// authenticate is the server side of the NNS handshake, checking the NTLMv2 response against the known password
+func (s *adwsTestServer) authenticate(conn io.ReadWriter) (*ntlmSession, error) {
+	if _, _, err := readNNSHandshake(conn); err != nil {
+		return nil, err
+	}
+
+	serverchallenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	targetinfo := []byte{ntlmAvTimestamp, 0, 8, 0, 0, 0x80, 0x3e, 0xd5, 0xde, 0xb1, 0xd5, 0x01, ntlmAvEOL, 0, 0, 0}
+	challenge := make([]byte, 48)
+	copy(challenge, ntlmSignature)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	binary.LittleEndian.PutUint32(challenge[20:], ntlmClientFlags)
+	copy(challenge[24:], serverchallenge)
+	binary.LittleEndian.PutUint16(challenge[40:], uint16(len(targetinfo)))
+	binary.LittleEndian.PutUint16(challenge[42:], uint16(len(targetinfo)))
+	binary.LittleEndian.PutUint32(challenge[44:], 48)
+	challenge = append(challenge, targetinfo...)
+	if err := writeNNSHandshake(conn, nnsHandshakeInProgress, challenge); err != nil {
+		return nil, err
+	}
+
+	_, authenticate, err := readNNSHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	ntresponse, _ := ntlmField(authenticate, 20)
+	domain, _ := ntlmField(authenticate, 28)
+	user, _ := ntlmField(authenticate, 36)
+	encryptedkey, _ := ntlmField(authenticate, 52)
+	flags := binary.LittleEndian.Uint32(authenticate[60:])
+
+	responsekey := ntowfv2(ntHash(s.password), s.user, s.domain)
+	if len(ntresponse) < 16 || !bytes.Equal(domain, utf16le(s.domain)) || !bytes.Equal(user, utf16le(s.user)) ||
+		!bytes.Equal(ntresponse[:16], hmacMD5(responsekey, serverchallenge, ntresponse[16:])) {
+		writeNNSHandshake(conn, nnsHandshakeError, []byte{0x80, 0x09, 0x03, 0x0C}) // SEC_E_LOGON_DENIED
+		return nil, errors.New("logon denied")
+	}
+
+	exportedkey := make([]byte, 16)
+	cipher, _ := rc4.NewCipher(hmacMD5(responsekey, ntresponse[:16]))
+	cipher.XORKeyStream(exportedkey, encryptedkey)
+	if err = writeNNSHandshake(conn, nnsHandshakeDone, nil); err != nil {
+		return nil, err
+	}
+	return newNTLMSession(exportedkey, flags, false), nil
+}
+
+func (s *adwsTestServer) respond(request *xmlNode, enumerations map[string][]*xmlNode) *xmlNode {
+	switch action := request.Path("Header", "Action").Text; action {
+	case adwsActionGet:
+		return el("addata:top",
+			adwsTestValue("defaultNamingContext", "DSDNString", "DC=test,DC=local"),
+			adwsTestValue("schemaNamingContext", "DSDNString", "CN=Schema,CN=Configuration,DC=test,DC=local"),
+		)
+	case adwsActionEnumerate:
+		query := request.Path("Body", "Enumerate", "Filter", "LdapQuery")
+		base := query.Child("BaseObject").Text
+		items, found := s.objects[base]
+		if !found {
+			return el("s:Fault",
+				el("s:Reason", el("s:Text", "The specified directory service attribute or value does not exist.")),
+				el("s:Detail", el("ad:FaultDetail", el("ad:DirectoryError", el("ad:ErrorCode", "32")))),
+			)
+		}
+		s.lastSelection = nil
+		for _, property := range request.Path("Body", "Enumerate", "Selection").Children {
+			s.lastSelection = append(s.lastSelection, property.Text)
+		}
+		context := fmt.Sprintf("context-%v", len(enumerations))
+		enumerations[context] = items
+		return el("wsen:EnumerateResponse", el("wsen:EnumerationContext", context))
+	case adwsActionPull:
+		pull := request.Path("Body", "Pull")
+		context := pull.Child("EnumerationContext").Text
+		s.lastMaxElement = pull.Child("MaxElements").Text
+		s.lastControls = nil
+		if controls := pull.Child("controls"); controls != nil {
+			for _, control := range controls.Children {
+				controltype, _ := control.Attr("type")
+				s.lastControls = append(s.lastControls, controltype)
+			}
+		}
+		items := enumerations[context]
+		page := items[:min(1, len(items))]
+		enumerations[context] = items[len(page):]
+		response := el("wsen:PullResponse", el("wsen:EnumerationContext", context), el("wsen:Items", page))
+		if len(enumerations[context]) == 0 {
+			response.Children = append(response.Children, el("wsen:EndOfSequence"))
+		}
+		return response
+	default:
+		return el("s:Fault", el("s:Reason", el("s:Text", "Unknown action "+action)))
+	}
+}
+
+// adwsTestEncoder encodes responses like WCF does, adding strings to the session dictionary as they're used
+type adwsTestEncoder struct {
+	dictionary map[string]int
+	session    int
+}
+
+func (e *adwsTestEncoder) message(body *xmlNode) []byte {
+	envelope := el("s:Envelope",
+		attr("xmlns:s", nsSOAP),
+		attr("xmlns:a", nsAddressing),
+		attr("xmlns:wsen", nsEnumeration),
+		attr("xmlns:ad", nsAD),
+		attr("xmlns:addata", nsADData),
+		attr("xmlns:xsi", nsXSI),
+		el("s:Header", el("a:Action", "response")),
+		el("s:Body", body),
+	)
+
+	var newstrings bytes.Buffer
+	for _, str := range []string{"EnumerationContext", "Items", "value", "LdapSyntax", "distinguishedName", nsADData} {
+		if _, found := e.dictionary[str]; !found {
+			e.dictionary[str] = e.session*2 + 1
+			e.session++
+			writeNBFXString(&newstrings, str)
+		}
+	}
+	var payload bytes.Buffer
+	writeMultiByteInt31(&payload, newstrings.Len())
+	payload.Write(newstrings.Bytes())
+	encodeNBFX(&payload, envelope, e.dictionary)
+
+	var message bytes.Buffer
+	message.WriteByte(nmfSizedEnvelope)
+	writeMultiByteInt31(&message, payload.Len())
+	message.Write(payload.Bytes())
+	return message.Bytes()
+}
+
+func TestADWSDump(t *testing.T) {
+	server := newADWSTestServer(t)
+
+	ad := &ADWS{LDAPOptions: server.options()}
+	if err := ad.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer ad.Disconnect()
+
+	rootdse, err := ad.Dump(DumpOptions{Scope: ldap.ScopeBaseObject, ReturnObjects: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rootdse) != 1 || rootdse[0].Attributes["defaultNamingContext"][0] != "DC=test,DC=local" {
+		t.Fatalf("unexpected RootDSE %v", rootdse)
+	}
+
+	// No attributes given, so they're listed from the schema
+	objects, err := ad.Dump(DumpOptions{
+		SearchBase:    "DC=test,DC=local",
+		Scope:         ldap.ScopeWholeSubtree,
+		NoSACL:        true,
+		ShowDeleted:   true,
+		ChunkSize:     100,
+		ReturnObjects: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selection := strings.Join(server.lastSelection, ","); selection != "addata:distinguishedName,addata:description,addata:objectSid" {
+		t.Errorf("selection was %v", selection)
+	}
+	if controls := strings.Join(server.lastControls, ","); controls != "1.2.840.113556.1.4.801,"+ldap.ControlTypeMicrosoftShowDeleted {
+		t.Errorf("controls were %v", controls)
+	}
+	if server.lastMaxElement != "100" {
+		t.Errorf("max elements was %v", server.lastMaxElement)
+	}
+
+	if len(objects) != 2 {
+		t.Fatalf("got %v objects, expected 2", len(objects))
+	}
+	bob := objects[0]
+	if bob.DistinguishedName != "CN=Bob,CN=Users,DC=test,DC=local" {
+		t.Errorf("first object is %v", bob.DistinguishedName)
+	}
+	if _, found := bob.Attributes["objectReferenceProperty"]; found {
+		t.Error("synthetic ADWS attribute was returned")
+	}
+	for attribute, expected := range map[string]string{
+		"description":            "Some user",
+		"objectSid":              "\x01\x01\x00\x00\x00\x00\x00\x05\x12\x00\x00\x00",
+		"nTSecurityDescriptor":   "\x01\x00\x04\x80",
+		"isCriticalSystemObject": "TRUE",
+		"whenCreated":            "20200102030405.0Z",
+	} {
+		if values := bob.Attributes[attribute]; len(values) != 1 || values[0] != expected {
+			t.Errorf("attribute %v is %q, expected %q", attribute, values, expected)
+		}
+	}
+	if memberof := objects[1].Attributes["memberOf"]; len(memberof) != 2 {
+		t.Errorf("memberOf is %v", memberof)
+	}
+
+	_, err = ad.Dump(DumpOptions{SearchBase: "DC=missing", Attributes: []string{"description"}})
+	if err == nil || !strings.Contains(err.Error(), "does not exist") || !strings.Contains(err.Error(), "32") {
+		t.Errorf("expected SOAP fault with LDAP error, got %v", err)
+	}
+}
+
+func TestADWSWrongPassword(t *testing.T) {
+	server := newADWSTestServer(t)
+
+	options := server.options()
+	options.Password = "wrong"
+	ad := &ADWS{LDAPOptions: options}
+	if err := ad.Connect(); err == nil {
+		ad.Disconnect()
+		t.Fatal("connected with wrong password")
+	}
+
+	options.AuthMode = NTLMPTH
+	options.Password = hex.EncodeToString(ntHash(server.password))
+	ad = &ADWS{LDAPOptions: options}
+	if err := ad.Connect(); err != nil {
+		t.Fatalf("pass the hash failed: %v", err)
+	}
+	ad.Disconnect()
+}
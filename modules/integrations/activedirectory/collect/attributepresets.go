@@ -0,0 +1,42 @@
+package collect
+
+// AttributePresets can be given instead of a list of attributes to collect. "analysis" is what the analysis uses,
+// which leaves out bulky or confidential attributes like certificates, photos and LAPS passwords that "*" returns.
+var AttributePresets = map[string][]string{
+	"analysis": {
+		// Identity
+		"distinguishedName", "name", "displayName", "description", "objectClass", "objectCategory",
+		"structuralObjectClass", "objectGUID", "objectSid", "sIDHistory", "sAMAccountName", "sAMAccountType",
+		"userPrincipalName", "dNSHostName", "mS-DS-CreatorSID", "mS-DS-ConsistencyGuid",
+
+		// Permissions
+		"nTSecurityDescriptor", "msDS-AllowedToActOnBehalfOfOtherIdentity", "msDS-AllowedToDelegateTo",
+		"msDS-GroupMSAMembership", "msDS-HostServiceAccount", "msDS-HostServiceAccountBL", "fRSRootSecurity",
+		"msDFS-LinkSecurityDescriptorv2", "servicePrincipalName",
+
+		// Groups
+		"member", "memberOf", "primaryGroupID", "groupType", "adminCount",
+
+		// Accounts
+		"userAccountControl", "pwdLastSet", "lastLogon", "lastLogonTimestamp", "logonCount", "accountExpires",
+		"badPasswordTime", "badPwdCount", "logonHours", "scriptPath", "ms-Mcs-AdmPwdExpirationTime",
+		"operatingSystem", "operatingSystemVersion", "operatingSystemServicePack", "operatingSystemHotfix",
+
+		// Domain, trusts and GPOs
+		"gPLink", "gPOptions", "gPCFileSysPath", "nETBIOSName", "nCName", "dnsRoot", "fSMORoleOwner",
+		"msDS-Behavior-Version", "nTMixedDomain", "minPwdAge", "minPwdLength", "pwdProperties", "pwdHistoryLength",
+		"lockoutDuration", "trustDirection", "trustAttributes", "trustPartner", "trustType", "securityIdentifier",
+		"dsHeuristics",
+
+		// Schema and extended rights
+		"lDAPDisplayName", "schemaIDGUID", "attributeSecurityGUID", "rightsGUID", "subClassOf", "possSuperiors",
+		"systemPossSuperiors", "systemMayContain", "systemMustContain",
+
+		// Certificate services
+		"certificateTemplates", "pKIEnrollmentAccess", "pKIExtendedKeyUsage", "pKIExpirationPeriod",
+		"pKIOverlapPeriod", "msPKI-Certificate-Name-Flag",
+
+		// Bookkeeping
+		"whenCreated", "whenChanged", "isCriticalSystemObject", "systemFlags", "instanceType", "isDeleted",
+	},
+}
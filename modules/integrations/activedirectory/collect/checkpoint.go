@@ -0,0 +1,330 @@
+package collect
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/pierrec/lz4/v4"
+	"github.com/schollz/progressbar/v3"
+	"github.com/tinylib/msgp/msgp"
+)
+
+const (
+	checkpointSuffix = ".checkpoint.json"
+	partialSuffix    = ".partial" // Objects from the interrupted run while a resumed dump copies them over
+)
+
+// DumpCheckpoint is saved next to the objects file after every page of a paged dump, so an interrupted dump can
+// continue from the last completed page. It's kept when the dump completes, so a resumed collection can skip
+// the naming contexts that were already done.
+type DumpCheckpoint struct {
+	SearchBase string
+	Scope      int
+	Query      string
+	Attributes []string
+	NoSACL     bool
+	Split      SplitMode
+	Server     string // Paging cookies are only valid on the DC that handed them out
+
+	Partitions     []dumpPartition // The searches the dump was split into, as they can't be listed the same way again
+	Partition      int             // The search the cookie belongs to
+	Cookie         []byte          // Fetches the page after the last one written, or nil to start the search from the beginning
+	Objects        int             // Objects in the file up to and including the last completed page
+	PartitionStart int             // Objects in the file from the searches before the one the cookie belongs to
+	Complete       bool
+	Saved          time.Time
+}
+
+func checkpointFile(objectsfile string) string {
+	return strings.TrimSuffix(objectsfile, ".objects.msgp.lz4") + checkpointSuffix
+}
+
+func LoadDumpCheckpoint(path string) (DumpCheckpoint, error) {
+	var checkpoint DumpCheckpoint
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return checkpoint, err
+	}
+	err = json.Unmarshal(data, &checkpoint)
+	return checkpoint, err
+}
+
+// Save replaces the checkpoint in one go, so a crash never leaves half a checkpoint behind
+func (checkpoint DumpCheckpoint) Save(path string) error {
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// usableFor returns why the checkpoint can't be used to resume a dump, or an empty string if it can
+func (checkpoint DumpCheckpoint) usableFor(current DumpCheckpoint) string {
+	switch {
+	case checkpoint.SearchBase != current.SearchBase:
+		return "it is for another naming context"
+	case checkpoint.Scope != current.Scope || checkpoint.Query != current.Query ||
+		!slices.Equal(checkpoint.Attributes, current.Attributes) || checkpoint.NoSACL != current.NoSACL ||
+		checkpoint.Split != current.Split:
+		return "it was collected with other options"
+	case checkpoint.Server != current.Server && !checkpoint.Complete && len(checkpoint.Cookie) > 0:
+		return fmt.Sprintf("it was collected from another DC (%v)", checkpoint.Server)
+	}
+	return ""
+}
+
+// RemoveCheckpoints cleans up after a collection has completed, so the next --resume starts afresh
+func RemoveCheckpoints(datapath string) {
+	checkpoints, _ := filepath.Glob(filepath.Join(datapath, "*"+checkpointSuffix))
+	for _, checkpoint := range checkpoints {
+		os.Remove(checkpoint)
+	}
+}
+
+// dumpOutput takes the objects from a dump and writes them to the objects file, calls the OnObject callback
+// and keeps them if they're to be returned. For paged dumps to a file it also maintains the checkpoint.
+type dumpOutput struct {
+	do      DumpOptions
+	file    *objectsFile
+	objects []activedirectory.RawObject
+	bar     *progressbar.ProgressBar
+
+	checkpointing  bool
+	checkpointpath string
+	checkpoint     DumpCheckpoint
+	resume         *DumpCheckpoint // Checkpoint we're resuming from, until its objects have been replayed
+}
+
+func newDumpOutput(do DumpOptions, server string, paged bool) (*dumpOutput, error) {
+	o := &dumpOutput{
+		do: do,
+		bar: progressbar.NewOptions(-1,
+			progressbar.OptionSetDescription("Dumping from "+do.SearchBase+" ..."),
+			progressbar.OptionShowCount(),
+			progressbar.OptionShowIts(),
+			progressbar.OptionSetItsString("objects"),
+			progressbar.OptionOnCompletion(func() { fmt.Println() }),
+			progressbar.OptionThrottle(time.Second*1),
+		),
+	}
+	if do.WriteToFile == "" {
+		return o, nil
+	}
+
+	o.checkpointing = paged
+	o.checkpointpath = checkpointFile(do.WriteToFile)
+	o.checkpoint = DumpCheckpoint{
+		SearchBase: do.SearchBase,
+		Scope:      do.Scope,
+		Query:      do.Query,
+		Attributes: do.Attributes,
+		NoSACL:     do.NoSACL,
+		Split:      do.Split,
+		Server:     server,
+	}
+	partial := do.WriteToFile + partialSuffix
+
+	if paged && do.Resume {
+		checkpoint, err := LoadDumpCheckpoint(o.checkpointpath)
+		if err == nil {
+			if reason := checkpoint.usableFor(o.checkpoint); reason != "" {
+				ui.Warn().Msgf("Can't resume collection of %v, %v", do.SearchBase, reason)
+			} else {
+				o.resume = &checkpoint
+			}
+		} else if !os.IsNotExist(err) {
+			ui.Warn().Msgf("Problem reading checkpoint %v: %v", o.checkpointpath, err)
+		}
+	}
+
+	switch {
+	case o.resume != nil && o.resume.Complete:
+		// Everything is in the file already, it's only read back
+		ui.Info().Msgf("Collection of %v was completed by a previous run, reusing %v objects", do.SearchBase, o.resume.Objects)
+		return o, nil
+	case o.resume != nil:
+		// If a previous resume was interrupted while copying, the partial file is still the one matching the checkpoint
+		if _, err := os.Stat(partial); err != nil {
+			if err = os.Rename(do.WriteToFile, partial); err != nil {
+				ui.Warn().Msgf("Can't resume collection of %v: %v", do.SearchBase, err)
+				o.resume = nil
+			}
+		}
+	}
+	if o.resume != nil {
+		ui.Info().Msgf("Resuming collection of %v after %v objects", do.SearchBase, o.resume.Objects)
+	} else {
+		// A stale checkpoint must never be paired with the new file
+		os.Remove(o.checkpointpath)
+		os.Remove(partial)
+	}
+
+	var err error
+	o.file, err = createObjectsFile(do.WriteToFile, paged)
+	if err != nil {
+		return nil, fmt.Errorf("problem opening domain cache file: %v", err)
+	}
+	return o, nil
+}
+
+// ResumeCookie returns the paging cookie to continue from, or nil to start from the beginning
+func (o *dumpOutput) ResumeCookie() []byte {
+	if o.resume == nil {
+		return nil
+	}
+	return o.resume.Cookie
+}
+
+// ResumePartitions returns the searches of the dump being resumed and the one to continue with, or nil if not resuming
+func (o *dumpOutput) ResumePartitions() ([]dumpPartition, int) {
+	if o.resume == nil || o.resume.Complete {
+		return nil, 0
+	}
+	return o.resume.Partitions, o.resume.Partition
+}
+
+// SetPartitions records the searches the dump is split into
+func (o *dumpOutput) SetPartitions(partitions []dumpPartition) {
+	o.checkpoint.Partitions = partitions
+}
+
+// Complete reports whether a previous run collected everything already, so there's nothing to search for
+func (o *dumpOutput) Complete() bool {
+	return o.resume != nil && o.resume.Complete
+}
+
+// Resumed is called when the DC has accepted the resumed paging cookie, and passes on the objects from before it
+func (o *dumpOutput) Resumed() error {
+	if o.resume == nil {
+		return nil
+	}
+	return o.replay(o.resume.Objects)
+}
+
+// RestartPartition is called when the DC doesn't accept the paging cookie any more. The objects from the searches
+// before the one the cookie belongs to are passed on, and that search starts over from the beginning.
+func (o *dumpOutput) RestartPartition(partition int, reason error) error {
+	ui.Warn().Msgf("Can't resume search %v of %v from where it stopped, starting it over: %v", partition+1, o.do.SearchBase, reason)
+	if err := o.replay(o.resume.PartitionStart); err != nil {
+		return err
+	}
+	// The checkpoint must match the new file before anything else is written to it
+	return o.Page(partition, nil)
+}
+
+// replay passes on the first objects of the file being resumed, and stops resuming
+func (o *dumpOutput) replay(count int) error {
+	source := o.do.WriteToFile
+	if !o.resume.Complete {
+		source += partialSuffix
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("problem opening previously collected objects: %v", err)
+	}
+	defer f.Close()
+
+	// The file may end in a page that wasn't completed, so only read up to the checkpoint
+	d := msgp.NewReader(lz4.NewReader(f))
+	for i := 0; i < count; i++ {
+		var ro activedirectory.RawObject
+		if err = ro.DecodeMsg(d); err != nil {
+			return fmt.Errorf("problem reading previously collected object %v from %v: %v", i, source, err)
+		}
+		if err = o.Add(ro); err != nil {
+			return err
+		}
+	}
+	f.Close()
+
+	if !o.resume.Complete {
+		if err = o.file.Sync(); err != nil {
+			return err
+		}
+		os.Remove(source)
+	}
+	o.checkpoint.PartitionStart = o.resume.PartitionStart
+	o.resume = nil
+	return nil
+}
+
+func (o *dumpOutput) Add(ro activedirectory.RawObject) error {
+	if o.file != nil {
+		if err := ro.EncodeMsg(o.file.Writer); err != nil {
+			return fmt.Errorf("problem encoding LDAP object %v: %v", ro.DistinguishedName, err)
+		}
+	}
+	if o.do.OnObject != nil {
+		if err := o.do.OnObject(&ro); err != nil {
+			return err
+		}
+	}
+	if o.do.ReturnObjects {
+		// Grow one page at a time
+		if len(o.objects) == cap(o.objects) && o.do.ChunkSize > 0 {
+			newobjects := make([]activedirectory.RawObject, len(o.objects), cap(o.objects)+o.do.ChunkSize)
+			copy(newobjects, o.objects)
+			o.objects = newobjects
+		}
+		o.objects = append(o.objects, ro)
+	}
+	o.checkpoint.Objects++
+	o.bar.Add(1)
+	return nil
+}
+
+// Page is called after each completed page except the last, with the search and cookie that fetch the next one
+func (o *dumpOutput) Page(partition int, cookie []byte) error {
+	if !o.checkpointing {
+		return nil
+	}
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("problem writing domain cache file: %v", err)
+	}
+	if cookie == nil {
+		o.checkpoint.PartitionStart = o.checkpoint.Objects
+	}
+	o.checkpoint.Partition = partition
+	o.checkpoint.Cookie = cookie
+	o.checkpoint.Saved = time.Now()
+	if err := o.checkpoint.Save(o.checkpointpath); err != nil {
+		return fmt.Errorf("problem saving checkpoint: %v", err)
+	}
+	return nil
+}
+
+// Finish completes the objects file, and marks the checkpoint as complete
+func (o *dumpOutput) Finish() ([]activedirectory.RawObject, error) {
+	o.bar.Finish()
+	if o.file != nil {
+		if err := o.file.Close(); err != nil {
+			return o.objects, fmt.Errorf("problem writing domain cache file: %v", err)
+		}
+	}
+	if o.checkpointing {
+		o.checkpoint.Cookie = nil
+		o.checkpoint.Complete = true
+		o.checkpoint.Saved = time.Now()
+		if err := o.checkpoint.Save(o.checkpointpath); err != nil {
+			return o.objects, fmt.Errorf("problem saving checkpoint: %v", err)
+		}
+	}
+	return o.objects, nil
+}
+
+// Close releases the objects file if the dump fails, what was synced stays there for a resume
+func (o *dumpOutput) Close() {
+	if o.file != nil {
+		o.file.Close()
+	}
+}
@@ -0,0 +1,177 @@
+package collect
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+)
+
+func TestDumpCheckpointResume(t *testing.T) {
+	do := DumpOptions{
+		SearchBase:  "DC=test,DC=local",
+		Query:       "(objectClass=*)",
+		ChunkSize:   2,
+		WriteToFile: filepath.Join(t.TempDir(), "DC=test,DC=local.objects.msgp.lz4"),
+	}
+	user := func(i int) activedirectory.RawObject {
+		return rawObject(fmt.Sprintf("CN=User%v,DC=test,DC=local", i), fmt.Sprintf("guid-%v", i), "")
+	}
+
+	// The first run dies in the middle of the second page
+	output, err := newDumpOutput(do, "dc1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.Add(user(1))
+	output.Add(user(2))
+	if err = output.Page(0, []byte("cookie")); err != nil {
+		t.Fatal(err)
+	}
+	output.Add(user(3))
+	output.file.file.Close() // No flushing or closing of the compressed stream, like a crash
+
+	// Another DC doesn't know the cookie
+	do.Resume = true
+	output, err = newDumpOutput(do, "dc2", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.ResumeCookie() != nil {
+		t.Error("resuming from checkpoint made on another DC")
+	}
+	output.Close()
+	if _, err = os.Stat(checkpointFile(do.WriteToFile)); err == nil {
+		t.Error("stale checkpoint was kept")
+	}
+
+	// Start over, and die again
+	do.Resume = false
+	output, _ = newDumpOutput(do, "dc1", true)
+	output.Add(user(1))
+	output.Add(user(2))
+	output.Page(0, []byte("cookie"))
+	output.Add(user(3))
+	output.Close()
+
+	var seen []string
+	do.Resume = true
+	do.OnObject = func(ro *activedirectory.RawObject) error {
+		seen = append(seen, ro.DistinguishedName)
+		return nil
+	}
+	output, err = newDumpOutput(do, "dc1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie := string(output.ResumeCookie()); cookie != "cookie" {
+		t.Fatalf("resume cookie is %q", cookie)
+	}
+	if err = output.Resumed(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 {
+		t.Errorf("replayed %v, expected the 2 objects from the completed page", seen)
+	}
+	output.Add(user(3))
+	output.Add(user(4))
+	if _, err = output.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(do.WriteToFile + partialSuffix); err == nil {
+		t.Error("partial file was not removed")
+	}
+
+	// A finished dump is read back without searching
+	seen = nil
+	output, err = newDumpOutput(do, "dc2", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !output.Complete() {
+		t.Fatal("completed dump is not reused")
+	}
+	if err = output.Resumed(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = output.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 4 || seen[3] != "CN=User4,DC=test,DC=local" {
+		t.Errorf("completed dump replayed %v", seen)
+	}
+
+	// Other options mean a new dump
+	do.Attributes = []string{"description"}
+	output, _ = newDumpOutput(do, "dc1", true)
+	if output.Complete() || output.ResumeCookie() != nil {
+		t.Error("checkpoint reused with other attributes")
+	}
+	output.Close()
+}
+
+func TestDumpCheckpointRestartPartition(t *testing.T) {
+	do := DumpOptions{
+		SearchBase:  "DC=test,DC=local",
+		Query:       "(objectClass=*)",
+		ChunkSize:   2,
+		Split:       SplitByObjectClass,
+		WriteToFile: filepath.Join(t.TempDir(), "DC=test,DC=local.objects.msgp.lz4"),
+	}
+	user := func(i int) activedirectory.RawObject {
+		return rawObject(fmt.Sprintf("CN=User%v,DC=test,DC=local", i), fmt.Sprintf("guid-%v", i), "")
+	}
+
+	// The first search completes, and the second one dies in the middle of its second page
+	output, err := newDumpOutput(do, "dc1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output.SetPartitions(objectClassPartitions(do))
+	output.Add(user(1))
+	output.Add(user(2))
+	output.Page(1, nil)
+	output.Add(user(3))
+	output.Add(user(4))
+	output.Page(1, []byte("cookie"))
+	output.Add(user(5))
+	output.Close()
+
+	var seen []string
+	do.Resume = true
+	do.OnObject = func(ro *activedirectory.RawObject) error {
+		seen = append(seen, ro.DistinguishedName)
+		return nil
+	}
+	output, err = newDumpOutput(do, "dc1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, current := output.ResumePartitions(); current != 1 {
+		t.Fatalf("resuming search %v, expected 1", current)
+	}
+
+	// The DC has forgotten the cookie, so only the first search is kept
+	if err = output.RestartPartition(1, errors.New("unwilling to perform")); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 2 || output.ResumeCookie() != nil {
+		t.Errorf("replayed %v, expected the 2 objects from the first search", seen)
+	}
+	checkpoint, err := LoadDumpCheckpoint(checkpointFile(do.WriteToFile))
+	if err != nil || checkpoint.Partition != 1 || checkpoint.Cookie != nil || checkpoint.Objects != 2 {
+		t.Errorf("checkpoint after restart is %+v (%v)", checkpoint, err)
+	}
+	for i := 3; i <= 5; i++ {
+		output.Add(user(i))
+	}
+	if _, err = output.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 5 || seen[4] != "CN=User5,DC=test,DC=local" {
+		t.Errorf("dump has %v", seen)
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -41,11 +43,12 @@ var (
 	ntdsfile = Command.Flags().String("ntdsfile", "", "Import AD objects from NTDS.DIT file")
 
 	servers = Command.Flags().StringArray("server", nil, "DC to connect to, use IP or full hostname, random DC is auto-detected if not supplied")
-	port    = Command.Flags().Int("port", -1, "LDAP port to connect to (389 or 636 typical, -1 for auto based on tlsmode)")
+	port    = Command.Flags().Int("port", -1, "LDAP port to connect to (389 or 636 typical, -1 for auto based on tlsmode and transport)")
 	domain  = Command.Flags().String("domain", "", "domain suffix to analyze (auto-detected if not supplied)")
 	user    = Command.Flags().String("username", "", "username to connect with")
 	pass    = Command.Flags().String("password", "", "password to connect with (use ! for blank password)")
 
+	transport      = Command.Flags().String("transport", "ldap", "Protocol to collect with (ldap, adws - Active Directory Web Services on port 9389, supports ntlm and ntlmpth authmode)")
 	tlsmodeString  = Command.Flags().String("tlsmode", "NoTLS", "Transport mode (TLS, StartTLS, NoTLS)")
 	channelbinding = Command.Flags().Bool("channelbinding", true, "Enable channel binding when connecting to LDAP")
 	ignoreCert     = Command.Flags().Bool("ignorecert", false, "Disable certificate checks")
@@ -53,11 +56,16 @@ var (
 	ldapdebug = Command.Flags().Bool("ldapdebug", false, "Enable LDAP debugging")
 
 	authdomain      = Command.Flags().String("authdomain", "", "domain for authentication, if using ntlm auth")
-	attributesparam = Command.Flags().String("attributes", "*", "Comma seperated list of attributes to get, * = all, or a comma seperated list of attribute names (expert)")
+	attributesparam = Command.Flags().String("attributes", "*", "Comma seperated list of attributes to get, * = all, analysis = only what adalanche uses, or a comma seperated list of attribute names (expert)")
 
 	nosacl   = Command.Flags().Bool("nosacl", true, "Request data with NO SACL flag, allows normal users to dump ntSecurityDescriptor field")
 	pagesize = Command.Flags().Int("pagesize", 1000, "Number of objects per request to collect (increase for performance, but some DCs have limits)")
 
+	pagedelay           = Command.Flags().Duration("pagedelay", 0, "Pause between requests for pages of objects (e.g. 2s)")
+	pagejitter          = Command.Flags().Duration("pagejitter", 0, "Add a random pause of up to this much to each pagedelay")
+	maxobjectspersecond = Command.Flags().Int("maxobjectspersecond", 0, "Limit collection to this many objects per second on average, 0 = unlimited (also limits pagesize)")
+	splitString         = Command.Flags().String("split", "none", "Split collection of each naming context into several searches (none, objectclass, ou) - LDAP only")
+
 	collectconfiguration = Command.Flags().String("configuration", "auto", "Collect Active Directory Configuration")
 	collectschema        = Command.Flags().String("schema", "auto", "Collect Active Directory Schema")
 	collectother         = Command.Flags().String("other", "auto", "Collect other Active Directory contexts (typically integrated DNS zones)")
@@ -67,9 +75,12 @@ var (
 	AuthmodeString       = Command.Flags().String("authmode", "ntlm", "Bind mode: unauth/anonymous, basic/simple, digest/md5, kerberoscache, ntlm, ntlmpth (password is hash)")
 
 	purgeolddata = Command.Flags().Bool("purgeolddata", false, "Purge existing data from the datapath if connection to DC is successfull")
+	resume       = Command.Flags().Bool("resume", false, "Continue an interrupted LDAP collection from the last completed page, and skip the naming contexts it already finished")
+	incremental  = Command.Flags().Bool("incremental", false, "Only collect objects changed or deleted since the last collection from the same DC, and merge them into the existing data (falls back to full collection)")
 
-	authmode AuthMode
-	tlsmode  TLSmode
+	authmode  AuthMode
+	tlsmode   TLSmode
+	splitmode SplitMode
 )
 
 func init() {
@@ -92,8 +103,25 @@ func PreRun(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("unknown TLS mode %v", tlsmode)
 	}
 
+	if *resume && *purgeolddata {
+		return errors.New("--resume continues from the existing data, it can't be combined with --purgeolddata")
+	}
+
+	splitmode, err = SplitModeString(*splitString)
+	if err != nil {
+		return err
+	}
+
+	switch *transport {
+	case "ldap", "adws":
+	default:
+		return fmt.Errorf("unknown transport %v", *transport)
+	}
+
 	if *port == -1 {
-		if tlsmode == TLS {
+		if *transport == "adws" {
+			*port = ADWSPort
+		} else if tlsmode == TLS {
 			*port = 636
 		} else {
 			*port = 389
@@ -138,7 +166,7 @@ func PreRun(cmd *cobra.Command, args []string) error {
 				return errors.New("AD controller auto-detection failed, use '--server' parameter")
 			}
 
-			if runtime.GOOS != "windows" && *user == "" && authmode != KerberosCache {
+			if (runtime.GOOS != "windows" || *transport == "adws") && *user == "" && authmode != KerberosCache {
 				// Auto-detect user
 				*user = os.Getenv("USERNAME")
 				if *user != "" {
@@ -169,6 +197,10 @@ func PreRun(cmd *cobra.Command, args []string) error {
 		if runtime.GOOS != "windows" {
 			return errors.New("You need to supply a username and password for platforms other than Windows")
 		}
+
+		if *transport == "adws" {
+			return errors.New("You need to supply a username and password when collecting over ADWS")
+		}
 	} else {
 		if *pass == "" {
 			fmt.Printf("Please enter password for %v: ", *user)
@@ -311,7 +343,11 @@ func Execute(cmd *cobra.Command, args []string) error {
 		var chosenserver string
 		for _, server := range *servers {
 			options.Server = server
-			ad = CreateDumper(options)
+			if *transport == "adws" {
+				ad = &ADWS{LDAPOptions: options}
+			} else {
+				ad = CreateDumper(options)
+			}
 
 			err := ad.Connect()
 			if err == nil {
@@ -333,7 +369,11 @@ func Execute(cmd *cobra.Command, args []string) error {
 		case "*":
 			// don't do anything
 		default:
-			attributes = strings.Split(*attributesparam, ",")
+			if preset, found := AttributePresets[*attributesparam]; found {
+				attributes = slices.Clone(preset)
+			} else {
+				attributes = strings.Split(*attributesparam, ",")
+			}
 		}
 
 		ui.Info().Msg("Probing RootDSE ...")
@@ -354,6 +394,19 @@ func Execute(cmd *cobra.Command, args []string) error {
 
 		rd := rootdse[0]
 
+		// Changes made while we're collecting will be picked up again next time, which is harmless
+		var dc DCSyncInfo
+		if len(rd.Attributes["dsServiceName"]) > 0 && len(rd.Attributes["highestCommittedUSN"]) > 0 {
+			usn, err := strconv.ParseInt(rd.Attributes["highestCommittedUSN"][0], 10, 64)
+			if err == nil {
+				dc.Server = rd.Attributes["dsServiceName"][0]
+				dc.HighestCommittedUSN = usn
+			}
+		}
+		if *incremental && dc.Server == "" {
+			ui.Warn().Msg("DC did not return its highest committed USN, doing full collection")
+		}
+
 		namingcontexts := map[string]bool{}
 		for _, context := range rd.Attributes["namingContexts"] {
 			namingcontexts[context] = false
@@ -422,6 +475,11 @@ func Execute(cmd *cobra.Command, args []string) error {
 			ui.Error().Msgf("Expected 1 Active Directory RootDSE object, but got %v", len(rootdse))
 		}
 
+		if *incremental && len(attributes) > 0 && !slices.Contains(attributes, "objectGUID") {
+			// Needed to match up changed and deleted objects with the existing ones
+			attributes = append(attributes, "objectGUID")
+		}
+
 		do := DumpOptions{
 			Attributes:    attributes,
 			Query:         "(objectClass=*)",
@@ -429,6 +487,12 @@ func Execute(cmd *cobra.Command, args []string) error {
 			NoSACL:        *nosacl,
 			ChunkSize:     *pagesize,
 			ReturnObjects: false,
+			Resume:        *resume,
+
+			PageDelay:           *pagedelay,
+			PageJitter:          *pagejitter,
+			MaxObjectsPerSecond: *maxobjectspersecond,
+			Split:               splitmode,
 		}
 
 		cs, _ := util.ParseBool(*collectschema)
@@ -436,9 +500,8 @@ func Execute(cmd *cobra.Command, args []string) error {
 			ui.Info().Msgf("Collecting schema objects from %v ...", schemaContext)
 			do.SearchBase = schemaContext
 			do.WriteToFile = filepath.Join(datapath, do.SearchBase+".objects.msgp.lz4")
-			_, err = ad.Dump(do)
+			err = collectNamingContext(ad, do, dc, *incremental)
 			if err != nil {
-				os.Remove(do.WriteToFile)
 				return fmt.Errorf("problem collecting Active Directory schema objects: %v", err)
 			}
 		}
@@ -458,9 +521,8 @@ func Execute(cmd *cobra.Command, args []string) error {
 				}
 			}
 
-			_, err = ad.Dump(do)
+			err = collectNamingContext(ad, do, dc, *incremental)
 			if err != nil {
-				os.Remove(do.WriteToFile)
 				return fmt.Errorf("problem collecting Active Directory configuration objects: %v", err)
 			}
 		}
@@ -472,9 +534,8 @@ func Execute(cmd *cobra.Command, args []string) error {
 				ui.Info().Msgf("Collecting from base DN %v ...", context)
 				do.SearchBase = context
 				do.WriteToFile = filepath.Join(datapath, do.SearchBase+".objects.msgp.lz4")
-				_, err = ad.Dump(do)
+				err = collectNamingContext(ad, do, dc, *incremental)
 				if err != nil {
-					os.Remove(do.WriteToFile)
 					return fmt.Errorf("problem collecting Active Directory Forest DNS objects: %v", err)
 				}
 			}
@@ -495,9 +556,8 @@ func Execute(cmd *cobra.Command, args []string) error {
 				}
 			}
 
-			_, err = ad.Dump(do)
+			err = collectNamingContext(ad, do, dc, *incremental)
 			if err != nil {
-				os.Remove(do.WriteToFile)
 				return fmt.Errorf("problem collecting Active Directory objects: %v", err)
 			}
 		}
@@ -506,6 +566,8 @@ func Execute(cmd *cobra.Command, args []string) error {
 		if err != nil {
 			return fmt.Errorf("problem disconnecting from AD: %v", err)
 		}
+
+		RemoveCheckpoints(datapath)
 	}
 
 	if *collectgpos == "auto" || cp {
@@ -598,7 +660,7 @@ func Execute(cmd *cobra.Command, args []string) error {
 					gpodatafile := filepath.Join(datapath, gpoguid[0]+".gpodata.json")
 					f, err := os.Create(gpodatafile)
 					if err != nil {
-						ui.Error().Msgf("Problem writing GPO information to %v: %v")
+						ui.Error().Msgf("Problem writing GPO information to %v: %v", gpodatafile, err)
 					}
 					defer f.Close()
 
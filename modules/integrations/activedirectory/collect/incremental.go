@@ -0,0 +1,299 @@
+package collect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/pierrec/lz4/v4"
+	"github.com/tinylib/msgp/msgp"
+)
+
+const syncStateSuffix = ".syncstate.json"
+
+// Deleted objects are only visible as tombstones for this long (the default tombstoneLifetime), so older
+// collections can't be updated incrementally without missing deletions
+const maxIncrementalAge = 180 * 24 * time.Hour
+
+// SyncState is saved next to the objects file of a naming context, so the next run can fetch only what changed since then
+type SyncState struct {
+	SearchBase          string
+	Server              string // dsServiceName of the DC, USNs are local to each DC
+	HighestCommittedUSN int64
+	Collected           time.Time
+}
+
+// DCSyncInfo is what the RootDSE of the DC we're talking to says, read before collection starts
+type DCSyncInfo struct {
+	Server              string
+	HighestCommittedUSN int64
+}
+
+func syncStateFile(objectsfile string) string {
+	return strings.TrimSuffix(objectsfile, ".objects.msgp.lz4") + syncStateSuffix
+}
+
+func LoadSyncState(path string) (SyncState, error) {
+	var state SyncState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func (state SyncState) Save(path string) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// usableFor returns why the state can't be used for an incremental collection, or an empty string if it can
+func (state SyncState) usableFor(do DumpOptions, dc DCSyncInfo) string {
+	switch {
+	case state.SearchBase != do.SearchBase:
+		return "it is for another naming context"
+	case state.Server != dc.Server:
+		return fmt.Sprintf("it was collected from another DC (%v)", state.Server)
+	case state.HighestCommittedUSN > dc.HighestCommittedUSN:
+		return "the DC has a lower USN than last time, it may have been restored"
+	case time.Since(state.Collected) > maxIncrementalAge:
+		return "it is older than the tombstone lifetime"
+	}
+	return ""
+}
+
+// collectNamingContext dumps a naming context to do.WriteToFile, and records the USN of the DC afterwards. If incremental
+// is set and the previous collection came from the same DC, only changed and deleted objects are fetched and merged
+// into the existing file. do.OnObject is called for all objects in the resulting file either way.
+func collectNamingContext(ad LDAPDumper, do DumpOptions, dc DCSyncInfo, incremental bool) error {
+	statefile := syncStateFile(do.WriteToFile)
+	newstate := SyncState{
+		SearchBase:          do.SearchBase,
+		Server:              dc.Server,
+		HighestCommittedUSN: dc.HighestCommittedUSN,
+		Collected:           time.Now(),
+	}
+
+	if incremental {
+		state, err := LoadSyncState(statefile)
+		if err == nil {
+			if _, err = os.Stat(do.WriteToFile); err != nil {
+				err = fmt.Errorf("previous objects file is missing")
+			} else if reason := state.usableFor(do, dc); reason != "" {
+				err = fmt.Errorf("can't use previous collection state, %v", reason)
+			}
+		}
+		if err == nil {
+			if err = incrementalDump(ad, do, state); err != nil {
+				return err
+			}
+			return newstate.Save(statefile)
+		}
+		ui.Info().Msgf("Doing full collection of %v: %v", do.SearchBase, err)
+	}
+
+	_, err := ad.Dump(do)
+	if err != nil {
+		if _, cperr := os.Stat(checkpointFile(do.WriteToFile)); cperr == nil {
+			ui.Warn().Msgf("Collected objects from %v up to the last completed page are kept, run again with --resume to continue", do.SearchBase)
+		} else {
+			os.Remove(do.WriteToFile)
+		}
+		os.Remove(statefile)
+		return err
+	}
+
+	if dc.Server == "" {
+		// Without a USN any previous state no longer matches the data
+		os.Remove(statefile)
+		return nil
+	}
+	return newstate.Save(statefile)
+}
+
+func incrementalDump(ad LDAPDumper, do DumpOptions, state SyncState) error {
+	usnfilter := fmt.Sprintf("(uSNChanged>=%v)", state.HighestCommittedUSN+1)
+
+	changes := do
+	changes.Query = "(&" + do.Query + usnfilter + ")"
+	changes.WriteToFile = ""
+	changes.OnObject = nil
+	changes.ReturnObjects = true
+	ui.Info().Msgf("Collecting objects changed in %v since USN %v ...", do.SearchBase, state.HighestCommittedUSN)
+	changed, err := ad.Dump(changes)
+	if err != nil {
+		return fmt.Errorf("problem collecting changed objects: %v", err)
+	}
+
+	deletions := DumpOptions{
+		SearchBase:    do.SearchBase,
+		Scope:         do.Scope,
+		Query:         "(&(isDeleted=TRUE)" + usnfilter + ")",
+		Attributes:    []string{"objectGUID"},
+		ChunkSize:     do.ChunkSize,
+		ShowDeleted:   true,
+		ReturnObjects: true,
+	}
+	ui.Info().Msgf("Collecting objects deleted from %v since USN %v ...", do.SearchBase, state.HighestCommittedUSN)
+	deleted, err := ad.Dump(deletions)
+	if err != nil {
+		return fmt.Errorf("problem collecting deleted objects: %v", err)
+	}
+
+	total, err := MergeObjectsFile(do.WriteToFile, changed, deleted, do.OnObject)
+	if err != nil {
+		return err
+	}
+	ui.Info().Msgf("Merged %v changed and %v deleted objects into %v, which now has %v objects", len(changed), len(deleted), do.WriteToFile, total)
+	return nil
+}
+
+// Objects are matched on objectGUID, as the DN changes when objects are renamed or moved
+func rawObjectKey(ro *activedirectory.RawObject) string {
+	if guid := ro.Attributes["objectGUID"]; len(guid) > 0 {
+		return guid[0]
+	}
+	return "dn:" + strings.ToLower(ro.DistinguishedName)
+}
+
+// MergeObjectsFile rewrites an objects file with the changed objects replacing or adding to the existing ones, and the
+// deleted objects removed. It returns the number of objects in the new file.
+func MergeObjectsFile(path string, changed, deleted []activedirectory.RawObject, onObject objectCallbackFunc) (int, error) {
+	replaced := make(map[string]struct{}, len(changed)+len(deleted))
+	for i := range changed {
+		replaced[rawObjectKey(&changed[i])] = struct{}{}
+	}
+	for i := range deleted {
+		replaced[rawObjectKey(&deleted[i])] = struct{}{}
+	}
+
+	infile, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("problem opening existing objects file: %v", err)
+	}
+	defer infile.Close()
+	d := msgp.NewReaderSize(lz4.NewReader(infile), 4*1024*1024)
+
+	tempfile := path + ".tmp"
+	e, err := createObjectsFile(tempfile, false)
+	if err != nil {
+		return 0, fmt.Errorf("problem creating merged objects file: %v", err)
+	}
+
+	var total int
+	write := func(ro *activedirectory.RawObject) error {
+		if err := ro.EncodeMsg(e.Writer); err != nil {
+			return fmt.Errorf("problem encoding LDAP object %v: %v", ro.DistinguishedName, err)
+		}
+		total++
+		if onObject != nil {
+			return onObject(ro)
+		}
+		return nil
+	}
+
+	err = func() error {
+		for {
+			var ro activedirectory.RawObject
+			err := ro.DecodeMsg(d)
+			if msgp.Cause(err) == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("problem decoding existing objects file: %v", err)
+			}
+			if _, found := replaced[rawObjectKey(&ro)]; found {
+				continue
+			}
+			if err = write(&ro); err != nil {
+				return err
+			}
+		}
+		for i := range changed {
+			if err := write(&changed[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if closeerr := e.Close(); err == nil {
+		err = closeerr
+	}
+	infile.Close()
+
+	if err == nil {
+		err = os.Rename(tempfile, path)
+	}
+	if err != nil {
+		os.Remove(tempfile)
+		return 0, err
+	}
+	return total, nil
+}
+
+// objectsFile writes objects to a compressed .objects.msgp.lz4 file the ADLoader can read
+type objectsFile struct {
+	*msgp.Writer
+	file *os.File
+	lz4  *lz4.Writer
+}
+
+// createObjectsFile creates the file, syncable files compress on one core so Sync can wait for everything to be written
+func createObjectsFile(path string, syncable bool) (*objectsFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	concurrency := -1
+	if syncable {
+		concurrency = 1
+	}
+	lz4writer := lz4.NewWriter(file)
+	lz4writer.Apply(
+		lz4.BlockChecksumOption(true),
+		lz4.ChecksumOption(true),
+		lz4.CompressionLevelOption(lz4.Level9),
+		lz4.ConcurrencyOption(concurrency),
+	)
+	return &objectsFile{
+		Writer: msgp.NewWriter(lz4writer),
+		file:   file,
+		lz4:    lz4writer,
+	}, nil
+}
+
+// Sync writes everything encoded so far to disk, so the file can be read up to here even if it's never closed
+func (of *objectsFile) Sync() error {
+	if err := of.Flush(); err != nil {
+		return err
+	}
+	if err := of.lz4.Flush(); err != nil {
+		return err
+	}
+	return of.file.Sync()
+}
+
+// Close can be called more than once, so it can be deferred as well as checked
+func (of *objectsFile) Close() error {
+	if of.file == nil {
+		return nil
+	}
+	err := of.Flush()
+	if lz4err := of.lz4.Close(); err == nil {
+		err = lz4err
+	}
+	if fileerr := of.file.Close(); err == nil {
+		err = fileerr
+	}
+	of.file = nil
+	return err
+}
@@ -0,0 +1,85 @@
+package collect
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/pierrec/lz4/v4"
+	"github.com/tinylib/msgp/msgp"
+)
+
+func rawObject(dn, guid, description string) activedirectory.RawObject {
+	return activedirectory.RawObject{
+		DistinguishedName: dn,
+		Attributes: map[string][]string{
+			"objectGUID":  {guid},
+			"description": {description},
+		},
+	}
+}
+
+func TestMergeObjectsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dc=test,dc=local.objects.msgp.lz4")
+
+	if _, err := MergeObjectsFile(path, nil, nil, nil); err == nil {
+		t.Fatal("merging into a missing file should fail")
+	}
+
+	// The full collection
+	outfile, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boutfile := lz4.NewWriter(outfile)
+	e := msgp.NewWriter(boutfile)
+	for _, ro := range []activedirectory.RawObject{
+		rawObject("CN=Alice,DC=test,DC=local", "guid-a", "old"),
+		rawObject("CN=Bob,DC=test,DC=local", "guid-b", "old"),
+		rawObject("CN=Carol,DC=test,DC=local", "guid-c", "old"),
+	} {
+		if err = ro.EncodeMsg(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.Flush()
+	boutfile.Close()
+	outfile.Close()
+
+	// Alice was moved and changed, Bob deleted and Dave added
+	written, err := MergeObjectsFile(path, []activedirectory.RawObject{
+		rawObject("CN=Alice,OU=Moved,DC=test,DC=local", "guid-a", "new"),
+		rawObject("CN=Dave,DC=test,DC=local", "guid-d", "new"),
+	}, []activedirectory.RawObject{
+		{DistinguishedName: "CN=Bob\\0ADEL:guid-b,CN=Deleted Objects,DC=test,DC=local", Attributes: map[string][]string{"objectGUID": {"guid-b"}}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 3 {
+		t.Errorf("merged file has %v objects, expected 3", written)
+	}
+
+	result := map[string]string{}
+	_, err = MergeObjectsFile(path, nil, nil, func(ro *activedirectory.RawObject) error {
+		result[ro.DistinguishedName] = ro.Attributes["description"][0]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"CN=Alice,OU=Moved,DC=test,DC=local": "new",
+		"CN=Carol,DC=test,DC=local":          "old",
+		"CN=Dave,DC=test,DC=local":           "new",
+	}
+	if len(result) != len(expected) {
+		t.Errorf("merged objects are %v, expected %v", result, expected)
+	}
+	for dn, description := range expected {
+		if result[dn] != description {
+			t.Errorf("object %v has description %q, expected %q", dn, result[dn], description)
+		}
+	}
+}
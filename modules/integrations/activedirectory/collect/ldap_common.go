@@ -1,6 +1,10 @@
 package collect
 
-import "github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+import (
+	"time"
+
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+)
 
 //go:generate go run github.com/dmarkham/enumer -type=TLSmode,AuthMode,LDAPScope,LDAPError,LDAPOption -json -output ldap_enums.go
 
@@ -162,9 +166,19 @@ type DumpOptions struct {
 	NoSACL     bool
 	ChunkSize  int
 
+	ShowDeleted bool // Include deleted objects (tombstones) in the results
+
 	OnObject      objectCallbackFunc
 	WriteToFile   string
 	ReturnObjects bool
+
+	Resume bool // Continue from the checkpoint left by an interrupted paged dump to WriteToFile
+
+	// Pacing and splitting, to keep the load on the DC down
+	PageDelay           time.Duration // Pause between pages, plus a random part of up to PageJitter
+	PageJitter          time.Duration
+	MaxObjectsPerSecond int       // Average rate limit, also caps the page size
+	Split               SplitMode // Run several smaller searches instead of one sweep of SearchBase
 }
 
 type LDAPDumper interface {
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"os"
 	"strings"
-	"time"
 
 	osuser "os/user"
 
@@ -18,9 +17,6 @@ import (
 	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
 	"github.com/lkarlslund/adalanche/modules/ui"
 	ldap "github.com/lkarlslund/ldap/v3"
-	"github.com/pierrec/lz4/v4"
-	"github.com/schollz/progressbar/v3"
-	"github.com/tinylib/msgp/msgp"
 )
 
 type AD struct {
@@ -193,35 +189,26 @@ func (ad *AD) RootDn() string {
 }
 
 func (ad *AD) Dump(do DumpOptions) ([]activedirectory.RawObject, error) {
-	var e *msgp.Writer
-	if do.WriteToFile != "" {
-		outfile, err := os.Create(do.WriteToFile)
-		if err != nil {
-			return nil, fmt.Errorf("problem opening domain cache file: %v", err)
-		}
-		defer outfile.Close()
-
-		boutfile := lz4.NewWriter(outfile)
-		lz4options := []lz4.Option{
-			lz4.BlockChecksumOption(true),
-			// lz4.BlockSizeOption(lz4.BlockSize(51 * 1024)),
-			lz4.ChecksumOption(true),
-			lz4.CompressionLevelOption(lz4.Level9),
-			lz4.ConcurrencyOption(-1),
-		}
-		boutfile.Apply(lz4options...)
-		defer boutfile.Close()
-		e = msgp.NewWriter(boutfile)
+	if do.Query == "" {
+		do.Query = "(objectClass=*)"
+	}
+	if do.MaxObjectsPerSecond > 0 && do.ChunkSize > do.MaxObjectsPerSecond {
+		// Smaller pages keep the bursts within the budget
+		do.ChunkSize = do.MaxObjectsPerSecond
+	}
+
+	output, err := newDumpOutput(do, ad.Server, do.ChunkSize > 0)
+	if err != nil {
+		return nil, err
 	}
+	defer output.Close()
 
-	bar := progressbar.NewOptions(-1,
-		progressbar.OptionSetDescription("Dumping from "+do.SearchBase+" ..."),
-		progressbar.OptionShowCount(),
-		progressbar.OptionShowIts(),
-		progressbar.OptionSetItsString("objects"),
-		progressbar.OptionOnCompletion(func() { fmt.Println() }),
-		progressbar.OptionThrottle(time.Second*1),
-	)
+	if output.Complete() {
+		if err = output.Resumed(); err != nil {
+			return nil, err
+		}
+		return output.Finish()
+	}
 
 	var controls []ldap.Control
 
@@ -234,80 +221,130 @@ func (ad *AD) Dump(do DumpOptions) ([]activedirectory.RawObject, error) {
 		controls = append(controls, sdcontrol)
 	}
 
-	if do.ChunkSize > 0 {
-		paging := ldap.NewControlPaging(uint32(do.ChunkSize))
-		controls = append(controls, paging)
-	}
-
-	if do.Query == "" {
-		do.Query = "(objectClass=*)"
+	if do.ShowDeleted {
+		controls = append(controls, ldap.NewControlMicrosoftShowDeleted())
 	}
 
-	var objects []activedirectory.RawObject
+	pace := newPacer(do)
 
-	for {
-		request := ldap.NewSearchRequest(
-			do.SearchBase, // The base dn to search
-			do.Scope, ldap.NeverDerefAliases, 0, 0, false,
-			do.Query,      // The filter to apply
-			do.Attributes, // A list attributes to retrieve
-			controls,
-		)
-
-		response, err := ad.conn.Search(request)
+	partitions, current := output.ResumePartitions()
+	if partitions == nil {
+		partitions, err = ad.partitions(do, controls, pace)
 		if err != nil {
-			return objects, fmt.Errorf("failed to execute search request: %w", err)
+			return nil, err
 		}
-		ui.Debug().Msgf("YOU ARE HERE")
+	}
+	output.SetPartitions(partitions)
 
-		// For a page of results, iterate through the reponse and pull the individual entries
-		for _, entry := range response.Entries {
-			newObject := activedirectory.RawObject{}
-			err = newObject.IngestLDAP(entry)
-			if err == nil {
-				if e != nil {
-					err = newObject.EncodeMsg(e)
-					if err != nil {
-						return nil, fmt.Errorf("problem encoding LDAP object %v: %v", newObject.DistinguishedName, err)
-					}
-				}
-				if do.OnObject != nil {
-					err = do.OnObject(&newObject)
-					if err != nil {
-						return nil, err
-					}
-				}
-				if do.ReturnObjects {
-					// Grow one page at a time
-					if len(objects) == cap(objects) {
-						newobjects := make([]activedirectory.RawObject, len(objects), cap(objects)+do.ChunkSize)
-						copy(newobjects, objects)
-						objects = newobjects
+	for current < len(partitions) {
+		err = ad.search(partitions[current], do.Attributes, do.ChunkSize, controls, output.ResumeCookie(), func(response *ldap.SearchResult, cookie []byte) error {
+			if err := output.Resumed(); err != nil {
+				return err
+			}
+
+			// For a page of results, iterate through the reponse and pull the individual entries
+			for _, entry := range response.Entries {
+				newObject := activedirectory.RawObject{}
+				if newObject.IngestLDAP(entry) == nil {
+					if err := output.Add(newObject); err != nil {
+						return err
 					}
-					objects = append(objects, newObject)
 				}
-				bar.Add(1)
 			}
-		}
 
-		responseControl := ldap.FindControl(response.Controls, ldap.ControlTypePaging)
-		if rctrl, ok := responseControl.(*ldap.ControlPaging); rctrl != nil && ok && len(rctrl.Cookie) != 0 {
-			pagingControl := ldap.FindControl(controls, ldap.ControlTypePaging)
-			if sctrl, ok := pagingControl.(*ldap.ControlPaging); sctrl != nil && ok {
-				sctrl.SetCookie(rctrl.Cookie)
-				continue
+			var err error
+			switch {
+			case len(cookie) > 0:
+				err = output.Page(current, cookie)
+			case current+1 < len(partitions):
+				err = output.Page(current+1, nil)
+			default:
+				// Last page of the dump
+				return nil
 			}
+			if err == nil {
+				pace.Wait(len(response.Entries))
+			}
+			return err
+		})
+
+		var ldaperr *ldap.Error
+		if output.ResumeCookie() != nil && errors.As(err, &ldaperr) && ldaperr.ResultCode != ldap.ErrorNetwork {
+			// The DC has forgotten about the search we were in the middle of
+			if err = output.RestartPartition(current, err); err != nil {
+				return output.objects, err
+			}
+			continue
+		}
+		if err != nil {
+			return output.objects, err
 		}
+		current++
+	}
+
+	return output.Finish()
+}
 
-		break
+// partitions returns the searches the dump is split into
+func (ad *AD) partitions(do DumpOptions, controls []ldap.Control, pace *pacer) ([]dumpPartition, error) {
+	switch {
+	case do.Split == SplitByObjectClass && do.Scope != ldap.ScopeBaseObject:
+		return objectClassPartitions(do), nil
+	case do.Split == SplitByOU && do.Scope == ldap.ScopeWholeSubtree:
+		var children []string
+		err := ad.search(dumpPartition{do.SearchBase, ldap.ScopeSingleLevel, "(objectClass=*)"}, []string{"distinguishedName"}, do.ChunkSize, controls, nil,
+			func(response *ldap.SearchResult, cookie []byte) error {
+				for _, entry := range response.Entries {
+					children = append(children, entry.DN)
+				}
+				pace.Wait(len(response.Entries))
+				return nil
+			})
+		if err != nil {
+			return nil, fmt.Errorf("problem listing objects below %v: %w", do.SearchBase, err)
+		}
+		ui.Debug().Msgf("Splitting dump of %v into %v searches", do.SearchBase, len(children)+1)
+		return ouPartitions(do, children), nil
 	}
+	return []dumpPartition{{do.SearchBase, do.Scope, do.Query}}, nil
+}
 
-	bar.Finish()
-	if e != nil {
-		e.Flush()
+// search runs a paged search, calling page with each page of results and the cookie for the next one
+func (ad *AD) search(partition dumpPartition, attributes []string, chunksize int, controls []ldap.Control, cookie []byte, page func(response *ldap.SearchResult, cookie []byte) error) error {
+	var paging *ldap.ControlPaging
+	if chunksize > 0 {
+		paging = ldap.NewControlPaging(uint32(chunksize))
+		paging.SetCookie(cookie)
+		controls = append(controls[:len(controls):len(controls)], paging)
 	}
 
-	return objects, nil
+	for {
+		request := ldap.NewSearchRequest(
+			partition.SearchBase, // The base dn to search
+			partition.Scope, ldap.NeverDerefAliases, 0, 0, false,
+			partition.Query, // The filter to apply
+			attributes,      // A list attributes to retrieve
+			controls,
+		)
+
+		response, err := ad.conn.Search(request)
+		if err != nil {
+			return fmt.Errorf("failed to execute search request: %w", err)
+		}
+
+		var next []byte
+		responseControl := ldap.FindControl(response.Controls, ldap.ControlTypePaging)
+		if rctrl, ok := responseControl.(*ldap.ControlPaging); paging != nil && rctrl != nil && ok {
+			next = rctrl.Cookie
+		}
+		if err = page(response, next); err != nil {
+			return err
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		paging.SetCookie(next)
+	}
 }
 
 type ControlInteger struct {
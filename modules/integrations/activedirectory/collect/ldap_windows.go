@@ -6,7 +6,6 @@ package collect
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"runtime"
 	"syscall"
 	"time"
@@ -18,10 +17,7 @@ import (
 	"github.com/lkarlslund/adalanche/modules/ui"
 	ldap "github.com/lkarlslund/ldap/v3"
 	"github.com/lkarlslund/ldap/v3/gssapi"
-	"github.com/pierrec/lz4/v4"
 	"github.com/pkg/errors"
-	"github.com/schollz/progressbar/v3"
-	"github.com/tinylib/msgp/msgp"
 )
 
 func GetSSPIClient() (ldap.GSSAPIClient, error) {
@@ -242,42 +238,41 @@ func (a *WAD) Disconnect() error {
 func (a *WAD) Dump(do DumpOptions) ([]activedirectory.RawObject, error) {
 	timeout_secs := int32(timeout.Seconds())
 
-	var e *msgp.Writer
-	if do.WriteToFile != "" {
-		outfile, err := os.Create(do.WriteToFile)
-		if err != nil {
-			return nil, fmt.Errorf("problem opening domain cache file: %v", err)
-		}
-		defer outfile.Close()
-
-		boutfile := lz4.NewWriter(outfile)
-		lz4options := []lz4.Option{
-			lz4.BlockChecksumOption(true),
-			// lz4.BlockSizeOption(lz4.BlockSize(51 * 1024)),
-			lz4.ChecksumOption(true),
-			lz4.CompressionLevelOption(lz4.Level9),
-			lz4.ConcurrencyOption(-1),
-		}
-		boutfile.Apply(lz4options...)
-		defer boutfile.Close()
-		e = msgp.NewWriter(boutfile)
-	}
-
-	bar := progressbar.NewOptions(-1,
-		progressbar.OptionSetDescription("Dumping from "+do.SearchBase+" ..."),
-		progressbar.OptionShowCount(),
-		progressbar.OptionShowIts(),
-		progressbar.OptionSetItsString("objects"),
-		progressbar.OptionOnCompletion(func() { fmt.Println() }),
-		progressbar.OptionThrottle(time.Second*1),
-	)
+	if do.Query == "" {
+		do.Query = "(objectClass=*)"
+	}
+	if do.Split != NoSplit {
+		ui.Warn().Msg("Splitting searches is only supported by the multiplatform LDAP client, doing one search")
+		do.Split = NoSplit
+	}
+	if do.MaxObjectsPerSecond > 0 && do.ChunkSize > do.MaxObjectsPerSecond {
+		// Smaller pages keep the bursts within the budget
+		do.ChunkSize = do.MaxObjectsPerSecond
+	}
 
-	var objects []activedirectory.RawObject
-	var err error
+	output, err := newDumpOutput(do, a.Server, do.ChunkSize > 0)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+
+	if output.Complete() {
+		if err = output.Resumed(); err != nil {
+			return nil, err
+		}
+		return output.Finish()
+	}
 
 	var scarray []*LDAPControl // 0 = paging, 1 = NoSACL, 2 = nil
 	if do.ChunkSize > 0 {
-		paging, err := a.conn.CreatePageControl(nil, uint32(do.ChunkSize))
+		var cookie *LDAPBerval
+		if resumecookie := output.ResumeCookie(); resumecookie != nil {
+			cookie = &LDAPBerval{
+				val: &resumecookie[0],
+				len: uint64(len(resumecookie)),
+			}
+		}
+		paging, err := a.conn.CreatePageControl(cookie, uint32(do.ChunkSize))
 		if err != nil {
 			return nil, err
 		}
@@ -302,18 +297,40 @@ func (a *WAD) Dump(do DumpOptions) ([]activedirectory.RawObject, error) {
 		scarray = append(scarray, &nosaclcontrol)
 	}
 
-	if do.Query == "" {
-		do.Query = "(objectClass=*)"
+	if do.ShowDeleted {
+		showdeletedcontrol := LDAPControl{
+			oid:        MakeCString(ldap.ControlTypeMicrosoftShowDeleted),
+			iscritical: true,
+		}
+		scarray = append(scarray, &showdeletedcontrol)
 	}
 
 	scarray = append(scarray, nil) // zero terminated array
+	pace := newPacer(do)
 	ui.Trace().Msgf("Searching for %v at '%v'", do.Query, do.SearchBase)
 
 	for {
 		search, err := a.conn.search(do.SearchBase, do.Query, do.Scope, do.Attributes, &scarray[0], int(timeout_secs), do.ChunkSize)
+		if err != nil && output.ResumeCookie() != nil {
+			// The DC has forgotten about the search we were in the middle of
+			if err = output.RestartPartition(0, err); err != nil {
+				return nil, err
+			}
+			paging, err := a.conn.CreatePageControl(nil, uint32(do.ChunkSize))
+			if err != nil {
+				return nil, err
+			}
+			oldcontrol := scarray[0]
+			scarray[0] = paging
+			oldcontrol.free()
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
+		if err = output.Resumed(); err != nil {
+			return nil, err
+		}
 
 		// Paging loop
 		controls, returncode, err := search.parse()
@@ -324,6 +341,7 @@ func (a *WAD) Dump(do DumpOptions) ([]activedirectory.RawObject, error) {
 			return nil, fmt.Errorf("ldap_search_ext_s returned %v", LDAPError(returncode))
 		}
 
+		var pageobjects int
 		var entry LDAPMessage
 		entry, err = search.first_entry()
 		for err == nil {
@@ -380,28 +398,10 @@ func (a *WAD) Dump(do DumpOptions) ([]activedirectory.RawObject, error) {
 				attr = entry.next_attribute(ber)
 			}
 
-			if e != nil {
-				err = item.EncodeMsg(e)
-				if err != nil {
-					return nil, fmt.Errorf("problem encoding LDAP object %v: %v", item.DistinguishedName, err)
-				}
-			}
-
-			if do.OnObject != nil {
-				do.OnObject(&item)
-			}
-
-			if do.ReturnObjects {
-				// Grow one page at a time
-				if len(objects) == cap(objects) {
-					newobjects := make([]activedirectory.RawObject, len(objects), cap(objects)+do.ChunkSize)
-					copy(newobjects, objects)
-					objects = newobjects
-				}
-				objects = append(objects, item)
+			if err = output.Add(item); err != nil {
+				return nil, err
 			}
-
-			bar.Add(1)
+			pageobjects++
 
 			entry = entry.next_entry()
 			if uintptr(entry.msg) == 0 {
@@ -422,6 +422,10 @@ func (a *WAD) Dump(do DumpOptions) ([]activedirectory.RawObject, error) {
 			}
 
 			ui.Trace().Msgf("Continuing search with cookie %0X", cookie.Data())
+			if err = output.Page(0, cookie.Data()); err != nil {
+				return nil, err
+			}
+			pace.Wait(pageobjects)
 
 			paging, err := a.conn.CreatePageControl(cookie, uint32(do.ChunkSize))
 			if err != nil {
@@ -440,12 +444,7 @@ func (a *WAD) Dump(do DumpOptions) ([]activedirectory.RawObject, error) {
 
 	runtime.KeepAlive(scarray)
 
-	bar.Finish()
-	if e != nil {
-		e.Flush()
-	}
-
-	return objects, err
+	return output.Finish()
 }
 
 var (
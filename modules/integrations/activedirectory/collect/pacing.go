@@ -0,0 +1,117 @@
+package collect
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/lkarlslund/adalanche/modules/ui"
+	ldap "github.com/lkarlslund/ldap/v3"
+)
+
+type SplitMode byte
+
+const (
+	NoSplit            SplitMode = iota
+	SplitByObjectClass           // One search per object class
+	SplitByOU                    // One search per child of the search base
+)
+
+func SplitModeString(s string) (SplitMode, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return NoSplit, nil
+	case "objectclass":
+		return SplitByObjectClass, nil
+	case "ou":
+		return SplitByOU, nil
+	}
+	return NoSplit, fmt.Errorf("unknown split mode %v", s)
+}
+
+// Object classes searched for one at a time when splitting by object class, most specific first, as each
+// search excludes the classes searched before it. Objects of other classes are found by a final search.
+var splitObjectClasses = []string{
+	"computer",
+	"user",
+	"group",
+	"groupPolicyContainer",
+	"organizationalUnit",
+	"container",
+	"foreignSecurityPrincipal",
+	"trustedDomain",
+}
+
+// dumpPartition is one of the searches a dump is split into
+type dumpPartition struct {
+	SearchBase string
+	Scope      int
+	Query      string
+}
+
+// objectClassPartitions splits the search into disjoint searches that together return the same objects
+func objectClassPartitions(do DumpOptions) []dumpPartition {
+	var partitions []dumpPartition
+	var excluded string
+	for _, class := range splitObjectClasses {
+		query := "(&" + do.Query + "(objectClass=" + class + ")"
+		if excluded != "" {
+			query += "(!(|" + excluded + "))"
+		}
+		partitions = append(partitions, dumpPartition{do.SearchBase, do.Scope, query + ")"})
+		excluded += "(objectClass=" + class + ")"
+	}
+	return append(partitions, dumpPartition{do.SearchBase, do.Scope, "(&" + do.Query + "(!(|" + excluded + ")))"})
+}
+
+// ouPartitions splits a subtree search into the base object and a subtree search below each of its children
+func ouPartitions(do DumpOptions, children []string) []dumpPartition {
+	partitions := []dumpPartition{{do.SearchBase, ldap.ScopeBaseObject, do.Query}}
+	for _, child := range children {
+		partitions = append(partitions, dumpPartition{child, ldap.ScopeWholeSubtree, do.Query})
+	}
+	return partitions
+}
+
+// pacer spaces out the pages of a dump as set by PageDelay, PageJitter and MaxObjectsPerSecond
+type pacer struct {
+	delay, jitter time.Duration
+	rate          int
+	started       time.Time
+	objects       int
+}
+
+func newPacer(do DumpOptions) *pacer {
+	return &pacer{
+		delay:   do.PageDelay,
+		jitter:  do.PageJitter,
+		rate:    do.MaxObjectsPerSecond,
+		started: time.Now(),
+	}
+}
+
+// next returns how long to wait after a page with this many objects
+func (p *pacer) next(objects int, now time.Time) time.Duration {
+	p.objects += objects
+	wait := p.delay
+	if p.jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(p.jitter)))
+	}
+	if p.rate > 0 {
+		// Stay within the budget on average since the dump started
+		due := p.started.Add(time.Duration(p.objects) * time.Second / time.Duration(p.rate))
+		if behind := due.Sub(now); behind > wait {
+			wait = behind
+		}
+	}
+	return wait
+}
+
+// Wait is called between pages
+func (p *pacer) Wait(objects int) {
+	if wait := p.next(objects, time.Now()); wait > 0 {
+		ui.Trace().Msgf("Waiting %v before requesting next page", wait)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,68 @@
+package collect
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	ldap "github.com/lkarlslund/ldap/v3"
+)
+
+func TestObjectClassPartitions(t *testing.T) {
+	partitions := objectClassPartitions(DumpOptions{
+		SearchBase: "DC=test,DC=local",
+		Scope:      ldap.ScopeWholeSubtree,
+		Query:      "(objectClass=*)",
+	})
+	if len(partitions) != len(splitObjectClasses)+1 {
+		t.Fatalf("got %v partitions", len(partitions))
+	}
+	for _, expected := range []string{
+		"(&(objectClass=*)(objectClass=computer))",
+		"(&(objectClass=*)(objectClass=user)(!(|(objectClass=computer))))",
+		"(&(objectClass=*)(objectClass=group)(!(|(objectClass=computer)(objectClass=user))))",
+	} {
+		var found bool
+		for _, partition := range partitions {
+			found = found || partition.Query == expected
+		}
+		if !found {
+			t.Errorf("no partition with query %v", expected)
+		}
+	}
+	for _, partition := range partitions {
+		if _, err := ldap.CompileFilter(partition.Query); err != nil {
+			t.Errorf("partition query %v is invalid: %v", partition.Query, err)
+		}
+	}
+	last := partitions[len(partitions)-1].Query
+	for _, class := range splitObjectClasses {
+		if !strings.Contains(last, "(objectClass="+class+")") {
+			t.Errorf("remaining objects query %v doesn't exclude %v", last, class)
+		}
+	}
+
+	ou := ouPartitions(DumpOptions{SearchBase: "DC=test,DC=local", Scope: ldap.ScopeWholeSubtree, Query: "(objectClass=*)"},
+		[]string{"CN=Users,DC=test,DC=local", "OU=Servers,DC=test,DC=local"})
+	if len(ou) != 3 || ou[0].Scope != ldap.ScopeBaseObject || ou[2].SearchBase != "OU=Servers,DC=test,DC=local" {
+		t.Errorf("unexpected OU partitions %v", ou)
+	}
+}
+
+func TestPacer(t *testing.T) {
+	start := time.Now()
+	p := &pacer{rate: 100, started: start}
+	if wait := p.next(50, start.Add(100*time.Millisecond)); wait != 400*time.Millisecond {
+		t.Errorf("50 objects at 100/s after 100ms should wait 400ms, not %v", wait)
+	}
+	if wait := p.next(50, start.Add(2*time.Second)); wait != 0 {
+		t.Errorf("100 objects at 100/s after 2s should not wait, not %v", wait)
+	}
+
+	p = &pacer{delay: time.Second, jitter: time.Second, started: start}
+	for i := 0; i < 10; i++ {
+		if wait := p.next(1000, start); wait < time.Second || wait >= 2*time.Second {
+			t.Errorf("delay with jitter is %v", wait)
+		}
+	}
+}
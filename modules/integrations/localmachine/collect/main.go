@@ -14,31 +14,36 @@ import (
 )
 
 var (
-	cmd = &cobra.Command{
-		Use:   "localmachine",
-		Short: "Gathers local information about a machine in the network (deploy with a sch.task via GPO for efficiency)",
-		RunE:  Execute,
+	offlinecmd = &cobra.Command{
+		Use:   "localmachine-offline --hives <folder>",
+		Short: "Imports a machine from its offline SYSTEM, SOFTWARE, SAM and SECURITY registry hives",
+		RunE:  ExecuteOffline,
 	}
+
+	hivefolder *string
 )
 
 func init() {
-	clicollect.Collect.AddCommand(cmd)
+	hivefolder = offlinecmd.Flags().String("hives", "", "Folder with the registry hives of the machine")
+	clicollect.Collect.AddCommand(offlinecmd)
 }
 
-func Execute(cmd *cobra.Command, args []string) error {
-	var outputpath string
-	if op := cmd.InheritedFlags().Lookup("datapath"); op != nil {
-		outputpath = op.Value.String()
+func ExecuteOffline(cmd *cobra.Command, args []string) error {
+	if *hivefolder == "" {
+		return fmt.Errorf("Missing --hives parameter")
 	}
-
-	err := os.MkdirAll(outputpath, 0600)
+	info, err := CollectOffline(*hivefolder)
 	if err != nil {
-		return fmt.Errorf("Problem accessing output folder: %v", err)
+		return err
 	}
+	return writeInfo(cmd, info)
+}
 
-	info, err := Collect()
-	if err != nil {
-		return err
+// writeInfo saves the collected information in the data folder, named after the machine and its domain
+func writeInfo(cmd *cobra.Command, info localmachine.Info) error {
+	var outputpath string
+	if op := cmd.InheritedFlags().Lookup("datapath"); op != nil {
+		outputpath = op.Value.String()
 	}
 
 	if outputpath == "" {
@@ -46,6 +51,11 @@ func Execute(cmd *cobra.Command, args []string) error {
 		outputpath = "."
 	}
 
+	err := os.MkdirAll(outputpath, 0600)
+	if err != nil {
+		return fmt.Errorf("Problem accessing output folder: %v", err)
+	}
+
 	targetname := info.Machine.Name + localmachine.Suffix
 	if info.Machine.IsDomainJoined {
 		targetname = info.Machine.Name + "$" + info.Machine.Domain + localmachine.Suffix
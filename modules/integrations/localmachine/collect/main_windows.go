@@ -0,0 +1,26 @@
+package collect
+
+import (
+	clicollect "github.com/lkarlslund/adalanche/modules/cli/collect"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmd = &cobra.Command{
+		Use:   "localmachine",
+		Short: "Gathers local information about a machine in the network (deploy with a sch.task via GPO for efficiency)",
+		RunE:  Execute,
+	}
+)
+
+func init() {
+	clicollect.Collect.AddCommand(cmd)
+}
+
+func Execute(cmd *cobra.Command, args []string) error {
+	info, err := Collect()
+	if err != nil {
+		return err
+	}
+	return writeInfo(cmd, info)
+}
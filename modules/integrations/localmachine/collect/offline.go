@@ -0,0 +1,532 @@
+package collect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/lkarlslund/adalanche/modules/basedata"
+	"github.com/lkarlslund/adalanche/modules/integrations/localmachine"
+	"github.com/lkarlslund/adalanche/modules/integrations/localmachine/regf"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/lkarlslund/adalanche/modules/version"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+var errTruncatedSID = errors.New("SID is too short for its subauthority count")
+
+type offlineHives struct {
+	system, software, sam, security *regf.Hive
+	controlset                      string
+}
+
+// openOfflineHive opens a hive file in the folder regardless of the case of its name, returning nil if it's not there
+func openOfflineHive(folder, name string) (*regf.Hive, error) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.EqualFold(entry.Name(), name) {
+			continue
+		}
+		path := filepath.Join(folder, entry.Name())
+		hive, err := regf.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Problem opening hive %v: %v", path, err)
+		}
+		if hive.Dirty() {
+			ui.Warn().Msgf("Hive %v was not cleanly written, recent changes kept in its transaction logs will be missing", path)
+		}
+		return hive, nil
+	}
+	ui.Warn().Msgf("No %v hive found in %v, information from it will be missing", name, folder)
+	return nil, nil
+}
+
+// CollectOffline gathers what it can about a machine from the SYSTEM, SOFTWARE, SAM and SECURITY registry hives
+// copied from its Windows\System32\config folder, so machines can be analyzed without running the collector on them
+func CollectOffline(folder string) (localmachine.Info, error) {
+	var hives offlineHives
+	var err error
+	for _, hive := range []struct {
+		name string
+		hive **regf.Hive
+	}{
+		{"SYSTEM", &hives.system},
+		{"SOFTWARE", &hives.software},
+		{"SAM", &hives.sam},
+		{"SECURITY", &hives.security},
+	} {
+		if *hive.hive, err = openOfflineHive(folder, hive.name); err != nil {
+			return localmachine.Info{}, err
+		}
+	}
+	if hives.system == nil {
+		return localmachine.Info{}, fmt.Errorf("The SYSTEM hive is required for offline collection")
+	}
+
+	hives.controlset = "ControlSet001"
+	if selectkey, err := hives.system.OpenKey(`Select`); err == nil {
+		if current, _, err := selectkey.GetIntegerValue("Current"); err == nil {
+			hives.controlset = fmt.Sprintf("ControlSet%03d", current)
+		}
+	}
+
+	machineinfo := hives.machine()
+	if machineinfo.LocalSID == "" {
+		return localmachine.Info{}, fmt.Errorf("Could not find the local machine SID in the SECURITY or SAM hive")
+	}
+
+	usersinfo, groupsinfo := hives.accounts(machineinfo)
+
+	root, _ := hives.system.Root()
+	info := localmachine.Info{
+		Common: basedata.Common{
+			Collector: "offline",
+			Commit:    version.Commit,
+			Collected: root.LastWritten(),
+		},
+		Machine:    machineinfo,
+		Users:      usersinfo,
+		Groups:     groupsinfo,
+		Shares:     hives.shares(),
+		Services:   hives.services(machineinfo, usersinfo),
+		Privileges: hives.privileges(),
+	}
+
+	ui.Info().Msgf("Read %v users, %v groups, %v services and %v privileges for machine %v from offline hives",
+		len(info.Users), len(info.Groups), len(info.Services), len(info.Privileges), info.Machine.Name)
+
+	return info, nil
+}
+
+func (h offlineHives) machine() localmachine.Machine {
+	var machineinfo localmachine.Machine
+
+	if key, err := h.system.OpenKey(h.controlset + `\Control\ComputerName\ComputerName`); err == nil {
+		machineinfo.Name, _, _ = key.GetStringValue("ComputerName")
+	}
+
+	if h.security != nil {
+		if key, err := h.security.OpenKey(`Policy\PolAcDmS`); err == nil {
+			if value, err := key.Value(""); err == nil {
+				if sid, _, err := parseSID(value.Data); err == nil {
+					machineinfo.LocalSID = sid.String()
+				}
+			}
+		}
+
+		// Primary domain, or workgroup if the SID is missing
+		if key, err := h.security.OpenKey(`Policy\PolPrDmN`); err == nil {
+			if value, err := key.Value(""); err == nil {
+				machineinfo.Domain = lsaUnicodeString(value.Data)
+			}
+		}
+		if key, err := h.security.OpenKey(`Policy\PolPrDmS`); err == nil {
+			if value, err := key.Value(""); err == nil && len(value.Data) > 0 {
+				_, _, err = parseSID(value.Data)
+				machineinfo.IsDomainJoined = err == nil
+			}
+		}
+	}
+
+	if machineinfo.LocalSID == "" && h.sam != nil {
+		// The account domain SID is at the end of the V value
+		if key, err := h.sam.OpenKey(`SAM\Domains\Account`); err == nil {
+			if v, _, err := key.GetBinaryValue("V"); err == nil && len(v) >= 24 {
+				if sid, _, err := parseSID(v[len(v)-24:]); err == nil {
+					machineinfo.LocalSID = sid.String()
+				}
+			}
+		}
+	}
+
+	if key, err := h.system.OpenKey(h.controlset + `\Control\Session Manager\Environment`); err == nil {
+		architecture, _, _ := key.GetStringValue("PROCESSOR_ARCHITECTURE")
+		switch strings.ToUpper(architecture) {
+		case "AMD64":
+			machineinfo.Architecture = "x86_64"
+		case "X86":
+			machineinfo.Architecture = "x86"
+		default:
+			machineinfo.Architecture = strings.ToLower(architecture)
+		}
+	}
+
+	if key, err := h.system.OpenKey(h.controlset + `\Control\ProductOptions`); err == nil {
+		machineinfo.ProductType, _, _ = key.GetStringValue("ProductType")
+		ptypes, _, err := key.GetStringsValue("ProductSuite")
+		if err == nil {
+			machineinfo.ProductSuite = strings.Join(ptypes, ", ")
+		}
+	}
+
+	// AppCompatCache from all the control sets
+	if root, err := h.system.Root(); err == nil {
+		subkeys, _ := root.SubKeys()
+		for _, subkey := range subkeys {
+			appcache_key, err := subkey.OpenKey(`Control\Session Manager\AppCompatCache`)
+			if err != nil {
+				continue
+			}
+			cache, _, err := appcache_key.GetBinaryValue(`AppCompatCache`)
+			if err != nil {
+				continue
+			}
+			var skipit bool
+			for _, existingcache := range machineinfo.AppCache {
+				if bytes.Equal(existingcache, cache) {
+					skipit = true
+					break
+				}
+			}
+			if !skipit {
+				machineinfo.AppCache = append(machineinfo.AppCache, cache)
+			}
+		}
+	}
+
+	if h.software == nil {
+		return machineinfo
+	}
+
+	if key, err := h.software.OpenKey(`Microsoft\Windows NT\CurrentVersion`); err == nil {
+		machineinfo.ProductName, _, _ = key.GetStringValue("ProductName")
+		machineinfo.EditionID, _, _ = key.GetStringValue("EditionId")
+		machineinfo.ReleaseID, _, _ = key.GetStringValue("ReleaseId")
+		machineinfo.BuildBranch, _, _ = key.GetStringValue("BuildBranch")
+		machineinfo.MajorVersionNumber, _, _ = key.GetIntegerValue("CurrentMajorVersionNumber")
+		machineinfo.Version, _, _ = key.GetStringValue("CurrentVersion")
+		machineinfo.BuildNumber, _, _ = key.GetStringValue("CurrentBuildNumber")
+		if ubr, _, err := key.GetIntegerValue("UBR"); err == nil {
+			machineinfo.BuildNumber += "." + strconv.FormatUint(ubr, 10)
+		}
+	}
+
+	// AUTOLOGON - the password is either in clear text in Winlogon or as an LSA secret
+	if key, err := h.software.OpenKey(`Microsoft\Windows NT\CurrentVersion\Winlogon`); err == nil {
+		if h.security == nil {
+			machineinfo.Domain, _, _ = key.GetStringValue(`CachePrimaryDomain`)
+			machineinfo.IsDomainJoined = machineinfo.Domain != ""
+		}
+
+		pwd, _, _ := key.GetStringValue(`DefaultPassword`)
+		if pwd != "" || h.lsaSecretExists("DefaultPassword") {
+			machineinfo.DefaultUsername, _, _ = key.GetStringValue(`DefaultUsername`)
+			machineinfo.DefaultDomain, _, _ = key.GetStringValue(`DefaultDomain`)
+		}
+		pwd, _, _ = key.GetStringValue(`AltDefaultPassword`)
+		if pwd != "" {
+			machineinfo.AltDefaultUsername, _, _ = key.GetStringValue(`AltDefaultUsername`)
+			machineinfo.AltDefaultDomain, _, _ = key.GetStringValue(`AltDefaultDomain`)
+		}
+	}
+
+	if key, err := h.software.OpenKey(`Microsoft\CCMSetup`); err == nil {
+		machineinfo.SCCMLastValidMP, _, _ = key.GetStringValue(`LastValidMP`)
+	}
+
+	if key, err := h.software.OpenKey(`Policies\Microsoft\Windows\WindowsUpdate`); err == nil {
+		machineinfo.WUServer, _, _ = key.GetStringValue(`WUServer`)
+		machineinfo.WUStatusServer, _, _ = key.GetStringValue(`WUStatusServer`)
+	}
+
+	if key, err := h.software.OpenKey(`Microsoft\Windows\CurrentVersion\Policies\System`); err == nil {
+		machineinfo.UACConsentPromptBehaviorAdmin, _, _ = key.GetIntegerValue(`ConsentPromptBehaviorAdmin`)
+		machineinfo.UACEnableLUA, _, _ = key.GetIntegerValue(`EnableLUA`)
+		machineinfo.UACLocalAccountTokenFilterPolicy, _, _ = key.GetIntegerValue(`LocalAccountTokenFilterPolicy`)
+		machineinfo.UACFilterAdministratorToken, _, _ = key.GetIntegerValue(`FilterAdministratorToken`)
+	}
+
+	return machineinfo
+}
+
+// lsaSecretExists tells if an LSA secret has a value, the value itself is encrypted
+func (h offlineHives) lsaSecretExists(name string) bool {
+	if h.security == nil {
+		return false
+	}
+	key, err := h.security.OpenKey(`Policy\Secrets\` + name + `\CurrVal`)
+	if err != nil {
+		return false
+	}
+	value, err := key.Value("")
+	return err == nil && len(value.Data) > 0
+}
+
+func (h offlineHives) shares() localmachine.Shares {
+	var sharesinfo localmachine.Shares
+
+	shares_key, err := h.system.OpenKey(h.controlset + `\Services\LanmanServer\Shares`)
+	if err != nil {
+		return nil
+	}
+	shares, _ := shares_key.ReadValueNames()
+	for _, share := range shares {
+		shareinfo := localmachine.Share{
+			Name: share,
+		}
+		if permissions_key, err := shares_key.OpenKey(`Security`); err == nil {
+			shareinfo.DACL, _, _ = permissions_key.GetBinaryValue(share)
+		}
+
+		share_settings, _, err := shares_key.GetStringsValue(share)
+		if err == nil {
+			for _, share_setting := range share_settings {
+				ss := strings.Split(share_setting, "=")
+				if len(ss) == 2 {
+					switch ss[0] {
+					case "Type":
+						stype, _ := strconv.Atoi(ss[1])
+						shareinfo.Type = stype
+					case "ShareName":
+						shareinfo.Name = ss[1]
+					case "Remark":
+						shareinfo.Remark = ss[1]
+					case "Path":
+						shareinfo.Path = ss[1]
+					}
+				}
+			}
+		}
+		sharesinfo = append(sharesinfo, shareinfo)
+	}
+	return sharesinfo
+}
+
+func (h offlineHives) services(machineinfo localmachine.Machine, users localmachine.Users) localmachine.Services {
+	var servicesinfo localmachine.Services
+
+	services_key, err := h.system.OpenKey(h.controlset + `\Services`)
+	if err != nil {
+		ui.Warn().Msgf("Problem opening services in SYSTEM hive: %v", err)
+		return nil
+	}
+	services, err := services_key.SubKeys()
+	if err != nil {
+		ui.Warn().Msgf("Problem reading services in SYSTEM hive: %v", err)
+	}
+
+	env := h.environment()
+	for _, service_key := range services {
+		stype, _, _ := service_key.GetIntegerValue("Type")
+		if stype < 16 {
+			continue // Drivers
+		}
+		displayname, _, _ := service_key.GetStringValue("DisplayName")
+		description, _, _ := service_key.GetStringValue("Description")
+		objectname, _, _ := service_key.GetStringValue("ObjectName")
+		imagepath, _, _ := service_key.GetStringValue("ImagePath")
+		requiredPrivileges, _, _ := service_key.GetStringsValue("RequiredPrivileges")
+		start, _, _ := service_key.GetIntegerValue("Start")
+
+		var registryowner string
+		var registrydacl []byte
+		if sd, err := service_key.SecurityDescriptor(); err == nil {
+			registryowner, registrydacl = ownerAndDACL(sd)
+		}
+
+		imagepath, imageexecutable := serviceExecutable(imagepath)
+
+		servicesinfo = append(servicesinfo, localmachine.Service{
+			RegistryOwner:      registryowner,
+			RegistryDACL:       registrydacl,
+			Name:               service_key.Name(),
+			DisplayName:        displayname,
+			Description:        description,
+			ImagePath:          imagepath,
+			ImageExecutable:    expandEnvironment(imageexecutable, env),
+			Start:              int(start),
+			Type:               int(stype),
+			Account:            objectname,
+			AccountSID:         accountSID(objectname, machineinfo, users),
+			RequiredPrivileges: requiredPrivileges,
+		})
+	}
+	return servicesinfo
+}
+
+// serviceExecutable cleans up the image path and finds the executable in it without looking at the file system
+func serviceExecutable(imagepath string) (string, string) {
+	if strings.HasPrefix(strings.ToLower(imagepath), `system32\`) {
+		imagepath = `%SystemRoot%\` + imagepath
+	} else if strings.HasPrefix(imagepath, `\SystemRoot\`) {
+		imagepath = `%SystemRoot%\` + imagepath[12:]
+	} else if strings.HasPrefix(imagepath, `\??\`) {
+		imagepath = imagepath[4:]
+	}
+
+	if imagepath == "" {
+		return "", ""
+	}
+	if imagepath[0] == '"' {
+		if nextquote := strings.Index(imagepath[1:], `"`); nextquote != -1 {
+			return imagepath, imagepath[1 : nextquote+1]
+		}
+		return imagepath, ""
+	}
+	// Unquoted, so assume the executable ends at the first .exe
+	if exe := strings.Index(strings.ToLower(imagepath), ".exe"); exe != -1 {
+		return imagepath, imagepath[:exe+4]
+	}
+	executable, _, _ := strings.Cut(imagepath, " ")
+	return imagepath, executable
+}
+
+// environment returns the system environment variables of the machine, with lowercase names
+func (h offlineHives) environment() map[string]string {
+	env := map[string]string{
+		"systemroot": `C:\Windows`,
+	}
+	if key, err := h.system.OpenKey(h.controlset + `\Control\Session Manager\Environment`); err == nil {
+		values, _ := key.Values()
+		for _, value := range values {
+			if s, err := value.String(); err == nil {
+				env[strings.ToLower(value.Name)] = s
+			}
+		}
+	}
+	if h.software != nil {
+		for _, setting := range []struct {
+			key, value, variable string
+		}{
+			{`Microsoft\Windows NT\CurrentVersion`, "SystemRoot", "systemroot"},
+			{`Microsoft\Windows\CurrentVersion`, "ProgramFilesDir", "programfiles"},
+			{`Microsoft\Windows\CurrentVersion`, "ProgramFilesDir (x86)", "programfiles(x86)"},
+			{`Microsoft\Windows\CurrentVersion`, "ProgramW6432Dir", "programw6432"},
+			{`Microsoft\Windows\CurrentVersion`, "CommonFilesDir", "commonprogramfiles"},
+			{`Microsoft\Windows NT\CurrentVersion\ProfileList`, "ProgramData", "programdata"},
+		} {
+			if key, err := h.software.OpenKey(setting.key); err == nil {
+				if s, _, err := key.GetStringValue(setting.value); err == nil && s != "" {
+					env[setting.variable] = s
+				}
+			}
+		}
+	}
+	if len(env["systemroot"]) >= 2 {
+		env["systemdrive"] = env["systemroot"][:2]
+	}
+	return env
+}
+
+// expandEnvironment replaces %variables% like ExpandEnvironmentStrings does on the machine itself
+func expandEnvironment(s string, env map[string]string) string {
+	for pass := 0; pass < 4 && strings.Contains(s, "%"); pass++ { // Variables can refer to other variables
+		var result strings.Builder
+		rest := s
+		for {
+			start := strings.Index(rest, "%")
+			if start == -1 {
+				break
+			}
+			end := strings.Index(rest[start+1:], "%")
+			if end == -1 {
+				break
+			}
+			end += start + 1
+			if value, found := env[strings.ToLower(rest[start+1:end])]; found {
+				result.WriteString(rest[:start] + value)
+				rest = rest[end+1:]
+			} else {
+				result.WriteString(rest[:end])
+				rest = rest[end:]
+			}
+		}
+		result.WriteString(rest)
+		if result.String() == s {
+			break
+		}
+		s = result.String()
+	}
+	return s
+}
+
+// accountSID translates the service account names that can be resolved without asking anyone
+func accountSID(account string, machineinfo localmachine.Machine, users localmachine.Users) string {
+	domain, name, found := strings.Cut(account, `\`)
+	if !found {
+		return ""
+	}
+	switch {
+	case strings.EqualFold(domain, "NT AUTHORITY"):
+		switch strings.ToLower(name) {
+		case "system":
+			return windowssecurity.SystemSID.String()
+		case "localservice", "local service":
+			return windowssecurity.LocalServiceSID.String()
+		case "networkservice", "network service":
+			return windowssecurity.NetworkServiceSID.String()
+		}
+	case strings.EqualFold(domain, "NT SERVICE"):
+		return windowssecurity.ServiceNameToServiceSID(name).String()
+	case domain == "." || strings.EqualFold(domain, machineinfo.Name):
+		for _, user := range users {
+			if strings.EqualFold(user.Name, name) {
+				return user.SID
+			}
+		}
+	}
+	return ""
+}
+
+// parseSID decodes a SID from hive data, which may be cut short of the subauthorities it claims to have
+func parseSID(data []byte) (windowssecurity.SID, []byte, error) {
+	if len(data) < 8 || len(data) < 8+4*int(data[1]) {
+		return "", data, errTruncatedSID
+	}
+	return windowssecurity.BytesToSID(data)
+}
+
+// ownerAndDACL splits a self relative security descriptor into the owner and the raw DACL
+func ownerAndDACL(sd []byte) (string, []byte) {
+	if len(sd) < 20 || sd[0] != 1 {
+		return "", nil
+	}
+	var owner string
+	if offset := binary.LittleEndian.Uint32(sd[4:]); offset != 0 && int(offset) < len(sd) {
+		if sid, _, err := parseSID(sd[offset:]); err == nil {
+			owner = sid.String()
+		}
+	}
+	var dacl []byte
+	const daclPresent = 0x0004
+	if offset := int(binary.LittleEndian.Uint32(sd[16:])); binary.LittleEndian.Uint16(sd[2:])&daclPresent != 0 && offset != 0 && offset+8 <= len(sd) {
+		if size := int(binary.LittleEndian.Uint16(sd[offset+2:])); offset+size <= len(sd) {
+			dacl = sd[offset : offset+size]
+		}
+	}
+	return owner, dacl
+}
+
+// lsaUnicodeString decodes the LSA_UNICODE_STRING structures LSA keeps its policy in, which have the string right after
+// the header of 8 or 16 bytes depending on the pointer size, as given by the buffer offset in the header
+func lsaUnicodeString(data []byte) string {
+	if len(data) < 8 {
+		return ""
+	}
+	length := int(binary.LittleEndian.Uint16(data[0:]))
+	offset := int(binary.LittleEndian.Uint32(data[4:]))
+	if offset == 0 && len(data) >= 16 {
+		offset = int(binary.LittleEndian.Uint32(data[8:]))
+	}
+	if length%2 != 0 || offset < 8 || offset+length > len(data) {
+		return ""
+	}
+	return decodeUTF16(data[offset : offset+length])
+}
+
+func decodeUTF16(data []byte) string {
+	chars := make([]uint16, len(data)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	return strings.TrimRight(string(utf16.Decode(chars)), "\x00")
+}
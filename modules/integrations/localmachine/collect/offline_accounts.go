@@ -0,0 +1,303 @@
+package collect
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+
+	"github.com/lkarlslund/adalanche/modules/integrations/localmachine"
+	"github.com/lkarlslund/adalanche/modules/integrations/localmachine/regf"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/lkarlslund/adalanche/modules/util"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+var errTruncatedSAMValue = errors.New("SAM value is too short")
+
+// SAM account control bits from the F value
+const (
+	acbDisabled      = 0x0001
+	acbPasswordNoExp = 0x0200
+	acbAutoLocked    = 0x0400
+)
+
+// Offsets in the V and C values are relative to the end of their headers
+const (
+	samUserHeaderSize  = 0xcc
+	samAliasHeaderSize = 0x34
+)
+
+// Privileges are kept as LUIDs in the Privilgs value
+var privilegeLUIDs = map[uint32]string{
+	2:  "SeCreateTokenPrivilege",
+	3:  "SeAssignPrimaryTokenPrivilege",
+	4:  "SeLockMemoryPrivilege",
+	5:  "SeIncreaseQuotaPrivilege",
+	6:  "SeMachineAccountPrivilege",
+	7:  "SeTcbPrivilege",
+	8:  "SeSecurityPrivilege",
+	9:  "SeTakeOwnershipPrivilege",
+	10: "SeLoadDriverPrivilege",
+	11: "SeSystemProfilePrivilege",
+	12: "SeSystemtimePrivilege",
+	13: "SeProfileSingleProcessPrivilege",
+	14: "SeIncreaseBasePriorityPrivilege",
+	15: "SeCreatePagefilePrivilege",
+	16: "SeCreatePermanentPrivilege",
+	17: "SeBackupPrivilege",
+	18: "SeRestorePrivilege",
+	19: "SeShutdownPrivilege",
+	20: "SeDebugPrivilege",
+	21: "SeAuditPrivilege",
+	22: "SeSystemEnvironmentPrivilege",
+	23: "SeChangeNotifyPrivilege",
+	24: "SeRemoteShutdownPrivilege",
+	25: "SeUndockPrivilege",
+	26: "SeSyncAgentPrivilege",
+	27: "SeEnableDelegationPrivilege",
+	28: "SeManageVolumePrivilege",
+	29: "SeImpersonatePrivilege",
+	30: "SeCreateGlobalPrivilege",
+	31: "SeTrustedCredManAccessPrivilege",
+	32: "SeRelabelPrivilege",
+	33: "SeIncreaseWorkingSetPrivilege",
+	34: "SeTimeZonePrivilege",
+	35: "SeCreateSymbolicLinkPrivilege",
+	36: "SeDelegateSessionUserImpersonatePrivilege",
+}
+
+// Logon rights are bits in the ActSysAc value
+var logonRights = []struct {
+	bit  uint32
+	name string
+}{
+	{0x0001, "SeInteractiveLogonRight"},
+	{0x0002, "SeNetworkLogonRight"},
+	{0x0004, "SeBatchLogonRight"},
+	{0x0010, "SeServiceLogonRight"},
+	{0x0040, "SeDenyInteractiveLogonRight"},
+	{0x0080, "SeDenyNetworkLogonRight"},
+	{0x0100, "SeDenyBatchLogonRight"},
+	{0x0200, "SeDenyServiceLogonRight"},
+	{0x0400, "SeRemoteInteractiveLogonRight"},
+	{0x0800, "SeDenyRemoteInteractiveLogonRight"},
+}
+
+// accounts reads the local users and groups (aliases) from the SAM hive
+func (h offlineHives) accounts(machineinfo localmachine.Machine) (localmachine.Users, localmachine.Groups) {
+	if h.sam == nil {
+		return nil, nil
+	}
+
+	var usersinfo localmachine.Users
+	if users_key, err := h.sam.OpenKey(`SAM\Domains\Account\Users`); err == nil {
+		subkeys, _ := users_key.SubKeys()
+		for _, user_key := range subkeys {
+			if _, err := strconv.ParseUint(user_key.Name(), 16, 32); err != nil {
+				continue // Names
+			}
+			f, _, _ := user_key.GetBinaryValue("F")
+			v, _, _ := user_key.GetBinaryValue("V")
+			user, rid, err := parseSAMUser(f, v)
+			if err != nil {
+				ui.Warn().Msgf("Problem reading SAM user %v: %v", user_key.Name(), err)
+				continue
+			}
+			user.SID = machineinfo.LocalSID + "-" + strconv.FormatUint(uint64(rid), 10)
+			usersinfo = append(usersinfo, user)
+		}
+	}
+
+	var groupsinfo localmachine.Groups
+	for _, domain := range []struct {
+		path, sid string
+	}{
+		{`SAM\Domains\Builtin\Aliases`, "S-1-5-32"},
+		{`SAM\Domains\Account\Aliases`, machineinfo.LocalSID},
+	} {
+		aliases_key, err := h.sam.OpenKey(domain.path)
+		if err != nil {
+			continue
+		}
+		subkeys, _ := aliases_key.SubKeys()
+		for _, alias_key := range subkeys {
+			rid, err := strconv.ParseUint(alias_key.Name(), 16, 32)
+			if err != nil {
+				continue // Members and Names
+			}
+			c, _, _ := alias_key.GetBinaryValue("C")
+			group, err := parseSAMAlias(c)
+			if err != nil {
+				ui.Warn().Msgf("Problem reading SAM group %v: %v", alias_key.Name(), err)
+				continue
+			}
+			group.SID = domain.sid + "-" + strconv.FormatUint(rid, 10)
+
+			for i, member := range group.Members {
+				for j, user := range usersinfo {
+					if user.SID == member.SID {
+						group.Members[i].Name = machineinfo.Name + `\` + user.Name
+						if group.SID == windowssecurity.AdministratorsSID.String() {
+							usersinfo[j].IsAdmin = true
+						}
+					}
+				}
+			}
+			groupsinfo = append(groupsinfo, group)
+		}
+	}
+
+	return usersinfo, groupsinfo
+}
+
+// parseSAMUser decodes the fixed length F value and the variable length V value of a SAM user
+func parseSAMUser(f, v []byte) (localmachine.User, uint32, error) {
+	if len(f) < 0x44 || len(v) < samUserHeaderSize {
+		return localmachine.User{}, 0, errTruncatedSAMValue
+	}
+	acb := binary.LittleEndian.Uint16(f[0x38:])
+	user := localmachine.User{
+		Name:                 samString(v, 0x0c, samUserHeaderSize),
+		FullName:             samString(v, 0x18, samUserHeaderSize),
+		IsEnabled:            acb&acbDisabled == 0,
+		IsLocked:             acb&acbAutoLocked != 0,
+		PasswordNeverExpires: acb&acbPasswordNoExp != 0,
+		LastLogon:            util.FiletimeToTime(binary.LittleEndian.Uint64(f[0x08:])),
+		LastLogoff:           util.FiletimeToTime(binary.LittleEndian.Uint64(f[0x10:])),
+		PasswordLastSet:      util.FiletimeToTime(binary.LittleEndian.Uint64(f[0x18:])),
+		BadPasswordCount:     int(binary.LittleEndian.Uint16(f[0x40:])),
+		NumberOfLogins:       int(binary.LittleEndian.Uint16(f[0x42:])),
+	}
+	if user.Name == "" {
+		return user, 0, errTruncatedSAMValue
+	}
+	return user, binary.LittleEndian.Uint32(f[0x30:]), nil
+}
+
+// parseSAMAlias decodes the C value of a SAM alias, which has the SIDs of the members
+func parseSAMAlias(c []byte) (localmachine.Group, error) {
+	if len(c) < samAliasHeaderSize {
+		return localmachine.Group{}, errTruncatedSAMValue
+	}
+	group := localmachine.Group{
+		Name:    samString(c, 0x10, samAliasHeaderSize),
+		Comment: samString(c, 0x1c, samAliasHeaderSize),
+	}
+	if group.Name == "" {
+		return group, errTruncatedSAMValue
+	}
+
+	offset := int(binary.LittleEndian.Uint32(c[0x28:])) + samAliasHeaderSize
+	count := int(binary.LittleEndian.Uint32(c[0x30:]))
+	if count == 0 {
+		return group, nil
+	}
+	if offset > len(c) {
+		return group, errTruncatedSAMValue
+	}
+	members := c[offset:]
+	for i := 0; i < count; i++ {
+		sid, rest, err := parseSID(members)
+		if err != nil {
+			return group, err
+		}
+		group.Members = append(group.Members, localmachine.Member{
+			SID: sid.String(),
+		})
+		members = rest
+	}
+	return group, nil
+}
+
+// samString reads a UTF-16 string pointed to by an offset and length pair in the header of a SAM value
+func samString(data []byte, entry, headersize int) string {
+	offset := int(binary.LittleEndian.Uint32(data[entry:])) + headersize
+	length := int(binary.LittleEndian.Uint32(data[entry+4:]))
+	if length == 0 || offset+length > len(data) {
+		return ""
+	}
+	return decodeUTF16(data[offset : offset+length])
+}
+
+// privileges reads the privileges and logon rights assigned to each account in the LSA policy
+func (h offlineHives) privileges() localmachine.Privileges {
+	if h.security == nil {
+		return nil
+	}
+	accounts_key, err := h.security.OpenKey(`Policy\Accounts`)
+	if err != nil {
+		ui.Warn().Msgf("Problem opening LSA accounts in SECURITY hive: %v", err)
+		return nil
+	}
+	accounts, _ := accounts_key.SubKeys()
+
+	assigned := make(map[string][]string)
+	for _, account_key := range accounts {
+		sid := account_key.Name()
+		if _, err := windowssecurity.ParseStringSID(sid); err != nil {
+			continue
+		}
+		for _, privilege := range accountPrivileges(account_key) {
+			assigned[privilege] = append(assigned[privilege], sid)
+		}
+	}
+
+	// Same order every time
+	var privilegesinfo localmachine.Privileges
+	for luid := uint32(2); luid <= 36; luid++ {
+		if sids := assigned[privilegeLUIDs[luid]]; len(sids) > 0 {
+			privilegesinfo = append(privilegesinfo, localmachine.Privilege{
+				Name:         privilegeLUIDs[luid],
+				AssignedSIDs: sids,
+			})
+		}
+	}
+	for _, right := range logonRights {
+		if sids := assigned[right.name]; len(sids) > 0 {
+			privilegesinfo = append(privilegesinfo, localmachine.Privilege{
+				Name:         right.name,
+				AssignedSIDs: sids,
+			})
+		}
+	}
+	return privilegesinfo
+}
+
+func accountPrivileges(account_key *regf.Key) []string {
+	var privileges []string
+	if key, err := account_key.OpenKey("Privilgs"); err == nil {
+		if value, err := key.Value(""); err == nil {
+			privileges = parsePrivilegeSet(value.Data)
+		}
+	}
+	if key, err := account_key.OpenKey("ActSysAc"); err == nil {
+		if value, err := key.Value(""); err == nil && len(value.Data) >= 4 {
+			access := binary.LittleEndian.Uint32(value.Data)
+			for _, right := range logonRights {
+				if access&right.bit != 0 {
+					privileges = append(privileges, right.name)
+				}
+			}
+		}
+	}
+	return privileges
+}
+
+// parsePrivilegeSet decodes a PRIVILEGE_SET with its count, control and LUID_AND_ATTRIBUTES entries
+func parsePrivilegeSet(data []byte) []string {
+	if len(data) < 8 {
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint32(data))
+	var privileges []string
+	for i := 0; i < count && 8+i*12+12 <= len(data); i++ {
+		entry := data[8+i*12:]
+		if binary.LittleEndian.Uint32(entry[4:]) != 0 {
+			continue
+		}
+		if name, found := privilegeLUIDs[binary.LittleEndian.Uint32(entry)]; found {
+			privileges = append(privileges, name)
+		}
+	}
+	return privileges
+}
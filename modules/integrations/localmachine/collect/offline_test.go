@@ -0,0 +1,163 @@
+package collect
+
+import (
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/lkarlslund/adalanche/modules/integrations/localmachine"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+func utf16le(s string) []byte {
+	var data []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		data = binary.LittleEndian.AppendUint16(data, c)
+	}
+	return data
+}
+
+func sidBytes(sid string) []byte {
+	s := windowssecurity.MustParseStringSID(sid)
+	return append([]byte{1, byte((len(s) - 6) / 4)}, s...)
+}
+
+// samValue lays out strings after a header with offset and length pairs at the given positions
+func samValue(headersize int, fields map[int][]byte) []byte {
+	data := make([]byte, headersize)
+	for entry, field := range fields {
+		binary.LittleEndian.PutUint32(data[entry:], uint32(len(data)-headersize))
+		binary.LittleEndian.PutUint32(data[entry+4:], uint32(len(field)))
+		data = append(data, field...)
+	}
+	return data
+}
+
+func TestParseSAM(t *testing.T) {
+	f := make([]byte, 0x50)
+	binary.LittleEndian.PutUint64(f[0x08:], 133000000000000000) // 2022-06-19
+	binary.LittleEndian.PutUint32(f[0x30:], 1001)
+	binary.LittleEndian.PutUint16(f[0x38:], 0x0010|acbDisabled|acbPasswordNoExp)
+	binary.LittleEndian.PutUint16(f[0x40:], 3)
+	binary.LittleEndian.PutUint16(f[0x42:], 42)
+	v := samValue(samUserHeaderSize, map[int][]byte{
+		0x0c: utf16le("backup"),
+		0x18: utf16le("Backup Account"),
+	})
+
+	user, rid, err := parseSAMUser(f, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rid != 1001 || user.Name != "backup" || user.FullName != "Backup Account" || user.IsEnabled || !user.PasswordNeverExpires ||
+		user.BadPasswordCount != 3 || user.NumberOfLogins != 42 || user.LastLogon.Year() != 2022 || !user.PasswordLastSet.IsZero() {
+		t.Errorf("unexpected user %+v with RID %v", user, rid)
+	}
+	if _, _, err = parseSAMUser(f[:0x30], v); err == nil {
+		t.Error("truncated F value was accepted")
+	}
+
+	c := samValue(samAliasHeaderSize, map[int][]byte{
+		0x10: utf16le("Administrators"),
+		0x28: append(sidBytes("S-1-5-21-1-2-3-500"), sidBytes("S-1-5-4")...),
+	})
+	binary.LittleEndian.PutUint32(c[0x30:], 2)
+	group, err := parseSAMAlias(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.Name != "Administrators" || len(group.Members) != 2 || group.Members[0].SID != "S-1-5-21-1-2-3-500" || group.Members[1].SID != "S-1-5-4" {
+		t.Errorf("unexpected group %+v", group)
+	}
+	binary.LittleEndian.PutUint32(c[0x30:], 3)
+	if _, err = parseSAMAlias(c); err == nil {
+		t.Error("member count beyond the data was accepted")
+	}
+}
+
+func TestParseLSA(t *testing.T) {
+	privileges := make([]byte, 8+3*12)
+	binary.LittleEndian.PutUint32(privileges, 3)
+	for i, luid := range []uint32{29, 17, 99} {
+		binary.LittleEndian.PutUint32(privileges[8+i*12:], luid)
+	}
+	if names := parsePrivilegeSet(privileges); len(names) != 2 || names[0] != "SeImpersonatePrivilege" || names[1] != "SeBackupPrivilege" {
+		t.Errorf("privilege set decoded as %v", names)
+	}
+
+	// 64-bit layout, with the buffer offset after the padding
+	name := make([]byte, 16)
+	binary.LittleEndian.PutUint16(name[0:], 8)
+	binary.LittleEndian.PutUint16(name[2:], 10)
+	binary.LittleEndian.PutUint32(name[8:], 16)
+	name = append(name, utf16le("CORP\x00")...)
+	if domain := lsaUnicodeString(name); domain != "CORP" {
+		t.Errorf("domain name decoded as %q", domain)
+	}
+
+	// Owner is SYSTEM, DACL is an empty ACL
+	sd := make([]byte, 20)
+	sd[0] = 1
+	binary.LittleEndian.PutUint16(sd[2:], 0x8004)
+	binary.LittleEndian.PutUint32(sd[4:], 20)
+	sd = append(sd, sidBytes("S-1-5-18")...)
+	binary.LittleEndian.PutUint32(sd[16:], uint32(len(sd)))
+	sd = append(sd, 2, 0, 8, 0, 0, 0, 0, 0)
+	if owner, dacl := ownerAndDACL(sd); owner != "S-1-5-18" || len(dacl) != 8 {
+		t.Errorf("security descriptor has owner %v and DACL %x", owner, dacl)
+	}
+
+	// Owner offset pointing at the last bytes of the descriptor
+	binary.LittleEndian.PutUint32(sd[4:], uint32(len(sd)-2))
+	sd[len(sd)-2] = 1
+	sd[len(sd)-1] = 4
+	if owner, dacl := ownerAndDACL(sd); owner != "" || len(dacl) != 8 {
+		t.Errorf("security descriptor with bad owner offset has owner %v and DACL %x", owner, dacl)
+	}
+
+	// PolAcDmS value cut short of its subauthorities
+	polacdms := sidBytes("S-1-5-21-1-2-3")
+	if sid, _, err := parseSID(polacdms); err != nil || sid.String() != "S-1-5-21-1-2-3" {
+		t.Errorf("domain SID decoded as %v: %v", sid, err)
+	}
+	for _, truncated := range [][]byte{polacdms[:len(polacdms)-1], polacdms[:8], polacdms[:2]} {
+		if _, _, err := parseSID(truncated); err == nil {
+			t.Errorf("truncated SID %x was accepted", truncated)
+		}
+	}
+}
+
+func TestServiceExecutable(t *testing.T) {
+	env := map[string]string{
+		"systemroot":   `C:\Windows`,
+		"windir":       `%SystemRoot%`,
+		"programfiles": `C:\Program Files`,
+	}
+	for imagepath, expected := range map[string]string{
+		`system32\svchost.exe -k netsvcs`:                `C:\Windows\system32\svchost.exe`,
+		`\SystemRoot\System32\lsass.exe`:                 `C:\Windows\System32\lsass.exe`,
+		`"%ProgramFiles%\Vendor App\agent.exe" /service`: `C:\Program Files\Vendor App\agent.exe`,
+		`C:\Program Files\Vendor App\agent.exe /service`: `C:\Program Files\Vendor App\agent.exe`,
+		`%windir%\%unknown%\tool.exe`:                    `C:\Windows\%unknown%\tool.exe`,
+		`\??\`:                                           ``,
+	} {
+		_, executable := serviceExecutable(imagepath)
+		if executable = expandEnvironment(executable, env); executable != expected {
+			t.Errorf("image path %v gave executable %v, expected %v", imagepath, executable, expected)
+		}
+	}
+
+	machine := localmachine.Machine{Name: "WS01"}
+	users := localmachine.Users{{Name: "svc_backup", SID: "S-1-5-21-1-2-3-1001"}}
+	for account, expected := range map[string]string{
+		`NT AUTHORITY\NetworkService`: "S-1-5-20",
+		`.\svc_backup`:                "S-1-5-21-1-2-3-1001",
+		`ws01\SVC_BACKUP`:             "S-1-5-21-1-2-3-1001",
+		`CORP\svc_sql`:                "",
+		`LocalSystem`:                 "",
+	} {
+		if sid := accountSID(account, machine, users); sid != expected {
+			t.Errorf("account %v resolved to %v, expected %v", account, sid, expected)
+		}
+	}
+}
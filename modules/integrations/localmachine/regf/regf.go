@@ -0,0 +1,469 @@
+// Package regf reads offline Windows registry hive files (SYSTEM, SOFTWARE, SAM, SECURITY etc.) on any platform
+package regf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/lkarlslund/adalanche/modules/util"
+)
+
+const (
+	NONE                       = 0
+	SZ                         = 1
+	EXPAND_SZ                  = 2
+	BINARY                     = 3
+	DWORD                      = 4
+	DWORD_BIG_ENDIAN           = 5
+	LINK                       = 6
+	MULTI_SZ                   = 7
+	RESOURCE_LIST              = 8
+	FULL_RESOURCE_DESCRIPTOR   = 9
+	RESOURCE_REQUIREMENTS_LIST = 10
+	QWORD                      = 11
+)
+
+const (
+	baseBlockSize = 0x1000
+
+	keyCompressedName   = 0x0020
+	valueCompressedName = 0x0001
+
+	dataInline     = 0x80000000
+	bigDataSegment = 16344
+)
+
+var (
+	ErrNotExist        = errors.New("registry key or value does not exist")
+	ErrUnexpectedType  = errors.New("unexpected registry value type")
+	ErrInvalidHive     = errors.New("not a registry hive file")
+	ErrCorruptedHive   = errors.New("registry hive is corrupted")
+	ErrTooDeeplyNested = errors.New("registry subkey lists are nested too deeply")
+)
+
+type Hive struct {
+	data  []byte
+	minor uint32
+	dirty bool
+	root  uint32
+}
+
+// Open reads a hive file into memory
+func Open(path string) (*Hive, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+func Parse(data []byte) (*Hive, error) {
+	if len(data) < baseBlockSize || string(data[0:4]) != "regf" {
+		return nil, ErrInvalidHive
+	}
+	if major := binary.LittleEndian.Uint32(data[0x14:]); major != 1 {
+		return nil, fmt.Errorf("unsupported hive format version %v", major)
+	}
+	h := &Hive{
+		data:  data,
+		minor: binary.LittleEndian.Uint32(data[0x18:]),
+		dirty: binary.LittleEndian.Uint32(data[0x04:]) != binary.LittleEndian.Uint32(data[0x08:]),
+		root:  binary.LittleEndian.Uint32(data[0x24:]),
+	}
+	if _, err := h.Root(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Dirty is true when the hive was not cleanly written, so the most recent changes are in the transaction logs which are not read
+func (h *Hive) Dirty() bool {
+	return h.dirty
+}
+
+func (h *Hive) Root() (*Key, error) {
+	return h.key(h.root)
+}
+
+// OpenKey opens a key by its backslash separated path from the root of the hive
+func (h *Hive) OpenKey(path string) (*Key, error) {
+	root, err := h.Root()
+	if err != nil {
+		return nil, err
+	}
+	return root.OpenKey(path)
+}
+
+// cell returns the contents of the cell at an offset relative to the first hive bin
+func (h *Hive) cell(offset uint32) ([]byte, error) {
+	start := baseBlockSize + int64(offset)
+	if offset == 0xffffffff || start+4 > int64(len(h.data)) {
+		return nil, ErrCorruptedHive
+	}
+	size := int64(int32(binary.LittleEndian.Uint32(h.data[start:])))
+	if size < 0 {
+		size = -size // Allocated
+	}
+	if size < 4 || start+size > int64(len(h.data)) {
+		return nil, ErrCorruptedHive
+	}
+	return h.data[start+4 : start+size], nil
+}
+
+func (h *Hive) key(offset uint32) (*Key, error) {
+	nk, err := h.cell(offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(nk) < 0x4c || string(nk[0:2]) != "nk" {
+		return nil, ErrCorruptedHive
+	}
+	namelength := int(binary.LittleEndian.Uint16(nk[0x48:]))
+	if 0x4c+namelength > len(nk) {
+		return nil, ErrCorruptedHive
+	}
+	return &Key{
+		hive: h,
+		nk:   nk,
+		name: decodeName(nk[0x4c:0x4c+namelength], binary.LittleEndian.Uint16(nk[0x02:])&keyCompressedName != 0),
+	}, nil
+}
+
+// subkeys appends the keys in a subkey list, following index roots into their sublists
+func (h *Hive) subkeys(offset uint32, keys []*Key, depth int) ([]*Key, error) {
+	if depth > 2 {
+		return keys, ErrTooDeeplyNested
+	}
+	list, err := h.cell(offset)
+	if err != nil {
+		return keys, err
+	}
+	if len(list) < 4 {
+		return keys, ErrCorruptedHive
+	}
+	count := int(binary.LittleEndian.Uint16(list[2:]))
+	stride := 4
+	switch string(list[0:2]) {
+	case "lf", "lh":
+		stride = 8 // Offset followed by a name hint
+	case "li", "ri":
+	default:
+		return keys, ErrCorruptedHive
+	}
+	if 4+count*stride > len(list) {
+		return keys, ErrCorruptedHive
+	}
+	for i := 0; i < count; i++ {
+		entry := binary.LittleEndian.Uint32(list[4+i*stride:])
+		if string(list[0:2]) == "ri" {
+			keys, err = h.subkeys(entry, keys, depth+1)
+		} else {
+			var key *Key
+			key, err = h.key(entry)
+			keys = append(keys, key)
+		}
+		if err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+type Key struct {
+	hive *Hive
+	nk   []byte
+	name string
+}
+
+func (k *Key) Name() string {
+	return k.name
+}
+
+func (k *Key) LastWritten() time.Time {
+	return util.FiletimeToTime(binary.LittleEndian.Uint64(k.nk[0x04:]))
+}
+
+func (k *Key) SubKeys() ([]*Key, error) {
+	if binary.LittleEndian.Uint32(k.nk[0x14:]) == 0 {
+		return nil, nil
+	}
+	return k.hive.subkeys(binary.LittleEndian.Uint32(k.nk[0x1c:]), nil, 0)
+}
+
+func (k *Key) ReadSubKeyNames() ([]string, error) {
+	subkeys, err := k.SubKeys()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(subkeys))
+	for i, subkey := range subkeys {
+		names[i] = subkey.name
+	}
+	return names, nil
+}
+
+// OpenKey opens a subkey by its backslash separated path, names are not case sensitive
+func (k *Key) OpenKey(path string) (*Key, error) {
+	key := k
+	for _, name := range strings.Split(path, `\`) {
+		if name == "" {
+			continue
+		}
+		subkeys, err := key.SubKeys()
+		if err != nil {
+			return nil, err
+		}
+		key = nil
+		for _, subkey := range subkeys {
+			if strings.EqualFold(subkey.name, name) {
+				key = subkey
+				break
+			}
+		}
+		if key == nil {
+			return nil, ErrNotExist
+		}
+	}
+	return key, nil
+}
+
+func (k *Key) Values() ([]Value, error) {
+	count := int(binary.LittleEndian.Uint32(k.nk[0x24:]))
+	if count == 0 {
+		return nil, nil
+	}
+	list, err := k.hive.cell(binary.LittleEndian.Uint32(k.nk[0x28:]))
+	if err != nil {
+		return nil, err
+	}
+	if count*4 > len(list) {
+		return nil, ErrCorruptedHive
+	}
+	values := make([]Value, count)
+	for i := range values {
+		values[i], err = k.hive.value(binary.LittleEndian.Uint32(list[i*4:]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (k *Key) ReadValueNames() ([]string, error) {
+	values, err := k.Values()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(values))
+	for i, value := range values {
+		names[i] = value.Name
+	}
+	return names, nil
+}
+
+// Value returns a value by name, the default value of the key has a blank name
+func (k *Key) Value(name string) (Value, error) {
+	values, err := k.Values()
+	if err != nil {
+		return Value{}, err
+	}
+	for _, value := range values {
+		if strings.EqualFold(value.Name, name) {
+			return value, nil
+		}
+	}
+	return Value{}, ErrNotExist
+}
+
+func (k *Key) GetStringValue(name string) (string, uint32, error) {
+	value, err := k.Value(name)
+	if err != nil {
+		return "", 0, err
+	}
+	s, err := value.String()
+	return s, value.Type, err
+}
+
+func (k *Key) GetStringsValue(name string) ([]string, uint32, error) {
+	value, err := k.Value(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	s, err := value.Strings()
+	return s, value.Type, err
+}
+
+func (k *Key) GetIntegerValue(name string) (uint64, uint32, error) {
+	value, err := k.Value(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	i, err := value.Integer()
+	return i, value.Type, err
+}
+
+func (k *Key) GetBinaryValue(name string) ([]byte, uint32, error) {
+	value, err := k.Value(name)
+	return value.Data, value.Type, err
+}
+
+// SecurityDescriptor returns the self relative security descriptor protecting the key
+func (k *Key) SecurityDescriptor() ([]byte, error) {
+	sk, err := k.hive.cell(binary.LittleEndian.Uint32(k.nk[0x2c:]))
+	if err != nil {
+		return nil, err
+	}
+	if len(sk) < 0x14 || string(sk[0:2]) != "sk" {
+		return nil, ErrCorruptedHive
+	}
+	size := int(binary.LittleEndian.Uint32(sk[0x10:]))
+	if 0x14+size > len(sk) {
+		return nil, ErrCorruptedHive
+	}
+	return sk[0x14 : 0x14+size], nil
+}
+
+func (h *Hive) value(offset uint32) (Value, error) {
+	vk, err := h.cell(offset)
+	if err != nil {
+		return Value{}, err
+	}
+	if len(vk) < 0x14 || string(vk[0:2]) != "vk" {
+		return Value{}, ErrCorruptedHive
+	}
+	namelength := int(binary.LittleEndian.Uint16(vk[0x02:]))
+	if 0x14+namelength > len(vk) {
+		return Value{}, ErrCorruptedHive
+	}
+	value := Value{
+		Name: decodeName(vk[0x14:0x14+namelength], binary.LittleEndian.Uint16(vk[0x10:])&valueCompressedName != 0),
+		Type: binary.LittleEndian.Uint32(vk[0x0c:]),
+	}
+
+	size := binary.LittleEndian.Uint32(vk[0x04:])
+	dataoffset := binary.LittleEndian.Uint32(vk[0x08:])
+	switch {
+	case size&dataInline != 0:
+		// Up to four bytes are kept in the offset field
+		size &^= dataInline
+		if size > 4 {
+			return Value{}, ErrCorruptedHive
+		}
+		value.Data = vk[0x08 : 0x08+size]
+	case size == 0:
+	case size > bigDataSegment && h.minor >= 4:
+		value.Data, err = h.bigData(dataoffset, int(size))
+	default:
+		var data []byte
+		data, err = h.cell(dataoffset)
+		if err == nil && int(size) > len(data) {
+			err = ErrCorruptedHive
+		}
+		if err == nil {
+			value.Data = data[:size]
+		}
+	}
+	return value, err
+}
+
+// bigData reassembles values stored in segments in hive format 1.4 and later
+func (h *Hive) bigData(offset uint32, size int) ([]byte, error) {
+	// The size comes from the hive, so don't allocate more than could possibly be there
+	if size > len(h.data) {
+		return nil, ErrCorruptedHive
+	}
+	db, err := h.cell(offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(db) < 8 || string(db[0:2]) != "db" {
+		return nil, ErrCorruptedHive
+	}
+	count := int(binary.LittleEndian.Uint16(db[0x02:]))
+	list, err := h.cell(binary.LittleEndian.Uint32(db[0x04:]))
+	if err != nil {
+		return nil, err
+	}
+	if count*4 > len(list) || size > count*bigDataSegment {
+		return nil, ErrCorruptedHive
+	}
+	data := make([]byte, 0, size)
+	for i := 0; i < count && len(data) < size; i++ {
+		segment, err := h.cell(binary.LittleEndian.Uint32(list[i*4:]))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, segment[:min(len(segment), bigDataSegment, size-len(data))]...)
+	}
+	if len(data) < size {
+		return nil, ErrCorruptedHive
+	}
+	return data, nil
+}
+
+type Value struct {
+	Name string
+	Type uint32
+	Data []byte
+}
+
+func (v Value) String() (string, error) {
+	switch v.Type {
+	case SZ, EXPAND_SZ, LINK:
+		return strings.TrimRight(decodeUTF16(v.Data), "\x00"), nil
+	}
+	return "", ErrUnexpectedType
+}
+
+func (v Value) Strings() ([]string, error) {
+	if v.Type != MULTI_SZ {
+		return nil, ErrUnexpectedType
+	}
+	var result []string
+	for _, s := range strings.Split(decodeUTF16(v.Data), "\x00") {
+		if s == "" {
+			break
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+func (v Value) Integer() (uint64, error) {
+	switch {
+	case v.Type == DWORD && len(v.Data) >= 4:
+		return uint64(binary.LittleEndian.Uint32(v.Data)), nil
+	case v.Type == DWORD_BIG_ENDIAN && len(v.Data) >= 4:
+		return uint64(binary.BigEndian.Uint32(v.Data)), nil
+	case v.Type == QWORD && len(v.Data) >= 8:
+		return binary.LittleEndian.Uint64(v.Data), nil
+	case v.Type == DWORD || v.Type == DWORD_BIG_ENDIAN || v.Type == QWORD:
+		return 0, ErrCorruptedHive
+	}
+	return 0, ErrUnexpectedType
+}
+
+func decodeName(data []byte, compressed bool) string {
+	if !compressed {
+		return decodeUTF16(data)
+	}
+	// Latin-1
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func decodeUTF16(data []byte) string {
+	chars := make([]uint16, len(data)/2)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+	return string(utf16.Decode(chars))
+}
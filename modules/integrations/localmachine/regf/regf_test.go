@@ -0,0 +1,241 @@
+package regf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"unicode/utf16"
+)
+
+type testKey struct {
+	name    string
+	values  []Value
+	subkeys []*testKey
+}
+
+// hiveBuilder writes a minimal hive, using an index root for keys with more than two subkeys
+type hiveBuilder struct {
+	bins     []byte
+	security uint32
+}
+
+func (b *hiveBuilder) cell(data []byte) uint32 {
+	offset := uint32(len(b.bins))
+	size := (len(data) + 4 + 7) &^ 7
+	cell := make([]byte, size)
+	binary.LittleEndian.PutUint32(cell, uint32(-int32(size)))
+	copy(cell[4:], data)
+	b.bins = append(b.bins, cell...)
+	return offset
+}
+
+func (b *hiveBuilder) offsets(offsets []uint32) uint32 {
+	list := make([]byte, len(offsets)*4)
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint32(list[i*4:], offset)
+	}
+	return b.cell(list)
+}
+
+func (b *hiveBuilder) list(signature string, offsets []uint32) uint32 {
+	stride := 4
+	if signature == "lh" {
+		stride = 8
+	}
+	list := make([]byte, 4+len(offsets)*stride)
+	copy(list, signature)
+	binary.LittleEndian.PutUint16(list[2:], uint16(len(offsets)))
+	for i, offset := range offsets {
+		binary.LittleEndian.PutUint32(list[4+i*stride:], offset)
+	}
+	return b.cell(list)
+}
+
+func (b *hiveBuilder) value(v Value) uint32 {
+	vk := make([]byte, 0x14+len(v.Name))
+	copy(vk, "vk")
+	binary.LittleEndian.PutUint16(vk[0x02:], uint16(len(v.Name)))
+	binary.LittleEndian.PutUint32(vk[0x0c:], v.Type)
+	binary.LittleEndian.PutUint16(vk[0x10:], valueCompressedName)
+	copy(vk[0x14:], v.Name)
+	switch {
+	case len(v.Data) <= 4:
+		binary.LittleEndian.PutUint32(vk[0x04:], uint32(len(v.Data))|dataInline)
+		copy(vk[0x08:], v.Data)
+	case len(v.Data) > bigDataSegment:
+		var segments []uint32
+		for data := v.Data; len(data) > 0; data = data[min(len(data), bigDataSegment):] {
+			segments = append(segments, b.cell(data[:min(len(data), bigDataSegment)]))
+		}
+		db := make([]byte, 8)
+		copy(db, "db")
+		binary.LittleEndian.PutUint16(db[0x02:], uint16(len(segments)))
+		binary.LittleEndian.PutUint32(db[0x04:], b.offsets(segments))
+		binary.LittleEndian.PutUint32(vk[0x04:], uint32(len(v.Data)))
+		binary.LittleEndian.PutUint32(vk[0x08:], b.cell(db))
+	default:
+		binary.LittleEndian.PutUint32(vk[0x04:], uint32(len(v.Data)))
+		binary.LittleEndian.PutUint32(vk[0x08:], b.cell(v.Data))
+	}
+	return b.cell(vk)
+}
+
+func (b *hiveBuilder) key(k *testKey) uint32 {
+	nk := make([]byte, 0x4c+len(k.name))
+	copy(nk, "nk")
+	binary.LittleEndian.PutUint16(nk[0x02:], keyCompressedName)
+	binary.LittleEndian.PutUint32(nk[0x14:], uint32(len(k.subkeys)))
+	binary.LittleEndian.PutUint32(nk[0x24:], uint32(len(k.values)))
+	binary.LittleEndian.PutUint32(nk[0x2c:], b.security)
+	binary.LittleEndian.PutUint16(nk[0x48:], uint16(len(k.name)))
+	copy(nk[0x4c:], k.name)
+
+	var subkeys []uint32
+	for _, subkey := range k.subkeys {
+		subkeys = append(subkeys, b.key(subkey))
+	}
+	switch {
+	case len(subkeys) > 2:
+		half := len(subkeys) / 2
+		binary.LittleEndian.PutUint32(nk[0x1c:], b.list("ri", []uint32{b.list("lh", subkeys[:half]), b.list("li", subkeys[half:])}))
+	case len(subkeys) > 0:
+		binary.LittleEndian.PutUint32(nk[0x1c:], b.list("lh", subkeys))
+	}
+
+	var values []uint32
+	for _, value := range k.values {
+		values = append(values, b.value(value))
+	}
+	if len(values) > 0 {
+		binary.LittleEndian.PutUint32(nk[0x28:], b.offsets(values))
+	}
+	return b.cell(nk)
+}
+
+func buildHive(root *testKey, securitydescriptor []byte) []byte {
+	b := &hiveBuilder{bins: make([]byte, 0x20)}
+	copy(b.bins, "hbin")
+
+	sk := make([]byte, 0x14+len(securitydescriptor))
+	copy(sk, "sk")
+	binary.LittleEndian.PutUint32(sk[0x10:], uint32(len(securitydescriptor)))
+	copy(sk[0x14:], securitydescriptor)
+	b.security = b.cell(sk)
+
+	rootoffset := b.key(root)
+
+	base := make([]byte, baseBlockSize)
+	copy(base, "regf")
+	binary.LittleEndian.PutUint32(base[0x04:], 1)
+	binary.LittleEndian.PutUint32(base[0x08:], 1)
+	binary.LittleEndian.PutUint32(base[0x14:], 1)
+	binary.LittleEndian.PutUint32(base[0x18:], 5)
+	binary.LittleEndian.PutUint32(base[0x24:], rootoffset)
+	return append(base, b.bins...)
+}
+
+func utf16z(s ...string) []byte {
+	var data []byte
+	for _, s := range s {
+		for _, c := range utf16.Encode([]rune(s + "\x00")) {
+			data = binary.LittleEndian.AppendUint16(data, c)
+		}
+	}
+	return data
+}
+
+func TestHive(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789"), 4000)
+	services := &testKey{name: "Services"}
+	for _, name := range []string{"Alpha", "Bravo", "Charlie", "Delta", "Echo"} {
+		services.subkeys = append(services.subkeys, &testKey{
+			name: name,
+			values: []Value{
+				{Name: "ImagePath", Type: EXPAND_SZ, Data: utf16z(`%SystemRoot%\` + name + ".exe")},
+				{Name: "Start", Type: DWORD, Data: []byte{2, 0, 0, 0}},
+			},
+		})
+	}
+	data := buildHive(&testKey{
+		name: "ROOT",
+		values: []Value{
+			{Name: "", Type: SZ, Data: utf16z("default")},
+			{Name: "Suite", Type: MULTI_SZ, Data: append(utf16z("Terminal Server", "Enterprise"), 0, 0)},
+			{Name: "Big", Type: BINARY, Data: big},
+			{Name: "Stamp", Type: QWORD, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+		},
+		subkeys: []*testKey{{name: "ControlSet001", subkeys: []*testKey{services}}},
+	}, []byte{1, 0, 4, 0x80})
+
+	hive, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hive.Dirty() {
+		t.Error("clean hive is reported as dirty")
+	}
+	root, _ := hive.Root()
+
+	if s, _, err := root.GetStringValue(""); s != "default" || err != nil {
+		t.Errorf("default value is %q (%v)", s, err)
+	}
+	if s, _, err := root.GetStringsValue("suite"); len(s) != 2 || s[1] != "Enterprise" || err != nil {
+		t.Errorf("multi string value is %q (%v)", s, err)
+	}
+	if b, _, err := root.GetBinaryValue("Big"); !bytes.Equal(b, big) || err != nil {
+		t.Errorf("big data value has %v bytes (%v)", len(b), err)
+	}
+	if i, _, err := root.GetIntegerValue("Stamp"); i != 0x0807060504030201 || err != nil {
+		t.Errorf("qword value is %x (%v)", i, err)
+	}
+	if _, _, err := root.GetIntegerValue("Suite"); err != ErrUnexpectedType {
+		t.Errorf("reading strings as integer gave %v", err)
+	}
+
+	servicekey, err := hive.OpenKey(`controlset001\SERVICES`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := servicekey.ReadSubKeyNames()
+	if len(names) != 5 || names[4] != "Echo" || err != nil {
+		t.Errorf("subkeys through index root are %v (%v)", names, err)
+	}
+	delta, err := servicekey.OpenKey("Delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, _, _ := delta.GetStringValue("ImagePath"); s != `%SystemRoot%\Delta.exe` {
+		t.Errorf("image path is %q", s)
+	}
+	if i, _, _ := delta.GetIntegerValue("Start"); i != 2 {
+		t.Errorf("inline dword is %v", i)
+	}
+	if sd, err := delta.SecurityDescriptor(); !bytes.Equal(sd, []byte{1, 0, 4, 0x80}) || err != nil {
+		t.Errorf("security descriptor is %x (%v)", sd, err)
+	}
+	if _, err = hive.OpenKey(`ControlSet001\Services\Foxtrot`); !errors.Is(err, ErrNotExist) {
+		t.Errorf("missing key gave %v", err)
+	}
+
+	// Damaged hives must fail without panicking
+	for _, size := range []int{baseBlockSize - 1, baseBlockSize + 0x30, len(data) - 64} {
+		if hive, err := Parse(data[:size]); err == nil {
+			hive.OpenKey(`ControlSet001\Services\Echo`)
+		}
+	}
+	// A huge size on a big data value is rejected before anything is allocated
+	huge := bytes.Clone(data)
+	binary.LittleEndian.PutUint32(huge[bytes.Index(huge, []byte("Big"))-0x14+0x04:], 0x7fffffff)
+	if hive, err := Parse(huge); err == nil {
+		root, _ := hive.Root()
+		if _, _, err = root.GetBinaryValue("Big"); err != ErrCorruptedHive {
+			t.Errorf("value with huge size gave %v", err)
+		}
+	}
+
+	binary.LittleEndian.PutUint32(data[0x04:], 2)
+	if hive, _ = Parse(data); !hive.Dirty() {
+		t.Error("dirty hive is not reported")
+	}
+}
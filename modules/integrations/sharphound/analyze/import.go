@@ -0,0 +1,689 @@
+package analyze
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory/analyze"
+	lmanalyze "github.com/lkarlslund/adalanche/modules/integrations/localmachine/analyze"
+	"github.com/lkarlslund/adalanche/modules/integrations/sharphound"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/lkarlslund/adalanche/modules/util"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+var (
+	EdgePSRemoteRights = engine.NewEdge("PSRemoteRights").RegisterProbabilityCalculator(func(source, target *engine.Object) engine.Probability { return 50 }).Tag("Granted")
+
+	// Same edges as the Active Directory analyzer creates from the raw attributes
+	EdgeRBCD = engine.NewEdge("RBConstrainedDeleg")
+	EdgeCD   = engine.NewEdge("ConstrainedDeleg")
+)
+
+type typeinfo struct {
+	objecttype engine.ObjectType
+	classes    []string
+}
+
+// The order here is the order files are imported in, so containers exist before the objects in them
+var supportedTypes = []string{"domains", "gpos", "ous", "containers", "groups", "users", "computers"}
+
+var typeinfos = map[string]typeinfo{
+	"domains":    {engine.ObjectTypeDomainDNS, []string{"top", "domain", "domainDNS"}},
+	"gpos":       {engine.ObjectTypeGroupPolicyContainer, []string{"top", "container", "groupPolicyContainer"}},
+	"ous":        {engine.ObjectTypeOrganizationalUnit, []string{"top", "organizationalUnit"}},
+	"containers": {engine.ObjectTypeContainer, []string{"top", "container"}},
+	"groups":     {engine.ObjectTypeGroup, []string{"top", "group"}},
+	"users":      {engine.ObjectTypeUser, []string{"top", "person", "organizationalPerson", "user"}},
+	"computers":  {engine.ObjectTypeComputer, []string{"top", "person", "organizationalPerson", "user", "computer"}},
+}
+
+var objecttypenames = map[string]engine.ObjectType{
+	"user":      engine.ObjectTypeUser,
+	"group":     engine.ObjectTypeGroup,
+	"computer":  engine.ObjectTypeComputer,
+	"domain":    engine.ObjectTypeDomainDNS,
+	"gpo":       engine.ObjectTypeGroupPolicyContainer,
+	"ou":        engine.ObjectTypeOrganizationalUnit,
+	"container": engine.ObjectTypeContainer,
+}
+
+func supportedType(t string) bool {
+	_, found := typeinfos[strings.ToLower(t)]
+	return found
+}
+
+// ACE right names from SharpHound and the edges they translate to regardless of the target type
+var aceRightEdges = map[string][]engine.Edge{
+	"GenericAll":               {activedirectory.EdgeGenericAll, activedirectory.EdgeWriteDACL, activedirectory.EdgeTakeOwnership, activedirectory.EdgeWriteAll, activedirectory.EdgeAllExtendedRights},
+	"GenericWrite":             {activedirectory.EdgeWriteAll},
+	"WriteOwner":               {activedirectory.EdgeTakeOwnership},
+	"WriteDacl":                {activedirectory.EdgeWriteDACL},
+	"Owns":                     {activedirectory.EdgeOwns},
+	"AddMember":                {activedirectory.EdgeAddMember},
+	"AddSelf":                  {activedirectory.EdgeAddSelfMember},
+	"ForceChangePassword":      {activedirectory.EdgeResetPassword},
+	"AllExtendedRights":        {activedirectory.EdgeAllExtendedRights},
+	"ReadLAPSPassword":         {activedirectory.EdgeReadLAPSPassword},
+	"ReadGMSAPassword":         {activedirectory.EdgeReadGMSAPassword},
+	"AddKeyCredentialLink":     {activedirectory.EdgeWriteKeyCredentialLink},
+	"WriteSPN":                 {activedirectory.EdgeWriteSPN},
+	"AddAllowedToAct":          {activedirectory.EdgeWriteAllowedToAct},
+	"WriteAccountRestrictions": {activedirectory.EdgeWriteAllowedToAct},
+	"GetChanges":               {activedirectory.EdgeDSReplicationGetChanges},
+	"GetChangesAll":            {activedirectory.EdgeDSReplicationGetChangesAll},
+	"GetChangesInFilteredSet":  {activedirectory.EdgeDSReplicationGetChangesInFilteredSet},
+}
+
+// aceEdges returns the edges an ACE with the given right grants on an object. GenericAll, GenericWrite and
+// AllExtendedRights are expanded into the specific edges the Active Directory analyzer would find for that type of object.
+func aceEdges(right string, target *engine.Object) []engine.Edge {
+	edges, found := aceRightEdges[right]
+	if !found {
+		if edge := engine.LookupEdge(right); edge != engine.NonExistingEdge {
+			return []engine.Edge{edge}
+		}
+		return nil
+	}
+
+	generic := right == "GenericAll"
+	write := generic || right == "GenericWrite"
+	extended := generic || right == "AllExtendedRights"
+
+	switch target.Type() {
+	case engine.ObjectTypeUser:
+		if write {
+			edges = append(edges, activedirectory.EdgeWriteSPN, activedirectory.EdgeWriteKeyCredentialLink, activedirectory.EdgeWriteAltSecurityIdentities,
+				activedirectory.EdgeWriteProfilePath, activedirectory.EdgeWriteScriptPath, activedirectory.EdgeWriteUserAccountControl)
+		}
+		if extended {
+			edges = append(edges, activedirectory.EdgeResetPassword)
+		}
+	case engine.ObjectTypeComputer:
+		if write {
+			edges = append(edges, activedirectory.EdgeWriteAllowedToAct, activedirectory.EdgeWriteKeyCredentialLink)
+		}
+		if extended {
+			edges = append(edges, activedirectory.EdgeResetPassword)
+			if target.HasTag("laps") {
+				edges = append(edges, activedirectory.EdgeReadLAPSPassword)
+			}
+		}
+	case engine.ObjectTypeGroup:
+		if write {
+			edges = append(edges, activedirectory.EdgeAddMember)
+		}
+	case engine.ObjectTypeDomainDNS:
+		if extended {
+			edges = append(edges, activedirectory.EdgeDSReplicationGetChanges, activedirectory.EdgeDSReplicationGetChangesAll,
+				activedirectory.EdgeDSReplicationGetChangesInFilteredSet)
+		}
+	}
+	return edges
+}
+
+type domaininfo struct {
+	name    string // DNS name in upper case, as SharpHound writes it
+	netbios string
+	context string
+	object  *engine.Object
+}
+
+type importedobject struct {
+	kind   string
+	data   *sharphound.Object
+	domain *domaininfo
+	object *engine.Object
+}
+
+type importer struct {
+	ao      *engine.Objects
+	domains map[string]*domaininfo
+	gpodns  map[string]string // GPO GUID in upper case without braces to DN
+	objects []importedobject
+}
+
+// ImportSharpHound converts the objects from a set of SharpHound files into the object collection
+func ImportSharpHound(ao *engine.Objects, files []sharphound.File) error {
+	im := importer{
+		ao:      ao,
+		domains: make(map[string]*domaininfo),
+		gpodns:  make(map[string]string),
+	}
+
+	for _, kind := range supportedTypes {
+		for fi := range files {
+			if !strings.EqualFold(files[fi].Meta.Type, kind) {
+				continue
+			}
+			for oi := range files[fi].Data {
+				data := &files[fi].Data[oi]
+				if data.IsDeleted {
+					continue
+				}
+				io := im.convert(kind, data)
+				if io.object != nil {
+					im.objects = append(im.objects, io)
+				}
+			}
+		}
+	}
+
+	for _, io := range im.objects {
+		im.relate(io)
+	}
+
+	im.finish()
+	return nil
+}
+
+func (im *importer) domain(name string) *domaininfo {
+	name = strings.ToUpper(name)
+	if name == "" {
+		return &domaininfo{}
+	}
+	d := im.domains[name]
+	if d == nil {
+		netbios, _, _ := strings.Cut(name, ".")
+		d = &domaininfo{
+			name:    name,
+			netbios: netbios,
+			context: util.DomainSuffixToDomainContext(name),
+		}
+		im.domains[name] = d
+	}
+	return d
+}
+
+// principal finds or adds the object for a SharpHound object identifier. Identifiers are SIDs, GUIDs
+// or well-known SIDs prefixed with the domain they belong to, like CONTOSO.LOCAL-S-1-5-32-544
+func (im *importer) principal(identifier string, d *domaininfo) *engine.Object {
+	if prefix, rest, found := strings.Cut(identifier, "-S-1-"); found {
+		d = im.domain(prefix)
+		identifier = "S-1-" + rest
+	}
+
+	if strings.HasPrefix(identifier, "S-1-") {
+		sid, err := windowssecurity.ParseStringSID(identifier)
+		if err != nil {
+			ui.Warn().Msgf("Invalid SID %v in SharpHound data: %v", identifier, err)
+			return nil
+		}
+		if sid.Component(2) == 21 && sid.Component(3) != 0 {
+			return im.ao.FindOrAddAdjacentSID(sid, im.ao.Root())
+		}
+		if d.netbios != "" {
+			if o, found := im.ao.FindTwoMulti(engine.ObjectSid, engine.AttributeValueSID(sid), engine.DataSource, engine.AttributeValueString(d.netbios)); found {
+				return o.First()
+			}
+		}
+		return im.ao.AddNew(
+			engine.IgnoreBlanks,
+			engine.ObjectSid, engine.AttributeValueSID(sid),
+			engine.DataSource, d.netbios,
+			engine.DomainContext, d.context,
+		)
+	}
+
+	guid, err := uuid.FromString(identifier)
+	if err != nil {
+		ui.Warn().Msgf("Invalid object identifier %v in SharpHound data: %v", identifier, err)
+		return nil
+	}
+	// SharpHound writes GUIDs the Windows way, and Active Directory data is stored with the raw byte order
+	o, _ := im.ao.FindOrAdd(engine.ObjectGUID, engine.AttributeValueGUID(util.SwapUUIDEndianess(guid)))
+	return o
+}
+
+// typedPrincipal is like principal, but also sets the object type if it's not known yet
+func (im *importer) typedPrincipal(tp sharphound.TypedPrincipal, d *domaininfo) *engine.Object {
+	o := im.principal(tp.ObjectIdentifier, d)
+	if o != nil && !o.HasAttr(engine.Type) {
+		if ot, found := objecttypenames[strings.ToLower(tp.ObjectType)]; found {
+			o.SetFlex(engine.Type, ot.ValueString())
+		}
+	}
+	return o
+}
+
+func (im *importer) convert(kind string, data *sharphound.Object) importedobject {
+	props := data.Properties
+	d := im.domain(propString(props, "domain"))
+	io := importedobject{
+		kind:   kind,
+		data:   data,
+		domain: d,
+	}
+
+	if netbios := propString(props, "netbios"); netbios != "" {
+		d.netbios = strings.ToUpper(netbios)
+	}
+
+	o := im.principal(data.ObjectIdentifier, d)
+	if o == nil {
+		return io
+	}
+	io.object = o
+
+	ti := typeinfos[kind]
+	dn := propString(props, "distinguishedname")
+
+	// SharpHound names are NAME@DOMAIN, or the DNS name for computers
+	shname := propString(props, "name")
+	if at := strings.LastIndex(shname, "@"); at != -1 {
+		shname = shname[:at]
+	}
+	name := shname
+	if rdn, _, _ := strings.Cut(dn, ","); rdn != "" {
+		_, name, _ = strings.Cut(rdn, "=")
+	}
+
+	o.SetFlex(
+		engine.IgnoreBlanks,
+		engine.DistinguishedName, dn,
+		engine.Name, name,
+		engine.Type, ti.objecttype.ValueString(),
+		engine.ObjectClass, ti.classes,
+		engine.DataSource, d.netbios,
+		engine.DomainContext, d.context,
+		engine.Description, propString(props, "description"),
+		engine.DisplayName, propString(props, "displayname"),
+		engine.WhenCreated, propTime(props, "whencreated"),
+	)
+	if admincount, _ := propBool(props, "admincount"); admincount {
+		o.SetFlex(activedirectory.AdminCount, int64(1))
+	}
+
+	switch kind {
+	case "domains":
+		d.object = o
+	case "gpos":
+		o.SetFlex(
+			engine.IgnoreBlanks,
+			activedirectory.GPCFileSysPath, propString(props, "gpcpath"),
+		)
+		if !o.HasAttr(engine.DisplayName) {
+			o.SetFlex(engine.IgnoreBlanks, engine.DisplayName, shname)
+		}
+		if dn != "" {
+			im.gpodns[strings.ToUpper(strings.Trim(data.ObjectIdentifier, "{}"))] = dn
+		}
+	case "ous":
+		if blocks, _ := propBool(props, "blocksinheritance"); blocks {
+			o.SetFlex(activedirectory.GPOptions, "1")
+		}
+	case "groups":
+		im.setAccount(o, d, props)
+	case "users", "computers":
+		im.setAccount(o, d, props)
+		o.SetFlex(
+			engine.IgnoreBlanks,
+			engine.UserPrincipalName, propString(props, "userprincipalname"),
+			activedirectory.ServicePrincipalName, propStrings(props, "serviceprincipalnames"),
+			activedirectory.OperatingSystem, propString(props, "operatingsystem"),
+			activedirectory.LastLogon, propTime(props, "lastlogon"),
+			activedirectory.LastLogonTimestamp, propTime(props, "lastlogontimestamp"),
+			activedirectory.PwdLastSet, propTime(props, "pwdlastset"),
+		)
+		var sidhistory []engine.AttributeValue
+		for _, s := range propStrings(props, "sidhistory") {
+			if sid, err := windowssecurity.ParseStringSID(s); err == nil {
+				sidhistory = append(sidhistory, engine.AttributeValueSID(sid))
+			}
+		}
+		o.SetFlex(engine.IgnoreBlanks, activedirectory.SIDHistory, sidhistory)
+
+		if lastlogon, ok := o.AttrTime(activedirectory.LastLogonTimestamp); ok {
+			o.SetValues(analyze.MetaLastLoginAge, engine.AttributeValueInt(int(time.Since(lastlogon)/time.Hour)))
+		}
+		if passwordlastset, ok := o.AttrTime(activedirectory.PwdLastSet); ok {
+			o.SetValues(analyze.MetaPasswordAge, engine.AttributeValueInt(int(time.Since(passwordlastset)/time.Hour)))
+		}
+
+		uac := userAccountControl(kind, props)
+		o.SetFlex(activedirectory.UserAccountControl, uac)
+		tagAccount(o, props, uac)
+
+		if kind == "computers" {
+			im.addMachine(o, d, propString(props, "name"))
+		}
+	}
+
+	return io
+}
+
+func (im *importer) setAccount(o *engine.Object, d *domaininfo, props map[string]any) {
+	sam := propString(props, "samaccountname")
+	if sam == "" {
+		return
+	}
+	o.SetFlex(engine.SAMAccountName, sam)
+	if d.netbios != "" {
+		o.SetFlex(engine.DownLevelLogonName, d.netbios+"\\"+sam)
+	}
+}
+
+// Creates the Machine object for a computer account, just like the Active Directory analyzer does
+func (im *importer) addMachine(computer *engine.Object, d *domaininfo, name string) {
+	sid := computer.SID()
+	if sid.IsBlank() {
+		ui.Error().Msgf("Computer account without SID in SharpHound data: %v", computer.Label())
+		return
+	}
+
+	var dnshostname string
+	if strings.Contains(name, ".") {
+		dnshostname = strings.ToLower(name)
+		computer.SetFlex(analyze.DnsHostName, dnshostname)
+	}
+
+	machine, _ := im.ao.FindOrAdd(
+		analyze.DomainJoinedSID, engine.AttributeValueSID(sid),
+		engine.IgnoreBlanks,
+		engine.Name, computer.Attr(engine.Name),
+		engine.Type, analyze.ObjectTypeMachine.ValueString(),
+		analyze.DnsHostName, dnshostname,
+		engine.DataSource, d.netbios,
+		engine.DomainContext, d.context,
+	)
+	machine.EdgeTo(computer, analyze.EdgeAuthenticatesAs)
+	machine.EdgeTo(computer, analyze.EdgeMachineAccount)
+	machine.ChildOf(computer)
+}
+
+// Rebuilds the userAccountControl bits that SharpHound has split into individual properties
+func userAccountControl(kind string, props map[string]any) int64 {
+	var uac int64 = engine.UAC_NORMAL_ACCOUNT
+	if kind == "computers" {
+		uac = engine.UAC_WORKSTATION_TRUST_ACCOUNT
+		if isdc, _ := propBool(props, "isdc"); isdc {
+			uac = engine.UAC_SERVER_TRUST_ACCOUNT
+		}
+	}
+
+	flags := []struct {
+		property string
+		bit      int64
+	}{
+		{"dontreqpreauth", engine.UAC_DONT_REQ_PREAUTH},
+		{"unconstraineddelegation", engine.UAC_TRUSTED_FOR_DELEGATION},
+		{"trustedtoauth", engine.UAC_TRUSTED_TO_AUTH_FOR_DELEGATION},
+		{"sensitive", engine.UAC_NOT_DELEGATED},
+		{"passwordnotreqd", engine.UAC_PASSWD_NOTREQD},
+		{"pwdneverexpires", engine.UAC_DONT_EXPIRE_PASSWORD},
+	}
+	for _, flag := range flags {
+		if set, _ := propBool(props, flag.property); set {
+			uac |= flag.bit
+		}
+	}
+	if enabled, found := propBool(props, "enabled"); found && !enabled {
+		uac |= engine.UAC_ACCOUNTDISABLE
+	}
+	return uac
+}
+
+// Same tags as the Active Directory analyzer derives from userAccountControl and friends
+func tagAccount(o *engine.Object, props map[string]any, uac int64) {
+	operatingsystem := strings.ToLower(propString(props, "operatingsystem"))
+	if strings.Contains(operatingsystem, "linux") {
+		o.Tag("linux")
+	}
+	if strings.Contains(operatingsystem, "windows") {
+		o.Tag("windows")
+	}
+	if haslaps, _ := propBool(props, "haslaps"); haslaps {
+		o.Tag("laps")
+	}
+	if uac&engine.UAC_TRUSTED_FOR_DELEGATION != 0 && uac&engine.UAC_NOT_DELEGATED == 0 {
+		o.Tag("unconstrained")
+	}
+	if uac&engine.UAC_TRUSTED_TO_AUTH_FOR_DELEGATION != 0 {
+		o.Tag("constrained")
+	}
+	if uac&engine.UAC_NOT_DELEGATED != 0 {
+		o.Tag("nodelegation")
+	}
+	if uac&engine.UAC_WORKSTATION_TRUST_ACCOUNT != 0 {
+		o.Tag("computer_account")
+	}
+	if uac&engine.UAC_SERVER_TRUST_ACCOUNT != 0 {
+		o.Tag("domaincontroller_account")
+	}
+	if uac&engine.UAC_ACCOUNTDISABLE != 0 {
+		o.Tag("account_disabled")
+		o.Tag("account_inactive")
+	} else {
+		o.Tag("account_enabled")
+		o.Tag("account_active")
+	}
+	if uac&engine.UAC_DONT_EXPIRE_PASSWORD != 0 {
+		o.Tag("password_never_expires")
+	}
+	if uac&engine.UAC_PASSWD_NOTREQD != 0 {
+		o.Tag("password_not_required")
+	}
+}
+
+// relate adds the edges for ACLs, memberships, sessions and delegations
+func (im *importer) relate(io importedobject) {
+	o, data, d := io.object, io.data, io.domain
+
+	for _, ace := range data.Aces {
+		edges := aceEdges(ace.RightName, o)
+		if len(edges) == 0 {
+			ui.Debug().Msgf("Ignoring unknown SharpHound ACE right %v on %v", ace.RightName, o.Label())
+			continue
+		}
+		principal := im.principal(ace.PrincipalSID, d)
+		if principal == nil {
+			continue
+		}
+		for _, edge := range edges {
+			principal.EdgeTo(o, edge)
+		}
+	}
+
+	for _, member := range data.Members {
+		if mo := im.typedPrincipal(member, d); mo != nil {
+			mo.EdgeTo(o, activedirectory.EdgeMemberOfGroup)
+		}
+	}
+	if data.PrimaryGroupSID != "" {
+		if group := im.principal(data.PrimaryGroupSID, d); group != nil {
+			o.EdgeTo(group, activedirectory.EdgeMemberOfGroup)
+		}
+	}
+
+	for _, target := range data.HasSIDHistory {
+		if to := im.typedPrincipal(target, d); to != nil {
+			o.EdgeTo(to, activedirectory.EdgeSIDHistoryEquality)
+		}
+	}
+
+	for _, actor := range data.AllowedToAct {
+		if ac := im.typedPrincipal(actor, d); ac != nil {
+			ac.EdgeTo(o, EdgeRBCD)
+		}
+	}
+
+	for _, target := range data.AllowedToDelegate {
+		to := im.typedPrincipal(target, d)
+		if to == nil {
+			continue
+		}
+		// Delegation is to services on the machine, not the computer account
+		if machine, found := im.ao.Find(analyze.DomainJoinedSID, engine.AttributeValueSID(to.SID())); found && !to.SID().IsBlank() {
+			to = machine
+		}
+		o.EdgeTo(to, EdgeCD)
+	}
+
+	if io.kind == "users" || io.kind == "computers" {
+		// Crude special handling for Authenticated Users, like the Active Directory analyzer
+		if authusers := im.wellKnown(windowssecurity.AuthenticatedUsersSID, d); authusers != nil {
+			o.EdgeTo(authusers, activedirectory.EdgeMemberOfGroup)
+			if io.kind == "users" && o.Attr(activedirectory.ServicePrincipalName).Len() > 0 {
+				o.Tag("kerberoast")
+				authusers.EdgeTo(o, activedirectory.EdgeHasSPN)
+			}
+		}
+		if uac, ok := o.AttrInt(activedirectory.UserAccountControl); ok && io.kind == "users" && uac&engine.UAC_DONT_REQ_PREAUTH != 0 {
+			if anonymous := im.wellKnown(windowssecurity.AnonymousLogonSID, d); anonymous != nil {
+				o.Tag("asreproast")
+				anonymous.EdgeTo(o, activedirectory.EdgeDontReqPreauth)
+			}
+		}
+	}
+
+	if io.kind == "computers" {
+		im.relateMachine(o, data, d)
+	}
+}
+
+func (im *importer) relateMachine(computer *engine.Object, data *sharphound.Object, d *domaininfo) {
+	machine, found := im.ao.Find(analyze.DomainJoinedSID, engine.AttributeValueSID(computer.SID()))
+	if !found {
+		return
+	}
+
+	rights := []struct {
+		result sharphound.PrincipalResult
+		edge   engine.Edge
+	}{
+		{data.LocalAdmins, lmanalyze.EdgeLocalAdminRights},
+		{data.RemoteDesktopUsers, lmanalyze.EdgeLocalRDPRights},
+		{data.DcomUsers, lmanalyze.EdgeLocalDCOMRights},
+		{data.PSRemoteUsers, EdgePSRemoteRights},
+	}
+	for _, right := range rights {
+		for _, tp := range right.result.Results {
+			if po := im.typedPrincipal(tp, d); po != nil {
+				po.EdgeTo(machine, right.edge)
+			}
+		}
+	}
+
+	for _, sessions := range []sharphound.SessionResult{data.Sessions, data.PrivilegedSessions, data.RegistrySessions} {
+		for _, session := range sessions.Results {
+			if user := im.principal(session.UserSID, d); user != nil {
+				machine.EdgeTo(user, lmanalyze.EdgeLocalSessionLastDay)
+			}
+		}
+	}
+}
+
+func (im *importer) wellKnown(sid windowssecurity.SID, d *domaininfo) *engine.Object {
+	if d.name == "" {
+		return nil
+	}
+	return im.principal(d.name+"-"+sid.String(), d)
+}
+
+// finish links GPOs, builds the container hierarchy and adds the DCsync indicators
+func (im *importer) finish() {
+	for _, io := range im.objects {
+		if len(io.data.Links) == 0 {
+			continue
+		}
+		var gplink string
+		for _, link := range io.data.Links {
+			gpodn, found := im.gpodns[strings.ToUpper(strings.Trim(link.GUID, "{}"))]
+			if !found {
+				ui.Warn().Msgf("Object %v linked to GPO %v that is not in the SharpHound data", io.object.Label(), link.GUID)
+				continue
+			}
+			options := "0"
+			if link.IsEnforced {
+				options = "2"
+			}
+			gplink += "[LDAP://" + gpodn + ";" + options + "]"
+		}
+		io.object.SetFlex(engine.IgnoreBlanks, activedirectory.GPLink, gplink)
+	}
+
+	for _, io := range im.objects {
+		o := io.object
+		if o.Parent() != nil || o.DN() == "" {
+			continue
+		}
+		parent := im.ao.Root()
+		for dn := util.ParentDistinguishedName(o.DN()); dn != ""; dn = util.ParentDistinguishedName(dn) {
+			if p, found := im.ao.Find(engine.DistinguishedName, engine.AttributeValueString(dn)); found {
+				parent = p
+				break
+			}
+		}
+		o.ChildOf(parent)
+		if parent != im.ao.Root() && !io.data.IsACLProtected {
+			parent.EdgeTo(o, analyze.EdgeInheritsSecurity)
+		}
+	}
+
+	for _, d := range im.domains {
+		if d.object == nil {
+			continue
+		}
+		if authusers := im.wellKnown(windowssecurity.AuthenticatedUsersSID, d); authusers != nil {
+			if everyone := im.wellKnown(windowssecurity.EveryoneSID, d); everyone != nil {
+				authusers.EdgeTo(everyone, activedirectory.EdgeMemberOfGroup)
+			}
+		}
+
+		dcsync := im.ao.AddNew(
+			engine.IgnoreBlanks,
+			engine.DataSource, d.netbios,
+			engine.Type, engine.ObjectTypeCallableServicePoint.ValueString(),
+			engine.Name, "DCsync",
+		)
+		dcsync.Tag("iddqd")
+		dcsync.ChildOf(d.object)
+		d.object.EdgeTo(dcsync, activedirectory.EdgeControls)
+
+		d.object.Edges(engine.In).Range(func(source *engine.Object, edge engine.EdgeBitmap) bool {
+			if edge.IsSet(activedirectory.EdgeDSReplicationGetChanges) && edge.IsSet(activedirectory.EdgeDSReplicationGetChangesAll) {
+				source.EdgeTo(dcsync, activedirectory.EdgeCall)
+			}
+			return true
+		})
+	}
+}
+
+func propString(props map[string]any, key string) string {
+	if s, ok := props[key].(string); ok {
+		return s
+	}
+	return ""
+}
+
+func propStrings(props map[string]any, key string) []string {
+	values, _ := props[key].([]any)
+	var result []string
+	for _, value := range values {
+		if s, ok := value.(string); ok && s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func propBool(props map[string]any, key string) (value bool, found bool) {
+	switch v := props[key].(type) {
+	case bool:
+		return v, true
+	case float64:
+		return v != 0, true
+	}
+	return false, false
+}
+
+// SharpHound times are seconds since the Unix epoch, with 0 or -1 for never
+func propTime(props map[string]any, key string) time.Time {
+	if v, ok := props[key].(float64); ok && v > 0 {
+		return time.Unix(int64(v), 0).UTC()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,306 @@
+package analyze
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory/analyze"
+	lmanalyze "github.com/lkarlslund/adalanche/modules/integrations/localmachine/analyze"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+const (
+	testDomainSID = "S-1-5-21-1-2-3"
+	testGPOGUID   = "31B2F340-016D-11D2-945F-00C04FB984F9"
+	testGPODN     = "CN={" + testGPOGUID + "},CN=POLICIES,CN=SYSTEM,DC=CORP,DC=LOCAL"
+)
+
+// sharpHoundFixture returns a small domain as SharpHound writes it, per file type. Version 6 adds fields
+// that version 5 doesn't have, which must not get in the way.
+func sharpHoundFixture(version int) map[string][]map[string]any {
+	ace := func(principal, right string) map[string]any {
+		a := map[string]any{"PrincipalSID": principal, "PrincipalType": "User", "RightName": right, "IsInherited": false}
+		if version >= 6 {
+			a["InheritanceHash"] = ""
+		}
+		return a
+	}
+	object := func(identifier string, props map[string]any, extra map[string]any) map[string]any {
+		props["domain"] = "CORP.LOCAL"
+		o := map[string]any{"ObjectIdentifier": identifier, "Properties": props, "Aces": []any{}, "IsDeleted": false, "IsACLProtected": false}
+		if version >= 6 {
+			o["ContainedBy"] = map[string]any{"ObjectIdentifier": testDomainSID, "ObjectType": "Domain"}
+			props["domainsid"] = testDomainSID
+		}
+		for key, value := range extra {
+			o[key] = value
+		}
+		return o
+	}
+	principal := func(identifier, objecttype string) map[string]any {
+		return map[string]any{"ObjectIdentifier": identifier, "ObjectType": objecttype}
+	}
+
+	return map[string][]map[string]any{
+		"domains": {object(testDomainSID, map[string]any{
+			"name":              "CORP.LOCAL",
+			"distinguishedname": "DC=CORP,DC=LOCAL",
+		}, map[string]any{
+			"Aces":  []any{ace(testDomainSID+"-1105", "GetChanges"), ace(testDomainSID+"-1105", "GetChangesAll")},
+			"Links": []any{map[string]any{"GUID": testGPOGUID, "IsEnforced": true}},
+		})},
+		"gpos": {object(testGPOGUID, map[string]any{
+			"name":              "DEFAULT DOMAIN POLICY@CORP.LOCAL",
+			"distinguishedname": testGPODN,
+			"gpcpath":           `\\corp.local\sysvol\corp.local\policies\{` + testGPOGUID + `}`,
+		}, nil)},
+		"ous": {object("B5D7C1F6-6B1C-4E7C-9A0E-7C4E9B6A1D01", map[string]any{
+			"name":              "SERVERS@CORP.LOCAL",
+			"distinguishedname": "OU=SERVERS,DC=CORP,DC=LOCAL",
+		}, map[string]any{
+			"Links": []any{map[string]any{"GUID": "{" + testGPOGUID + "}", "IsEnforced": false}},
+		})},
+		"groups": {
+			object(testDomainSID+"-512", map[string]any{
+				"name":              "DOMAIN ADMINS@CORP.LOCAL",
+				"distinguishedname": "CN=DOMAIN ADMINS,CN=USERS,DC=CORP,DC=LOCAL",
+				"samaccountname":    "Domain Admins",
+				"admincount":        true,
+			}, map[string]any{
+				"Members": []any{principal(testDomainSID+"-1104", "User")},
+			}),
+			object("CORP.LOCAL-S-1-5-32-544", map[string]any{
+				"name":              "ADMINISTRATORS@CORP.LOCAL",
+				"distinguishedname": "CN=ADMINISTRATORS,CN=BUILTIN,DC=CORP,DC=LOCAL",
+			}, map[string]any{
+				"Members": []any{principal(testDomainSID+"-512", "Group")},
+			}),
+		},
+		"users": {
+			object(testDomainSID+"-1104", map[string]any{
+				"name":              "ALICE@CORP.LOCAL",
+				"distinguishedname": "CN=ALICE,CN=USERS,DC=CORP,DC=LOCAL",
+				"samaccountname":    "alice",
+				"enabled":           true,
+			}, map[string]any{
+				"PrimaryGroupSID": testDomainSID + "-513",
+				"Aces":            []any{ace(testDomainSID+"-1106", "ForceChangePassword")},
+			}),
+			object(testDomainSID+"-1105", map[string]any{
+				"name":                  "BACKUP@CORP.LOCAL",
+				"distinguishedname":     "CN=BACKUP,CN=USERS,DC=CORP,DC=LOCAL",
+				"samaccountname":        "backup",
+				"enabled":               true,
+				"serviceprincipalnames": []any{"backup/srv01.corp.local"},
+			}, nil),
+			object(testDomainSID+"-1106", map[string]any{
+				"name":              "HELPDESK@CORP.LOCAL",
+				"distinguishedname": "CN=HELPDESK,CN=USERS,DC=CORP,DC=LOCAL",
+				"samaccountname":    "helpdesk",
+				"enabled":           true,
+			}, nil),
+		},
+		"computers": {object(testDomainSID+"-1107", map[string]any{
+			"name":              "SRV01.CORP.LOCAL",
+			"distinguishedname": "CN=SRV01,OU=SERVERS,DC=CORP,DC=LOCAL",
+			"samaccountname":    "SRV01$",
+			"enabled":           true,
+			"operatingsystem":   "Windows Server 2022 Standard",
+		}, map[string]any{
+			"Aces":        []any{ace(testDomainSID+"-1106", "GenericAll")},
+			"LocalAdmins": map[string]any{"Collected": true, "Results": []any{principal(testDomainSID+"-1106", "User")}},
+			"Sessions":    map[string]any{"Collected": true, "Results": []any{map[string]any{"UserSID": testDomainSID + "-1104", "ComputerSID": testDomainSID + "-1107"}}},
+		})},
+	}
+}
+
+// writeSharpHoundFixture writes the fixture as separate JSON files, or as one zip file like SharpHound does by default
+func writeSharpHoundFixture(t *testing.T, dir string, version int, zipped bool) {
+	var zw *zip.Writer
+	if zipped {
+		f, err := os.Create(filepath.Join(dir, "20240101000000_BloodHound.zip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		zw = zip.NewWriter(f)
+		defer zw.Close()
+	}
+	for kind, objects := range sharpHoundFixture(version) {
+		data, err := json.Marshal(map[string]any{
+			"data": objects,
+			"meta": map[string]any{"methods": 0, "type": kind, "count": len(objects), "version": version},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := "20240101000000_" + kind + ".json"
+		if zw == nil {
+			err = os.WriteFile(filepath.Join(dir, name), data, 0600)
+		} else {
+			var w io.Writer
+			if w, err = zw.Create(name); err == nil {
+				_, err = w.Write(data)
+			}
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func loadSharpHound(t *testing.T, dir string) *engine.Objects {
+	ld := &SharpHoundLoader{}
+	ld.Init()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := ld.Load(filepath.Join(dir, entry.Name()), func(cur, max int) {}); err != nil {
+			t.Fatalf("Loading %v: %v", entry.Name(), err)
+		}
+	}
+	aos, err := ld.Close()
+	if err != nil || len(aos) != 1 {
+		t.Fatalf("Expected one object collection, got %v and %v", len(aos), err)
+	}
+	return aos[0]
+}
+
+func hasEdge(source, target *engine.Object, edge engine.Edge) bool {
+	var found bool
+	source.Edges(engine.Out).Range(func(o *engine.Object, eb engine.EdgeBitmap) bool {
+		if o == target {
+			found = eb.IsSet(edge)
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+func findSID(t *testing.T, ao *engine.Objects, s string) *engine.Object {
+	sid, err := windowssecurity.ParseStringSID(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, found := ao.Find(activedirectory.ObjectSid, engine.AttributeValueSID(sid))
+	if !found {
+		t.Fatalf("No object with SID %v", s)
+	}
+	return o
+}
+
+func TestImportSharpHound(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version int
+		zipped  bool
+	}{
+		{"v5 json", 5, false},
+		{"v5 zip", 5, true},
+		{"v6 json", 6, false},
+		{"v6 zip", 6, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeSharpHoundFixture(t, dir, tc.version, tc.zipped)
+			ao := loadSharpHound(t, dir)
+
+			domain := findSID(t, ao, testDomainSID)
+			admins := findSID(t, ao, testDomainSID+"-512")
+			alice := findSID(t, ao, testDomainSID+"-1104")
+			backup := findSID(t, ao, testDomainSID+"-1105")
+			helpdesk := findSID(t, ao, testDomainSID+"-1106")
+			srv01 := findSID(t, ao, testDomainSID+"-1107")
+
+			if alice.DN() != "CN=ALICE,CN=USERS,DC=CORP,DC=LOCAL" || alice.OneAttrString(engine.DataSource) != "CORP" || alice.Type() != engine.ObjectTypeUser {
+				t.Errorf("Unexpected user %v with data source %v and type %v", alice.DN(), alice.OneAttrString(engine.DataSource), alice.Type())
+			}
+
+			// ACEs
+			if !hasEdge(helpdesk, alice, activedirectory.EdgeResetPassword) {
+				t.Error("ForceChangePassword didn't give ResetPassword")
+			}
+			if !hasEdge(helpdesk, srv01, activedirectory.EdgeGenericAll) || !hasEdge(helpdesk, srv01, activedirectory.EdgeWriteAllowedToAct) {
+				t.Error("GenericAll on a computer wasn't expanded")
+			}
+			if !hasEdge(backup, domain, activedirectory.EdgeDSReplicationGetChangesAll) {
+				t.Error("GetChangesAll didn't give DSReplGetChngsAll")
+			}
+			dcsync, found := ao.Find(engine.Name, engine.AttributeValueString("DCsync"))
+			if !found || !hasEdge(backup, dcsync, activedirectory.EdgeCall) {
+				t.Error("Replication rights didn't lead to DCsync")
+			}
+
+			// Group membership, including well-known groups prefixed with the domain
+			if !hasEdge(alice, admins, activedirectory.EdgeMemberOfGroup) {
+				t.Error("Alice isn't a member of Domain Admins")
+			}
+			administrators, found := ao.FindTwo(activedirectory.ObjectSid, engine.AttributeValueSID(windowssecurity.AdministratorsSID), engine.DataSource, engine.AttributeValueString("CORP"))
+			if !found || !hasEdge(admins, administrators, activedirectory.EdgeMemberOfGroup) {
+				t.Error("Domain Admins isn't a member of Administrators")
+			}
+			if !hasEdge(alice, findSID(t, ao, testDomainSID+"-513"), activedirectory.EdgeMemberOfGroup) {
+				t.Error("Primary group membership is missing")
+			}
+
+			// GPO links
+			if gplink := domain.OneAttrString(activedirectory.GPLink); gplink != "[LDAP://"+testGPODN+";2]" {
+				t.Errorf("Domain has gPLink %v", gplink)
+			}
+			ou, found := ao.Find(engine.DistinguishedName, engine.AttributeValueString("OU=SERVERS,DC=CORP,DC=LOCAL"))
+			if !found || ou.OneAttrString(activedirectory.GPLink) != "[LDAP://"+testGPODN+";0]" {
+				t.Error("OU isn't linked to the GPO")
+			}
+			if srv01.Parent() != ou {
+				t.Error("Computer isn't placed in its OU")
+			}
+
+			// Local admins and sessions are on the machine
+			machine, found := ao.Find(analyze.DomainJoinedSID, srv01.OneAttr(activedirectory.ObjectSid))
+			if !found || !hasEdge(helpdesk, machine, lmanalyze.EdgeLocalAdminRights) || !hasEdge(machine, alice, lmanalyze.EdgeLocalSessionLastDay) {
+				t.Error("Local admin rights or sessions are missing from the machine")
+			}
+		})
+	}
+}
+
+func TestSharpHoundMergesWithActiveDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeSharpHoundFixture(t, dir, 6, true)
+	sh := loadSharpHound(t, dir)
+
+	sid, _ := windowssecurity.ParseStringSID(testDomainSID + "-1104")
+	ad := engine.NewObjects()
+	ad.Add(engine.NewObject(
+		activedirectory.ObjectSid, engine.AttributeValueSID(sid),
+		engine.DistinguishedName, engine.AttributeValueString("CN=ALICE,CN=USERS,DC=CORP,DC=LOCAL"),
+		engine.DataSource, engine.AttributeValueString("CORP"),
+		activedirectory.LogonCount, engine.AttributeValueInt(42),
+	))
+
+	merged, err := engine.Merge([]*engine.Objects{ad, sh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, found := merged.FindMulti(activedirectory.ObjectSid, engine.AttributeValueSID(sid))
+	if !found || alice.Len() != 1 {
+		t.Fatalf("Expected alice to be merged into one object, found %v", alice.Len())
+	}
+	o := alice.First()
+	if o.OneAttrString(activedirectory.LogonCount) != "42" || o.OneAttrString(engine.SAMAccountName) != "alice" {
+		t.Errorf("Merged object lacks attributes from one of the sources: %v", o.Label())
+	}
+	helpdesk := findSID(t, merged, testDomainSID+"-1106")
+	if !hasEdge(helpdesk, o, activedirectory.EdgeResetPassword) {
+		t.Error("SharpHound edge was lost in the merge")
+	}
+}
@@ -0,0 +1,120 @@
+package analyze
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/integrations/localmachine"
+	"github.com/lkarlslund/adalanche/modules/integrations/sharphound"
+	"github.com/lkarlslund/adalanche/modules/ui"
+)
+
+const loadername = "SharpHound JSON file"
+
+var (
+	LoaderID = engine.AddLoader(func() engine.Loader { return &SharpHoundLoader{} })
+)
+
+type SharpHoundLoader struct {
+	mutex sync.Mutex
+	files []sharphound.File
+}
+
+func (ld *SharpHoundLoader) Name() string {
+	return loadername
+}
+
+func (ld *SharpHoundLoader) Init() error {
+	ld.files = nil
+	return nil
+}
+
+func (ld *SharpHoundLoader) Load(path string, cb engine.ProgressCallbackFunc) error {
+	lowerpath := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lowerpath, localmachine.Suffix), strings.HasSuffix(lowerpath, ".gpodata.json"):
+		return engine.ErrUninterested
+	case strings.HasSuffix(lowerpath, ".zip"):
+		return ld.loadZip(path)
+	case strings.HasSuffix(lowerpath, ".json"):
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Problem opening SharpHound file %v: %v", path, err)
+		}
+		defer f.Close()
+		return ld.loadJSON(path, f)
+	}
+	return engine.ErrUninterested
+}
+
+func (ld *SharpHoundLoader) loadZip(path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		// Not our kind of zip file
+		return engine.ErrUninterested
+	}
+	defer zr.Close()
+
+	var found bool
+	for _, zf := range zr.File {
+		if !strings.HasSuffix(strings.ToLower(zf.Name), ".json") {
+			continue
+		}
+		r, err := zf.Open()
+		if err != nil {
+			return fmt.Errorf("Problem opening %v in SharpHound zip file %v: %v", zf.Name, path, err)
+		}
+		err = ld.loadJSON(path+":"+zf.Name, r)
+		r.Close()
+		if err == engine.ErrUninterested {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return engine.ErrUninterested
+	}
+	return nil
+}
+
+func (ld *SharpHoundLoader) loadJSON(name string, r io.Reader) error {
+	var file sharphound.File
+	err := json.NewDecoder(r).Decode(&file)
+	if err != nil || !supportedType(file.Meta.Type) {
+		// Some other JSON file
+		return engine.ErrUninterested
+	}
+
+	if file.Meta.Version != 5 && file.Meta.Version != 6 {
+		ui.Warn().Msgf("SharpHound file %v has unsupported version %v, results may be incomplete", name, file.Meta.Version)
+	}
+	ui.Debug().Msgf("Loaded %v SharpHound %v objects from %v", len(file.Data), file.Meta.Type, name)
+
+	ld.mutex.Lock()
+	ld.files = append(ld.files, file)
+	ld.mutex.Unlock()
+	return nil
+}
+
+func (ld *SharpHoundLoader) Close() ([]*engine.Objects, error) {
+	if len(ld.files) == 0 {
+		return nil, nil
+	}
+
+	ao := engine.NewLoaderObjects(ld)
+	err := ImportSharpHound(ao, ld.files)
+	ld.files = nil
+	if err != nil {
+		return nil, err
+	}
+	return []*engine.Objects{ao}, nil
+}
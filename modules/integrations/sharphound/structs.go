@@ -0,0 +1,77 @@
+package sharphound
+
+// Structures for the JSON files written by SharpHound (schema version 5 and 6), which are usually delivered as a zip file.
+// All the object types share one structure, as the type is only known from the meta section at the end of the file.
+
+type File struct {
+	Data []Object `json:"data"`
+	Meta Meta     `json:"meta"`
+}
+
+type Meta struct {
+	Methods int64  `json:"methods"`
+	Type    string `json:"type"`
+	Count   int    `json:"count"`
+	Version int    `json:"version"`
+}
+
+type Object struct {
+	ObjectIdentifier string         `json:"ObjectIdentifier"`
+	Properties       map[string]any `json:"Properties"`
+	Aces             []ACE          `json:"Aces"`
+	IsDeleted        bool           `json:"IsDeleted"`
+	IsACLProtected   bool           `json:"IsACLProtected"`
+
+	// Users and computers
+	PrimaryGroupSID   string           `json:"PrimaryGroupSID"`
+	AllowedToDelegate []TypedPrincipal `json:"AllowedToDelegate"`
+	HasSIDHistory     []TypedPrincipal `json:"HasSIDHistory"`
+
+	// Groups
+	Members []TypedPrincipal `json:"Members"`
+
+	// Computers
+	AllowedToAct       []TypedPrincipal `json:"AllowedToAct"`
+	Sessions           SessionResult    `json:"Sessions"`
+	PrivilegedSessions SessionResult    `json:"PrivilegedSessions"`
+	RegistrySessions   SessionResult    `json:"RegistrySessions"`
+	LocalAdmins        PrincipalResult  `json:"LocalAdmins"`
+	RemoteDesktopUsers PrincipalResult  `json:"RemoteDesktopUsers"`
+	DcomUsers          PrincipalResult  `json:"DcomUsers"`
+	PSRemoteUsers      PrincipalResult  `json:"PSRemoteUsers"`
+
+	// Domains and OUs
+	Links []GPLink `json:"Links"`
+}
+
+type ACE struct {
+	PrincipalSID  string `json:"PrincipalSID"`
+	PrincipalType string `json:"PrincipalType"`
+	RightName     string `json:"RightName"`
+	IsInherited   bool   `json:"IsInherited"`
+}
+
+type TypedPrincipal struct {
+	ObjectIdentifier string `json:"ObjectIdentifier"`
+	ObjectType       string `json:"ObjectType"`
+}
+
+type Session struct {
+	UserSID     string `json:"UserSID"`
+	ComputerSID string `json:"ComputerSID"`
+}
+
+type SessionResult struct {
+	Collected bool      `json:"Collected"`
+	Results   []Session `json:"Results"`
+}
+
+type PrincipalResult struct {
+	Collected bool             `json:"Collected"`
+	Results   []TypedPrincipal `json:"Results"`
+}
+
+type GPLink struct {
+	IsEnforced bool   `json:"IsEnforced"`
+	GUID       string `json:"GUID"`
+}
@@ -0,0 +1,35 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+)
+
+func TestNumericComparison(t *testing.T) {
+	score := engine.NewAttribute("testScore").Type(engine.AttributeTypeInt)
+
+	ao := engine.NewObjects()
+	for i, value := range []int64{10, 80, 95} {
+		ao.Add(engine.NewObject(engine.Name, engine.AttributeValueString(string(rune('a'+i))), score, engine.AttributeValueInt(value)))
+	}
+	ao.Add(engine.NewObject(engine.Name, engine.AttributeValueString("none")))
+
+	tests := map[string]int{
+		"(testScore>=80)":                2,
+		"(testScore>80)":                 1,
+		"(testScore<80)":                 1,
+		"(testScore<=80)":                2,
+		"(!(testScore>=80))":             2,
+		"(&(testScore>5)(testScore<90))": 2,
+	}
+	for filter, expected := range tests {
+		q, err := ParseLDAPQueryStrict(filter, ao)
+		if err != nil {
+			t.Fatalf("parsing %v: %v", filter, err)
+		}
+		if count := Execute(q, ao).Len(); count != expected {
+			t.Errorf("%v matched %v objects, expected %v", filter, count, expected)
+		}
+	}
+}
@@ -448,16 +448,17 @@ type TypedComparison[t cmp.Ordered] struct {
 	Value      t
 }
 
+// Evaluate is true if any of the values has the right type and compares true
 func (tc TypedComparison[t]) Evaluate(a engine.Attribute, o *engine.Object) bool {
-	val := o.Attr(a)
-	if val == nil {
-		return false
-	}
-	realval, ok := val.(t)
-	if !ok {
-		return false
-	}
-	return Comparator[t](tc.Comparator).Compare(realval, tc.Value)
+	var result bool
+	o.Attr(a).Iterate(func(val engine.AttributeValue) bool {
+		if realval, ok := val.Raw().(t); ok && Comparator[t](tc.Comparator).Compare(realval, tc.Value) {
+			result = true
+			return false
+		}
+		return true
+	})
+	return result
 }
 
 func (tc TypedComparison[t]) ToLDAPFilter(a string) string {
@@ -0,0 +1,163 @@
+package query
+
+import (
+	"github.com/lkarlslund/adalanche/modules/engine"
+)
+
+type PathPatternOptions struct {
+	MinProbability engine.Probability // Edges with a lower probability are not followed
+	MaxResults     int                // Stop after this many matches, 0 is unlimited
+	MaxPerStart    int                // Move on to the next start object after this many matches from it, 0 is unlimited
+}
+
+// PathHop is one step in a matched path
+type PathHop struct {
+	Direction engine.EdgeDirection // Out means the object before this hop can pwn the object after it
+	Edges     engine.EdgeBitmap
+}
+
+// PathMatch is a chain of objects matching a path pattern, with one hop less than there are objects
+type PathMatch struct {
+	Objects []*engine.Object
+	Hops    []PathHop
+}
+
+// ExecutePathPattern returns all loop free paths through the objects that match the pattern
+func ExecutePathPattern(pp PathPattern, ao *engine.Objects, opts PathPatternOptions) []PathMatch {
+	if len(pp.Nodes) == 0 {
+		return nil
+	}
+
+	// Searching from the constrained end is much cheaper
+	reversed := pp.Nodes[0] == nil && pp.Nodes[len(pp.Nodes)-1] != nil
+	if reversed {
+		pp = pp.reverse()
+	}
+
+	var starts engine.ObjectSlice
+	if pp.Nodes[0] != nil {
+		starts = Execute(pp.Nodes[0], ao).AsSlice()
+	} else {
+		starts = ao.AsSlice()
+	}
+
+	var results []PathMatch
+	var startresults int
+	visited := make(map[*engine.Object]struct{})
+	var objects []*engine.Object
+	var hops []PathHop
+
+	var matchSegment func(segment, segmenthops int) bool
+	matchSegment = func(segment, segmenthops int) bool {
+		current := objects[len(objects)-1]
+
+		if segment == len(pp.Edges) {
+			results = append(results, PathMatch{
+				Objects: append([]*engine.Object{}, objects...),
+				Hops:    append([]PathHop{}, hops...),
+			})
+			return (opts.MaxResults <= 0 || len(results) < opts.MaxResults) &&
+				(opts.MaxPerStart <= 0 || len(results)-startresults < opts.MaxPerStart)
+		}
+
+		ep := pp.Edges[segment]
+		if segmenthops >= ep.MinHops && (pp.Nodes[segment+1] == nil || pp.Nodes[segment+1].Evaluate(current)) {
+			if !matchSegment(segment+1, 0) {
+				return false
+			}
+		}
+
+		maxhops := ep.MaxHops
+		if maxhops < 0 {
+			maxhops = DefaultMaxHops
+		}
+		if segmenthops >= maxhops {
+			return true
+		}
+
+		keepgoing := true
+		current.Edges(ep.Direction).Range(func(next *engine.Object, eb engine.EdgeBitmap) bool {
+			if _, found := visited[next]; found {
+				return true
+			}
+			eb = eb.Intersect(ep.Edges)
+			if eb.IsBlank() {
+				return true
+			}
+			if opts.MinProbability > 0 {
+				source, target := current, next
+				if ep.Direction == engine.In {
+					source, target = next, current
+				}
+				if eb.MaxProbability(source, target) < opts.MinProbability {
+					return true
+				}
+			}
+
+			visited[next] = struct{}{}
+			objects = append(objects, next)
+			hops = append(hops, PathHop{Direction: ep.Direction, Edges: eb})
+			keepgoing = matchSegment(segment, segmenthops+1)
+			objects = objects[:len(objects)-1]
+			hops = hops[:len(hops)-1]
+			delete(visited, next)
+			return keepgoing
+		})
+		return keepgoing
+	}
+
+	starts.Iterate(func(o *engine.Object) bool {
+		visited[o] = struct{}{}
+		objects = append(objects[:0], o)
+		hops = hops[:0]
+		startresults = len(results)
+		matchSegment(0, 0)
+		delete(visited, o)
+		return opts.MaxResults <= 0 || len(results) < opts.MaxResults
+	})
+
+	if reversed {
+		for i := range results {
+			results[i] = results[i].reverse()
+		}
+	}
+
+	return results
+}
+
+func (pp PathPattern) reverse() PathPattern {
+	result := PathPattern{
+		Nodes: make([]NodeFilter, len(pp.Nodes)),
+		Edges: make([]EdgePattern, len(pp.Edges)),
+	}
+	for i, node := range pp.Nodes {
+		result.Nodes[len(pp.Nodes)-1-i] = node
+	}
+	for i, edge := range pp.Edges {
+		edge.Direction = flipDirection(edge.Direction)
+		result.Edges[len(pp.Edges)-1-i] = edge
+	}
+	return result
+}
+
+func (pm PathMatch) reverse() PathMatch {
+	result := PathMatch{
+		Objects: make([]*engine.Object, len(pm.Objects)),
+		Hops:    make([]PathHop, len(pm.Hops)),
+	}
+	for i, o := range pm.Objects {
+		result.Objects[len(pm.Objects)-1-i] = o
+	}
+	for i, hop := range pm.Hops {
+		hop.Direction = flipDirection(hop.Direction)
+		result.Hops[len(pm.Hops)-1-i] = hop
+	}
+	return result
+}
+
+func flipDirection(direction engine.EdgeDirection) engine.EdgeDirection {
+	if direction == engine.In {
+		return engine.Out
+	}
+	return engine.In
+}
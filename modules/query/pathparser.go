@@ -0,0 +1,184 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gobwas/glob/util/runes"
+	"github.com/lkarlslund/adalanche/modules/engine"
+)
+
+// Used for edge patterns with an open ended hop range, like [*] or [*2..]
+const DefaultMaxHops = 8
+
+// PathPattern is a chain of node filters connected by edge patterns, written like
+//
+//	(objectClass=user)-[GenericAll|WriteDACL*1..3]->(&(objectClass=computer)(userAccountControl:and:=524288))
+//
+// A node is an LDAP filter, or () to match any object. An edge is -[...]-> for attacks going from left to right,
+// or <-[...]- for the opposite direction. Inside the brackets is an optional list of edge names separated by | or ,
+// followed by an optional hop range: * for 1 or more, *3 for exactly 3, *1..3, *..3 or *2.. - without a range it's one hop.
+// --> and <-- are shorthands for one hop over any edge.
+type PathPattern struct {
+	Nodes []NodeFilter // nil matches any object
+	Edges []EdgePattern
+}
+
+type EdgePattern struct {
+	Direction engine.EdgeDirection // Out means the object on the left can pwn the object on the right
+	Edges     engine.EdgeBitmap
+	MinHops   int
+	MaxHops   int // -1 means no limit, capped at DefaultMaxHops
+}
+
+// ParsePathPattern parses a path pattern. A single LDAP filter is a valid pattern with one node and no edges.
+func ParsePathPattern(s string, ao *engine.Objects) (PathPattern, error) {
+	var pp PathPattern
+	rs := []rune(strings.TrimSpace(s))
+
+	for {
+		rs = skipSpaces(rs)
+
+		var node NodeFilter
+		var err error
+		if runes.HasPrefix(rs, []rune("()")) {
+			rs = rs[2:]
+		} else {
+			rs, node, err = parseLDAPRuneQuery(rs, ao)
+			if err != nil {
+				return pp, fmt.Errorf("Error parsing node %v in path pattern: %v", len(pp.Nodes)+1, err)
+			}
+		}
+		pp.Nodes = append(pp.Nodes, node)
+
+		rs = skipSpaces(rs)
+		if len(rs) == 0 {
+			break
+		}
+
+		var edge EdgePattern
+		rs, edge, err = parseEdgePattern(rs)
+		if err != nil {
+			return pp, fmt.Errorf("Error parsing edge %v in path pattern: %v", len(pp.Edges)+1, err)
+		}
+		pp.Edges = append(pp.Edges, edge)
+	}
+
+	return pp, nil
+}
+
+func parseEdgePattern(s []rune) ([]rune, EdgePattern, error) {
+	ep := EdgePattern{
+		Direction: engine.Out,
+		Edges:     engine.AllEdgesBitmap,
+		MinHops:   1,
+		MaxHops:   1,
+	}
+
+	// Shorthands
+	if runes.HasPrefix(s, []rune("-->")) {
+		return s[3:], ep, nil
+	}
+	if runes.HasPrefix(s, []rune("<--")) {
+		ep.Direction = engine.In
+		return s[3:], ep, nil
+	}
+
+	var closing []rune
+	switch {
+	case runes.HasPrefix(s, []rune("-[")):
+		s = s[2:]
+		closing = []rune("]->")
+	case runes.HasPrefix(s, []rune("<-[")):
+		s = s[3:]
+		closing = []rune("]-")
+		ep.Direction = engine.In
+	default:
+		return nil, ep, fmt.Errorf("Expecting -[, <-[, --> or <-- but had '%v'", string(s))
+	}
+
+	end := runes.Index(s, []rune("]"))
+	if end == -1 {
+		return nil, ep, errors.New("Missing ] in edge pattern")
+	}
+	spec := strings.TrimSpace(string(s[:end]))
+	s = s[end:]
+	if !runes.HasPrefix(s, closing) {
+		return nil, ep, fmt.Errorf("Edge pattern must end with %v", string(closing))
+	}
+	s = s[len(closing):]
+
+	names := spec
+	var hoprange string
+	var hasrange bool
+	if star := strings.Index(spec, "*"); star != -1 {
+		names = spec[:star]
+		hoprange = strings.TrimSpace(spec[star+1:])
+		hasrange = true
+	}
+
+	names = strings.TrimSpace(names)
+	if names != "" {
+		var edges engine.EdgeBitmap
+		for _, name := range strings.FieldsFunc(names, func(r rune) bool { return r == '|' || r == ',' }) {
+			name = strings.TrimSpace(name)
+			edge := engine.LookupEdge(name)
+			if edge == engine.NonExistingEdge {
+				return nil, ep, fmt.Errorf("Unknown edge %v", name)
+			}
+			edges = edges.Set(edge)
+		}
+		ep.Edges = edges
+	}
+
+	if hasrange {
+		var err error
+		ep.MinHops, ep.MaxHops, err = parseHopRange(hoprange)
+		if err != nil {
+			return nil, ep, err
+		}
+	}
+
+	return s, ep, nil
+}
+
+func parseHopRange(s string) (int, int, error) {
+	if s == "" {
+		return 1, -1, nil
+	}
+
+	minstring, maxstring, isrange := strings.Cut(s, "..")
+	if !isrange {
+		hops, err := strconv.Atoi(s)
+		if err != nil || hops < 0 {
+			return 0, 0, fmt.Errorf("Invalid hop count %v", s)
+		}
+		return hops, hops, nil
+	}
+
+	min, max := 1, -1
+	var err error
+	if minstring = strings.TrimSpace(minstring); minstring != "" {
+		min, err = strconv.Atoi(minstring)
+		if err != nil || min < 0 {
+			return 0, 0, fmt.Errorf("Invalid minimum hop count %v", minstring)
+		}
+	}
+	if maxstring = strings.TrimSpace(maxstring); maxstring != "" {
+		max, err = strconv.Atoi(maxstring)
+		if err != nil || max < min {
+			return 0, 0, fmt.Errorf("Invalid maximum hop count %v", maxstring)
+		}
+	}
+	return min, max, nil
+}
+
+func skipSpaces(s []rune) []rune {
+	for len(s) > 0 && unicode.IsSpace(s[0]) {
+		s = s[1:]
+	}
+	return s
+}
@@ -0,0 +1,65 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+)
+
+func TestPathPattern(t *testing.T) {
+	ao := engine.NewObjects()
+	objects := make(map[string]*engine.Object)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		objects[name] = engine.NewObject(engine.Name, engine.AttributeValueString(name))
+		ao.Add(objects[name])
+	}
+	genericall, writedacl := engine.LookupEdge("GenericAll"), engine.LookupEdge("WriteDACL")
+	objects["a"].EdgeTo(objects["b"], genericall)
+	objects["b"].EdgeTo(objects["c"], genericall)
+	objects["c"].EdgeTo(objects["d"], genericall)
+	objects["a"].EdgeTo(objects["d"], writedacl)
+
+	tests := map[string]int{
+		"(name=a)":                                   1,
+		"(name=a)-[GenericAll*1..3]->(name=d)":       1,
+		"(name=a)-[GenericAll|WriteDACL*]->(name=d)": 2,
+		"(name=a)-[WriteDACL]->(name=d)":             1,
+		"(name=a)-[GenericAll*..2]->(name=d)":        0,
+		"()-[*]->(name=d)":                           4,
+		"(name=d) <-[GenericAll,WriteDACL]- ()":      2,
+		"(name=a)-->()-->(name=c)":                   1,
+	}
+	for pattern, expected := range tests {
+		pp, err := ParsePathPattern(pattern, ao)
+		if err != nil {
+			t.Fatalf("parsing %v: %v", pattern, err)
+		}
+		matches := ExecutePathPattern(pp, ao, PathPatternOptions{})
+		if len(matches) != expected {
+			t.Errorf("%v matched %v paths, expected %v", pattern, len(matches), expected)
+		}
+		for _, match := range matches {
+			if len(match.Hops) != len(match.Objects)-1 {
+				t.Errorf("%v returned %v hops for %v objects", pattern, len(match.Hops), len(match.Objects))
+			}
+		}
+	}
+
+	// One path from each start object
+	for pattern, expected := range map[string]int{
+		"()-[*]->(name=d)":                           1,
+		"(name=a)-[GenericAll|WriteDACL*]->(name=d)": 1,
+		"()-[GenericAll]->()":                        3,
+	} {
+		pp, _ := ParsePathPattern(pattern, ao)
+		if matches := ExecutePathPattern(pp, ao, PathPatternOptions{MaxPerStart: 1}); len(matches) != expected {
+			t.Errorf("%v matched %v paths with one per start, expected %v", pattern, len(matches), expected)
+		}
+	}
+
+	for _, pattern := range []string{"(name=a)-[GenericAll->(name=b)", "(name=a)-[NoSuchEdge]->()", "(name=a)-[*3..1]->()", "(name=a)-"} {
+		if _, err := ParsePathPattern(pattern, ao); err == nil {
+			t.Errorf("expected error parsing %v", pattern)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Package risk scores objects by how close they are to tier 0
+package risk
+
+import (
+	"container/heap"
+	"fmt"
+	"runtime"
+	"sync"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/query"
+	"github.com/lkarlslund/adalanche/modules/ui"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+// Tier0Query finds the domain objects, domain controllers, built-in administrative groups and other objects that control the forest.
+// Groups are found by SID, so it works regardless of the language of the domain.
+const Tier0Query = "(|(tag=iddqd)(type=Domain-DNS)(objectSid=S-1-5-32-544)(objectSid=S-1-5-32-548)(objectSid=S-1-5-32-549)(objectSid=S-1-5-32-551)(objectSid=S-1-5-21-*-498)(objectSid=S-1-5-21-*-512)(objectSid=S-1-5-21-*-516)(objectSid=S-1-5-21-*-518)(objectSid=S-1-5-21-*-519))"
+
+var (
+	Score          = engine.NewAttribute("riskScore").Type(engine.AttributeTypeInt).Single().SetDescription("How dangerous a compromise of this object is, 0-100 based on the tier 0 objects it can reach")
+	Tier0Reachable = engine.NewAttribute("riskTier0Reachable").Type(engine.AttributeTypeInt).Single().SetDescription("Number of tier 0 objects this object can reach")
+	MinHops        = engine.NewAttribute("riskMinHops").Type(engine.AttributeTypeInt).Single().SetDescription("Fewest edges from this object to a tier 0 object")
+	MaxProbability = engine.NewAttribute("riskMaxProbability").Type(engine.AttributeTypeInt).Single().SetDescription("Highest accumulated probability in percent of reaching a tier 0 object")
+)
+
+// Every hop beyond the first takes this many points off the risk score
+const hopPenalty = 5
+
+type riskInfo struct {
+	reachable   int
+	minhops     int
+	probability float64 // 0-1
+}
+
+// ComputeScores sets the risk attributes on all users, groups and computers. Edges are followed the same way
+// AnalyzeObjects does with default options: probabilities multiply along the path, edges below 1% are ignored
+// and Everyone and Authenticated Users are not expanded.
+//
+// riskScore is the highest accumulated probability in percent, minus a few points for each extra hop, and
+// at least 1 for anything that can reach tier 0. Tier 0 objects themselves score 100.
+func ComputeScores(ao *engine.Objects) error {
+	tier0, err := query.ParseLDAPQueryStrict(Tier0Query, ao)
+	if err != nil {
+		return fmt.Errorf("Error parsing tier 0 query: %v", err)
+	}
+
+	var targets []*engine.Object
+	query.Execute(tier0, ao).Iterate(func(o *engine.Object) bool {
+		targets = append(targets, o)
+		return true
+	})
+
+	risks := reachTargets(targets)
+
+	ao.Iterate(func(o *engine.Object) bool {
+		switch o.Type() {
+		case engine.ObjectTypeUser, engine.ObjectTypeGroup, engine.ObjectTypeComputer:
+		default:
+			return true
+		}
+		risk, found := risks[o]
+		if !found {
+			o.SetValues(Score, engine.AttributeValueInt(0))
+			o.SetValues(Tier0Reachable, engine.AttributeValueInt(0))
+			return true
+		}
+		o.SetValues(Score, engine.AttributeValueInt(risk.score()))
+		o.SetValues(Tier0Reachable, engine.AttributeValueInt(risk.reachable))
+		o.SetValues(MinHops, engine.AttributeValueInt(risk.minhops))
+		o.SetValues(MaxProbability, engine.AttributeValueInt(int(risk.probability*100+0.5)))
+		return true
+	})
+
+	ui.Info().Msgf("Computed risk scores from %v tier 0 objects, %v objects can reach tier 0", len(targets), len(risks))
+	return nil
+}
+
+func (ri riskInfo) score() int {
+	if ri.minhops == 0 {
+		return 100
+	}
+	score := int(ri.probability*100+0.5) - (ri.minhops-1)*hopPenalty
+	return min(max(score, 1), 100)
+}
+
+// Calls each for every object with an edge to o, with the probability of that edge
+func riskPredecessors(o *engine.Object, each func(source *engine.Object, probability engine.Probability)) {
+	if o.SID() == windowssecurity.EveryoneSID || o.SID() == windowssecurity.AuthenticatedUsersSID {
+		return
+	}
+	o.Edges(engine.In).Range(func(source *engine.Object, eb engine.EdgeBitmap) bool {
+		if probability := eb.MaxProbability(source, o); probability >= 1 {
+			each(source, probability)
+		}
+		return true
+	})
+}
+
+// reachTargets finds everything that can reach the targets, how many of them, in how few hops and with what probability
+func reachTargets(targets []*engine.Object) map[*engine.Object]*riskInfo {
+	risks := make(map[*engine.Object]*riskInfo)
+	var lock sync.Mutex
+
+	// Walk backwards from each target to count how many targets each object reaches
+	pb := ui.ProgressBar("Computing risk scores", len(targets))
+	work := make(chan *engine.Object)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range work {
+				hops := map[*engine.Object]int{target: 0}
+				queue := []*engine.Object{target}
+				for len(queue) > 0 {
+					current := queue[0]
+					queue = queue[1:]
+					riskPredecessors(current, func(source *engine.Object, _ engine.Probability) {
+						if _, found := hops[source]; !found {
+							hops[source] = hops[current] + 1
+							queue = append(queue, source)
+						}
+					})
+				}
+
+				lock.Lock()
+				for o, distance := range hops {
+					risk, found := risks[o]
+					if !found {
+						risk = &riskInfo{minhops: distance}
+						risks[o] = risk
+					}
+					if o != target {
+						risk.reachable++
+					}
+					risk.minhops = min(risk.minhops, distance)
+				}
+				lock.Unlock()
+				pb.Add(1)
+			}
+		}()
+	}
+	for _, target := range targets {
+		work <- target
+	}
+	close(work)
+	wg.Wait()
+	pb.Finish()
+
+	// Best accumulated probability from all targets at once, Dijkstra style on the largest product
+	pq := riskQueue{}
+	for _, target := range targets {
+		risks[target].probability = 1
+		heap.Push(&pq, riskQueueItem{target, 1})
+	}
+	done := make(map[*engine.Object]struct{})
+	for pq.Len() > 0 {
+		item := heap.Pop(&pq).(riskQueueItem)
+		if _, found := done[item.object]; found {
+			continue
+		}
+		done[item.object] = struct{}{}
+		riskPredecessors(item.object, func(source *engine.Object, probability engine.Probability) {
+			accumulated := item.probability * float64(probability) / 100
+			if risk := risks[source]; accumulated > risk.probability {
+				risk.probability = accumulated
+				heap.Push(&pq, riskQueueItem{source, accumulated})
+			}
+		})
+	}
+
+	return risks
+}
+
+type riskQueueItem struct {
+	object      *engine.Object
+	probability float64
+}
+
+// Max heap on probability
+type riskQueue []riskQueueItem
+
+func (rq riskQueue) Len() int           { return len(rq) }
+func (rq riskQueue) Less(i, j int) bool { return rq[i].probability > rq[j].probability }
+func (rq riskQueue) Swap(i, j int)      { rq[i], rq[j] = rq[j], rq[i] }
+func (rq *riskQueue) Push(x any)        { *rq = append(*rq, x.(riskQueueItem)) }
+func (rq *riskQueue) Pop() any {
+	old := *rq
+	item := old[len(old)-1]
+	*rq = old[:len(old)-1]
+	return item
+}
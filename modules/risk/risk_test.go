@@ -0,0 +1,56 @@
+package risk
+
+import (
+	"testing"
+
+	"github.com/lkarlslund/adalanche/modules/engine"
+	"github.com/lkarlslund/adalanche/modules/integrations/activedirectory"
+	"github.com/lkarlslund/adalanche/modules/windowssecurity"
+)
+
+func TestComputeScores(t *testing.T) {
+	object := func(name, objecttype, sid string) *engine.Object {
+		parsed, err := windowssecurity.ParseStringSID(sid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return engine.NewObject(engine.Name, engine.AttributeValueString(name), engine.Type, engine.AttributeValueString(objecttype), activedirectory.ObjectSid, engine.AttributeValueSID(parsed))
+	}
+
+	ao := engine.NewObjects()
+	admins := object("Domain Admins", "Group", "S-1-5-21-1-2-3-512")
+	admin := object("admin", "Person", "S-1-5-21-1-2-3-1000")
+	helpdesk := object("helpdesk", "Person", "S-1-5-21-1-2-3-1001")
+	bystander := object("bystander", "Person", "S-1-5-21-1-2-3-1002")
+	ao.Add(admins, admin, helpdesk, bystander)
+	admin.EdgeTo(admins, activedirectory.EdgeMemberOfGroup)
+	helpdesk.EdgeTo(admin, activedirectory.EdgeWriteDACL)
+
+	if err := ComputeScores(ao); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		o                             *engine.Object
+		score, reachable, probability int64
+		hops                          int64
+	}{
+		{admins, 100, 0, 100, 0},
+		{admin, 100, 1, 100, 1},
+		{helpdesk, 100 - hopPenalty, 1, 100, 2},
+		{bystander, 0, 0, 0, -1},
+	}
+	for _, test := range tests {
+		score, _ := test.o.AttrInt(Score)
+		reachable, _ := test.o.AttrInt(Tier0Reachable)
+		probability, _ := test.o.AttrInt(MaxProbability)
+		hops, found := test.o.AttrInt(MinHops)
+		if !found {
+			hops = -1
+		}
+		if score != test.score || reachable != test.reachable || probability != test.probability || hops != test.hops {
+			t.Errorf("%v has score %v, reachable %v, probability %v and hops %v, expected %+v", test.o.Label(), score, reachable, probability, hops, test)
+		}
+	}
+
+}
@@ -0,0 +1,134 @@
+package ui
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+type EventType string
+
+const (
+	EventProgressStart  EventType = "progress-start"
+	EventProgressUpdate EventType = "progress-update"
+	EventProgressFinish EventType = "progress-finish"
+	EventLog            EventType = "log"
+)
+
+// Event is pushed to subscribers whenever a progress bar changes or a log line is written
+type Event struct {
+	Type     EventType      `json:"type"`
+	Time     time.Time      `json:"time"`
+	Progress *ProgressEvent `json:"progress,omitempty"`
+	Log      *LogEvent      `json:"log,omitempty"`
+}
+
+type ProgressEvent struct {
+	ID      uuid.UUID `json:"id"`
+	Title   string    `json:"title"`
+	Current int64     `json:"current"`
+	Total   int64     `json:"total"`
+	Percent float32   `json:"percent"`
+	Started time.Time `json:"started"`
+	Done    bool      `json:"done"`
+}
+
+type LogEvent struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// Progress updates are sent at most this often per bar, start and finish are always sent
+const progressEventInterval = 250 * time.Millisecond
+
+var (
+	subscriberLock  sync.Mutex
+	subscribers     = map[chan Event]struct{}{}
+	subscriberCount atomic.Int32
+)
+
+// Subscribe returns a channel receiving all future events. Slow subscribers lose events rather than blocking
+// the code producing them, so a buffer of a few hundred is reasonable. Call unsubscribe when done.
+func Subscribe(buffer int) (<-chan Event, func()) {
+	c := make(chan Event, buffer)
+	subscriberLock.Lock()
+	subscribers[c] = struct{}{}
+	subscriberCount.Add(1)
+	subscriberLock.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			subscriberLock.Lock()
+			delete(subscribers, c)
+			subscriberCount.Add(-1)
+			subscriberLock.Unlock()
+			close(c)
+		})
+	}
+}
+
+func publishing() bool {
+	return subscriberCount.Load() > 0
+}
+
+func publish(e Event) {
+	subscriberLock.Lock()
+	for c := range subscribers {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+	subscriberLock.Unlock()
+}
+
+// ProgressSnapshot returns the state of all running progress bars, so new subscribers can catch up
+func ProgressSnapshot() []ProgressEvent {
+	pbLock.Lock()
+	result := make([]ProgressEvent, 0, len(progressbars))
+	for pb := range progressbars {
+		result = append(result, pb.event())
+	}
+	pbLock.Unlock()
+	return result
+}
+
+func (pb *progressBar) event() ProgressEvent {
+	current := atomic.LoadInt64(&pb.Current)
+	total := atomic.LoadInt64(&pb.Total)
+	var percent float32
+	if total > 0 {
+		percent = min(float32(current)*100/float32(total), 100)
+	}
+	return ProgressEvent{
+		ID:      pb.ID,
+		Title:   pb.Title,
+		Current: current,
+		Total:   total,
+		Percent: percent,
+		Started: pb.Started,
+		Done:    pb.Done,
+	}
+}
+
+func (pb *progressBar) publish(t EventType) {
+	if !publishing() {
+		return
+	}
+	now := time.Now()
+	if t == EventProgressUpdate {
+		last := atomic.LoadInt64(&pb.lastEvent)
+		if now.UnixNano()-last < int64(progressEventInterval) || !atomic.CompareAndSwapInt64(&pb.lastEvent, last, now.UnixNano()) {
+			return
+		}
+	}
+	progress := pb.event()
+	publish(Event{
+		Type:     t,
+		Time:     now,
+		Progress: &progress,
+	})
+}
@@ -96,6 +96,16 @@ func (t Logger) Msgf(format string, args ...any) Logger {
 		tprefix := pterm.DefaultBasicText.Sprint(timetext + " ")
 		pterm.Fprint(t.pterm.Writer, tprefix+t.pterm.Sprintfln(format, args...))
 	}
+	if logLevel <= t.ll && publishing() {
+		publish(Event{
+			Type: EventLog,
+			Time: time.Now(),
+			Log: &LogEvent{
+				Level:   t.ll.String(),
+				Message: fmt.Sprintf(format, args...),
+			},
+		})
+	}
 	if t.ll == LevelFatal {
 		if logfile != nil {
 			logfile.Close()
@@ -29,6 +29,7 @@ type progressBar struct {
 	barFiller           string
 
 	lastReport int64
+	lastEvent  int64 // UnixNano of last published update event
 	Done       bool
 
 	writer io.Writer
@@ -91,6 +92,8 @@ func ProgressBar(title string, max int) *progressBar {
 	progressbars[&pb] = struct{}{}
 	pbLock.Unlock()
 
+	pb.publish(EventProgressStart)
+
 	return &pb
 }
 
@@ -98,7 +101,8 @@ func (pb *progressBar) ChangeMax(newmax int) {
 	if newmax == 0 {
 		Fatal().Msg("Cannot set max to 0")
 	}
-	pb.Total = int64(newmax)
+	atomic.StoreInt64(&pb.Total, int64(newmax))
+	pb.publish(EventProgressUpdate)
 }
 
 func (pb *progressBar) GetMax() int {
@@ -111,11 +115,13 @@ func (pb *progressBar) Start() {
 
 func (pb *progressBar) Add(i int) {
 	atomic.AddInt64(&pb.Current, int64(i))
+	pb.publish(EventProgressUpdate)
 	pb.update()
 }
 
 func (pb *progressBar) Set(i int) {
 	atomic.StoreInt64(&pb.Current, int64(i))
+	pb.publish(EventProgressUpdate)
 	pb.update()
 }
 
@@ -126,6 +132,7 @@ func (pb *progressBar) Finish() {
 	pbLock.Unlock()
 
 	pb.Done = true
+	pb.publish(EventProgressFinish)
 }
 
 func (pb *progressBar) update() {